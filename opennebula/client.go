@@ -1,10 +1,21 @@
 package opennebula
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/kolo/xmlrpc"
 )
 
@@ -13,47 +24,304 @@ type OneClient interface {
 	IsSuccess(result []interface{}) (res string, err error)
 }
 
+// rpcCaller is satisfied by xmlrpc.Client, tests replace it with a mock
+type rpcCaller interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+}
+
+type endpoint struct {
+	url string
+	rpc rpcCaller
+}
+
 type Client struct {
-	Rcp      xmlrpc.Client
-	session  string
-	Username string
-	Password string
+	endpoints     []endpoint
+	current       int
+	mutex         sync.Mutex
+	session       string
+	maxRetries    int
+	retryInterval time.Duration
+	pollDelay     time.Duration // before the first poll of a state change
+	pollInterval  time.Duration // at least between two polls of a state change
+	Username      string
+	Password      string
+}
+
+// requestTimeoutError is returned when a front-end did not answer within request_timeout.
+type requestTimeoutError struct {
+	timeout time.Duration
 }
 
-func NewClient(endpoint, username, password string) (*Client, error) {
-	client, err := xmlrpc.NewClient(endpoint, nil)
+func (e *requestTimeoutError) Error() string {
+	return fmt.Sprintf("OpenNebula did not answer within %s", e.timeout)
+}
+
+// timeoutTransport limits the time a request may take, including reading the response.
+// xmlrpc creates the http.Client itself, so its Timeout can not be set.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
 	if err != nil {
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			return nil, &requestTimeoutError{timeout: t.timeout}
+		}
 		return nil, err
 	}
 
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a request once its response was read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// NewTransport returns the HTTP transport for a client. Certificates are not verified
+// with insecure set, a timeout of 0 lets requests take as long as they need.
+func NewTransport(insecure bool, timeout time.Duration) http.RoundTripper {
+	// every client gets its own transport, so that several provider configurations
+	// (e.g. aliases for different zones) don't share connections
+	transport := cleanhttp.DefaultPooledTransport()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if timeout == 0 {
+		return transport
+	}
+	return &timeoutTransport{next: transport, timeout: timeout}
+}
+
+func NewClient(url, username, password string) (*Client, error) {
+	return NewFailoverClient([]string{url}, username, password, NewTransport(false, 0))
+}
+
+// NewFailoverClient creates a client for a set of front-ends (e.g. an HA setup).
+// Calls go to the first endpoint until it becomes unreachable, then the next one is used.
+func NewFailoverClient(urls []string, username, password string, transport http.RoundTripper) (*Client, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("At least one OpenNebula endpoint is required")
+	}
+
+	endpoints := make([]endpoint, 0, len(urls))
+	for _, url := range urls {
+		client, err := xmlrpc.NewClient(url, transport)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint{url: url, rpc: client})
+	}
+
 	return &Client{
-		Rcp:      *client,
-		session:  fmt.Sprintf("%s:%s", username, password),
-		Username: username,
-		Password: password,
+		endpoints: endpoints,
+		session:   fmt.Sprintf("%s:%s", username, password),
+		Username:  username,
+		Password:  password,
 	}, nil
 }
 
 func (c *Client) Call(command string, args ...interface{}) (string, error) {
-	var result []interface{}
+	return c.call(false, nil, command, args...)
+}
 
-	args = append([]interface{}{c.session}, args...)
+// call performs a request and logs it. Traced calls are logged with their full
+// arguments and response at INFO level, so they show up without the DEBUG output
+// of every other call. The given secrets are masked in the traced output.
+func (c *Client) call(trace bool, secrets []string, command string, args ...interface{}) (string, error) {
+	level := "DEBUG"
+	if trace {
+		level = "INFO"
+		log.Printf("[%s] OpenNebula call %s %s", level, command, redactSecrets(fmt.Sprintf("%v", args), secrets))
+	} else {
+		log.Printf("[%s] OpenNebula call %s", level, command)
+	}
 
-	if err := c.Rcp.Call(command, args, &result); err != nil {
-		return "", err
+	// the session is added after logging, it contains the credentials
+	params := append([]interface{}{c.session}, args...)
+
+	var res string
+	var err error
+	for attempt := 0; ; attempt++ {
+		res, err = c.attempt(command, params)
+		if err == nil {
+			break
+		}
+
+		if attempt >= c.maxRetries || !isTransientError(err) || !isRetryable(command, err) {
+			log.Printf("[%s] OpenNebula call %s failed: %s", level, command, err)
+			return "", err
+		}
+
+		wait := c.retryInterval << uint(attempt)
+		log.Printf("[DEBUG] OpenNebula call %s failed, retry %d of %d in %s: %s", command, attempt+1, c.maxRetries, wait, err)
+		time.Sleep(wait)
 	}
 
-	res, err := c.IsSuccess(result)
-	if err != nil {
-		return "", err
+	if trace {
+		log.Printf("[%s] OpenNebula response to %s: %s", level, command, redactSecrets(res, secrets))
 	}
 
 	return res, nil
 }
 
+// attempt performs a single request, including the failover between endpoints.
+func (c *Client) attempt(command string, params []interface{}) (string, error) {
+	var result []interface{}
+	if err := c.send(command, params, &result); err != nil {
+		return "", err
+	}
+
+	return c.IsSuccess(result)
+}
+
+// send sends the request to the endpoint that answered last. On transport errors the
+// remaining endpoints are tried in order, the first one answering becomes the current one.
+func (c *Client) send(command string, args []interface{}, result *[]interface{}) error {
+	c.mutex.Lock()
+	start := c.current
+	c.mutex.Unlock()
+
+	var err error
+	for i := 0; i < len(c.endpoints); i++ {
+		index := (start + i) % len(c.endpoints)
+		e := c.endpoints[index]
+
+		err = e.rpc.Call(command, args, result)
+		// a write which failed after it was sent may have been carried out, it is not
+		// sent to another front-end
+		if err != nil && isTransportError(err) && isRetryable(command, err) {
+			log.Printf("[WARN] OpenNebula endpoint %s is unreachable: %s", e.url, err)
+			continue
+		}
+
+		if index != start {
+			log.Printf("[INFO] Failing over to OpenNebula endpoint %s", e.url)
+			c.mutex.Lock()
+			c.current = index
+			c.mutex.Unlock()
+		}
+
+		return err
+	}
+
+	return err
+}
+
+// isTransportError tells apart connection failures from faults the server answered with.
+// A timed out request is neither, the front-end may still carry it out, so it is not
+// sent again to avoid e.g. allocating an object twice.
+func isTransportError(err error) bool {
+	if isRequestTimeout(err) {
+		return false
+	}
+
+	_, fault := err.(xmlrpc.FaultError)
+	return !fault
+}
+
+func isRequestTimeout(err error) bool {
+	var timeout *requestTimeoutError
+	return errors.As(err, &timeout)
+}
+
+// isTransientError tells whether a failed call may succeed when retried: the
+// front-ends could not be reached, or OpenNebula failed internally. Rejected
+// credentials, missing objects and other faults are permanent.
+func isTransientError(err error) bool {
+	if e, ok := err.(*OneError); ok {
+		return e.Code == OneErrorInternal
+	}
+
+	return isTransportError(err)
+}
+
+// isRetryable tells whether a failed call can be sent again without side effects:
+// read-only methods can, any other call only if it never reached the front-end.
+// An allocation that failed after it was sent may have been carried out anyway.
+func isRetryable(command string, err error) bool {
+	if isReadOnlyMethod(command) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isReadOnlyMethod tells whether a method only reads objects, e.g. one.vm.info or
+// one.vmpool.info.
+func isReadOnlyMethod(command string) bool {
+	return strings.HasSuffix(command, ".info") || strings.HasSuffix(command, ".monitoring") ||
+		strings.HasPrefix(command, "one.system.")
+}
+
+// tracedClient is used by resources with debug set, see resourceClient.
+type tracedClient struct {
+	*Client
+	secrets []string
+}
+
+func (t tracedClient) Call(command string, args ...interface{}) (string, error) {
+	return t.Client.call(true, t.secrets, command, args...)
+}
+
+// redactSecrets masks the secret values in a traced request or response, both as they
+// are and as they are escaped in a template.
+func redactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s = strings.Replace(s, secret, "<redacted>", -1)
+		s = strings.Replace(s, escapeTemplateValue(secret), "<redacted>", -1)
+	}
+
+	return s
+}
+
+// untracedClient returns the client without tracing, for calls with credentials in
+// their arguments.
+func untracedClient(client OneClient) OneClient {
+	if t, ok := client.(tracedClient); ok {
+		return t.Client
+	}
+
+	return client
+}
+
+// resourceClient returns the client a resource talks to OpenNebula with. If the
+// resource has debug set, its calls are traced without the values of its secret_context.
+func resourceClient(d *schema.ResourceData, meta interface{}) OneClient {
+	client := meta.(*Client)
+	if debug, ok := d.GetOk("debug"); ok && debug.(bool) {
+		return tracedClient{Client: client, secrets: secretValues(d)}
+	}
+
+	return client
+}
+
 func (c *Client) IsSuccess(result []interface{}) (res string, err error) {
 	if !result[0].(bool) {
-		err = fmt.Errorf("%s", result[1].(string))
+		e := &OneError{Message: result[1].(string)}
+		if len(result) > 2 {
+			if code, ok := result[2].(int64); ok {
+				e.Code = int(code)
+			}
+		}
+		err = e
 		return
 	}
 
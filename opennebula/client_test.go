@@ -0,0 +1,313 @@
+package opennebula
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/kolo/xmlrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockRpc struct {
+	mock.Mock
+}
+
+func (m *MockRpc) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	r := m.Called(serviceMethod, args, reply)
+	return r.Error(0)
+}
+
+func answer(result ...interface{}) func(mock.Arguments) {
+	return func(args mock.Arguments) {
+		*args.Get(2).(*[]interface{}) = result
+	}
+}
+
+func failoverClient(rpcs ...rpcCaller) *Client {
+	endpoints := make([]endpoint, 0, len(rpcs))
+	for i, rpc := range rpcs {
+		endpoints = append(endpoints, endpoint{url: fmt.Sprintf("http://one-%d:2633/RPC2", i), rpc: rpc})
+	}
+	return &Client{endpoints: endpoints, session: "user:pass"}
+}
+
+func TestCallFailsOverToNextEndpoint(t *testing.T) {
+	down := new(MockRpc)
+	up := new(MockRpc)
+	client := failoverClient(down, up)
+
+	args := []interface{}{"user:pass", 1}
+	down.On("Call", "one.vm.info", args, mock.Anything).Return(errors.New("connection refused")).Once()
+	up.On("Call", "one.vm.info", args, mock.Anything).Run(answer(true, "<VM/>")).Return(nil).Twice()
+
+	res, err := client.Call("one.vm.info", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "<VM/>", res)
+
+	// The dead endpoint is not tried again once another one answered
+	res, err = client.Call("one.vm.info", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "<VM/>", res)
+
+	down.AssertExpectations(t)
+	up.AssertExpectations(t)
+}
+
+func TestCallDoesNotFailOverOnFaults(t *testing.T) {
+	first := new(MockRpc)
+	second := new(MockRpc)
+	client := failoverClient(first, second)
+
+	first.On("Call", "one.vm.info", mock.Anything, mock.Anything).Return(xmlrpc.FaultError{Code: 1, String: "bad request"})
+
+	_, err := client.Call("one.vm.info", 1)
+	assert.NotNil(t, err)
+	second.AssertNotCalled(t, "Call", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCallDoesNotFailOverWritesFailedAfterBeingSent(t *testing.T) {
+	first := new(MockRpc)
+	second := new(MockRpc)
+	client := failoverClient(first, second)
+
+	first.On("Call", "one.vm.allocate", mock.Anything, mock.Anything).Return(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")})
+
+	_, err := client.Call("one.vm.allocate", "NAME = \"vm\"", false)
+	assert.EqualError(t, err, "read tcp: connection reset by peer")
+	second.AssertNotCalled(t, "Call", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCallFailsOverWritesWhichWereNotSent(t *testing.T) {
+	first := new(MockRpc)
+	second := new(MockRpc)
+	client := failoverClient(first, second)
+
+	args := []interface{}{"user:pass", "NAME = \"vm\"", false}
+	first.On("Call", "one.vm.allocate", args, mock.Anything).Return(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+	second.On("Call", "one.vm.allocate", args, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	res, err := client.Call("one.vm.allocate", "NAME = \"vm\"", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "42", res)
+	second.AssertExpectations(t)
+}
+
+func TestCallFailsWhenAllEndpointsAreDown(t *testing.T) {
+	first := new(MockRpc)
+	second := new(MockRpc)
+	client := failoverClient(first, second)
+
+	first.On("Call", "one.vm.info", mock.Anything, mock.Anything).Return(errors.New("connection refused"))
+	second.On("Call", "one.vm.info", mock.Anything, mock.Anything).Return(errors.New("no route to host"))
+
+	_, err := client.Call("one.vm.info", 1)
+	assert.EqualError(t, err, "no route to host")
+}
+
+func TestResourceClientTracesDebugResources(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 1}, mock.Anything).Run(answer(true, "<VM/>")).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"debug": true})
+	traced := resourceClient(d, client)
+	assert.IsType(t, tracedClient{}, traced)
+
+	res, err := traced.Call("one.vm.info", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "<VM/>", res)
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	assert.Equal(t, client, resourceClient(d, client))
+}
+
+func TestTracedCallRedactsSecrets(t *testing.T) {
+	os.Setenv("OPENNEBULA_TEST_SECRET", `pa"ss`)
+	defer os.Unsetenv("OPENNEBULA_TEST_SECRET")
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	tmpl := "CONTEXT = [\n  DB_PASSWORD = \"pa\\\"ss\" ]"
+	rpc.On("Call", "one.template.instantiate", []interface{}{"user:pass", 1, "", false, tmpl, false}, mock.Anything).Run(answer(true, int64(42))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"debug":          true,
+		"secret_context": map[string]interface{}{"DB_PASSWORD": "env:OPENNEBULA_TEST_SECRET"},
+	})
+	_, err := resourceClient(d, client).Call("one.template.instantiate", 1, "", false, tmpl, false)
+	assert.Nil(t, err)
+
+	assert.Contains(t, output.String(), `DB_PASSWORD = "<redacted>"`)
+	assert.NotContains(t, output.String(), `pa"ss`)
+	assert.NotContains(t, output.String(), `pa\"ss`)
+}
+
+func TestTracedInfoRedactsGraphicsPassword(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	info := "<VM><ID>1</ID><TEMPLATE><GRAPHICS><TYPE>VNC</TYPE><PASSWD><![CDATA[s3cr3t]]></PASSWD></GRAPHICS></TEMPLATE></VM>"
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 1}, mock.Anything).Run(answer(true, info)).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"debug":    true,
+		"graphics": []interface{}{map[string]interface{}{"type": "VNC", "passwd": "s3cr3t"}},
+	})
+	res, err := resourceClient(d, client).Call("one.vm.info", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, info, res)
+
+	assert.Contains(t, output.String(), "<PASSWD><![CDATA[<redacted>]]></PASSWD>")
+	assert.NotContains(t, output.String(), "s3cr3t")
+}
+
+func TestUntracedClient(t *testing.T) {
+	client := failoverClient(new(MockRpc))
+
+	assert.Equal(t, client, untracedClient(tracedClient{Client: client}))
+	assert.Equal(t, client, untracedClient(client))
+}
+
+func TestCallRetriesTransientErrors(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.maxRetries = 2
+	client.retryInterval = time.Millisecond
+
+	rpc.On("Call", "one.vm.info", mock.Anything, mock.Anything).Return(errors.New("connection reset by peer")).Once()
+	rpc.On("Call", "one.vm.info", mock.Anything, mock.Anything).Run(answer(false, "[one.vm.info] Internal error", int64(0x2000))).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", mock.Anything, mock.Anything).Run(answer(true, "<VM/>")).Return(nil).Once()
+
+	res, err := client.Call("one.vm.info", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "<VM/>", res)
+	rpc.AssertExpectations(t)
+}
+
+func TestCallGivesUpAfterMaxRetries(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.maxRetries = 2
+	client.retryInterval = time.Millisecond
+
+	rpc.On("Call", "one.vm.info", mock.Anything, mock.Anything).Return(errors.New("request error: bad status code - 500")).Times(3)
+
+	_, err := client.Call("one.vm.info", 1)
+	assert.EqualError(t, err, "request error: bad status code - 500")
+	rpc.AssertExpectations(t)
+}
+
+func TestCallDoesNotRetryPermanentErrors(t *testing.T) {
+	for _, code := range []int64{0x0100, 0x0200, 0x0400} {
+		rpc := new(MockRpc)
+		client := failoverClient(rpc)
+		client.maxRetries = 3
+		client.retryInterval = time.Millisecond
+
+		rpc.On("Call", "one.vm.info", mock.Anything, mock.Anything).Run(answer(false, "[one.vm.info] failed", code)).Return(nil).Once()
+
+		_, err := client.Call("one.vm.info", 1)
+		assert.EqualError(t, err, "[one.vm.info] failed")
+		rpc.AssertExpectations(t)
+	}
+}
+
+func TestCallDoesNotRetryWritesOnceSent(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.maxRetries = 3
+	client.retryInterval = time.Millisecond
+
+	rpc.On("Call", "one.vm.allocate", mock.Anything, mock.Anything).Return(errors.New("connection reset by peer")).Once()
+	rpc.On("Call", "one.template.instantiate", mock.Anything, mock.Anything).Run(answer(false, "[one.template.instantiate] Internal error", int64(0x2000))).Return(nil).Once()
+
+	_, err := client.Call("one.vm.allocate", "NAME = \"web\"", false)
+	assert.EqualError(t, err, "connection reset by peer")
+	_, err = client.Call("one.template.instantiate", 1, "", false, "", false)
+	assert.EqualError(t, err, "[one.template.instantiate] Internal error")
+	rpc.AssertExpectations(t)
+}
+
+func TestCallRetriesWritesNotSent(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.maxRetries = 2
+	client.retryInterval = time.Millisecond
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	rpc.On("Call", "one.vm.attach", mock.Anything, mock.Anything).Return(&url.Error{Op: "Post", URL: "http://one-0:2633/RPC2", Err: refused}).Once()
+	rpc.On("Call", "one.vm.attach", mock.Anything, mock.Anything).Run(answer(true, int64(5))).Return(nil).Once()
+
+	res, err := client.Call("one.vm.attach", 5, "DISK = [ IMAGE_ID = \"3\" ]")
+	assert.Nil(t, err)
+	assert.Equal(t, "5", res)
+	rpc.AssertExpectations(t)
+}
+
+func TestCallFailsWhenTheFrontendHangs(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := NewFailoverClient([]string{server.URL}, "oneadmin", "secret", NewTransport(false, 50*time.Millisecond))
+	assert.NoError(t, err)
+	client.maxRetries = 3
+	client.retryInterval = time.Millisecond
+
+	start := time.Now()
+	_, err = client.Call("one.vm.info", 1)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "OpenNebula did not answer within 50ms")
+	assert.True(t, isRequestTimeout(err))
+	assert.False(t, isTransientError(err))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestNewTransport(t *testing.T) {
+	transport, ok := NewTransport(true, 0).(*http.Transport)
+	assert.True(t, ok)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+
+	transport, ok = NewTransport(false, 0).(*http.Transport)
+	assert.True(t, ok)
+	assert.Nil(t, transport.TLSClientConfig)
+
+	timeout, ok := NewTransport(false, time.Minute).(*timeoutTransport)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, timeout.timeout)
+}
+
+func TestCallReturnsTheErrorCode(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vm.info", mock.Anything, mock.Anything).Run(answer(false, "[one.vm.info] Error getting virtual machine [1].", int64(0x0400))).Return(nil)
+
+	_, err := client.Call("one.vm.info", 1)
+	assert.Equal(t, &OneError{Code: OneErrorNoExists, Message: "[one.vm.info] Error getting virtual machine [1]."}, err)
+}
+
+func TestIsSuccessWithoutErrorCode(t *testing.T) {
+	_, err := new(Client).IsSuccess([]interface{}{false, "[one.vm.info] failed"})
+	assert.Equal(t, &OneError{Message: "[one.vm.info] failed"}, err)
+}
@@ -0,0 +1,76 @@
+package opennebula
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceMarketplaceApp() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceMarketplaceAppRead,
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Name of the marketplace app",
+			},
+			"marketplace_id": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				Description: "ID of the marketplace to look the app up in. Required if several marketplaces have an app of that name",
+			},
+			"marketplace": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the marketplace of the app",
+			},
+			"size": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Size of the app in MB",
+			},
+			"format": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Format of the image of the app, e.g. qcow2",
+			},
+		},
+	}
+}
+
+func dataSourceMarketplaceAppRead(d *schema.ResourceData, meta interface{}) error {
+	name := d.Get("name").(string)
+	marketplaceId, filtered := d.GetOkExists("marketplace_id")
+
+	// all apps the user has access to
+	app, err := findInPool(meta.(*Client), "one.marketapppool.info", "MARKETPLACEAPP", func(app map[string]string) bool {
+		return app["NAME"] == name && (!filtered || app["MARKETPLACE_ID"] == fmt.Sprint(marketplaceId))
+	}, -2, -1, -1)
+	if e, ok := err.(*ambiguousInPoolError); ok {
+		// apps of the same name in several marketplaces have to be told apart by marketplace_id
+		marketplaces := make([]string, 0, len(e.matches))
+		for _, app := range e.matches {
+			marketplaces = append(marketplaces, fmt.Sprintf("%s (%s)", app["MARKETPLACE_ID"], app["MARKETPLACE"]))
+		}
+		return fmt.Errorf("Marketplace app %q exists in several marketplaces, e.g. %s, set marketplace_id to choose one", name, strings.Join(marketplaces, ", "))
+	}
+	if err != nil {
+		return fmt.Errorf("Could not resolve marketplace app %q: %s", name, err)
+	}
+
+	return saveMarketplaceAppDataToState(d, app)
+}
+
+func saveMarketplaceAppDataToState(d *schema.ResourceData, app map[string]string) error {
+	d.SetId(app["ID"])
+	d.Set("marketplace_id", convertToInt(app["MARKETPLACE_ID"]))
+	d.Set("marketplace", app["MARKETPLACE"])
+	d.Set("size", convertToOptionalInt(app["SIZE"], 0))
+	d.Set("format", app["FORMAT"])
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var testMarketplaceAppPool = `<MARKETPLACEAPP_POOL>
+	<MARKETPLACEAPP><ID>12</ID><NAME>Ubuntu 18.04</NAME><MARKETPLACE_ID>0</MARKETPLACE_ID><MARKETPLACE>OpenNebula Public</MARKETPLACE><SIZE>2252</SIZE><FORMAT>qcow2</FORMAT></MARKETPLACEAPP>
+	<MARKETPLACEAPP><ID>30</ID><NAME>Ubuntu 18.04</NAME><MARKETPLACE_ID>100</MARKETPLACE_ID><MARKETPLACE>internal</MARKETPLACE><SIZE>2048</SIZE><FORMAT>raw</FORMAT></MARKETPLACEAPP>
+	<MARKETPLACEAPP><ID>31</ID><NAME>MySQL</NAME><MARKETPLACE_ID>100</MARKETPLACE_ID><MARKETPLACE>internal</MARKETPLACE><SIZE>4096</SIZE><FORMAT>qcow2</FORMAT></MARKETPLACEAPP>
+</MARKETPLACEAPP_POOL>`
+
+func testMarketplaceAppClient() *Client {
+	rpc := new(MockRpc)
+	rpc.On("Call", "one.marketapppool.info", []interface{}{"user:pass", -2, 0, -poolPageSize}, mock.Anything).Run(answer(true, testMarketplaceAppPool)).Return(nil)
+	return failoverClient(rpc)
+}
+
+func TestMarketplaceAppByName(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, dataSourceMarketplaceApp().Schema, map[string]interface{}{"name": "MySQL"})
+
+	assert.NoError(t, dataSourceMarketplaceAppRead(d, testMarketplaceAppClient()))
+	assert.Equal(t, "31", d.Id())
+	assert.Equal(t, 100, d.Get("marketplace_id"))
+	assert.Equal(t, "internal", d.Get("marketplace"))
+	assert.Equal(t, 4096, d.Get("size"))
+	assert.Equal(t, "qcow2", d.Get("format"))
+}
+
+func TestMarketplaceAppInSeveralMarketplaces(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, dataSourceMarketplaceApp().Schema, map[string]interface{}{"name": "Ubuntu 18.04"})
+	err := dataSourceMarketplaceAppRead(d, testMarketplaceAppClient())
+	assert.EqualError(t, err, `Marketplace app "Ubuntu 18.04" exists in several marketplaces, e.g. 0 (OpenNebula Public), 100 (internal), set marketplace_id to choose one`)
+
+	d = schema.TestResourceDataRaw(t, dataSourceMarketplaceApp().Schema, map[string]interface{}{"name": "Ubuntu 18.04", "marketplace_id": 0})
+	assert.NoError(t, dataSourceMarketplaceAppRead(d, testMarketplaceAppClient()))
+	assert.Equal(t, "12", d.Id())
+	assert.Equal(t, 2252, d.Get("size"))
+}
+
+func TestMarketplaceAppNotFound(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, dataSourceMarketplaceApp().Schema, map[string]interface{}{"name": "MySQL", "marketplace_id": 0})
+	assert.Error(t, dataSourceMarketplaceAppRead(d, testMarketplaceAppClient()))
+}
@@ -0,0 +1,396 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"strconv"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	// OpenNebula uses negative limits as sentinels instead of real quota values,
+	// these are its values for "use the default quota" and "unlimited"
+	QuotaDefault   = -1
+	QuotaUnlimited = -2
+)
+
+type Quotas struct {
+	Id              int               `xml:"ID"`
+	Name            string            `xml:"NAME"`
+	VmQuota         *VmQuota          `xml:"VM_QUOTA>VM"`
+	DatastoreQuotas []*DatastoreQuota `xml:"DATASTORE_QUOTA>DATASTORE"`
+	NetworkQuotas   []*NetworkQuota   `xml:"NETWORK_QUOTA>NETWORK"`
+	ImageQuotas     []*ImageQuota     `xml:"IMAGE_QUOTA>IMAGE"`
+}
+
+type VmQuota struct {
+	Cpu                float64 `xml:"CPU"`
+	CpuUsed            float64 `xml:"CPU_USED"`
+	Memory             float64 `xml:"MEMORY"`
+	MemoryUsed         float64 `xml:"MEMORY_USED"`
+	Vms                float64 `xml:"VMS"`
+	VmsUsed            float64 `xml:"VMS_USED"`
+	SystemDiskSize     float64 `xml:"SYSTEM_DISK_SIZE"`
+	SystemDiskSizeUsed float64 `xml:"SYSTEM_DISK_SIZE_USED"`
+}
+
+type DatastoreQuota struct {
+	Id         int     `xml:"ID"`
+	Images     float64 `xml:"IMAGES"`
+	ImagesUsed float64 `xml:"IMAGES_USED"`
+	Size       float64 `xml:"SIZE"`
+	SizeUsed   float64 `xml:"SIZE_USED"`
+}
+
+type NetworkQuota struct {
+	Id         int     `xml:"ID"`
+	Leases     float64 `xml:"LEASES"`
+	LeasesUsed float64 `xml:"LEASES_USED"`
+}
+
+type ImageQuota struct {
+	Id             int     `xml:"ID"`
+	RunningVms     float64 `xml:"RVMS"`
+	RunningVmsUsed float64 `xml:"RVMS_USED"`
+}
+
+// UnmarshalXML presets the limits with the default sentinel, limits left out of
+// a quota use the default quota instead of being 0. The same applies to the other quotas.
+func (q *VmQuota) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain VmQuota
+	p := plain{Cpu: QuotaDefault, Memory: QuotaDefault, Vms: QuotaDefault, SystemDiskSize: QuotaDefault}
+	if err := d.DecodeElement(&p, &start); err != nil {
+		return err
+	}
+	*q = VmQuota(p)
+	return nil
+}
+
+func (q *DatastoreQuota) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain DatastoreQuota
+	p := plain{Images: QuotaDefault, Size: QuotaDefault}
+	if err := d.DecodeElement(&p, &start); err != nil {
+		return err
+	}
+	*q = DatastoreQuota(p)
+	return nil
+}
+
+func (q *NetworkQuota) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain NetworkQuota
+	p := plain{Leases: QuotaDefault}
+	if err := d.DecodeElement(&p, &start); err != nil {
+		return err
+	}
+	*q = NetworkQuota(p)
+	return nil
+}
+
+func (q *ImageQuota) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain ImageQuota
+	p := plain{RunningVms: QuotaDefault}
+	if err := d.DecodeElement(&p, &start); err != nil {
+		return err
+	}
+	*q = ImageQuota(p)
+	return nil
+}
+
+func dataSourceUserQuota() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceUserQuotaRead,
+
+		Schema: quotaDataSourceSchema("user_id", "ID of the user. Defaults to the user the provider is authenticated as"),
+	}
+}
+
+func dataSourceGroupQuota() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceGroupQuotaRead,
+
+		Schema: quotaDataSourceSchema("group_id", "ID of the group"),
+	}
+}
+
+func quotaDataSourceSchema(idAttribute string, idDescription string) map[string]*schema.Schema {
+	limit := func(description string) *schema.Schema {
+		return &schema.Schema{
+			Type:        schema.TypeFloat,
+			Computed:    true,
+			Description: description + ". As in OpenNebula, -1 means the default quota applies (only with resolve_defaults disabled) and -2 means unlimited",
+		}
+	}
+	used := func(description string) *schema.Schema {
+		return &schema.Schema{
+			Type:        schema.TypeFloat,
+			Computed:    true,
+			Description: description,
+		}
+	}
+	id := func(description string) *schema.Schema {
+		return &schema.Schema{
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: description,
+		}
+	}
+
+	s := map[string]*schema.Schema{
+		"name": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "Name of the owner of the quotas",
+		},
+		"vm_quota": {
+			Type:        schema.TypeList,
+			Computed:    true,
+			Description: "Compute quota and its usage",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"cpu":                   limit("Maximum CPU"),
+					"cpu_used":              used("Used CPU"),
+					"memory":                limit("Maximum memory in MB"),
+					"memory_used":           used("Used memory in MB"),
+					"vms":                   limit("Maximum number of VMs"),
+					"vms_used":              used("Number of VMs"),
+					"system_disk_size":      limit("Maximum size of system disks in MB"),
+					"system_disk_size_used": used("Used size of system disks in MB"),
+				},
+			},
+		},
+		"datastore_quota": {
+			Type:        schema.TypeList,
+			Computed:    true,
+			Description: "Datastore quotas and their usage",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"datastore_id": id("ID of the datastore"),
+					"images":       limit("Maximum number of images"),
+					"images_used":  used("Number of images"),
+					"size":         limit("Maximum size in MB"),
+					"size_used":    used("Used size in MB"),
+				},
+			},
+		},
+		"network_quota": {
+			Type:        schema.TypeList,
+			Computed:    true,
+			Description: "Network quotas and their usage",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"network_id":  id("ID of the network"),
+					"leases":      limit("Maximum number of leases"),
+					"leases_used": used("Number of leases"),
+				},
+			},
+		},
+		"image_quota": {
+			Type:        schema.TypeList,
+			Computed:    true,
+			Description: "Image quotas and their usage",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"image_id":         id("ID of the image"),
+					"running_vms":      limit("Maximum number of running VMs using the image"),
+					"running_vms_used": used("Number of running VMs using the image"),
+				},
+			},
+		},
+	}
+
+	s["resolve_defaults"] = &schema.Schema{
+		Type:        schema.TypeBool,
+		Optional:    true,
+		Default:     true,
+		Description: "Replace limits using the default quota with the effective default limit. If disabled, they are reported as -1",
+	}
+
+	s[idAttribute] = &schema.Schema{
+		Type:        schema.TypeInt,
+		Optional:    true,
+		Computed:    true,
+		Description: idDescription,
+	}
+
+	return s
+}
+
+func dataSourceUserQuotaRead(d *schema.ResourceData, meta interface{}) error {
+	id := -1
+	if v, ok := d.GetOk("user_id"); ok {
+		id = v.(int)
+	}
+
+	quotas, err := loadQuotas(meta.(*Client), "one.user.info", id, "one.userquota.info", d.Get("resolve_defaults").(bool))
+	if err != nil {
+		return err
+	}
+
+	d.Set("user_id", quotas.Id)
+	return saveQuotasToState(d, quotas)
+}
+
+func dataSourceGroupQuotaRead(d *schema.ResourceData, meta interface{}) error {
+	id := -1
+	if v, ok := d.GetOk("group_id"); ok {
+		id = v.(int)
+	}
+
+	quotas, err := loadQuotas(meta.(*Client), "one.group.info", id, "one.groupquota.info", d.Get("resolve_defaults").(bool))
+	if err != nil {
+		return err
+	}
+
+	d.Set("group_id", quotas.Id)
+	return saveQuotasToState(d, quotas)
+}
+
+// loadQuotas reads the quotas of a user or group. With resolveDefaults set, the
+// limits which point to the default quotas are resolved.
+func loadQuotas(client OneClient, infoMethod string, id int, defaultsMethod string, resolveDefaults bool) (*Quotas, error) {
+	var quotas *Quotas
+	var defaults *Quotas
+
+	resp, err := client.Call(infoMethod, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &quotas); err != nil {
+		return nil, err
+	}
+
+	if !resolveDefaults {
+		return quotas, nil
+	}
+
+	resp, err = client.Call(defaultsMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &defaults); err != nil {
+		return nil, err
+	}
+
+	resolveDefaultQuotas(quotas, defaults)
+
+	return quotas, nil
+}
+
+func resolveDefaultQuotas(quotas *Quotas, defaults *Quotas) {
+	if quotas.VmQuota != nil {
+		vmDefaults := defaults.VmQuota
+		if vmDefaults == nil {
+			vmDefaults = &VmQuota{
+				Cpu:            QuotaUnlimited,
+				Memory:         QuotaUnlimited,
+				Vms:            QuotaUnlimited,
+				SystemDiskSize: QuotaUnlimited,
+			}
+		}
+		quotas.VmQuota.Cpu = effectiveQuotaLimit(quotas.VmQuota.Cpu, vmDefaults.Cpu)
+		quotas.VmQuota.Memory = effectiveQuotaLimit(quotas.VmQuota.Memory, vmDefaults.Memory)
+		quotas.VmQuota.Vms = effectiveQuotaLimit(quotas.VmQuota.Vms, vmDefaults.Vms)
+		quotas.VmQuota.SystemDiskSize = effectiveQuotaLimit(quotas.VmQuota.SystemDiskSize, vmDefaults.SystemDiskSize)
+	}
+
+	for _, q := range quotas.DatastoreQuotas {
+		dsDefaults := &DatastoreQuota{Images: QuotaUnlimited, Size: QuotaUnlimited}
+		for _, dq := range defaults.DatastoreQuotas {
+			if dq.Id == q.Id {
+				dsDefaults = dq
+			}
+		}
+		q.Images = effectiveQuotaLimit(q.Images, dsDefaults.Images)
+		q.Size = effectiveQuotaLimit(q.Size, dsDefaults.Size)
+	}
+
+	for _, q := range quotas.NetworkQuotas {
+		netDefaults := &NetworkQuota{Leases: QuotaUnlimited}
+		for _, dq := range defaults.NetworkQuotas {
+			if dq.Id == q.Id {
+				netDefaults = dq
+			}
+		}
+		q.Leases = effectiveQuotaLimit(q.Leases, netDefaults.Leases)
+	}
+
+	for _, q := range quotas.ImageQuotas {
+		imgDefaults := &ImageQuota{RunningVms: QuotaUnlimited}
+		for _, dq := range defaults.ImageQuotas {
+			if dq.Id == q.Id {
+				imgDefaults = dq
+			}
+		}
+		q.RunningVms = effectiveQuotaLimit(q.RunningVms, imgDefaults.RunningVms)
+	}
+}
+
+// effectiveQuotaLimit replaces the "default" sentinel with the default limit.
+// A default limit that points to the default again means that there is no limit at all.
+func effectiveQuotaLimit(limit float64, defaultLimit float64) float64 {
+	if limit != QuotaDefault {
+		return limit
+	}
+	if defaultLimit == QuotaDefault {
+		return QuotaUnlimited
+	}
+	return defaultLimit
+}
+
+func saveQuotasToState(d *schema.ResourceData, quotas *Quotas) error {
+	d.SetId(strconv.Itoa(quotas.Id))
+	d.Set("name", quotas.Name)
+
+	vmQuota := []interface{}{}
+	if q := quotas.VmQuota; q != nil {
+		vmQuota = append(vmQuota, map[string]interface{}{
+			"cpu":                   q.Cpu,
+			"cpu_used":              q.CpuUsed,
+			"memory":                q.Memory,
+			"memory_used":           q.MemoryUsed,
+			"vms":                   q.Vms,
+			"vms_used":              q.VmsUsed,
+			"system_disk_size":      q.SystemDiskSize,
+			"system_disk_size_used": q.SystemDiskSizeUsed,
+		})
+	}
+	if err := d.Set("vm_quota", vmQuota); err != nil {
+		return err
+	}
+
+	datastoreQuota := make([]interface{}, 0, len(quotas.DatastoreQuotas))
+	for _, q := range quotas.DatastoreQuotas {
+		datastoreQuota = append(datastoreQuota, map[string]interface{}{
+			"datastore_id": q.Id,
+			"images":       q.Images,
+			"images_used":  q.ImagesUsed,
+			"size":         q.Size,
+			"size_used":    q.SizeUsed,
+		})
+	}
+	if err := d.Set("datastore_quota", datastoreQuota); err != nil {
+		return err
+	}
+
+	networkQuota := make([]interface{}, 0, len(quotas.NetworkQuotas))
+	for _, q := range quotas.NetworkQuotas {
+		networkQuota = append(networkQuota, map[string]interface{}{
+			"network_id":  q.Id,
+			"leases":      q.Leases,
+			"leases_used": q.LeasesUsed,
+		})
+	}
+	if err := d.Set("network_quota", networkQuota); err != nil {
+		return err
+	}
+
+	imageQuota := make([]interface{}, 0, len(quotas.ImageQuotas))
+	for _, q := range quotas.ImageQuotas {
+		imageQuota = append(imageQuota, map[string]interface{}{
+			"image_id":         q.Id,
+			"running_vms":      q.RunningVms,
+			"running_vms_used": q.RunningVmsUsed,
+		})
+	}
+	return d.Set("image_quota", imageQuota)
+}
@@ -0,0 +1,108 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEffectiveQuotaLimit(t *testing.T) {
+	assert.Equal(t, float64(10), effectiveQuotaLimit(10, 20))
+	assert.Equal(t, float64(0), effectiveQuotaLimit(0, 20))
+	assert.Equal(t, float64(QuotaUnlimited), effectiveQuotaLimit(QuotaUnlimited, 20))
+	assert.Equal(t, float64(20), effectiveQuotaLimit(QuotaDefault, 20))
+	assert.Equal(t, float64(QuotaUnlimited), effectiveQuotaLimit(QuotaDefault, QuotaUnlimited))
+	assert.Equal(t, float64(QuotaUnlimited), effectiveQuotaLimit(QuotaDefault, QuotaDefault))
+}
+
+func TestLoadQuotasResolvesDefaults(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.user.info", []interface{}{5}).Return(`<USER>
+		<ID>5</ID>
+		<NAME>jdoe</NAME>
+		<VM_QUOTA><VM>
+			<CPU>-1</CPU><CPU_USED>1.5</CPU_USED>
+			<MEMORY>-2</MEMORY><MEMORY_USED>2048</MEMORY_USED>
+			<VMS>4</VMS><VMS_USED>2</VMS_USED>
+			<SYSTEM_DISK_SIZE>-1</SYSTEM_DISK_SIZE><SYSTEM_DISK_SIZE_USED>0</SYSTEM_DISK_SIZE_USED>
+		</VM></VM_QUOTA>
+		<DATASTORE_QUOTA><DATASTORE>
+			<ID>1</ID><IMAGES>-1</IMAGES><IMAGES_USED>3</IMAGES_USED><SIZE>1000</SIZE><SIZE_USED>300</SIZE_USED>
+		</DATASTORE></DATASTORE_QUOTA>
+		<NETWORK_QUOTA>
+			<NETWORK><ID>0</ID><LEASES>-1</LEASES><LEASES_USED>1</LEASES_USED></NETWORK>
+			<NETWORK><ID>2</ID><LEASES>5</LEASES><LEASES_USED>2</LEASES_USED></NETWORK>
+		</NETWORK_QUOTA>
+		<IMAGE_QUOTA/>
+	</USER>`, nil)
+	mockClient.On("Call", "one.userquota.info", []interface{}(nil)).Return(`<DEFAULT_USER_QUOTAS>
+		<VM_QUOTA><VM><CPU>8</CPU><MEMORY>-1</MEMORY><VMS>-1</VMS><SYSTEM_DISK_SIZE>-2</SYSTEM_DISK_SIZE></VM></VM_QUOTA>
+		<DATASTORE_QUOTA><DATASTORE><ID>1</ID><IMAGES>10</IMAGES><SIZE>-1</SIZE></DATASTORE></DATASTORE_QUOTA>
+	</DEFAULT_USER_QUOTAS>`, nil)
+
+	quotas, err := loadQuotas(mockClient, "one.user.info", 5, "one.userquota.info", true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "jdoe", quotas.Name)
+	assert.Equal(t, float64(8), quotas.VmQuota.Cpu)
+	assert.Equal(t, 1.5, quotas.VmQuota.CpuUsed)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.VmQuota.Memory)
+	assert.Equal(t, float64(4), quotas.VmQuota.Vms)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.VmQuota.SystemDiskSize)
+	assert.Len(t, quotas.DatastoreQuotas, 1)
+	assert.Equal(t, float64(10), quotas.DatastoreQuotas[0].Images)
+	assert.Equal(t, float64(1000), quotas.DatastoreQuotas[0].Size)
+	assert.Len(t, quotas.NetworkQuotas, 2)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.NetworkQuotas[0].Leases)
+	assert.Equal(t, float64(5), quotas.NetworkQuotas[1].Leases)
+	assert.Empty(t, quotas.ImageQuotas)
+}
+
+func TestLoadQuotasKeepsSentinels(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.group.info", []interface{}{100}).Return(`<GROUP>
+		<ID>100</ID>
+		<NAME>devs</NAME>
+		<VM_QUOTA><VM><CPU>-1</CPU><MEMORY>-2</MEMORY><VMS>0</VMS><SYSTEM_DISK_SIZE>-1</SYSTEM_DISK_SIZE></VM></VM_QUOTA>
+	</GROUP>`, nil)
+
+	quotas, err := loadQuotas(mockClient, "one.group.info", 100, "one.groupquota.info", false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, float64(QuotaDefault), quotas.VmQuota.Cpu)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.VmQuota.Memory)
+	assert.Equal(t, float64(0), quotas.VmQuota.Vms)
+	mockClient.AssertNotCalled(t, "Call", "one.groupquota.info", []interface{}(nil))
+}
+
+func TestLoadQuotasTreatsMissingLimitsAsDefault(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.user.info", []interface{}{5}).Return(`<USER>
+		<ID>5</ID>
+		<VM_QUOTA><VM><CPU>2</CPU><CPU_USED>1</CPU_USED></VM></VM_QUOTA>
+		<DATASTORE_QUOTA><DATASTORE><ID>1</ID><IMAGES_USED>3</IMAGES_USED></DATASTORE></DATASTORE_QUOTA>
+		<NETWORK_QUOTA><NETWORK><ID>0</ID></NETWORK></NETWORK_QUOTA>
+		<IMAGE_QUOTA><IMAGE><ID>4</ID></IMAGE></IMAGE_QUOTA>
+	</USER>`, nil)
+	mockClient.On("Call", "one.userquota.info", []interface{}(nil)).Return(`<DEFAULT_USER_QUOTAS>
+		<VM_QUOTA><VM><CPU>8</CPU><MEMORY>4096</MEMORY><VMS>-2</VMS><SYSTEM_DISK_SIZE>-1</SYSTEM_DISK_SIZE></VM></VM_QUOTA>
+	</DEFAULT_USER_QUOTAS>`, nil)
+
+	raw, err := loadQuotas(mockClient, "one.user.info", 5, "one.userquota.info", false)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), raw.VmQuota.Cpu)
+	assert.Equal(t, float64(QuotaDefault), raw.VmQuota.Memory)
+	assert.Equal(t, float64(QuotaDefault), raw.DatastoreQuotas[0].Size)
+	assert.Equal(t, float64(QuotaDefault), raw.NetworkQuotas[0].Leases)
+	assert.Equal(t, float64(QuotaDefault), raw.ImageQuotas[0].RunningVms)
+
+	quotas, err := loadQuotas(mockClient, "one.user.info", 5, "one.userquota.info", true)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), quotas.VmQuota.Cpu)
+	assert.Equal(t, float64(4096), quotas.VmQuota.Memory)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.VmQuota.Vms)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.VmQuota.SystemDiskSize)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.DatastoreQuotas[0].Images)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.NetworkQuotas[0].Leases)
+	assert.Equal(t, float64(QuotaUnlimited), quotas.ImageQuotas[0].RunningVms)
+}
@@ -0,0 +1,63 @@
+package opennebula
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceTemplate() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceTemplateRead,
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Name of the template, it has to identify a single template the user has access to",
+			},
+			"uid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the user that owns the template",
+			},
+			"gid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the group that owns the template",
+			},
+			"uname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the user that owns the template",
+			},
+			"gname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the group that owns the template",
+			},
+		},
+	}
+}
+
+func dataSourceTemplateRead(d *schema.ResourceData, meta interface{}) error {
+	name := d.Get("name").(string)
+
+	// all templates the user has access to
+	tmpl, err := findInPool(meta.(*Client), "one.templatepool.info", "VMTEMPLATE", nameMatches(name), -2, -1, -1)
+	if err != nil {
+		return fmt.Errorf("Could not resolve template %q: %s", name, err)
+	}
+
+	return saveTemplateDataToState(d, tmpl)
+}
+
+func saveTemplateDataToState(d *schema.ResourceData, tmpl map[string]string) error {
+	d.SetId(tmpl["ID"])
+	d.Set("uid", convertToInt(tmpl["UID"]))
+	d.Set("gid", convertToInt(tmpl["GID"]))
+	d.Set("uname", tmpl["UNAME"])
+	d.Set("gname", tmpl["GNAME"])
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+var testTemplatePool = `<VMTEMPLATE_POOL>
+	<VMTEMPLATE><ID>4</ID><UID>2</UID><GID>1</GID><UNAME>jdoe</UNAME><GNAME>users</GNAME><NAME>web</NAME></VMTEMPLATE>
+	<VMTEMPLATE><ID>6</ID><UID>0</UID><GID>0</GID><UNAME>oneadmin</UNAME><GNAME>oneadmin</GNAME><NAME>db</NAME></VMTEMPLATE>
+	<VMTEMPLATE><ID>9</ID><UID>2</UID><GID>1</GID><UNAME>jdoe</UNAME><GNAME>users</GNAME><NAME>db</NAME></VMTEMPLATE>
+</VMTEMPLATE_POOL>`
+
+func TestSaveTemplateDataToState(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.templatepool.info", []interface{}{-2, 0, -poolPageSize}).Return(testTemplatePool, nil)
+
+	tmpl, err := findInPool(mockClient, "one.templatepool.info", "VMTEMPLATE", nameMatches("web"), -2, -1, -1)
+	assert.NoError(t, err)
+
+	d := schema.TestResourceDataRaw(t, dataSourceTemplate().Schema, map[string]interface{}{"name": "web"})
+	assert.NoError(t, saveTemplateDataToState(d, tmpl))
+
+	assert.Equal(t, "4", d.Id())
+	assert.Equal(t, 2, d.Get("uid"))
+	assert.Equal(t, "users", d.Get("gname"))
+}
+
+func TestTemplateNameMustBeUnique(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.templatepool.info", []interface{}{-2, 0, -poolPageSize}).Return(testTemplatePool, nil)
+
+	_, err := findInPool(mockClient, "one.templatepool.info", "VMTEMPLATE", nameMatches("db"), -2, -1, -1)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "6, 9")
+}
@@ -0,0 +1,163 @@
+package opennebula
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceVm() *schema.Resource {
+	r := &schema.Resource{
+		Read: dataSourceVmRead,
+
+		Schema: map[string]*schema.Schema{
+			"id": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				Description:   "ID of the VM. Either id or name has to be set",
+				ConflictsWith: []string{"name"},
+			},
+			"name": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				Description:   "Name of the VM, it has to identify a single VM the user has access to",
+				ConflictsWith: []string{"id"},
+			},
+			"ip_attribute": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Use different attribute from VM Info. TEMPLATE/CONTEXT/ETH0_IP is the default value",
+			},
+			"ip6_attribute": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Read ip6 from this attribute of the VM info instead, e.g. TEMPLATE/CONTEXT/ETH0_IP6",
+			},
+			"ip": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "IP address that is assigned to the VM",
+			},
+			"ips": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "IP addresses of the NICs of the VM in NIC order, the IPv6 address for NICs without an IPv4 one",
+			},
+			"ip6": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "IPv6 address that is assigned to the VM, empty if it has none",
+			},
+			"ip6s": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "IPv6 addresses of the NICs of the VM in NIC order, preferring global ones over link local ones. NICs without IPv6 are left out",
+			},
+			"state": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Current state of the VM",
+			},
+			"lcmstate": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Current LCM state of the VM",
+			},
+			"uid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the user that owns the VM",
+			},
+			"gid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the group that owns the VM",
+			},
+			"uname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the user that owns the VM",
+			},
+			"gname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the group that owns the VM",
+			},
+			"permissions": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Permissions of the VM (in Unix format, owner-group-other, use-manage-admin)",
+			},
+		},
+	}
+
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
+	}
+
+	return r
+}
+
+func dataSourceVmRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	id, err := dataSourceVmId(client, d)
+	if err != nil {
+		return err
+	}
+
+	attributes, err := loadVMInfo(client, id)
+	if err != nil {
+		return fmt.Errorf("Could not read VM %d: %s", id, err)
+	}
+
+	saveVmDataToState(d, attributes)
+	return nil
+}
+
+// dataSourceVmId resolves the configured id or name to the ID of the VM.
+func dataSourceVmId(client OneClient, d *schema.ResourceData) (int, error) {
+	if v, ok := d.GetOkExists("id"); ok {
+		return v.(int), nil
+	}
+
+	name, ok := d.GetOk("name")
+	if !ok {
+		return 0, fmt.Errorf("Either id or name has to be set")
+	}
+
+	// -1 for the state includes all VMs except the terminated ones
+	vm, err := findInPool(client, "one.vmpool.info", VmElementName, nameMatches(name.(string)), -2, -1, -1, -1)
+	if err != nil {
+		return 0, fmt.Errorf("Could not resolve VM %q: %s", name, err)
+	}
+
+	return convertToInt(vm["ID"]), nil
+}
+
+func saveVmDataToState(d *schema.ResourceData, attributes map[string]string) {
+	d.SetId(attributes["ID"])
+	d.Set("id", convertToInt(attributes["ID"]))
+	d.Set("name", attributes["NAME"])
+	d.Set("uid", convertToInt(attributes["UID"]))
+	d.Set("gid", convertToInt(attributes["GID"]))
+	d.Set("uname", attributes["UNAME"])
+	d.Set("gname", attributes["GNAME"])
+	d.Set("state", convertToInt(attributes[StateAttribute]))
+	d.Set("lcmstate", convertToInt(attributes[LcmStateAttribute]))
+	ips := readVmIps(attributes)
+	d.Set("ip", determineIp(d, attributes, ips))
+	d.Set("ips", ips)
+	ip6s := readVmIp6s(attributes)
+	d.Set("ip6", determineIp6(d, attributes, ip6s))
+	d.Set("ip6s", ip6s)
+	if hasPermissions(attributes) {
+		permissions := buildPermissions(attributes)
+		d.Set("permissions", permissionString(permissions))
+		setPermissionBits(d, permissions)
+	}
+}
@@ -0,0 +1,138 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// VmMonitoringData is the answer of one.vm.monitoring. OpenNebula 5 wraps each sample
+// in a VM record, newer versions return the MONITORING samples directly.
+type VmMonitoringData struct {
+	Records []*VmMonitoringRecord `xml:"VM"`
+	Samples []*VmMonitoring       `xml:"MONITORING"`
+}
+
+type VmMonitoringRecord struct {
+	LastPoll   int64         `xml:"LAST_POLL"`
+	Monitoring *VmMonitoring `xml:"MONITORING"`
+}
+
+type VmMonitoring struct {
+	Timestamp   int64   `xml:"TIMESTAMP"`
+	Cpu         float64 `xml:"CPU"`
+	Memory      int64   `xml:"MEMORY"`
+	NetRx       int64   `xml:"NETRX"`
+	NetTx       int64   `xml:"NETTX"`
+	DiskRdBytes int64   `xml:"DISKRDBYTES"`
+	DiskWrBytes int64   `xml:"DISKWRBYTES"`
+}
+
+func dataSourceVmMonitoring() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceVmMonitoringRead,
+
+		Schema: map[string]*schema.Schema{
+			"vm_id": {
+				Type:        schema.TypeInt,
+				Required:    true,
+				Description: "ID of the VM",
+			},
+			"timestamp": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Time the latest sample was taken at",
+			},
+			"cpu": {
+				Type:        schema.TypeFloat,
+				Computed:    true,
+				Description: "CPU usage in percent of one CPU",
+			},
+			"memory": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Memory usage in KB",
+			},
+			"net_rx": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Bytes received over the network",
+			},
+			"net_tx": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Bytes sent over the network",
+			},
+			"disk_read_bytes": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Bytes read from the disks",
+			},
+			"disk_write_bytes": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Bytes written to the disks",
+			},
+		},
+	}
+}
+
+func dataSourceVmMonitoringRead(d *schema.ResourceData, meta interface{}) error {
+	id := d.Get("vm_id").(int)
+
+	sample, err := loadLatestVmMonitoring(meta.(*Client), id)
+	if err != nil {
+		return err
+	}
+	if sample == nil {
+		return fmt.Errorf("No monitoring data available for VM %d", id)
+	}
+
+	d.SetId(strconv.Itoa(id))
+	d.Set("timestamp", int(sample.Timestamp))
+	d.Set("cpu", sample.Cpu)
+	d.Set("memory", int(sample.Memory))
+	d.Set("net_rx", int(sample.NetRx))
+	d.Set("net_tx", int(sample.NetTx))
+	d.Set("disk_read_bytes", int(sample.DiskRdBytes))
+	d.Set("disk_write_bytes", int(sample.DiskWrBytes))
+
+	return nil
+}
+
+// loadLatestVmMonitoring returns the most recent monitoring sample of a VM, or nil
+// if it has not been monitored yet.
+func loadLatestVmMonitoring(client OneClient, id int) (*VmMonitoring, error) {
+	var data *VmMonitoringData
+
+	resp, err := client.Call("one.vm.monitoring", id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = xml.Unmarshal([]byte(resp), &data); err != nil {
+		return nil, err
+	}
+
+	samples := data.Samples
+	for _, r := range data.Records {
+		if r.Monitoring == nil {
+			continue
+		}
+		if r.Monitoring.Timestamp == 0 {
+			r.Monitoring.Timestamp = r.LastPoll
+		}
+		samples = append(samples, r.Monitoring)
+	}
+
+	var latest *VmMonitoring
+	for _, s := range samples {
+		if latest == nil || s.Timestamp >= latest.Timestamp {
+			latest = s
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,48 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadLatestVmMonitoring(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.monitoring", []interface{}{4}).Return(`<MONITORING_DATA>
+		<VM><ID>4</ID><LAST_POLL>200</LAST_POLL><MONITORING><CPU>12.5</CPU><MEMORY>524288</MEMORY><NETRX>10</NETRX></MONITORING></VM>
+		<VM><ID>4</ID><LAST_POLL>300</LAST_POLL><MONITORING><CPU>3</CPU><MEMORY>262144</MEMORY><DISKWRBYTES>4096</DISKWRBYTES></MONITORING></VM>
+		<VM><ID>4</ID><LAST_POLL>100</LAST_POLL><MONITORING><CPU>99</CPU></MONITORING></VM>
+	</MONITORING_DATA>`, nil)
+
+	sample, err := loadLatestVmMonitoring(mockClient, 4)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(300), sample.Timestamp)
+	assert.Equal(t, float64(3), sample.Cpu)
+	assert.Equal(t, int64(262144), sample.Memory)
+	assert.Equal(t, int64(4096), sample.DiskWrBytes)
+}
+
+func TestLoadLatestVmMonitoringWithTimestamps(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.monitoring", []interface{}{4}).Return(`<MONITORING_DATA>
+		<MONITORING><TIMESTAMP>500</TIMESTAMP><ID>4</ID><CPU>7</CPU><NETTX>20</NETTX></MONITORING>
+		<MONITORING><TIMESTAMP>400</TIMESTAMP><ID>4</ID><CPU>8</CPU></MONITORING>
+	</MONITORING_DATA>`, nil)
+
+	sample, err := loadLatestVmMonitoring(mockClient, 4)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(500), sample.Timestamp)
+	assert.Equal(t, int64(20), sample.NetTx)
+}
+
+func TestLoadLatestVmMonitoringWithoutSamples(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.monitoring", []interface{}{4}).Return("<MONITORING_DATA/>", nil)
+
+	sample, err := loadLatestVmMonitoring(mockClient, 4)
+
+	assert.NoError(t, err)
+	assert.Nil(t, sample)
+}
@@ -0,0 +1,74 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+var testVmPool = `<VM_POOL>
+	<VM><ID>12</ID><NAME>web-0</NAME></VM>
+	<VM><ID>15</ID><NAME>db</NAME></VM>
+	<VM><ID>17</ID><NAME>db</NAME></VM>
+</VM_POOL>`
+
+var testVmInfo = `<VM>
+	<ID>12</ID><UID>2</UID><GID>1</GID><UNAME>jdoe</UNAME><GNAME>users</GNAME><NAME>web-0</NAME>
+	<PERMISSIONS>
+		<OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M><OWNER_A>0</OWNER_A>
+		<GROUP_U>1</GROUP_U><GROUP_M>0</GROUP_M><GROUP_A>0</GROUP_A>
+		<OTHER_U>0</OTHER_U><OTHER_M>0</OTHER_M><OTHER_A>0</OTHER_A>
+	</PERMISSIONS>
+	<STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+	<TEMPLATE><CONTEXT><ETH0_IP>10.0.0.12</ETH0_IP></CONTEXT></TEMPLATE>
+</VM>`
+
+func TestDataSourceVmIdByName(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vmpool.info", []interface{}{-2, 0, -poolPageSize, -1}).Return(testVmPool, nil)
+
+	d := schema.TestResourceDataRaw(t, dataSourceVm().Schema, map[string]interface{}{"name": "web-0"})
+	id, err := dataSourceVmId(mockClient, d)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 12, id)
+}
+
+func TestDataSourceVmIdRejectsAmbiguousNames(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vmpool.info", []interface{}{-2, 0, -poolPageSize, -1}).Return(testVmPool, nil)
+
+	d := schema.TestResourceDataRaw(t, dataSourceVm().Schema, map[string]interface{}{"name": "db"})
+	_, err := dataSourceVmId(mockClient, d)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "15, 17")
+}
+
+func TestDataSourceVmIdById(t *testing.T) {
+	mockClient := new(MockClient)
+
+	d := schema.TestResourceDataRaw(t, dataSourceVm().Schema, map[string]interface{}{"id": 0})
+	id, err := dataSourceVmId(mockClient, d)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, id)
+	mockClient.AssertNotCalled(t, "Call")
+}
+
+func TestSaveVmDataToState(t *testing.T) {
+	attributes, err := parseResponse([]byte(testVmInfo), VmElementName)
+	assert.NoError(t, err)
+
+	d := schema.TestResourceDataRaw(t, dataSourceVm().Schema, map[string]interface{}{"id": 12})
+	saveVmDataToState(d, attributes)
+
+	assert.Equal(t, "12", d.Id())
+	assert.Equal(t, "web-0", d.Get("name"))
+	assert.Equal(t, "10.0.0.12", d.Get("ip"))
+	assert.Equal(t, 3, d.Get("lcmstate"))
+	assert.Equal(t, "jdoe", d.Get("uname"))
+	assert.Equal(t, "640", d.Get("permissions"))
+	assert.Equal(t, true, d.Get("group_use"))
+}
@@ -0,0 +1,66 @@
+package opennebula
+
+import (
+	"log"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Error codes OpenNebula sends along with the message of a failed call
+const (
+	OneErrorAuthentication = 0x0100
+	OneErrorAuthorization  = 0x0200
+	OneErrorNoExists       = 0x0400
+	OneErrorAction         = 0x0800
+	OneErrorXmlRpcApi      = 0x1000
+	OneErrorInternal       = 0x2000
+	OneErrorAllocate       = 0x4000
+	OneErrorLocked         = 0x8000
+)
+
+// OneError is a failed call OpenNebula answered with. Code is 0 if OpenNebula did
+// not send one.
+type OneError struct {
+	Code    int
+	Message string
+}
+
+func (e *OneError) Error() string {
+	return e.Message
+}
+
+// isNotFoundError tells whether OpenNebula rejected a call because the object does not exist.
+func isNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, ok := err.(*notFoundInPoolError); ok {
+		return true
+	}
+
+	if e, ok := err.(*OneError); ok && e.Code != 0 {
+		return e.Code == OneErrorNoExists
+	}
+
+	// errors without a code, e.g. "[one.vm.info] Error getting virtual machine [42]."
+	return strings.Contains(err.Error(), "Error getting")
+}
+
+// handleNotFound removes a resource from the state if it has been deleted
+// outside of Terraform. It returns whether the caller should stop reading
+// the resource, along with the error it should return.
+func handleNotFound(d *schema.ResourceData, err error) (bool, error) {
+	if err == nil {
+		return false, nil
+	}
+
+	if isNotFoundError(err) {
+		log.Printf("[WARN] Object %s not found, removing it from the state", d.Id())
+		d.SetId("")
+		return true, nil
+	}
+
+	return true, err
+}
@@ -0,0 +1,136 @@
+package opennebula
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHandleNotFoundClearsId(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	done, err := handleNotFound(d, fmt.Errorf("[one.vm.info] Error getting virtual machine [42]."))
+
+	assert.True(t, done)
+	assert.NoError(t, err)
+	assert.Equal(t, "", d.Id())
+}
+
+func TestHandleNotFoundKeepsOtherErrors(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	done, err := handleNotFound(d, fmt.Errorf("connection refused"))
+
+	assert.True(t, done)
+	assert.Error(t, err)
+	assert.Equal(t, "42", d.Id())
+}
+
+func TestHandleNotFoundWithoutError(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	done, err := handleNotFound(d, nil)
+
+	assert.False(t, done)
+	assert.NoError(t, err)
+	assert.Equal(t, "42", d.Id())
+}
+
+func TestIsNotFoundErrorUsesTheCode(t *testing.T) {
+	assert.True(t, isNotFoundError(&OneError{Code: OneErrorNoExists, Message: "[one.vm.info] Error getting virtual machine [42]."}))
+	assert.True(t, isNotFoundError(&OneError{Code: OneErrorNoExists, Message: "[one.vm.info] Object does not exist"}))
+	assert.False(t, isNotFoundError(&OneError{Code: OneErrorAuthorization, Message: "[one.vm.info] Error getting virtual machine [42]."}))
+	assert.True(t, isNotFoundError(&OneError{Message: "[one.vm.info] Error getting virtual machine [42]."}))
+}
+
+func TestVmReadClearsIdOfMissingVm(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "[one.vm.info] Object does not exist", int64(OneErrorNoExists))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	assert.NoError(t, resourceVmRead(d, client))
+	assert.Equal(t, "", d.Id())
+}
+
+func TestVmReadKeepsAuthorizationErrors(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "[one.vm.info] Not authorized to perform USE VM [42].", int64(OneErrorAuthorization))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	err := resourceVmRead(d, client)
+	assert.Equal(t, &OneError{Code: OneErrorAuthorization, Message: "[one.vm.info] Not authorized to perform USE VM [42]."}, err)
+	assert.Equal(t, "42", d.Id())
+}
+
+func TestVmReadClearsIdOfTerminatedVm(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, "<VM><ID>42</ID><STATE>6</STATE><LCM_STATE>0</LCM_STATE></VM>")).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	assert.NoError(t, resourceVmRead(d, client))
+	assert.Equal(t, "", d.Id())
+}
+
+func TestVmReadKeepsTransportErrors(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Return(fmt.Errorf("dial tcp: connection refused"))
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	assert.EqualError(t, resourceVmRead(d, client), "dial tcp: connection refused")
+	assert.Equal(t, "42", d.Id())
+}
+
+func TestReadKeepsAuthorizationErrorsWithoutLookingUpByName(t *testing.T) {
+	for method, r := range map[string]*schema.Resource{
+		"one.group.info":    resourceGroup(),
+		"one.user.info":     resourceUser(),
+		"one.secgroup.info": resourceSecurityGroup(),
+	} {
+		rpc := new(MockRpc)
+		client := failoverClient(rpc)
+		rpc.On("Call", method, []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "Not authorized", int64(OneErrorAuthorization))).Return(nil)
+
+		d := schema.TestResourceDataRaw(t, r.Schema, map[string]interface{}{"name": "other"})
+		d.SetId("42")
+
+		assert.Error(t, r.Read(d, client), method)
+		assert.Equal(t, "42", d.Id(), method)
+		assert.Equal(t, []string{method}, testRpcMethods(rpc), method)
+	}
+}
+
+func TestReadClearsIdOfMissingObjects(t *testing.T) {
+	for method, r := range map[string]*schema.Resource{
+		"one.group.info":    resourceGroup(),
+		"one.user.info":     resourceUser(),
+		"one.secgroup.info": resourceSecurityGroup(),
+	} {
+		rpc := new(MockRpc)
+		client := failoverClient(rpc)
+		rpc.On("Call", method, []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "Object does not exist", int64(OneErrorNoExists))).Return(nil)
+
+		d := schema.TestResourceDataRaw(t, r.Schema, map[string]interface{}{"name": "other"})
+		d.SetId("42")
+
+		assert.NoError(t, r.Read(d, client), method)
+		assert.Equal(t, "", d.Id(), method)
+	}
+}
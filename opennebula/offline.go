@@ -0,0 +1,85 @@
+package opennebula
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// offlineClient replaces the Client when the provider runs with offline set. It
+// never reaches OpenNebula, every call fails.
+type offlineClient struct{}
+
+func (c *offlineClient) Call(command string, args ...interface{}) (string, error) {
+	return "", fmt.Errorf("OpenNebula call %s is not possible in offline mode", command)
+}
+
+func (c *offlineClient) IsSuccess(result []interface{}) (string, error) {
+	return "", fmt.Errorf("The provider is in offline mode")
+}
+
+func isOffline(meta interface{}) bool {
+	_, ok := meta.(*offlineClient)
+	return ok
+}
+
+// offlineResource lets a resource work without OpenNebula in offline mode: reads
+// keep the last known state and changes are rejected.
+func offlineResource(name string, r *schema.Resource) *schema.Resource {
+	create, read, update, del, exists := r.Create, r.Read, r.Update, r.Delete, r.Exists
+	reject := func(operation string) error {
+		return fmt.Errorf("Can not %s %s in offline mode, the provider does not connect to OpenNebula", operation, name)
+	}
+
+	r.Create = func(d *schema.ResourceData, meta interface{}) error {
+		if isOffline(meta) {
+			return reject("create")
+		}
+		return create(d, meta)
+	}
+	r.Read = func(d *schema.ResourceData, meta interface{}) error {
+		if isOffline(meta) {
+			return nil
+		}
+		return read(d, meta)
+	}
+	if update != nil {
+		r.Update = func(d *schema.ResourceData, meta interface{}) error {
+			if isOffline(meta) {
+				return reject("update")
+			}
+			return update(d, meta)
+		}
+	}
+	r.Delete = func(d *schema.ResourceData, meta interface{}) error {
+		if isOffline(meta) {
+			return reject("delete")
+		}
+		return del(d, meta)
+	}
+	if exists != nil {
+		r.Exists = func(d *schema.ResourceData, meta interface{}) (bool, error) {
+			if isOffline(meta) {
+				return true, nil
+			}
+			return exists(d, meta)
+		}
+	}
+
+	return r
+}
+
+// offlineDataSource makes a data source return a synthetic result in offline mode:
+// the ID "offline" and the computed attributes left empty.
+func offlineDataSource(r *schema.Resource) *schema.Resource {
+	read := r.Read
+	r.Read = func(d *schema.ResourceData, meta interface{}) error {
+		if isOffline(meta) {
+			d.SetId("offline")
+			return nil
+		}
+		return read(d, meta)
+	}
+
+	return r
+}
@@ -0,0 +1,62 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func offlineProvider(t *testing.T) (*schema.Provider, interface{}) {
+	p := Provider().(*schema.Provider)
+	d := schema.TestResourceDataRaw(t, p.Schema, map[string]interface{}{"offline": true})
+	meta, err := providerConfigure(d)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return p, meta
+}
+
+func TestOfflineProviderNeedsNoEndpoint(t *testing.T) {
+	_, meta := offlineProvider(t)
+
+	assert.IsType(t, &offlineClient{}, meta)
+	_, err := meta.(OneClient).Call("one.vm.info", 1)
+	assert.EqualError(t, err, "OpenNebula call one.vm.info is not possible in offline mode")
+}
+
+func TestOfflineResourceKeepsState(t *testing.T) {
+	p, meta := offlineProvider(t)
+	r := p.ResourcesMap["opennebula_vnet"]
+
+	d := schema.TestResourceDataRaw(t, r.Schema, map[string]interface{}{"name": "private", "bridge": "br0"})
+	d.SetId("3")
+
+	assert.NoError(t, r.Read(d, meta))
+	assert.Equal(t, "3", d.Id())
+	assert.Equal(t, "private", d.Get("name"))
+
+	exists, err := r.Exists(d, meta)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestOfflineResourceRejectsChanges(t *testing.T) {
+	p, meta := offlineProvider(t)
+	r := p.ResourcesMap["opennebula_template"]
+	d := schema.TestResourceDataRaw(t, r.Schema, map[string]interface{}{"name": "web"})
+
+	assert.EqualError(t, r.Create(d, meta), "Can not create opennebula_template in offline mode, the provider does not connect to OpenNebula")
+	assert.Error(t, r.Update(d, meta))
+	assert.Error(t, r.Delete(d, meta))
+}
+
+func TestOfflineDataSourceIsSynthetic(t *testing.T) {
+	p, meta := offlineProvider(t)
+	r := p.DataSourcesMap["opennebula_vm"]
+	d := schema.TestResourceDataRaw(t, r.Schema, map[string]interface{}{"name": "web-1"})
+
+	assert.NoError(t, r.Read(d, meta))
+	assert.Equal(t, "offline", d.Id())
+}
@@ -1,8 +1,12 @@
 package opennebula
 
 import (
+	"encoding/xml"
+	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
 )
 
 type Permissions struct {
@@ -17,11 +21,70 @@ type Permissions struct {
 	Other_A int `xml:"OTHER_A"`
 }
 
+type User struct {
+	Name       string `xml:"NAME"`
+	Id         int    `xml:"ID"`
+	Gid        int    `xml:"GID"`
+	Gname      string `xml:"GNAME"`
+	Groups     []int  `xml:"GROUPS>ID"`
+	AuthDriver string `xml:"AUTH_DRIVER"`
+}
+
+// Computed attributes exposing the single permission bits
+var permissionBits = map[string]string{
+	"owner_use":    "owner may use the object",
+	"owner_manage": "owner may manage the object",
+	"owner_admin":  "owner may administrate the object",
+	"group_use":    "group may use the object",
+	"group_manage": "group may manage the object",
+	"group_admin":  "group may administrate the object",
+	"other_use":    "other users may use the object",
+	"other_manage": "other users may manage the object",
+	"other_admin":  "other users may administrate the object",
+}
+
+func permissionBitsSchema() map[string]*schema.Schema {
+	s := make(map[string]*schema.Schema)
+	for key, description := range permissionBits {
+		s[key] = &schema.Schema{
+			Type:        schema.TypeBool,
+			Computed:    true,
+			Description: "Whether the " + description + ", derived from permissions",
+		}
+	}
+
+	return s
+}
+
+// permissionBitValues maps the permission bits to their attribute names.
+func permissionBitValues(p *Permissions) map[string]bool {
+	return map[string]bool{
+		"owner_use":    p.Owner_U == 1,
+		"owner_manage": p.Owner_M == 1,
+		"owner_admin":  p.Owner_A == 1,
+		"group_use":    p.Group_U == 1,
+		"group_manage": p.Group_M == 1,
+		"group_admin":  p.Group_A == 1,
+		"other_use":    p.Other_U == 1,
+		"other_manage": p.Other_M == 1,
+		"other_admin":  p.Other_A == 1,
+	}
+}
+
+func setPermissionBits(d *schema.ResourceData, p *Permissions) {
+	if p == nil {
+		return
+	}
+	for key, value := range permissionBitValues(p) {
+		d.Set(key, value)
+	}
+}
+
 func permissionString(p *Permissions) string {
 	owner := p.Owner_U<<2 | p.Owner_M<<1 | p.Owner_A
 	group := p.Group_U<<2 | p.Group_M<<1 | p.Group_A
 	other := p.Other_U<<2 | p.Other_M<<1 | p.Other_A
-	return strconv.Itoa(owner*100 + group*10 + other)
+	return fmt.Sprintf("%03d", owner*100+group*10+other)
 }
 
 func permission(p string) *Permissions {
@@ -43,20 +106,66 @@ func permission(p string) *Permissions {
 	}
 }
 
-func changePermissions(id int, p *Permissions, client *Client, call string) (string, error) {
-  return client.Call(
-    call,
-    id,
-    p.Owner_U,
-    p.Owner_M,
-    p.Owner_A,
-    p.Group_U,
-    p.Group_M,
-    p.Group_A,
-    p.Other_U,
-    p.Other_M,
-    p.Other_A,
-    false, // recursive (do not change the associated images' permissions)
-  )
+// changePermissions calls the given chmod method. With recursive set, the images
+// of a template are changed too (only supported by one.template.chmod).
+func changePermissions(id int, p *Permissions, client OneClient, call string, recursive bool) (string, error) {
+	return client.Call(
+		call,
+		id,
+		p.Owner_U,
+		p.Owner_M,
+		p.Owner_A,
+		p.Group_U,
+		p.Group_M,
+		p.Group_A,
+		p.Other_U,
+		p.Other_M,
+		p.Other_A,
+		recursive,
+	)
 }
 
+// loadCurrentUser returns the user the client is authenticated as.
+func loadCurrentUser(client OneClient) (*User, error) {
+	var user *User
+
+	resp, err := client.Call("one.user.info", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = xml.Unmarshal([]byte(resp), &user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// canManage tells whether the user holds the MANAGE right on an object owned by uid/gid.
+// Members of the oneadmin group (ID 0) are allowed to manage everything.
+func canManage(user *User, uid int, gid int, p *Permissions) bool {
+	if user.Id == 0 || user.Gid == 0 {
+		return true
+	}
+
+	if p == nil {
+		return false
+	}
+
+	if user.Id == uid && p.Owner_M == 1 {
+		return true
+	}
+
+	if p.Group_M == 1 {
+		if user.Gid == gid {
+			return true
+		}
+		for _, g := range user.Groups {
+			if g == gid {
+				return true
+			}
+		}
+	}
+
+	return p.Other_M == 1
+}
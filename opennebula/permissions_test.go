@@ -0,0 +1,75 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangePermissionsPassesRecursiveFlag(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.chmod", []interface{}{4, 1, 1, 0, 1, 0, 0, 0, 0, 0, true}).Return("4", nil)
+
+	_, err := changePermissions(4, permission("640"), mockClient, "one.template.chmod", true)
+
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+}
+
+func TestChangePermissionsNotRecursive(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.chmod", []interface{}{4, 1, 1, 0, 1, 0, 0, 0, 0, 0, false}).Return("4", nil)
+
+	_, err := changePermissions(4, permission("640"), mockClient, "one.vm.chmod", false)
+
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+}
+
+func TestPermissionRoundTrip(t *testing.T) {
+	for _, p := range []string{"000", "640", "755", "777", "104"} {
+		assert.Equal(t, p, permissionString(permission(p)))
+	}
+}
+
+func TestCanManage(t *testing.T) {
+	p := permission("640")
+	owner := &User{Id: 5, Gid: 100}
+	groupMember := &User{Id: 6, Gid: 1, Groups: []int{1, 100}}
+	other := &User{Id: 7, Gid: 1, Groups: []int{1}}
+	admin := &User{Id: 8, Gid: 0}
+
+	assert.True(t, canManage(owner, 5, 100, p))
+	assert.False(t, canManage(groupMember, 5, 100, p))
+	assert.True(t, canManage(groupMember, 5, 100, permission("660")))
+	assert.False(t, canManage(other, 5, 100, permission("660")))
+	assert.True(t, canManage(other, 5, 100, permission("662")))
+	assert.True(t, canManage(admin, 5, 100, permission("600")))
+}
+
+func TestPermissionBitValues(t *testing.T) {
+	bits := permissionBitValues(permission("751"))
+
+	assert.Equal(t, map[string]bool{
+		"owner_use":    true,
+		"owner_manage": true,
+		"owner_admin":  true,
+		"group_use":    true,
+		"group_manage": false,
+		"group_admin":  true,
+		"other_use":    false,
+		"other_manage": false,
+		"other_admin":  true,
+	}, bits)
+}
+
+func TestSetPermissionBits(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceTemplate().Schema, map[string]interface{}{})
+	setPermissionBits(d, permission("640"))
+
+	assert.True(t, d.Get("owner_manage").(bool))
+	assert.True(t, d.Get("group_use").(bool))
+	assert.False(t, d.Get("group_manage").(bool))
+	assert.False(t, d.Get("other_use").(bool))
+}
@@ -0,0 +1,132 @@
+package opennebula
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// notFoundInPoolError is returned by findInPool when no element matches.
+type notFoundInPoolError struct {
+	element string
+}
+
+func (e *notFoundInPoolError) Error() string {
+	return fmt.Sprintf("Could not find any %s matching the criteria", strings.ToLower(e.element))
+}
+
+// ambiguousInPoolError is returned by findInPool when several elements match. It
+// holds the matches found until the search stopped, so callers can describe them.
+type ambiguousInPoolError struct {
+	element string
+	matches []map[string]string
+}
+
+func (e *ambiguousInPoolError) Error() string {
+	ids := make([]string, 0, len(e.matches))
+	for _, attributes := range e.matches {
+		ids = append(ids, attributes["ID"])
+	}
+	return fmt.Sprintf("Criteria are ambiguous, they match the %s IDs %s", strings.ToLower(e.element), strings.Join(ids, ", "))
+}
+
+// parsePool flattens every element of a pool response into its own attribute
+// map, using the same paths as parseResponse.
+func parsePool(data []byte, element string) ([]map[string]string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var elements []map[string]string
+
+	for {
+		t, err := decoder.Token()
+		if err == io.EOF {
+			return elements, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if tt, ok := t.(xml.StartElement); ok && tt.Name.Local == element {
+			attributes, err := parseSubTree(decoder, element)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, attributes)
+		}
+	}
+}
+
+// Elements requested per call when paging through a pool
+const poolPageSize = 500
+
+// findInPool calls a pool info method and returns the attributes of the only
+// element accepted by the predicate. Finding none or several is an error. The
+// search stops as soon as a second match makes the criteria ambiguous.
+func findInPool(client OneClient, poolMethod string, element string, predicate func(map[string]string) bool, args ...interface{}) (map[string]string, error) {
+	var matches []map[string]string
+	err := callPool(client, poolMethod, element, args, func(attributes map[string]string) bool {
+		if predicate(attributes) {
+			matches = append(matches, attributes)
+		}
+		return len(matches) < 2
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, &notFoundInPoolError{element: element}
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, &ambiguousInPoolError{element: element, matches: matches}
+	}
+}
+
+// callPool calls a pool info method and passes its elements to visit until visit
+// returns false. Pools called with the whole range, i.e. a filter followed by -1, -1,
+// are read in pages of poolPageSize elements instead of at once, so that large pools
+// are never held in memory as a whole and the remaining pages are not requested once
+// visit is done.
+func callPool(client OneClient, poolMethod string, element string, args []interface{}, visit func(map[string]string) bool) error {
+	paged := len(args) >= 3 && args[1] == -1 && args[2] == -1
+	if paged {
+		args = append([]interface{}{}, args...)
+	}
+
+	for offset := 0; ; offset += poolPageSize {
+		if paged {
+			// a negative end is the size of the page starting at the offset
+			args[1], args[2] = offset, -poolPageSize
+		}
+
+		resp, err := client.Call(poolMethod, args...)
+		if err != nil {
+			return err
+		}
+
+		elements, err := parsePool([]byte(resp), element)
+		if err != nil {
+			return err
+		}
+
+		for _, attributes := range elements {
+			if !visit(attributes) {
+				return nil
+			}
+		}
+
+		if !paged || len(elements) < poolPageSize {
+			return nil
+		}
+	}
+}
+
+// nameMatches is the predicate for the common lookup by name.
+func nameMatches(name string) func(map[string]string) bool {
+	return func(attributes map[string]string) bool {
+		return attributes["NAME"] == name
+	}
+}
@@ -0,0 +1,138 @@
+package opennebula
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testVnetPool = `<VNET_POOL>
+	<VNET><ID>2</ID><NAME>public</NAME><UNAME>oneadmin</UNAME><AR_POOL><AR><AR_ID>0</AR_ID></AR></AR_POOL></VNET>
+	<VNET><ID>5</ID><NAME>private</NAME><UNAME>oneadmin</UNAME></VNET>
+	<VNET><ID>8</ID><NAME>private</NAME><UNAME>jdoe</UNAME></VNET>
+</VNET_POOL>`
+
+func TestParsePool(t *testing.T) {
+	elements, err := parsePool([]byte(testVnetPool), "VNET")
+
+	assert.NoError(t, err)
+	assert.Len(t, elements, 3)
+	assert.Equal(t, "public", elements[0]["NAME"])
+	assert.Equal(t, "0", elements[0]["AR_POOL/AR/AR_ID"])
+}
+
+func TestFindInPoolSingleMatch(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vnpool.info", []interface{}{-3, 0, -poolPageSize}).Return(testVnetPool, nil)
+
+	vnet, err := findInPool(mockClient, "one.vnpool.info", "VNET", nameMatches("public"), -3, -1, -1)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2", vnet["ID"])
+	mockClient.AssertExpectations(t)
+}
+
+func TestFindInPoolNoMatch(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vnpool.info", []interface{}{-3, 0, -poolPageSize}).Return(testVnetPool, nil)
+
+	_, err := findInPool(mockClient, "one.vnpool.info", "VNET", nameMatches("dmz"), -3, -1, -1)
+
+	assert.Error(t, err)
+	assert.True(t, isNotFoundError(err))
+}
+
+func TestFindInPoolAmbiguousMatch(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vnpool.info", []interface{}{-3, 0, -poolPageSize}).Return(testVnetPool, nil)
+
+	_, err := findInPool(mockClient, "one.vnpool.info", "VNET", nameMatches("private"), -3, -1, -1)
+
+	assert.Error(t, err)
+	assert.False(t, isNotFoundError(err))
+	assert.Contains(t, err.Error(), "5, 8")
+}
+
+func TestFindInPoolCustomPredicate(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vnpool.info", []interface{}{-3, 0, -poolPageSize}).Return(testVnetPool, nil)
+
+	vnet, err := findInPool(mockClient, "one.vnpool.info", "VNET", func(attributes map[string]string) bool {
+		return attributes["NAME"] == "private" && attributes["UNAME"] == "jdoe"
+	}, -3, -1, -1)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "8", vnet["ID"])
+}
+
+// testVmPoolClient serves a pool of size VMs named vm-<ID>, honoring the range of
+// one.vmpool.info the way OpenNebula does.
+type testVmPoolClient struct {
+	MockClient
+	size  int
+	calls int
+}
+
+func (c *testVmPoolClient) Call(command string, args ...interface{}) (string, error) {
+	c.calls++
+	start, end := args[1].(int), args[2].(int)
+	if start < 0 {
+		start = 0
+	}
+	last := c.size
+	if end < -1 && start-end < last {
+		last = start - end
+	}
+
+	var pool strings.Builder
+	pool.WriteString("<VM_POOL>")
+	for id := start; id < last; id++ {
+		fmt.Fprintf(&pool, "<VM><ID>%d</ID><NAME>vm-%d</NAME><TEMPLATE><MEMORY>1024</MEMORY><DISK><IMAGE_ID>3</IMAGE_ID></DISK></TEMPLATE></VM>", id, id)
+	}
+	pool.WriteString("</VM_POOL>")
+	return pool.String(), nil
+}
+
+func TestFindInPoolReadsPages(t *testing.T) {
+	client := &testVmPoolClient{size: 2*poolPageSize + 10}
+
+	vm, err := findInPool(client, "one.vmpool.info", VmElementName, nameMatches(fmt.Sprintf("vm-%d", 2*poolPageSize+5)), -2, -1, -1, -1)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(2*poolPageSize+5), vm["ID"])
+	assert.Equal(t, 3, client.calls)
+}
+
+func TestFindInPoolStopsAtAmbiguousMatch(t *testing.T) {
+	client := &testVmPoolClient{size: 4 * poolPageSize}
+
+	_, err := findInPool(client, "one.vmpool.info", VmElementName, func(attributes map[string]string) bool {
+		return strings.HasPrefix(attributes["NAME"], "vm-1")
+	}, -2, -1, -1, -1)
+
+	assert.EqualError(t, err, "Criteria are ambiguous, they match the vm IDs 1, 10")
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestFindInPoolWithoutRange(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.grouppool.info", []interface{}(nil)).Return(`<GROUP_POOL><GROUP><ID>0</ID><NAME>oneadmin</NAME></GROUP></GROUP_POOL>`, nil).Once()
+
+	group, err := findInPool(mockClient, "one.grouppool.info", "GROUP", nameMatches("oneadmin"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "0", group["ID"])
+	mockClient.AssertExpectations(t)
+}
+
+func BenchmarkFindInPool(b *testing.B) {
+	client := &testVmPoolClient{size: 4000}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := findInPool(client, "one.vmpool.info", VmElementName, nameMatches("vm-3999"), -2, -1, -1, -1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,48 +1,206 @@
 package opennebula
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/hashicorp/terraform/terraform"
 )
 
 func Provider() terraform.ResourceProvider {
-	return &schema.Provider{
+	p := &schema.Provider{
 		Schema: map[string]*schema.Schema{
 			"endpoint": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "The URL to your public or private OpenNebula",
-				DefaultFunc: schema.EnvDefaultFunc("OPENNEBULA_ENDPOINT", nil),
+				Optional:    true,
+				Description: "The URL to your public or private OpenNebula. Defaults to the OPENNEBULA_ENDPOINT or ONE_XMLRPC environment variables",
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"OPENNEBULA_ENDPOINT", "ONE_XMLRPC"}, nil),
+			},
+			"endpoints": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "URLs of the front-ends of an HA setup, tried in order when one becomes unreachable",
+				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
 			"username": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "The ID of the user to identify as",
+				Optional:    true,
+				Description: "The ID of the user to identify as. Defaults to the OPENNEBULA_USERNAME environment variable or the ONE_AUTH file",
 				DefaultFunc: schema.EnvDefaultFunc("OPENNEBULA_USERNAME", nil),
 			},
 			"password": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "The password for the user",
+				Optional:    true,
+				Sensitive:   true,
+				Description: "The password for the user, or a login token (see oneuser token-create) to reuse a session. Defaults to the OPENNEBULA_PASSWORD environment variable or the ONE_AUTH file",
 				DefaultFunc: schema.EnvDefaultFunc("OPENNEBULA_PASSWORD", nil),
 			},
+			"max_retries": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      3,
+				Description:  "How often a call is retried when the front-ends are unreachable or fail internally. Calls which change objects are only retried if they could not be sent",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"retry_interval": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				Description:  "Seconds to wait before the first retry, doubled for every further retry",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"poll_delay": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      10,
+				Description:  "Seconds to wait before polling OpenNebula for a state change, e.g. of a VM being deployed",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"poll_interval": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      3,
+				Description:  "Minimum seconds between two polls for a state change. Short intervals suit small test VMs, long ones spare the API in large deployments",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"insecure": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Skip the verification of the TLS certificates of the endpoints, e.g. for a self-signed proxy",
+			},
+			"request_timeout": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      60,
+				Description:  "Seconds a call may take before it fails, 0 to wait indefinitely. Timed out calls are not retried",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"offline": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Don't connect to OpenNebula, e.g. to validate or plan in CI. Resources keep their state, data sources return empty results and changes fail. Defaults to the OPENNEBULA_OFFLINE environment variable",
+				DefaultFunc: schema.EnvDefaultFunc("OPENNEBULA_OFFLINE", false),
+			},
+		},
+
+		DataSourcesMap: map[string]*schema.Resource{
+			"opennebula_user_quota":      dataSourceUserQuota(),
+			"opennebula_group_quota":     dataSourceGroupQuota(),
+			"opennebula_vm_monitoring":   dataSourceVmMonitoring(),
+			"opennebula_template":        dataSourceTemplate(),
+			"opennebula_vm":              dataSourceVm(),
+			"opennebula_marketplace_app": dataSourceMarketplaceApp(),
 		},
 
 		ResourcesMap: map[string]*schema.Resource{
-			"opennebula_template": resourceTemplate(),
-			"opennebula_vnet":     resourceVnet(),
-			"opennebula_vm":       resourceVm(),
-			"opennebula_image":    resourceImage(),
+			"opennebula_template":        resourceTemplate(),
+			"opennebula_vnet":            resourceVnet(),
+			"opennebula_virtual_network": resourceVnet(),
+			"opennebula_vm":              resourceVm(),
+			"opennebula_image":           resourceImage(),
+			"opennebula_security_group":  resourceSecurityGroup(),
+			"opennebula_group":           resourceGroup(),
+			"opennebula_user":            resourceUser(),
+			"opennebula_acl":             resourceAcl(),
+			"opennebula_vm_group":        resourceVmGroup(),
+			"opennebula_host":            resourceHost(),
+			"opennebula_cluster":         resourceCluster(),
+			"opennebula_virtual_router":  resourceVirtualRouter(),
+			"opennebula_user_quota":      resourceUserQuota(),
+			"opennebula_group_quota":     resourceGroupQuota(),
 		},
 
 		ConfigureFunc: providerConfigure,
 	}
+
+	for name, r := range p.ResourcesMap {
+		p.ResourcesMap[name] = offlineResource(name, r)
+	}
+	for name, r := range p.DataSourcesMap {
+		p.DataSourcesMap[name] = offlineDataSource(r)
+	}
+
+	return p
 }
 
 func providerConfigure(d *schema.ResourceData) (interface{}, error) {
-	return NewClient(
-		d.Get("endpoint").(string),
-		d.Get("username").(string),
-		d.Get("password").(string),
-	)
+	if d.Get("offline").(bool) {
+		return &offlineClient{}, nil
+	}
+
+	var urls []string
+	if v, ok := d.GetOk("endpoint"); ok {
+		urls = append(urls, v.(string))
+	}
+	for _, v := range d.Get("endpoints").([]interface{}) {
+		urls = append(urls, v.(string))
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("Either endpoint or endpoints must be set")
+	}
+
+	username := d.Get("username").(string)
+	password := d.Get("password").(string)
+	// the file holds a pair of credentials, it is not mixed with a username or a
+	// password set otherwise
+	if username == "" && password == "" {
+		var err error
+		if username, password, err = readOneAuth(); err != nil {
+			return nil, err
+		}
+	}
+
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("username and password must be set, either in the provider, the environment or the ONE_AUTH file")
+	}
+
+	transport := NewTransport(d.Get("insecure").(bool), time.Duration(d.Get("request_timeout").(int))*time.Second)
+	client, err := NewFailoverClient(urls, username, password, transport)
+	if err != nil {
+		return nil, err
+	}
+	client.maxRetries = d.Get("max_retries").(int)
+	client.retryInterval = time.Duration(d.Get("retry_interval").(int)) * time.Second
+	client.pollDelay = time.Duration(d.Get("poll_delay").(int)) * time.Second
+	client.pollInterval = time.Duration(d.Get("poll_interval").(int)) * time.Second
+
+	return client, nil
+}
+
+// readOneAuth reads the credentials from the file the OpenNebula CLI uses: the file
+// named by ONE_AUTH or ~/.one/one_auth, containing "username:password". A missing
+// ~/.one/one_auth is not an error, a missing file named by ONE_AUTH is.
+func readOneAuth() (string, string, error) {
+	path := os.Getenv("ONE_AUTH")
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		path = filepath.Join(home, ".one", "one_auth")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Could not read the credentials from %s: %s", path, err)
+	}
+
+	credentials := strings.SplitN(strings.TrimSpace(string(content)), ":", 2)
+	if len(credentials) != 2 {
+		return "", "", fmt.Errorf("The credentials in %s must have the form username:password", path)
+	}
+
+	return credentials[0], credentials[1], nil
 }
@@ -3,8 +3,13 @@ package opennebula
 import (
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestProvider(t *testing.T) {
@@ -38,3 +43,121 @@ func testEnvIsSet(k string, t *testing.T) {
 		t.Fatalf("%s must be set for acceptance tests", k)
 	}
 }
+
+func TestProviderConfigurationsAreIsolated(t *testing.T) {
+	configure := func(endpoint string, username string) *Client {
+		d := schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, map[string]interface{}{
+			"endpoint": endpoint,
+			"username": username,
+			"password": username + "-secret",
+		})
+		meta, err := providerConfigure(d)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return meta.(*Client)
+	}
+
+	zoneA := configure("http://zone-a:2633/RPC2", "alice")
+	zoneB := configure("http://zone-b:2633/RPC2", "bob")
+
+	rpcA := new(MockRpc)
+	rpcB := new(MockRpc)
+	zoneA.endpoints[0].rpc = rpcA
+	zoneB.endpoints[0].rpc = rpcB
+	rpcA.On("Call", "one.vm.info", []interface{}{"alice:alice-secret", 1}, mock.Anything).Run(answer(true, "<VM><ID>1</ID></VM>")).Return(nil)
+	rpcB.On("Call", "one.vm.info", []interface{}{"bob:bob-secret", 1}, mock.Anything).Run(answer(true, "<VM><ID>101</ID></VM>")).Return(nil)
+
+	resA, err := zoneA.Call("one.vm.info", 1)
+	assert.NoError(t, err)
+	resB, err := zoneB.Call("one.vm.info", 1)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "<VM><ID>1</ID></VM>", resA)
+	assert.Equal(t, "<VM><ID>101</ID></VM>", resB)
+	assert.Equal(t, "http://zone-a:2633/RPC2", zoneA.endpoints[0].url)
+	assert.Equal(t, "http://zone-b:2633/RPC2", zoneB.endpoints[0].url)
+	rpcA.AssertExpectations(t)
+	rpcB.AssertExpectations(t)
+}
+
+func TestProviderConfiguresPolling(t *testing.T) {
+	configure := func(raw map[string]interface{}) *Client {
+		raw["endpoint"] = "http://one:2633/RPC2"
+		raw["username"] = "alice"
+		raw["password"] = "secret"
+		meta, err := providerConfigure(schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, raw))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return meta.(*Client)
+	}
+
+	defaults := configure(map[string]interface{}{})
+	assert.Equal(t, 10*time.Second, defaults.pollDelay)
+	assert.Equal(t, 3*time.Second, defaults.pollInterval)
+
+	ci := configure(map[string]interface{}{"poll_delay": 0, "poll_interval": 1})
+	assert.Equal(t, time.Duration(0), ci.pollDelay)
+	assert.Equal(t, time.Second, ci.pollInterval)
+}
+
+func TestReadOneAuth(t *testing.T) {
+	file, err := ioutil.TempFile("", "one_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("alice:token:with:colons\n")
+	file.Close()
+
+	os.Setenv("ONE_AUTH", file.Name())
+	defer os.Unsetenv("ONE_AUTH")
+
+	username, password, err := readOneAuth()
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", username)
+	assert.Equal(t, "token:with:colons", password)
+
+	os.Setenv("ONE_AUTH", file.Name()+".missing")
+	_, _, err = readOneAuth()
+	assert.Error(t, err)
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Unsetenv("ONE_AUTH")
+	os.Setenv("HOME", filepath.Join(filepath.Dir(file.Name()), "missing"))
+	username, _, err = readOneAuth()
+	assert.NoError(t, err)
+	assert.Equal(t, "", username)
+}
+
+func TestProviderDoesNotMixCredentialsWithOneAuth(t *testing.T) {
+	file, err := ioutil.TempFile("", "one_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("alice:secret\n")
+	file.Close()
+
+	os.Setenv("ONE_AUTH", file.Name())
+	defer os.Unsetenv("ONE_AUTH")
+
+	d := schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, map[string]interface{}{
+		"endpoint": "http://one:2633/RPC2",
+		"username": "bob",
+		"password": "",
+	})
+	_, err = providerConfigure(d)
+	assert.Error(t, err)
+
+	d = schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, map[string]interface{}{
+		"endpoint": "http://one:2633/RPC2",
+		"username": "",
+		"password": "",
+	})
+	meta, err := providerConfigure(d)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice:secret", meta.(*Client).session)
+}
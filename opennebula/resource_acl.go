@@ -0,0 +1,300 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type AclPool struct {
+	Acls []*Acl `xml:"ACL"`
+}
+
+type Acl struct {
+	Id       int    `xml:"ID"`
+	User     string `xml:"USER"`
+	Resource string `xml:"RESOURCE"`
+	Rights   string `xml:"RIGHTS"`
+	Zone     string `xml:"ZONE"`
+	String   string `xml:"STRING"`
+}
+
+// Bits OpenNebula encodes the components of ACL rules with, see oneacl(1)
+const (
+	aclIndividual = 0x100000000
+	aclGroup      = 0x200000000
+	aclAll        = 0x400000000
+	aclCluster    = 0x800000000
+)
+
+var aclResourceTypes = map[string]uint64{
+	"VM":             0x1000000000,
+	"HOST":           0x2000000000,
+	"NET":            0x4000000000,
+	"IMAGE":          0x8000000000,
+	"USER":           0x10000000000,
+	"TEMPLATE":       0x20000000000,
+	"GROUP":          0x40000000000,
+	"DATASTORE":      0x100000000000,
+	"CLUSTER":        0x200000000000,
+	"DOCUMENT":       0x400000000000,
+	"ZONE":           0x800000000000,
+	"SECGROUP":       0x1000000000000,
+	"VDC":            0x2000000000000,
+	"VROUTER":        0x4000000000000,
+	"MARKETPLACE":    0x8000000000000,
+	"MARKETPLACEAPP": 0x10000000000000,
+	"VMGROUP":        0x20000000000000,
+	"VNTEMPLATE":     0x40000000000000,
+}
+
+var aclRights = map[string]uint64{
+	"USE":    0x1,
+	"MANAGE": 0x2,
+	"ADMIN":  0x4,
+	"CREATE": 0x8,
+}
+
+var aclIdPattern = regexp.MustCompile(`^([#@%]\d+|\*)$`)
+
+func resourceAcl() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceAclCreate,
+		Read:   resourceAclRead,
+		Exists: resourceAclExists,
+		Delete: resourceAclDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"user": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				Description:  "Users the rule applies to: #<user id>, @<group id> or * for all users",
+				ValidateFunc: validateAclComponent(parseAclUser),
+			},
+			"resource": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				Description:  "Resources the rule applies to, e.g. VM+NET/@1: resource types joined by +, then /#<id>, /@<group id>, /%<cluster id> or /*",
+				ValidateFunc: validateAclComponent(parseAclResource),
+			},
+			"rights": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				Description:  "Operations the rule allows, joined by +: USE, MANAGE, ADMIN, CREATE",
+				ValidateFunc: validateAclComponent(parseAclRights),
+			},
+			"zone": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ForceNew:     true,
+				Description:  "Zones the rule applies to: #<zone id> or * for all zones. Defaults to the current zone",
+				ValidateFunc: validateAclComponent(parseAclZone),
+			},
+		},
+	}
+}
+
+func resourceAclCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	args := make([]interface{}, 0, 4)
+	for _, c := range []struct {
+		key   string
+		parse func(string) (uint64, error)
+	}{{"user", parseAclUser}, {"resource", parseAclResource}, {"rights", parseAclRights}, {"zone", parseAclZone}} {
+		v, ok := d.GetOk(c.key)
+		if !ok {
+			continue
+		}
+		value, err := c.parse(v.(string))
+		if err != nil {
+			return err
+		}
+		args = append(args, strconv.FormatUint(value, 16))
+	}
+
+	resp, err := client.Call("one.acl.addrule", args...)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	return resourceAclRead(d, meta)
+}
+
+func resourceAclRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.acl.info")
+	if err != nil {
+		return err
+	}
+
+	var pool *AclPool
+	if err = xml.Unmarshal([]byte(resp), &pool); err != nil {
+		return err
+	}
+
+	acl := findAcl(pool, intId(d.Id()))
+	if acl == nil {
+		// one.acl.info lists all rules, so a deleted rule is only missing from the pool
+		_, err = handleNotFound(d, &notFoundInPoolError{element: "ACL"})
+		return err
+	}
+
+	// OpenNebula renders the rule its own way, e.g. with the resource types in
+	// another order, so the configured components are kept while they are equal.
+	components := strings.Fields(acl.String)
+	for i, c := range []struct {
+		key     string
+		encoded string
+		parse   func(string) (uint64, error)
+	}{{"user", acl.User, parseAclUser}, {"resource", acl.Resource, parseAclResource}, {"rights", acl.Rights, parseAclRights}, {"zone", acl.Zone, parseAclZone}} {
+		if i < len(components) && !aclComponentEquals(d.Get(c.key).(string), c.encoded, c.parse) {
+			d.Set(c.key, components[i])
+		}
+	}
+
+	return nil
+}
+
+func resourceAclExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceAclRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceAclDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceAclRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	client := meta.(*Client)
+	if _, err = client.Call("one.acl.delrule", intId(d.Id())); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted ACL rule %s\n", d.Id())
+	return nil
+}
+
+func findAcl(pool *AclPool, id int) *Acl {
+	for _, acl := range pool.Acls {
+		if acl.Id == id {
+			return acl
+		}
+	}
+
+	return nil
+}
+
+// aclComponentEquals compares a component of the configuration with its hexadecimal
+// encoding returned by one.acl.info.
+func aclComponentEquals(value string, encoded string, parse func(string) (uint64, error)) bool {
+	configured, err := parse(value)
+	if err != nil {
+		return false
+	}
+	current, err := strconv.ParseUint(encoded, 16, 64)
+	if err != nil {
+		return false
+	}
+
+	return configured == current
+}
+
+func validateAclComponent(parse func(string) (uint64, error)) schema.SchemaValidateFunc {
+	return func(v interface{}, k string) (ws []string, errors []error) {
+		if _, err := parse(v.(string)); err != nil {
+			errors = append(errors, fmt.Errorf("%q: %s", k, err))
+		}
+		return
+	}
+}
+
+// parseAclId encodes #<id>, @<id>, %<id> and * the way OpenNebula does.
+func parseAclId(s string) (uint64, error) {
+	if !aclIdPattern.MatchString(s) {
+		return 0, fmt.Errorf("%s is not one of #<id>, @<id>, %%<id> or *", s)
+	}
+	if s == "*" {
+		return aclAll, nil
+	}
+
+	id, err := strconv.ParseUint(s[1:], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	switch s[0] {
+	case '#':
+		return aclIndividual + id, nil
+	case '@':
+		return aclGroup + id, nil
+	default:
+		return aclCluster + id, nil
+	}
+}
+
+func parseAclUser(s string) (uint64, error) {
+	if strings.HasPrefix(s, "%") {
+		return 0, fmt.Errorf("Users can not be selected by cluster")
+	}
+	return parseAclId(s)
+}
+
+func parseAclZone(s string) (uint64, error) {
+	if !strings.HasPrefix(s, "#") && s != "*" {
+		return 0, fmt.Errorf("%s is not one of #<zone id> or *", s)
+	}
+	return parseAclId(s)
+}
+
+func parseAclResource(s string) (uint64, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("%s is not of the form <types>/<id>", s)
+	}
+
+	value, err := parseAclId(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range strings.Split(parts[0], "+") {
+		bit, ok := aclResourceTypes[strings.ToUpper(t)]
+		if !ok {
+			return 0, fmt.Errorf("Unknown resource type %s", t)
+		}
+		value |= bit
+	}
+
+	return value, nil
+}
+
+func parseAclRights(s string) (uint64, error) {
+	var value uint64
+	for _, r := range strings.Split(s, "+") {
+		bit, ok := aclRights[strings.ToUpper(r)]
+		if !ok {
+			return 0, fmt.Errorf("Unknown right %s", r)
+		}
+		value |= bit
+	}
+
+	return value, nil
+}
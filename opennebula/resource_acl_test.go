@@ -0,0 +1,97 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testAclPool = `<ACL_POOL>
+	<ACL><ID>0</ID><USER>200000001</USER><RESOURCE>5400000000</RESOURCE><RIGHTS>8</RIGHTS><ZONE>100000000</ZONE><STRING>@1 VM+NET/* CREATE #0</STRING></ACL>
+	<ACL><ID>5</ID><USER>100000003</USER><RESOURCE>8200000064</RESOURCE><RIGHTS>3</RIGHTS><ZONE>400000000</ZONE><STRING>#3 IMAGE/@100 USE+MANAGE *</STRING></ACL>
+</ACL_POOL>`
+
+func TestParseAclRule(t *testing.T) {
+	user, err := parseAclUser("@1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x200000001), user)
+
+	resource, err := parseAclResource("VM+NET/*")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x5400000000), resource)
+
+	resource, err = parseAclResource("net+vm/%2")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x5800000002), resource)
+
+	rights, err := parseAclRights("USE+MANAGE")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x3), rights)
+
+	zone, err := parseAclZone("*")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x400000000), zone)
+}
+
+func TestParseAclRuleRejectsInvalidComponents(t *testing.T) {
+	_, err := parseAclUser("%1")
+	assert.Error(t, err)
+	_, err = parseAclUser("1")
+	assert.Error(t, err)
+	_, err = parseAclResource("VM")
+	assert.Error(t, err)
+	_, err = parseAclResource("VM+DISK/*")
+	assert.EqualError(t, err, "Unknown resource type DISK")
+	_, err = parseAclRights("USE+DELETE")
+	assert.EqualError(t, err, "Unknown right DELETE")
+	_, err = parseAclZone("@0")
+	assert.Error(t, err)
+}
+
+func TestAclCreate(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.acl.addrule", []interface{}{"user:pass", "200000001", "5400000000", "8"}, mock.Anything).Run(answer(true, int64(0))).Return(nil)
+	rpc.On("Call", "one.acl.info", []interface{}{"user:pass"}, mock.Anything).Run(answer(true, testAclPool)).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceAcl().Schema, map[string]interface{}{
+		"user":     "@1",
+		"resource": "NET+VM/*",
+		"rights":   "CREATE",
+	})
+
+	assert.NoError(t, resourceAclCreate(d, client))
+	assert.Equal(t, "0", d.Id())
+	assert.Equal(t, "NET+VM/*", d.Get("resource"))
+	assert.Equal(t, "#0", d.Get("zone"))
+	rpc.AssertExpectations(t)
+}
+
+func TestAclReadImportedRule(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.acl.info", []interface{}{"user:pass"}, mock.Anything).Run(answer(true, testAclPool)).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceAcl().Schema, map[string]interface{}{})
+	d.SetId("5")
+
+	assert.NoError(t, resourceAclRead(d, client))
+	assert.Equal(t, "#3", d.Get("user"))
+	assert.Equal(t, "IMAGE/@100", d.Get("resource"))
+	assert.Equal(t, "USE+MANAGE", d.Get("rights"))
+	assert.Equal(t, "*", d.Get("zone"))
+}
+
+func TestAclReadClearsIdOfDeletedRule(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.acl.info", []interface{}{"user:pass"}, mock.Anything).Run(answer(true, testAclPool)).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceAcl().Schema, map[string]interface{}{"user": "@1", "resource": "VM/*", "rights": "USE"})
+	d.SetId("7")
+
+	assert.NoError(t, resourceAclRead(d, client))
+	assert.Equal(t, "", d.Id())
+}
@@ -0,0 +1,203 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"log"
+	"strconv"
+)
+
+type Cluster struct {
+	Name       string `xml:"NAME"`
+	Id         int    `xml:"ID"`
+	Hosts      []int  `xml:"HOSTS>ID"`
+	Datastores []int  `xml:"DATASTORES>ID"`
+	Vnets      []int  `xml:"VNETS>ID"`
+}
+
+func resourceCluster() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceClusterCreate,
+		Read:   resourceClusterRead,
+		Exists: resourceClusterExists,
+		Update: resourceClusterUpdate,
+		Delete: resourceClusterDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Name of the cluster",
+			},
+			"hosts": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Set:         schema.HashInt,
+				Description: "IDs of the hosts of the cluster. Hosts which are not listed go back to the default cluster, so leaving it empty empties the cluster",
+			},
+			"datastores": {
+				Type:        schema.TypeSet,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Set:         schema.HashInt,
+				Description: "IDs of the datastores of the cluster",
+			},
+			"vnets": {
+				Type:        schema.TypeSet,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Set:         schema.HashInt,
+				Description: "IDs of the virtual networks of the cluster",
+			},
+		},
+	}
+}
+
+func resourceClusterCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.cluster.allocate", d.Get("name").(string))
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	if hosts, ok := d.GetOk("hosts"); ok {
+		if err = updateClusterHosts(client, intId(d.Id()), &schema.Set{F: schema.HashInt}, hosts.(*schema.Set)); err != nil {
+			return err
+		}
+	}
+
+	return resourceClusterRead(d, meta)
+}
+
+func resourceClusterRead(d *schema.ResourceData, meta interface{}) error {
+	var cluster *Cluster
+
+	client := meta.(*Client)
+
+	// Try to find the cluster by ID, if specified
+	if d.Id() != "" {
+		resp, err := client.Call("one.cluster.info", intId(d.Id()))
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &cluster); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise, try to find the cluster by name, which is unique
+	if d.Id() == "" {
+		match, err := findInPool(client, "one.clusterpool.info", "CLUSTER", nameMatches(d.Get("name").(string)))
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find cluster with name %s", d.Get("name").(string))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Call("one.cluster.info", intId(match["ID"]))
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &cluster); err != nil {
+			return err
+		}
+	}
+
+	d.SetId(strconv.Itoa(cluster.Id))
+	d.Set("name", cluster.Name)
+	if err := d.Set("hosts", cluster.Hosts); err != nil {
+		return err
+	}
+	if err := d.Set("datastores", cluster.Datastores); err != nil {
+		return err
+	}
+	if err := d.Set("vnets", cluster.Vnets); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceClusterExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceClusterRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceClusterUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if d.HasChange("name") {
+		resp, err := client.Call(
+			"one.cluster.rename",
+			intId(d.Id()),
+			d.Get("name").(string),
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated name for cluster %s\n", resp)
+	}
+
+	if d.HasChange("hosts") {
+		old, new := d.GetChange("hosts")
+		if err := updateClusterHosts(client, intId(d.Id()), old.(*schema.Set), new.(*schema.Set)); err != nil {
+			return err
+		}
+	}
+
+	return resourceClusterRead(d, meta)
+}
+
+func resourceClusterDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceClusterRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	// OpenNebula only deletes clusters without hosts
+	client := meta.(*Client)
+	if err = updateClusterHosts(client, intId(d.Id()), d.Get("hosts").(*schema.Set), &schema.Set{F: schema.HashInt}); err != nil {
+		return err
+	}
+
+	resp, err := client.Call("one.cluster.delete", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted cluster %s\n", resp)
+	return nil
+}
+
+// updateClusterHosts removes the hosts which are not configured anymore and adds the new ones.
+func updateClusterHosts(client OneClient, id int, old *schema.Set, new *schema.Set) error {
+	for _, hostId := range old.Difference(new).List() {
+		if _, err := client.Call("one.cluster.delhost", id, hostId.(int)); err != nil {
+			return fmt.Errorf("Could not remove host %d from cluster %d: %s", hostId, id, err)
+		}
+	}
+
+	for _, hostId := range new.Difference(old).List() {
+		if _, err := client.Call("one.cluster.addhost", id, hostId.(int)); err != nil {
+			return fmt.Errorf("Could not add host %d to cluster %d: %s", hostId, id, err)
+		}
+	}
+
+	return nil
+}
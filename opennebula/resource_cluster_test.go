@@ -0,0 +1,103 @@
+package opennebula
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestClusterReadReportsMembers(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.cluster.info", []interface{}{"user:pass", 100}, mock.Anything).Run(answer(true, `<CLUSTER>
+		<ID>100</ID><NAME>production</NAME>
+		<HOSTS><ID>3</ID><ID>4</ID></HOSTS>
+		<DATASTORES><ID>0</ID><ID>1</ID><ID>2</ID></DATASTORES>
+		<VNETS/>
+	</CLUSTER>`)).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceCluster().Schema, map[string]interface{}{"name": "production", "hosts": []interface{}{3}})
+	d.SetId("100")
+
+	assert.NoError(t, resourceClusterRead(d, client))
+	assert.ElementsMatch(t, []interface{}{3, 4}, d.Get("hosts").(*schema.Set).List())
+	assert.ElementsMatch(t, []interface{}{0, 1, 2}, d.Get("datastores").(*schema.Set).List())
+	assert.Empty(t, d.Get("vnets").(*schema.Set).List())
+}
+
+func TestUpdateClusterHosts(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.cluster.delhost", []interface{}{100, 3}).Return("100", nil).Once()
+	mockClient.On("Call", "one.cluster.addhost", []interface{}{100, 5}).Return("100", nil).Once()
+
+	old := schema.NewSet(schema.HashInt, []interface{}{3, 4})
+	new := schema.NewSet(schema.HashInt, []interface{}{4, 5})
+
+	assert.NoError(t, updateClusterHosts(mockClient, 100, old, new))
+	mockClient.AssertExpectations(t)
+}
+
+func TestClusterReadKeepsAuthorizationErrors(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.cluster.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "Not authorized", int64(OneErrorAuthorization))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceCluster().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.Error(t, resourceClusterRead(d, client))
+	assert.Equal(t, "42", d.Id())
+	assert.Equal(t, []string{"one.cluster.info"}, testRpcMethods(rpc))
+}
+
+func TestClusterReadClearsIdOfMissingClusters(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.cluster.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "Object does not exist", int64(OneErrorNoExists))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceCluster().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.NoError(t, resourceClusterRead(d, client))
+	assert.Equal(t, "", d.Id())
+}
+
+func TestClusterHostsCanBeEmptied(t *testing.T) {
+	r := resourceCluster()
+	s := &terraform.InstanceState{ID: "100", Attributes: map[string]string{
+		"name":    "production",
+		"hosts.#": "2",
+		"hosts." + strconv.Itoa(schema.HashInt(3)): "3",
+		"hosts." + strconv.Itoa(schema.HashInt(4)): "4",
+	}}
+
+	// the SDK can't tell an empty list from a missing one, both have to empty the cluster
+	diff, err := r.Diff(s, terraform.NewResourceConfigRaw(map[string]interface{}{"name": "production"}), nil)
+	assert.NoError(t, err)
+	d, err := schema.InternalMap(r.Schema).Data(s, diff)
+	assert.NoError(t, err)
+
+	assert.True(t, d.HasChange("hosts"))
+	assert.Empty(t, d.Get("hosts").(*schema.Set).List())
+}
+
+func TestClusterDeleteRemovesHostsFirst(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.cluster.info", []interface{}{"user:pass", 100}, mock.Anything).Run(answer(true, `<CLUSTER>
+		<ID>100</ID><NAME>production</NAME><HOSTS><ID>3</ID></HOSTS><DATASTORES/><VNETS/>
+	</CLUSTER>`)).Return(nil).Once()
+	rpc.On("Call", "one.cluster.delhost", []interface{}{"user:pass", 100, 3}, mock.Anything).Run(answer(true, int64(100))).Return(nil).Once()
+	rpc.On("Call", "one.cluster.delete", []interface{}{"user:pass", 100}, mock.Anything).Run(answer(true, int64(100))).Return(nil).Once()
+
+	d := schema.TestResourceDataRaw(t, resourceCluster().Schema, map[string]interface{}{"name": "production", "hosts": []interface{}{3}})
+	d.SetId("100")
+
+	assert.NoError(t, resourceClusterDelete(d, client))
+	assert.Equal(t, []string{"one.cluster.info", "one.cluster.delhost", "one.cluster.delete"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
@@ -0,0 +1,218 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"log"
+	"strconv"
+)
+
+type Group struct {
+	Name   string `xml:"NAME"`
+	Id     int    `xml:"ID"`
+	Users  []int  `xml:"USERS>ID"`
+	Admins []int  `xml:"ADMINS>ID"`
+}
+
+func resourceGroup() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceGroupCreate,
+		Read:   resourceGroupRead,
+		Exists: resourceGroupExists,
+		Update: resourceGroupUpdate,
+		Delete: resourceGroupDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Name of the group",
+			},
+			"template": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Description:      "Attributes of the group, in OpenNebula's XML or String format",
+				DiffSuppressFunc: suppressEquivalentTemplates,
+			},
+			"admins": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Set:         schema.HashInt,
+				Description: "IDs of the users administrating the group. They have to be members of the group",
+			},
+			"users": {
+				Type:        schema.TypeSet,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Set:         schema.HashInt,
+				Description: "IDs of the users which are members of the group",
+			},
+		},
+	}
+}
+
+func resourceGroupCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.group.allocate", d.Get("name").(string))
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	if template := d.Get("template").(string); template != "" {
+		if _, err = client.Call("one.group.update", intId(d.Id()), template, 1); err != nil {
+			return err
+		}
+	}
+
+	admins := d.Get("admins").(*schema.Set)
+	if err = updateGroupAdmins(client, intId(d.Id()), &schema.Set{F: schema.HashInt}, admins); err != nil {
+		return err
+	}
+
+	return resourceGroupRead(d, meta)
+}
+
+func resourceGroupRead(d *schema.ResourceData, meta interface{}) error {
+	var group *Group
+
+	client := meta.(*Client)
+
+	// Try to find the group by ID, if specified
+	if d.Id() != "" {
+		resp, err := client.Call("one.group.info", intId(d.Id()))
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &group); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise, try to find the group by name, which is unique
+	if d.Id() == "" {
+		match, err := findInPool(client, "one.grouppool.info", "GROUP", nameMatches(d.Get("name").(string)))
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find group with name %s", d.Get("name").(string))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Call("one.group.info", intId(match["ID"]))
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &group); err != nil {
+			return err
+		}
+	}
+
+	d.SetId(strconv.Itoa(group.Id))
+	d.Set("name", group.Name)
+	if err := d.Set("users", group.Users); err != nil {
+		return err
+	}
+	if err := d.Set("admins", group.Admins); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceGroupExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceGroupRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceGroupUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if d.HasChange("template") {
+		old, new := d.GetChange("template")
+		if err := updateGroupTemplate(client, intId(d.Id()), old.(string), new.(string)); err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated template of group %s\n", d.Id())
+	}
+
+	if d.HasChange("admins") {
+		old, new := d.GetChange("admins")
+		if err := updateGroupAdmins(client, intId(d.Id()), old.(*schema.Set), new.(*schema.Set)); err != nil {
+			return err
+		}
+	}
+
+	return resourceGroupRead(d, meta)
+}
+
+func resourceGroupDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceGroupRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	client := meta.(*Client)
+	resp, err := client.Call("one.group.delete", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted group %s\n", resp)
+	return nil
+}
+
+// updateGroupTemplate merges the template into the one of the group, as it is set when
+// the group is created. Attributes which are not configured anymore are cleared
+// explicitly, merging alone would keep them.
+func updateGroupTemplate(client OneClient, id int, old string, new string) error {
+	if new != "" {
+		if _, err := client.Call("one.group.update", id, new, 1); err != nil {
+			return err
+		}
+	}
+
+	if removed := removedTemplateAttributes(old, new); len(removed) > 0 {
+		cleared := make(map[string]string, len(removed))
+		for _, name := range removed {
+			cleared[name] = ""
+		}
+		if _, err := client.Call("one.group.update", id, buildAttributes(cleared), 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateGroupAdmins removes the admins which are not configured anymore and adds the new ones.
+func updateGroupAdmins(client OneClient, id int, old *schema.Set, new *schema.Set) error {
+	for _, userId := range old.Difference(new).List() {
+		if _, err := client.Call("one.group.deladmin", id, userId.(int)); err != nil {
+			return fmt.Errorf("Could not remove user %d from the admins of group %d: %s", userId, id, err)
+		}
+	}
+
+	for _, userId := range new.Difference(old).List() {
+		if _, err := client.Call("one.group.addadmin", id, userId.(int)); err != nil {
+			return fmt.Errorf("Could not make user %d an admin of group %d: %s", userId, id, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupMembers(t *testing.T) {
+	var group *Group
+	err := xml.Unmarshal([]byte(`<GROUP><ID>100</ID><NAME>tenant-a</NAME>
+		<TEMPLATE><DESCRIPTION><![CDATA[Tenant A]]></DESCRIPTION></TEMPLATE>
+		<USERS><ID>3</ID><ID>4</ID><ID>7</ID></USERS>
+		<ADMINS><ID>3</ID></ADMINS>
+	</GROUP>`), &group)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 4, 7}, group.Users)
+	assert.Equal(t, []int{3}, group.Admins)
+}
+
+func TestUpdateGroupTemplateMergesAndClearsRemovedAttributes(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.group.update", []interface{}{100, "DESCRIPTION = \"Tenant A\"", 1}).Return("100", nil).Once()
+	mockClient.On("Call", "one.group.update", []interface{}{100, "LABELS = \"\"", 1}).Return("100", nil).Once()
+
+	assert.NoError(t, updateGroupTemplate(mockClient, 100, "DESCRIPTION = \"Tenant\"\nLABELS = \"web\"", "DESCRIPTION = \"Tenant A\""))
+	mockClient.AssertExpectations(t)
+}
+
+func TestUpdateGroupAdmins(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.group.deladmin", []interface{}{100, 3}).Return("100", nil).Once()
+	mockClient.On("Call", "one.group.addadmin", []interface{}{100, 7}).Return("100", nil).Once()
+	mockClient.On("Call", "one.group.addadmin", []interface{}{100, 8}).Return("100", nil).Once()
+
+	old := schema.NewSet(schema.HashInt, []interface{}{3, 4})
+	new := schema.NewSet(schema.HashInt, []interface{}{4, 7, 8})
+
+	assert.NoError(t, updateGroupAdmins(mockClient, 100, old, new))
+	mockClient.AssertExpectations(t)
+}
@@ -0,0 +1,299 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type Host struct {
+	Name      string     `xml:"NAME"`
+	Id        int        `xml:"ID"`
+	State     int        `xml:"STATE"`
+	ImMad     string     `xml:"IM_MAD"`
+	VmMad     string     `xml:"VM_MAD"`
+	ClusterId int        `xml:"CLUSTER_ID"`
+	Cluster   string     `xml:"CLUSTER"`
+	Share     *HostShare `xml:"HOST_SHARE"`
+}
+
+type HostShare struct {
+	TotalMem   int `xml:"TOTAL_MEM"`
+	TotalCpu   int `xml:"TOTAL_CPU"`
+	MaxMem     int `xml:"MAX_MEM"`
+	MaxCpu     int `xml:"MAX_CPU"`
+	FreeMem    int `xml:"FREE_MEM"`
+	FreeCpu    int `xml:"FREE_CPU"`
+	UsedMem    int `xml:"USED_MEM"`
+	UsedCpu    int `xml:"USED_CPU"`
+	RunningVms int `xml:"RUNNING_VMS"`
+}
+
+// Values of one.host.status, in the order of their codes
+var hostStatuses = []string{"enabled", "disabled", "offline"}
+
+// Host states which one.host.status leads to, other states are enabled ones
+var hostStateStatus = map[int]string{
+	4: "disabled", // DISABLED
+	7: "disabled", // MONITORING_DISABLED
+	8: "offline",  // OFFLINE
+}
+
+// Monitoring values of HOST_SHARE exposed as computed attributes
+var hostShareAttributes = map[string]string{
+	"total_mem":   "Total memory of the host in KB",
+	"total_cpu":   "Total CPU of the host, 100 per core",
+	"max_mem":     "Memory of the host available to VMs in KB",
+	"max_cpu":     "CPU of the host available to VMs, 100 per core",
+	"free_mem":    "Memory of the host which is not in use in KB, as last monitored",
+	"free_cpu":    "CPU of the host which is not in use, as last monitored",
+	"used_mem":    "Memory of the host in use in KB, as last monitored",
+	"used_cpu":    "CPU of the host in use, as last monitored",
+	"running_vms": "Number of VMs running on the host",
+}
+
+func resourceHost() *schema.Resource {
+	r := &schema.Resource{
+		Create: resourceHostCreate,
+		Read:   resourceHostRead,
+		Exists: resourceHostExists,
+		Update: resourceHostUpdate,
+		Delete: resourceHostDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Hostname of the host, OpenNebula connects to it by this name",
+			},
+			"im_mad": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Information driver monitoring the host, e.g. kvm",
+			},
+			"vm_mad": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Virtualization driver running the VMs of the host, e.g. kvm",
+			},
+			"cluster_id": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				Description: "ID of the cluster of the host. Defaults to the default cluster",
+			},
+			"status": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "enabled",
+				Description:  "Whether VMs are scheduled to the host: " + strings.Join(hostStatuses, ", ") + ". An offline host is not monitored either",
+				ValidateFunc: validation.StringInSlice(hostStatuses, false),
+			},
+			"state": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Current state of the host",
+			},
+			"cluster": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the cluster of the host",
+			},
+		},
+	}
+
+	for key, description := range hostShareAttributes {
+		r.Schema[key] = &schema.Schema{
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: description,
+		}
+	}
+
+	return r
+}
+
+func resourceHostCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	clusterId := -1
+	if v, ok := d.GetOkExists("cluster_id"); ok {
+		clusterId = v.(int)
+	}
+
+	resp, err := client.Call(
+		"one.host.allocate",
+		d.Get("name").(string),
+		d.Get("im_mad").(string),
+		d.Get("vm_mad").(string),
+		clusterId,
+	)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	if status := d.Get("status").(string); status != "enabled" {
+		if err = changeHostStatus(client, intId(d.Id()), status); err != nil {
+			return err
+		}
+	}
+
+	return resourceHostRead(d, meta)
+}
+
+func resourceHostRead(d *schema.ResourceData, meta interface{}) error {
+	var host *Host
+
+	client := meta.(*Client)
+
+	// Try to find the host by ID, if specified
+	if d.Id() != "" {
+		resp, err := client.Call("one.host.info", intId(d.Id()))
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &host); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise, try to find the host by name, which is unique
+	if d.Id() == "" {
+		match, err := findInPool(client, "one.hostpool.info", "HOST", nameMatches(d.Get("name").(string)))
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find host with name %s", d.Get("name").(string))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Call("one.host.info", intId(match["ID"]))
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &host); err != nil {
+			return err
+		}
+	}
+
+	d.SetId(strconv.Itoa(host.Id))
+	d.Set("name", host.Name)
+	d.Set("im_mad", host.ImMad)
+	d.Set("vm_mad", host.VmMad)
+	d.Set("cluster_id", host.ClusterId)
+	d.Set("cluster", host.Cluster)
+	d.Set("state", host.State)
+	d.Set("status", hostStatus(host.State))
+	for key, value := range readHostShare(host.Share) {
+		d.Set(key, value)
+	}
+
+	return nil
+}
+
+func resourceHostExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceHostRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceHostUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if d.HasChange("name") {
+		resp, err := client.Call(
+			"one.host.rename",
+			intId(d.Id()),
+			d.Get("name").(string),
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated name for host %s\n", resp)
+	}
+
+	if d.HasChange("cluster_id") {
+		// adding the host to a cluster removes it from its current one
+		resp, err := client.Call("one.cluster.addhost", d.Get("cluster_id").(int), intId(d.Id()))
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully moved host %s to cluster %s\n", d.Id(), resp)
+	}
+
+	if d.HasChange("status") {
+		if err := changeHostStatus(client, intId(d.Id()), d.Get("status").(string)); err != nil {
+			return err
+		}
+	}
+
+	return resourceHostRead(d, meta)
+}
+
+func resourceHostDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceHostRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	client := meta.(*Client)
+	resp, err := client.Call("one.host.delete", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted host %s\n", resp)
+	return nil
+}
+
+func changeHostStatus(client OneClient, id int, status string) error {
+	if _, err := client.Call("one.host.status", id, indexOf(hostStatuses, status)); err != nil {
+		return fmt.Errorf("Could not change the status of host %d to %s: %s", id, status, err)
+	}
+
+	log.Printf("[INFO] Successfully changed the status of host %d to %s\n", id, status)
+	return nil
+}
+
+// hostStatus returns the status of one.host.status the host is in.
+func hostStatus(state int) string {
+	if status, ok := hostStateStatus[state]; ok {
+		return status
+	}
+	return "enabled"
+}
+
+func readHostShare(share *HostShare) map[string]int {
+	if share == nil {
+		share = &HostShare{}
+	}
+
+	return map[string]int{
+		"total_mem":   share.TotalMem,
+		"total_cpu":   share.TotalCpu,
+		"max_mem":     share.MaxMem,
+		"max_cpu":     share.MaxCpu,
+		"free_mem":    share.FreeMem,
+		"free_cpu":    share.FreeCpu,
+		"used_mem":    share.UsedMem,
+		"used_cpu":    share.UsedCpu,
+		"running_vms": share.RunningVms,
+	}
+}
@@ -0,0 +1,73 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHostStatus(t *testing.T) {
+	assert.Equal(t, "enabled", hostStatus(2))
+	assert.Equal(t, "enabled", hostStatus(3))
+	assert.Equal(t, "disabled", hostStatus(4))
+	assert.Equal(t, "disabled", hostStatus(7))
+	assert.Equal(t, "offline", hostStatus(8))
+}
+
+func TestChangeHostStatus(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.host.status", []interface{}{4, 2}).Return("4", nil).Once()
+
+	assert.NoError(t, changeHostStatus(mockClient, 4, "offline"))
+	mockClient.AssertExpectations(t)
+}
+
+func TestHostRead(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.host.info", []interface{}{"user:pass", 4}, mock.Anything).Run(answer(true, `<HOST>
+		<ID>4</ID><NAME>kvm-04</NAME><STATE>4</STATE><IM_MAD>kvm</IM_MAD><VM_MAD>kvm</VM_MAD>
+		<CLUSTER_ID>100</CLUSTER_ID><CLUSTER>production</CLUSTER>
+		<HOST_SHARE><TOTAL_MEM>65843076</TOTAL_MEM><TOTAL_CPU>1600</TOTAL_CPU><FREE_CPU>1520</FREE_CPU><RUNNING_VMS>3</RUNNING_VMS></HOST_SHARE>
+	</HOST>`)).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceHost().Schema, map[string]interface{}{})
+	d.SetId("4")
+
+	assert.NoError(t, resourceHostRead(d, client))
+	assert.Equal(t, "kvm-04", d.Get("name"))
+	assert.Equal(t, 100, d.Get("cluster_id"))
+	assert.Equal(t, "production", d.Get("cluster"))
+	assert.Equal(t, "disabled", d.Get("status"))
+	assert.Equal(t, 65843076, d.Get("total_mem"))
+	assert.Equal(t, 1520, d.Get("free_cpu"))
+	assert.Equal(t, 0, d.Get("free_mem"))
+	assert.Equal(t, 3, d.Get("running_vms"))
+}
+
+func TestHostReadKeepsAuthorizationErrors(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.host.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "Not authorized", int64(OneErrorAuthorization))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceHost().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.Error(t, resourceHostRead(d, client))
+	assert.Equal(t, "42", d.Id())
+	assert.Equal(t, []string{"one.host.info"}, testRpcMethods(rpc))
+}
+
+func TestHostReadClearsIdOfMissingHosts(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.host.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(false, "Object does not exist", int64(OneErrorNoExists))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceHost().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.NoError(t, resourceHostRead(d, client))
+	assert.Equal(t, "", d.Id())
+}
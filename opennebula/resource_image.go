@@ -2,34 +2,71 @@ package opennebula
 
 import (
 	"encoding/xml"
-	"errors"
 	"fmt"
 	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type Image struct {
-	Name        string       `xml:"NAME"`
-	Id          int          `xml:"ID"`
-	Uid         int          `xml:"UID"`
-	Gid         int          `xml:"GID"`
-	Uname       string       `xml:"UNAME"`
-	Gname       string       `xml:"GNAME"`
-	Permissions *Permissions `xml:"PERMISSIONS"`
-	RegTime     string       `xml:"REG"`
-	Size        int          `xml:"SIZE"`
-	State       int          `xml:"STATE"`
-	Source      string       `xml:"SOURCE"`
-	Path        string       `xml:"PATH"`
-	Persistent  string       `xml:"PERSISTENT"`
-	DatastoreID int          `xml:"DATASTORE_ID"`
-	Datastore   string       `xml:"DATASTORE"`
-	FsType      string       `xml:"FSTYPE"`
-	RunningVMs  int          `xml:"RUNNING_VMS"`
+	Name        string         `xml:"NAME"`
+	Id          int            `xml:"ID"`
+	Uid         int            `xml:"UID"`
+	Gid         int            `xml:"GID"`
+	Uname       string         `xml:"UNAME"`
+	Gname       string         `xml:"GNAME"`
+	Permissions *Permissions   `xml:"PERMISSIONS"`
+	RegTime     string         `xml:"REG"`
+	Type        int            `xml:"TYPE"`
+	Size        int            `xml:"SIZE"`
+	State       int            `xml:"STATE"`
+	Source      string         `xml:"SOURCE"`
+	Path        string         `xml:"PATH"`
+	Persistent  string         `xml:"PERSISTENT"`
+	DatastoreID int            `xml:"DATASTORE_ID"`
+	Datastore   string         `xml:"DATASTORE"`
+	FsType      string         `xml:"FSTYPE"`
+	Format      string         `xml:"FORMAT"`
+	Fs          string         `xml:"FS"`
+	RunningVMs  int            `xml:"RUNNING_VMS"`
+	Vms         []int          `xml:"VMS>ID"`
+	Template    *ImageTemplate `xml:"TEMPLATE"`
+}
+
+type ImageTemplate struct {
+	Driver    string `xml:"DRIVER"`
+	DevPrefix string `xml:"DEV_PREFIX"`
+	Target    string `xml:"TARGET"`
+	Readonly  string `xml:"READONLY"`
+	Error     string `xml:"ERROR"`
+}
+
+const ImageTypeContext = 5
+
+// Image states OpenNebula reports as STATE
+const (
+	ImageStateReady = 1
+	ImageStateError = 5
+)
+
+var (
+	imageTypes        = []string{"OS", "CDROM", "DATABLOCK", "KERNEL", "RAMDISK", "CONTEXT"}
+	imageFormats      = []string{"raw", "qcow2"}
+	imageFilesystems  = []string{"ext2", "ext3", "ext4", "xfs", "vfat", "swap"}
+	imageDevPrefixes  = []string{"hd", "sd", "vd", "xvd"}
+	imageTargetRegexp = regexp.MustCompile("^(hd|sd|vd|xvd)[a-z]+$")
+)
+
+// Driver specific attributes kept in the Image template
+var imageDriverAttributes = map[string]string{
+	"driver":     "DRIVER",
+	"dev_prefix": "DEV_PREFIX",
+	"target":     "TARGET",
 }
 
 type Images struct {
@@ -37,7 +74,7 @@ type Images struct {
 }
 
 func resourceImage() *schema.Resource {
-	return &schema.Resource{
+	r := &schema.Resource{
 		Create: resourceImageCreate,
 		Read:   resourceImageRead,
 		Exists: resourceImageExists,
@@ -54,9 +91,10 @@ func resourceImage() *schema.Resource {
 				Description: "Name of the Image",
 			},
 			"description": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "Description of the Image, in OpenNebula's XML or String format",
+				Type:             schema.TypeString,
+				Optional:         true,
+				Description:      "Description of the Image, in OpenNebula's XML or String format",
+				DiffSuppressFunc: suppressEquivalentTemplates,
 			},
 			"permissions": {
 				Type:        schema.TypeString,
@@ -108,6 +146,41 @@ func resourceImage() *schema.Resource {
 				Optional:    true,
 				Description: "Name of the Image to be cloned from. If Image Name is empty, a new Image will be created",
 			},
+			"path": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				Description:   "Path or URL the contents of a new Image are copied from, e.g. an image built by Packer",
+				ConflictsWith: []string{"clone_from_image"},
+			},
+			"size": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				Description:   "Size in MB of a new empty Image",
+				ValidateFunc:  validation.IntAtLeast(1),
+				ConflictsWith: []string{"clone_from_image", "path"},
+			},
+			"type": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ForceNew:     true,
+				Description:  "Type of a new Image: " + strings.Join(imageTypes, ", "),
+				ValidateFunc: validation.StringInSlice(imageTypes, false),
+			},
+			"state": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Current state of the Image, 1 is READY",
+			},
+			"vms": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Description: "IDs of the VMs using the Image, sorted",
+			},
 			"datastore_id": {
 				Type:        schema.TypeInt,
 				Required:    true,
@@ -119,8 +192,77 @@ func resourceImage() *schema.Resource {
 				Default:     true,
 				Description: "Flag which indicates if the Image has to be persistent",
 			},
+			"format": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ForceNew:     true,
+				Description:  "Format of the Image: " + strings.Join(imageFormats, ", "),
+				ValidateFunc: validation.StringInSlice(imageFormats, false),
+			},
+			"fs": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Description:  "Filesystem OpenNebula formats a new empty Image with: " + strings.Join(imageFilesystems, ", "),
+				ValidateFunc: validation.StringInSlice(imageFilesystems, false),
+			},
+			"driver": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Format the hypervisor driver uses to access the Image, e.g. raw or qcow2 for KVM",
+			},
+			"dev_prefix": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				Description:  "Prefix of the device the Image is attached as: " + strings.Join(imageDevPrefixes, ", "),
+				ValidateFunc: validation.StringInSlice(imageDevPrefixes, false),
+			},
+			"target": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				Description:  "Device the Image is attached as, e.g. vdb. It has to start with dev_prefix if both are set",
+				ValidateFunc: validation.StringMatch(imageTargetRegexp, "must be a device name such as vdb or sdc"),
+			},
+			"readonly": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Attach the Image as a read only device",
+			},
 		},
+		CustomizeDiff: resourceImageCustomizeDiff,
+	}
+
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
 	}
+
+	return r
+}
+
+func resourceImageCustomizeDiff(diff *schema.ResourceDiff, meta interface{}) error {
+	if err := validateImageTarget(diff.Get("dev_prefix").(string), diff.Get("target").(string)); err != nil {
+		return err
+	}
+
+	fs := diff.Get("fs").(string)
+	if fs == "" {
+		return nil
+	}
+
+	if diff.Get("clone_from_image").(string) != "" {
+		return fmt.Errorf("\"fs\" can only be used for new empty Images, not for Images cloned from %s", diff.Get("clone_from_image"))
+	}
+
+	if fs == "swap" && diff.Get("format").(string) == "qcow2" {
+		return fmt.Errorf("A swap filesystem requires the \"raw\" format")
+	}
+
+	return nil
 }
 
 func resourceImageCreate(d *schema.ResourceData, meta interface{}) error {
@@ -137,10 +279,30 @@ func resourceImageCreate(d *schema.ResourceData, meta interface{}) error {
 		isPersistent = "YES"
 	}
 
+	tmpl := fmt.Sprintf("NAME = \"%s\"\nPERSISTENT = \"%s\"\n", d.Get("name").(string), isPersistent)
+	if path := d.Get("path").(string); path != "" {
+		tmpl += fmt.Sprintf("PATH = \"%s\"\n", escapeTemplateValue(path))
+	}
+	if size := d.Get("size").(int); size > 0 {
+		tmpl += fmt.Sprintf("SIZE = \"%d\"\n", size)
+	}
+	if imageType := d.Get("type").(string); imageType != "" {
+		tmpl += fmt.Sprintf("TYPE = \"%s\"\n", imageType)
+	}
+	if format := d.Get("format").(string); format != "" {
+		tmpl += fmt.Sprintf("FORMAT = \"%s\"\n", format)
+	}
+	if fs := d.Get("fs").(string); fs != "" {
+		tmpl += fmt.Sprintf("FS = \"%s\"\n", fs)
+	}
+	if driver := buildImageDriverAttributes(d); len(driver) > 0 {
+		tmpl += buildAttributes(driver) + "\n"
+	}
+
 	// Create base object
 	resp, err := client.Call(
 		"one.image.allocate",
-		fmt.Sprintf("NAME = \"%s\"\nPERSISTENT = \"%s\"\n", d.Get("name").(string), isPersistent)+d.Get("description").(string),
+		tmpl+d.Get("description").(string),
 		d.Get("datastore_id"),
 	)
 	if err != nil {
@@ -155,7 +317,7 @@ func resourceImageCreate(d *schema.ResourceData, meta interface{}) error {
 	}
 
 	// update permisions
-	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod"); err != nil {
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod", false); err != nil {
 		return err
 	}
 
@@ -189,7 +351,7 @@ func resourceImageClone(d *schema.ResourceData, meta interface{}) error {
 	}
 
 	// update permisions
-	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod"); err != nil {
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod", false); err != nil {
 		return err
 	}
 
@@ -203,48 +365,66 @@ func resourceImageClone(d *schema.ResourceData, meta interface{}) error {
 		return err
 	}
 
+	// the clone keeps the driver attributes of its source unless they are configured
+	if driver := buildImageDriverAttributes(d); len(driver) > 0 {
+		if _, err = client.Call("one.image.update", intId(d.Id()), buildAttributes(driver), 1); err != nil {
+			return err
+		}
+	}
+
 	return resourceImageRead(d, meta)
 }
 
 func waitForImageState(d *schema.ResourceData, meta interface{}, state string) (interface{}, error) {
-	var img *Image
 	client := meta.(*Client)
 
 	log.Printf("Waiting for Image (%s) to be in state Ready", d.Id())
 
 	stateConf := &resource.StateChangeConf{
-		Pending: []string{"anythingelse"},
-		Target:  []string{state},
-		Refresh: func() (interface{}, string, error) {
-			log.Println("Refreshing Image state...")
-			if d.Id() != "" {
-				resp, err := client.Call("one.image.info", intId(d.Id()))
-				if err == nil {
-					if err = xml.Unmarshal([]byte(resp), &img); err != nil {
-						return nil, "", fmt.Errorf("Couldn't fetch Image state: %s", err)
-					}
-				} else {
-					return nil, "", fmt.Errorf("Could not find Image by ID %s", d.Id())
-				}
-			}
-			log.Printf("Image is currently in state %v", img.State)
-			if img.State == 1 {
-				return img, "ready", nil
-			} else {
-				return nil, "anythingelse", nil
-			}
-		},
+		Pending:    []string{"anythingelse"},
+		Target:     []string{state},
+		Refresh:    imageStateRefreshFunc(client, intId(d.Id())),
 		Timeout:    10 * time.Minute,
-		Delay:      10 * time.Second,
-		MinTimeout: 3 * time.Second,
+		Delay:      client.pollDelay,
+		MinTimeout: client.pollInterval,
 	}
 
 	return stateConf.WaitForState()
 }
 
+// imageStateRefreshFunc reports an Image as ready once OpenNebula finished copying
+// its contents. An Image in state ERROR will not become ready anymore.
+func imageStateRefreshFunc(client OneClient, id int) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		var img *Image
+
+		log.Println("Refreshing Image state...")
+		resp, err := client.Call("one.image.info", id)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not find Image by ID %d", id)
+		}
+		if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+			return nil, "", fmt.Errorf("Couldn't fetch Image state: %s", err)
+		}
+
+		log.Printf("Image is currently in state %v", img.State)
+		switch img.State {
+		case ImageStateReady:
+			return img, "ready", nil
+		case ImageStateError:
+			message := ""
+			if img.Template != nil {
+				message = img.Template.Error
+			}
+			return nil, "", fmt.Errorf("Image %d is in state ERROR: %s", id, message)
+		default:
+			return nil, "anythingelse", nil
+		}
+	}
+}
+
 func resourceImageRead(d *schema.ResourceData, meta interface{}) error {
 	var img *Image
-	var imgs *Images
 
 	client := meta.(*Client)
 	found := false
@@ -257,34 +437,32 @@ func resourceImageRead(d *schema.ResourceData, meta interface{}) error {
 			if err = xml.Unmarshal([]byte(resp), &img); err != nil {
 				return err
 			}
-		} else {
+		} else if isNotFoundError(err) {
 			log.Printf("Could not find Image by ID %s", d.Id())
+		} else {
+			return err
 		}
 	}
 
 	// Otherwise, try to find the Image by (user, name) as the de facto compound primary key
 	if d.Id() == "" || !found {
-		resp, err := client.Call("one.imagepool.info", -3, -1, -1)
+		match, err := findInPool(client, "one.imagepool.info", "IMAGE", nameMatches(d.Get("name").(string)), -3, -1, -1)
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find Image with name %s for user %s", d.Get("name").(string), client.Username)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 
-		if err = xml.Unmarshal([]byte(resp), &imgs); err != nil {
+		resp, err := client.Call("one.image.info", intId(match["ID"]))
+		if err != nil {
 			return err
 		}
 
-		for _, t := range imgs.Image {
-			if t.Name == d.Get("name").(string) {
-				img = t
-				found = true
-				break
-			}
-		}
-
-		if !found || img == nil {
-			d.SetId("")
-			log.Printf("Could not find Image with name %s for user %s", d.Get("name").(string), client.Username)
-			return nil
+		if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+			return err
 		}
 	}
 
@@ -295,41 +473,91 @@ func resourceImageRead(d *schema.ResourceData, meta interface{}) error {
 	d.Set("uname", img.Uname)
 	d.Set("gname", img.Gname)
 	d.Set("permissions", permissionString(img.Permissions))
+	setPermissionBits(d, img.Permissions)
+	d.Set("state", img.State)
+	d.Set("vms", sortedVmIds(img.Vms))
+	d.Set("size", img.Size)
+	if img.Type >= 0 && img.Type < len(imageTypes) {
+		d.Set("type", imageTypes[img.Type])
+	}
+
+	// OpenNebula 5 reports the format as FSTYPE
+	format := img.Format
+	if format == "" {
+		format = img.FsType
+	}
+	if format != "" {
+		d.Set("format", format)
+	}
+	if img.Fs != "" {
+		d.Set("fs", img.Fs)
+	}
+	if t := img.Template; t != nil {
+		d.Set("driver", t.Driver)
+		d.Set("dev_prefix", t.DevPrefix)
+		d.Set("target", t.Target)
+		d.Set("readonly", t.Readonly == "YES")
+	}
 
 	return nil
 }
 
 func getImageIdByName(d *schema.ResourceData, meta interface{}) (int, error) {
-	var img *Image
-	var imgs *Images
-
 	client := meta.(*Client)
-	found := false
+	name := d.Get("clone_from_image").(string)
 
-	resp, err := client.Call("one.imagepool.info", -3, -1, -1)
+	img, err := findInPool(client, "one.imagepool.info", "IMAGE", nameMatches(name), -3, -1, -1)
 	if err != nil {
+		log.Printf("Could not find Image with name %s for user %s", name, client.Username)
 		return 0, err
 	}
 
-	if err = xml.Unmarshal([]byte(resp), &imgs); err != nil {
-		return 0, err
+	return strconv.Atoi(img["ID"])
+}
+
+// imageInUseError explains a failed operation on an image with the VMs using it,
+// which is the usual reason OpenNebula rejects it. Other errors are returned as is.
+func imageInUseError(client OneClient, id int, action string, err error) error {
+	var img *Image
+
+	resp, infoErr := client.Call("one.image.info", id, false)
+	if infoErr != nil {
+		return err
+	}
+	if xml.Unmarshal([]byte(resp), &img) != nil || len(img.Vms) == 0 {
+		return err
 	}
 
-	for _, t := range imgs.Image {
-		if t.Name == d.Get("clone_from_image").(string) {
-			img = t
-			found = true
-			break
-		}
+	vms := make([]string, 0, len(img.Vms))
+	for _, vm := range img.Vms {
+		vms = append(vms, strconv.Itoa(vm))
 	}
 
-	if !found || img == nil {
-		log.Printf("Could not find Image with name %s for user %s", d.Get("clone_from_image").(string), client.Username)
-		err = errors.New("ImageNotFound")
-		return 0, err
+	return fmt.Errorf("Could not %s Image %d, it is used by the VMs %s. Detach it from them or terminate them first: %s", action, id, strings.Join(vms, ", "), err)
+}
+
+func checkImageManageable(client OneClient, id int) error {
+	var img *Image
+
+	resp, err := client.Call("one.image.info", id, false)
+	if err != nil {
+		return err
 	}
 
-	return img.Id, nil
+	if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+		return err
+	}
+
+	user, err := loadCurrentUser(client)
+	if err != nil {
+		return err
+	}
+
+	if !canManage(user, img.Uid, img.Gid, img.Permissions) {
+		return fmt.Errorf("user %s is not allowed to manage image %d", user.Name, id)
+	}
+
+	return nil
 }
 
 func resourceImageExists(d *schema.ResourceData, meta interface{}) (bool, error) {
@@ -348,12 +576,31 @@ func resourceImageUpdate(d *schema.ResourceData, meta interface{}) error {
 		_, err := client.Call(
 			"one.image.update",
 			intId(d.Id()),
-			d.Get("description").(string),
+			joinTemplateSections(d.Get("description").(string), buildAttributes(buildImageDriverAttributes(d))),
 			0, // replace the whole image instead of merging it with the existing one
 		)
 		if err != nil {
 			return err
 		}
+	} else if d.HasChange("driver") || d.HasChange("dev_prefix") || d.HasChange("target") || d.HasChange("readonly") {
+		driver := buildImageDriverAttributes(d)
+		// clear the values that were removed from the configuration
+		for _, name := range imageDriverAttributes {
+			if _, ok := driver[name]; !ok {
+				driver[name] = ""
+			}
+		}
+		driver["READONLY"] = boolToYesNo(d.Get("readonly").(bool))
+
+		_, err := client.Call(
+			"one.image.update",
+			intId(d.Id()),
+			buildAttributes(driver),
+			1, // merge the driver attributes into the existing template
+		)
+		if err != nil {
+			return err
+		}
 	}
 
 	if d.HasChange("name") {
@@ -368,8 +615,16 @@ func resourceImageUpdate(d *schema.ResourceData, meta interface{}) error {
 		log.Printf("[INFO] Successfully updated name for Image %s\n", resp)
 	}
 
+	if d.HasChange("persistent") {
+		_, err := client.Call("one.image.persistent", intId(d.Id()), d.Get("persistent").(bool))
+		if err != nil {
+			return imageInUseError(client, intId(d.Id()), "change the persistency of", err)
+		}
+		log.Printf("[INFO] Successfully changed the persistency of Image %s\n", d.Id())
+	}
+
 	if d.HasChange("permissions") {
-		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod")
+		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod", false)
 		if err != nil {
 			return err
 		}
@@ -379,6 +634,33 @@ func resourceImageUpdate(d *schema.ResourceData, meta interface{}) error {
 	return nil
 }
 
+func buildImageDriverAttributes(d *schema.ResourceData) map[string]string {
+	attributes := make(map[string]string)
+	for key, name := range imageDriverAttributes {
+		if v := d.Get(key).(string); v != "" {
+			attributes[name] = v
+		}
+	}
+	if d.Get("readonly").(bool) {
+		attributes["READONLY"] = boolToYesNo(true)
+	}
+
+	return attributes
+}
+
+// validateImageTarget makes sure the target device matches the device prefix.
+func validateImageTarget(devPrefix string, target string) error {
+	if devPrefix == "" || target == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(target, devPrefix) {
+		return fmt.Errorf("Target %q does not match the device prefix %q", target, devPrefix)
+	}
+
+	return nil
+}
+
 func resourceImageDelete(d *schema.ResourceData, meta interface{}) error {
 	err := resourceImageRead(d, meta)
 	if err != nil || d.Id() == "" {
@@ -389,7 +671,7 @@ func resourceImageDelete(d *schema.ResourceData, meta interface{}) error {
 
 	resp, err := client.Call("one.image.delete", intId(d.Id()), false)
 	if err != nil {
-		return err
+		return imageInUseError(client, intId(d.Id()), "delete", err)
 	}
 
 	log.Printf("[INFO] Successfully deleted Image %s\n", resp)
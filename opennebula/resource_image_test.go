@@ -0,0 +1,141 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestValidateImageTarget(t *testing.T) {
+	assert.NoError(t, validateImageTarget("vd", "vdb"))
+	assert.NoError(t, validateImageTarget("", "sdc"))
+	assert.NoError(t, validateImageTarget("xvd", ""))
+	assert.Error(t, validateImageTarget("sd", "vdb"))
+}
+
+func TestImageTargetRegexp(t *testing.T) {
+	assert.True(t, imageTargetRegexp.MatchString("xvda"))
+	assert.False(t, imageTargetRegexp.MatchString("vd1"))
+	assert.False(t, imageTargetRegexp.MatchString("/dev/vdb"))
+}
+
+func TestImageInUseErrorListsVms(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.image.info", []interface{}{3, false}).Return(
+		"<IMAGE><ID>3</ID><RUNNING_VMS>2</RUNNING_VMS><VMS><ID>12</ID><ID>15</ID></VMS></IMAGE>", nil)
+
+	err := imageInUseError(mockClient, 3, "delete", fmt.Errorf("[one.image.delete] Cannot delete image"))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "used by the VMs 12, 15")
+}
+
+func TestImageInUseErrorKeepsOtherErrors(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.image.info", []interface{}{3, false}).Return("<IMAGE><ID>3</ID><VMS></VMS></IMAGE>", nil)
+
+	original := fmt.Errorf("[one.image.delete] Not authorized")
+	assert.Equal(t, original, imageInUseError(mockClient, 3, "delete", original))
+}
+
+func TestImageStateRefreshFunc(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.image.info", []interface{}{3}).Return("<IMAGE><ID>3</ID><STATE>4</STATE></IMAGE>", nil).Once()
+	mockClient.On("Call", "one.image.info", []interface{}{3}).Return("<IMAGE><ID>3</ID><STATE>1</STATE></IMAGE>", nil).Once()
+
+	refresh := imageStateRefreshFunc(mockClient, 3)
+
+	_, state, err := refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "anythingelse", state)
+
+	img, state, err := refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "ready", state)
+	assert.Equal(t, 3, img.(*Image).Id)
+}
+
+func TestImageStateRefreshFuncFailsOnError(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.image.info", []interface{}{3}).Return(
+		"<IMAGE><ID>3</ID><STATE>5</STATE><TEMPLATE><ERROR>Could not copy image</ERROR></TEMPLATE></IMAGE>", nil)
+
+	_, _, err := imageStateRefreshFunc(mockClient, 3)()
+
+	assert.EqualError(t, err, "Image 3 is in state ERROR: Could not copy image")
+}
+
+func TestImageVmIds(t *testing.T) {
+	var img *Image
+	err := xml.Unmarshal([]byte("<IMAGE><ID>3</ID><RUNNING_VMS>3</RUNNING_VMS><VMS><ID>15</ID><ID>2</ID><ID>9</ID></VMS></IMAGE>"), &img)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 9, 15}, sortedVmIds(img.Vms))
+}
+
+// testPlanCreate plans the creation of a resource from the given configuration,
+// which runs its CustomizeDiff.
+func testPlanCreate(r *schema.Resource, raw map[string]interface{}) error {
+	_, err := r.Diff(nil, terraform.NewResourceConfigRaw(raw), nil)
+	return err
+}
+
+func TestImageCustomizeDiffRejectsSwapInQcow2(t *testing.T) {
+	config := map[string]interface{}{
+		"name":         "swap",
+		"permissions":  "640",
+		"datastore_id": 1,
+		"size":         1024,
+		"type":         "DATABLOCK",
+		"fs":           "swap",
+		"format":       "qcow2",
+	}
+	err := testPlanCreate(resourceImage(), config)
+	assert.EqualError(t, err, `A swap filesystem requires the "raw" format`)
+
+	config["format"] = "raw"
+	assert.NoError(t, testPlanCreate(resourceImage(), config))
+}
+
+func TestImageCustomizeDiffRejectsFsForClones(t *testing.T) {
+	err := testPlanCreate(resourceImage(), map[string]interface{}{
+		"name":             "copy",
+		"permissions":      "640",
+		"datastore_id":     1,
+		"clone_from_image": "7",
+		"fs":               "ext4",
+	})
+
+	assert.EqualError(t, err, `"fs" can only be used for new empty Images, not for Images cloned from 7`)
+}
+
+func TestImageReadFallsBackToFsType(t *testing.T) {
+	rpc := new(MockRpc)
+	rpc.On("Call", "one.image.info", []interface{}{"user:pass", 3, false}, mock.Anything).Run(answer(true,
+		"<IMAGE><ID>3</ID><NAME>data</NAME><PERMISSIONS><OWNER_U>1</OWNER_U></PERMISSIONS><FSTYPE>qcow2</FSTYPE><FS>ext4</FS></IMAGE>")).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceImage().Schema, map[string]interface{}{})
+	d.SetId("3")
+
+	assert.NoError(t, resourceImageRead(d, failoverClient(rpc)))
+	assert.Equal(t, "qcow2", d.Get("format"))
+	assert.Equal(t, "ext4", d.Get("fs"))
+}
+
+func TestImageReadPrefersFormat(t *testing.T) {
+	rpc := new(MockRpc)
+	rpc.On("Call", "one.image.info", []interface{}{"user:pass", 3, false}, mock.Anything).Run(answer(true,
+		"<IMAGE><ID>3</ID><NAME>data</NAME><PERMISSIONS><OWNER_U>1</OWNER_U></PERMISSIONS><FORMAT>raw</FORMAT><FSTYPE>qcow2</FSTYPE></IMAGE>")).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceImage().Schema, map[string]interface{}{})
+	d.SetId("3")
+
+	assert.NoError(t, resourceImageRead(d, failoverClient(rpc)))
+	assert.Equal(t, "raw", d.Get("format"))
+	assert.Equal(t, "", d.Get("fs"))
+}
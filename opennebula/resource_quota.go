@@ -0,0 +1,327 @@
+package opennebula
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// quotaKind describes one kind of quota, i.e. how its block in the configuration
+// maps to the section of the quota template OpenNebula expects.
+type quotaKind struct {
+	attribute   string
+	idAttribute string
+	section     string
+	limits      map[string]string
+}
+
+var quotaKinds = []quotaKind{
+	{"vm_quota", "", "VM", map[string]string{"cpu": "CPU", "memory": "MEMORY", "vms": "VMS", "system_disk_size": "SYSTEM_DISK_SIZE"}},
+	{"datastore_quota", "datastore_id", "DATASTORE", map[string]string{"images": "IMAGES", "size": "SIZE"}},
+	{"network_quota", "network_id", "NETWORK", map[string]string{"leases": "LEASES"}},
+	{"image_quota", "image_id", "IMAGE", map[string]string{"running_vms": "RVMS"}},
+}
+
+// quotaOwner holds the methods to read and set the quotas of a user or group.
+type quotaOwner struct {
+	idAttribute string
+	infoMethod  string
+	quotaMethod string
+}
+
+func resourceUserQuota() *schema.Resource {
+	return quotaResource(quotaOwner{"user_id", "one.user.info", "one.user.quota"}, "ID of the user")
+}
+
+func resourceGroupQuota() *schema.Resource {
+	return quotaResource(quotaOwner{"group_id", "one.group.info", "one.group.quota"}, "ID of the group")
+}
+
+func quotaResource(owner quotaOwner, idDescription string) *schema.Resource {
+	read := func(d *schema.ResourceData, meta interface{}) error {
+		return resourceQuotaRead(d, meta, owner)
+	}
+	write := func(d *schema.ResourceData, meta interface{}) error {
+		if err := writeQuotas(d, meta.(*Client), owner, false); err != nil {
+			return err
+		}
+		return read(d, meta)
+	}
+
+	return &schema.Resource{
+		Create: func(d *schema.ResourceData, meta interface{}) error {
+			d.SetId(strconv.Itoa(d.Get(owner.idAttribute).(int)))
+			return write(d, meta)
+		},
+		Read:   read,
+		Update: write,
+		Delete: func(d *schema.ResourceData, meta interface{}) error {
+			return writeQuotas(d, meta.(*Client), owner, true)
+		},
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: quotaResourceSchema(owner.idAttribute, idDescription),
+	}
+}
+
+func quotaResourceSchema(idAttribute string, idDescription string) map[string]*schema.Schema {
+	limit := func(description string) *schema.Schema {
+		return &schema.Schema{
+			Type:         schema.TypeFloat,
+			Optional:     true,
+			Default:      float64(QuotaDefault),
+			Description:  description + ". As in OpenNebula, -1 means the default quota applies and -2 means unlimited",
+			ValidateFunc: validateQuotaLimit,
+		}
+	}
+	id := func(description string) *schema.Schema {
+		return &schema.Schema{
+			Type:        schema.TypeInt,
+			Required:    true,
+			Description: description,
+		}
+	}
+
+	return map[string]*schema.Schema{
+		idAttribute: {
+			Type:        schema.TypeInt,
+			Required:    true,
+			ForceNew:    true,
+			Description: idDescription,
+		},
+		"vm_quota": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			MaxItems:    1,
+			Description: "Compute quota",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"cpu":              limit("Maximum CPU"),
+					"memory":           limit("Maximum memory in MB"),
+					"vms":              limit("Maximum number of VMs"),
+					"system_disk_size": limit("Maximum size of system disks in MB"),
+				},
+			},
+		},
+		"datastore_quota": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			Description: "Datastore quotas",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"datastore_id": id("ID of the datastore"),
+					"images":       limit("Maximum number of images"),
+					"size":         limit("Maximum size in MB"),
+				},
+			},
+		},
+		"network_quota": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			Description: "Network quotas",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"network_id": id("ID of the network"),
+					"leases":     limit("Maximum number of leases"),
+				},
+			},
+		},
+		"image_quota": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			Description: "Image quotas",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"image_id":    id("ID of the image"),
+					"running_vms": limit("Maximum number of running VMs using the image"),
+				},
+			},
+		},
+	}
+}
+
+// validateQuotaLimit accepts real limits and the default and unlimited sentinels.
+func validateQuotaLimit(v interface{}, k string) (ws []string, errors []error) {
+	if v.(float64) < QuotaUnlimited {
+		errors = append(errors, fmt.Errorf("%q must be at least 0, or %d for the default quota or %d for unlimited", k, QuotaDefault, QuotaUnlimited))
+	}
+	return
+}
+
+// resourceQuotaRead reads the limits of the quotas. OpenNebula keeps quotas which
+// only use the default limits to track the usage, they are left out unless they are
+// configured, as they are the same as no quota.
+func resourceQuotaRead(d *schema.ResourceData, meta interface{}, owner quotaOwner) error {
+	quotas, err := loadQuotas(meta.(*Client), owner.infoMethod, intId(d.Id()), "", false)
+	if done, err := handleNotFound(d, err); done {
+		return err
+	}
+
+	d.Set(owner.idAttribute, quotas.Id)
+
+	vmQuota := []interface{}{}
+	if q := quotas.VmQuota; q != nil {
+		if len(d.Get("vm_quota").([]interface{})) > 0 || !defaultQuotaLimits(q.Cpu, q.Memory, q.Vms, q.SystemDiskSize) {
+			vmQuota = append(vmQuota, map[string]interface{}{
+				"cpu":              q.Cpu,
+				"memory":           q.Memory,
+				"vms":              q.Vms,
+				"system_disk_size": q.SystemDiskSize,
+			})
+		}
+	}
+	if err := d.Set("vm_quota", vmQuota); err != nil {
+		return err
+	}
+
+	configured := configuredQuotaIds(d, "datastore_quota", "datastore_id")
+	datastoreQuota := make([]interface{}, 0, len(quotas.DatastoreQuotas))
+	for _, q := range quotas.DatastoreQuotas {
+		if configured[q.Id] || !defaultQuotaLimits(q.Images, q.Size) {
+			datastoreQuota = append(datastoreQuota, map[string]interface{}{
+				"datastore_id": q.Id,
+				"images":       q.Images,
+				"size":         q.Size,
+			})
+		}
+	}
+	if err := d.Set("datastore_quota", datastoreQuota); err != nil {
+		return err
+	}
+
+	configured = configuredQuotaIds(d, "network_quota", "network_id")
+	networkQuota := make([]interface{}, 0, len(quotas.NetworkQuotas))
+	for _, q := range quotas.NetworkQuotas {
+		if configured[q.Id] || !defaultQuotaLimits(q.Leases) {
+			networkQuota = append(networkQuota, map[string]interface{}{
+				"network_id": q.Id,
+				"leases":     q.Leases,
+			})
+		}
+	}
+	if err := d.Set("network_quota", networkQuota); err != nil {
+		return err
+	}
+
+	configured = configuredQuotaIds(d, "image_quota", "image_id")
+	imageQuota := make([]interface{}, 0, len(quotas.ImageQuotas))
+	for _, q := range quotas.ImageQuotas {
+		if configured[q.Id] || !defaultQuotaLimits(q.RunningVms) {
+			imageQuota = append(imageQuota, map[string]interface{}{
+				"image_id":    q.Id,
+				"running_vms": q.RunningVms,
+			})
+		}
+	}
+	return d.Set("image_quota", imageQuota)
+}
+
+func defaultQuotaLimits(limits ...float64) bool {
+	for _, limit := range limits {
+		if limit != QuotaDefault {
+			return false
+		}
+	}
+	return true
+}
+
+func configuredQuotaIds(d *schema.ResourceData, attribute string, idAttribute string) map[int]bool {
+	ids := make(map[int]bool)
+	for _, q := range d.Get(attribute).(*schema.Set).List() {
+		ids[q.(map[string]interface{})[idAttribute].(int)] = true
+	}
+	return ids
+}
+
+// writeQuotas sets the changed quotas. With reset set, all configured quotas are
+// reset to the default quota, e.g. when the resource is destroyed.
+func writeQuotas(d *schema.ResourceData, client OneClient, owner quotaOwner, reset bool) error {
+	sections := make([]string, 0, len(quotaKinds))
+	for _, kind := range quotaKinds {
+		old, new := d.GetChange(kind.attribute)
+		if reset {
+			old, new = new, nil
+		}
+		sections = append(sections, buildQuotaUpdate(kind, quotaEntries(old), quotaEntries(new)))
+	}
+
+	template := joinTemplateSections(sections...)
+	if template == "" {
+		return nil
+	}
+
+	_, err := client.Call(owner.quotaMethod, intId(d.Id()), template)
+	if reset && isNotFoundError(err) {
+		log.Printf("[WARN] The owner of the quotas %s no longer exists", d.Id())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not set the quotas of %s %s: %s", owner.idAttribute, d.Id(), err)
+	}
+
+	log.Printf("[INFO] Successfully set the quotas of %s %s", owner.idAttribute, d.Id())
+	return nil
+}
+
+func quotaEntries(v interface{}) []interface{} {
+	switch entries := v.(type) {
+	case *schema.Set:
+		return entries.List()
+	case []interface{}:
+		return entries
+	}
+	return nil
+}
+
+// buildQuotaUpdate renders the configured quotas of a kind. OpenNebula can't delete
+// a quota, so quotas removed from the configuration are reset to the default quota.
+func buildQuotaUpdate(kind quotaKind, old []interface{}, new []interface{}) string {
+	sections := make([]string, 0, len(new)+len(old))
+	configured := make(map[int]bool)
+	for _, q := range new {
+		quota := q.(map[string]interface{})
+		configured[quotaId(kind, quota)] = true
+		sections = append(sections, buildQuota(kind, quota))
+	}
+
+	for _, q := range old {
+		quota := q.(map[string]interface{})
+		if configured[quotaId(kind, quota)] {
+			continue
+		}
+		defaults := make(map[string]interface{})
+		if kind.idAttribute != "" {
+			defaults[kind.idAttribute] = quota[kind.idAttribute]
+		}
+		for name := range kind.limits {
+			defaults[name] = float64(QuotaDefault)
+		}
+		sections = append(sections, buildQuota(kind, defaults))
+	}
+
+	return joinTemplateSections(sections...)
+}
+
+// quotaId returns the ID of the object a quota applies to, the VM quota has none.
+func quotaId(kind quotaKind, quota map[string]interface{}) int {
+	if kind.idAttribute == "" {
+		return -1
+	}
+	return quota[kind.idAttribute].(int)
+}
+
+func buildQuota(kind quotaKind, quota map[string]interface{}) string {
+	attributes := make(map[string]string)
+	if kind.idAttribute != "" {
+		attributes["ID"] = strconv.Itoa(quota[kind.idAttribute].(int))
+	}
+	for name, templateName := range kind.limits {
+		attributes[templateName] = strconv.FormatFloat(quota[name].(float64), 'f', -1, 64)
+	}
+
+	return buildVectorAttribute(kind.section, attributes)
+}
@@ -0,0 +1,81 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testUserQuotas = `<USER><ID>5</ID><NAME>jdoe</NAME>
+	<VM_QUOTA><VM><CPU>-2</CPU><CPU_USED>1</CPU_USED><MEMORY>0</MEMORY><VMS>-1</VMS><SYSTEM_DISK_SIZE>-1</SYSTEM_DISK_SIZE></VM></VM_QUOTA>
+	<DATASTORE_QUOTA>
+		<DATASTORE><ID>1</ID><IMAGES>-1</IMAGES><SIZE>-1</SIZE></DATASTORE>
+		<DATASTORE><ID>2</ID><IMAGES>-1</IMAGES><IMAGES_USED>3</IMAGES_USED><SIZE>-1</SIZE></DATASTORE>
+	</DATASTORE_QUOTA>
+	<NETWORK_QUOTA><NETWORK><ID>0</ID><LEASES>-2</LEASES></NETWORK></NETWORK_QUOTA>
+	<IMAGE_QUOTA/>
+</USER>`
+
+func TestBuildQuotaUpdate(t *testing.T) {
+	kind := quotaKinds[1]
+	old := []interface{}{
+		map[string]interface{}{"datastore_id": 1, "images": float64(10), "size": float64(QuotaUnlimited)},
+		map[string]interface{}{"datastore_id": 2, "images": float64(0), "size": float64(100)},
+	}
+	new := []interface{}{
+		map[string]interface{}{"datastore_id": 1, "images": float64(QuotaUnlimited), "size": float64(0)},
+	}
+
+	assert.Equal(t, "DATASTORE = [\n  ID = \"1\",\n  IMAGES = \"-2\",\n  SIZE = \"0\" ]\nDATASTORE = [\n  ID = \"2\",\n  IMAGES = \"-1\",\n  SIZE = \"-1\" ]", buildQuotaUpdate(kind, old, new))
+	assert.Equal(t, "", buildQuotaUpdate(kind, nil, nil))
+}
+
+func TestValidateQuotaLimit(t *testing.T) {
+	for _, limit := range []float64{0, 2.5, QuotaDefault, QuotaUnlimited} {
+		_, errs := validateQuotaLimit(limit, "cpu")
+		assert.Empty(t, errs, "limit %v", limit)
+	}
+	_, errs := validateQuotaLimit(float64(-3), "cpu")
+	assert.Len(t, errs, 1)
+}
+
+func TestUserQuotaCreateKeepsSentinels(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceUserQuota().Schema, map[string]interface{}{
+		"user_id":         5,
+		"vm_quota":        []interface{}{map[string]interface{}{"cpu": -2, "memory": 0}},
+		"datastore_quota": []interface{}{map[string]interface{}{"datastore_id": 1}},
+		"network_quota":   []interface{}{map[string]interface{}{"network_id": 0, "leases": -2}},
+	})
+
+	rpc := new(MockRpc)
+	template := "VM = [\n  CPU = \"-2\",\n  MEMORY = \"0\",\n  SYSTEM_DISK_SIZE = \"-1\",\n  VMS = \"-1\" ]\n" +
+		"DATASTORE = [\n  ID = \"1\",\n  IMAGES = \"-1\",\n  SIZE = \"-1\" ]\n" +
+		"NETWORK = [\n  ID = \"0\",\n  LEASES = \"-2\" ]"
+	rpc.On("Call", "one.user.quota", []interface{}{"user:pass", 5, template}, mock.Anything).Run(answer(true, int64(5))).Return(nil).Once()
+	rpc.On("Call", "one.user.info", []interface{}{"user:pass", 5}, mock.Anything).Run(answer(true, testUserQuotas)).Return(nil).Once()
+
+	assert.NoError(t, resourceUserQuota().Create(d, failoverClient(rpc)))
+	rpc.AssertExpectations(t)
+
+	assert.Equal(t, "5", d.Id())
+	assert.Equal(t, []interface{}{map[string]interface{}{"cpu": float64(-2), "memory": float64(0), "vms": float64(-1), "system_disk_size": float64(-1)}}, d.Get("vm_quota"))
+	// the configured quota with default limits is kept, the one only tracking usage is not
+	assert.Equal(t, []interface{}{map[string]interface{}{"datastore_id": 1, "images": float64(-1), "size": float64(-1)}}, d.Get("datastore_quota").(*schema.Set).List())
+	assert.Equal(t, []interface{}{map[string]interface{}{"network_id": 0, "leases": float64(-2)}}, d.Get("network_quota").(*schema.Set).List())
+}
+
+func TestUserQuotaDeleteResetsQuotasToDefault(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceUserQuota().Schema, map[string]interface{}{
+		"user_id":       5,
+		"network_quota": []interface{}{map[string]interface{}{"network_id": 0, "leases": 4}},
+	})
+	d.SetId("5")
+
+	rpc := new(MockRpc)
+	rpc.On("Call", "one.user.quota", []interface{}{"user:pass", 5, "NETWORK = [\n  ID = \"0\",\n  LEASES = \"-1\" ]"}, mock.Anything).Run(answer(true, int64(5))).Return(nil).Once()
+
+	assert.NoError(t, resourceUserQuota().Delete(d, failoverClient(rpc)))
+	rpc.AssertExpectations(t)
+}
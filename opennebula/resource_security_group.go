@@ -0,0 +1,361 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type SecurityGroup struct {
+	Name        string               `xml:"NAME"`
+	Id          int                  `xml:"ID"`
+	Uid         int                  `xml:"UID"`
+	Gid         int                  `xml:"GID"`
+	Uname       string               `xml:"UNAME"`
+	Gname       string               `xml:"GNAME"`
+	Permissions *Permissions         `xml:"PERMISSIONS"`
+	Rules       []*SecurityGroupRule `xml:"TEMPLATE>RULE"`
+	UpdatedVms  []int                `xml:"UPDATED_VMS>ID"`
+	OutdatedVms []int                `xml:"OUTDATED_VMS>ID"`
+	UpdatingVms []int                `xml:"UPDATING_VMS>ID"`
+	ErrorVms    []int                `xml:"ERROR_VMS>ID"`
+}
+
+type SecurityGroupRule struct {
+	Protocol  string `xml:"PROTOCOL"`
+	RuleType  string `xml:"RULE_TYPE"`
+	Range     string `xml:"RANGE"`
+	NetworkId string `xml:"NETWORK_ID"`
+	IcmpType  string `xml:"ICMP_TYPE"`
+}
+
+var (
+	securityGroupProtocols = []string{"ALL", "TCP", "UDP", "ICMP", "ICMPv6", "IPSEC"}
+	securityGroupRuleTypes = []string{"INBOUND", "OUTBOUND"}
+)
+
+func resourceSecurityGroup() *schema.Resource {
+	r := &schema.Resource{
+		Create: resourceSecurityGroupCreate,
+		Read:   resourceSecurityGroupRead,
+		Exists: resourceSecurityGroupExists,
+		Update: resourceSecurityGroupUpdate,
+		Delete: resourceSecurityGroupDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Name of the Security Group",
+			},
+			"description": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Description:      "Description of the Security Group, in OpenNebula's XML or String format",
+				DiffSuppressFunc: suppressEquivalentTemplates,
+			},
+			"permissions": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Permissions for the Security Group (in Unix format, owner-group-other, use-manage-admin)",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+
+					if len(value) != 3 {
+						errors = append(errors, fmt.Errorf("%q has specify 3 permission sets: owner-group-other", k))
+					}
+
+					all := true
+					for _, c := range strings.Split(value, "") {
+						if c < "0" || c > "7" {
+							all = false
+						}
+					}
+					if !all {
+						errors = append(errors, fmt.Errorf("Each character in %q should specify a Unix-like permission set with a number from 0 to 7", k))
+					}
+
+					return
+				},
+			},
+
+			"uid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the user that will own the Security Group",
+			},
+			"gid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the group that will own the Security Group",
+			},
+			"uname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the user that will own the Security Group",
+			},
+			"gname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the group that will own the Security Group",
+			},
+			"vms": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Description: "IDs of the VMs using the Security Group, whether their rules are up to date or not, sorted",
+			},
+			"rule": {
+				Type:        schema.TypeList,
+				Required:    true,
+				Description: "Firewall rules of the Security Group",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"protocol": {
+							Type:         schema.TypeString,
+							Required:     true,
+							Description:  "Protocol the rule matches: " + strings.Join(securityGroupProtocols, ", "),
+							ValidateFunc: validation.StringInSlice(securityGroupProtocols, false),
+						},
+						"rule_type": {
+							Type:         schema.TypeString,
+							Required:     true,
+							Description:  "Direction of the traffic the rule matches: " + strings.Join(securityGroupRuleTypes, ", "),
+							ValidateFunc: validation.StringInSlice(securityGroupRuleTypes, false),
+						},
+						"range": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Ports the rule matches, e.g. 22,80:90. All ports if empty",
+						},
+						"network_id": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      -1,
+							Description:  "ID of the vnet whose addresses the rule matches, -1 for any address",
+							ValidateFunc: validation.IntAtLeast(-1),
+						},
+						"icmp_type": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      -1,
+							Description:  "ICMP type the rule matches if protocol is ICMP, -1 for all types",
+							ValidateFunc: validation.IntBetween(-1, 255),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
+	}
+
+	return r
+}
+
+func resourceSecurityGroupCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call(
+		"one.secgroup.allocate",
+		fmt.Sprintf("NAME = \"%s\"\n", escapeTemplateValue(d.Get("name").(string)))+buildSecurityGroupTemplate(d),
+	)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	// update permisions
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.secgroup.chmod", false); err != nil {
+		return err
+	}
+
+	return resourceSecurityGroupRead(d, meta)
+}
+
+func resourceSecurityGroupRead(d *schema.ResourceData, meta interface{}) error {
+	var sg *SecurityGroup
+
+	client := meta.(*Client)
+
+	// Try to find the Security Group by ID, if specified
+	if d.Id() != "" {
+		resp, err := client.Call("one.secgroup.info", intId(d.Id()))
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &sg); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise, try to find the Security Group by (user, name) as the de facto compound primary key
+	if d.Id() == "" {
+		match, err := findInPool(client, "one.secgrouppool.info", "SECURITY_GROUP", nameMatches(d.Get("name").(string)), -3, -1, -1)
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find Security Group with name %s for user %s", d.Get("name").(string), client.Username)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Call("one.secgroup.info", intId(match["ID"]))
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &sg); err != nil {
+			return err
+		}
+	}
+
+	d.SetId(strconv.Itoa(sg.Id))
+	d.Set("name", sg.Name)
+	d.Set("uid", sg.Uid)
+	d.Set("gid", sg.Gid)
+	d.Set("uname", sg.Uname)
+	d.Set("gname", sg.Gname)
+	d.Set("permissions", permissionString(sg.Permissions))
+	setPermissionBits(d, sg.Permissions)
+	d.Set("vms", securityGroupVmIds(sg))
+	if err := d.Set("rule", readSecurityGroupRules(sg.Rules)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceSecurityGroupExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceSecurityGroupRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceSecurityGroupUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if d.HasChange("description") || d.HasChange("rule") {
+		_, err := client.Call(
+			"one.secgroup.update",
+			intId(d.Id()),
+			buildSecurityGroupTemplate(d),
+			0, // replace the whole template, the rules are a list and can not be merged
+		)
+		if err != nil {
+			return err
+		}
+
+		// propagate the new rules to the VMs using the Security Group
+		if _, err = client.Call("one.secgroup.commit", intId(d.Id()), false); err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated rules of Security Group %s\n", d.Id())
+	}
+
+	if d.HasChange("name") {
+		resp, err := client.Call(
+			"one.secgroup.rename",
+			intId(d.Id()),
+			d.Get("name").(string),
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated name for Security Group %s\n", resp)
+	}
+
+	if d.HasChange("permissions") {
+		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.secgroup.chmod", false)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated Security Group %s\n", resp)
+	}
+
+	return resourceSecurityGroupRead(d, meta)
+}
+
+func resourceSecurityGroupDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceSecurityGroupRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	client := meta.(*Client)
+	resp, err := client.Call("one.secgroup.delete", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted Security Group %s\n", resp)
+	return nil
+}
+
+// buildSecurityGroupTemplate renders the description followed by one RULE per rule block.
+func buildSecurityGroupTemplate(d *schema.ResourceData) string {
+	sections := []string{d.Get("description").(string)}
+	for _, rule := range d.Get("rule").([]interface{}) {
+		sections = append(sections, buildSecurityGroupRuleString(rule.(map[string]interface{})))
+	}
+
+	return joinTemplateSections(sections...)
+}
+
+func buildSecurityGroupRuleString(rule map[string]interface{}) string {
+	attributes := map[string]string{
+		"PROTOCOL":  rule["protocol"].(string),
+		"RULE_TYPE": rule["rule_type"].(string),
+	}
+	if r, _ := rule["range"].(string); r != "" {
+		attributes["RANGE"] = r
+	}
+	if id, _ := rule["network_id"].(int); id >= 0 {
+		attributes["NETWORK_ID"] = strconv.Itoa(id)
+	}
+	if icmpType, _ := rule["icmp_type"].(int); icmpType >= 0 {
+		attributes["ICMP_TYPE"] = strconv.Itoa(icmpType)
+	}
+
+	return buildVectorAttribute("RULE", attributes)
+}
+
+// securityGroupVmIds collects the VMs using the Security Group, which OpenNebula lists
+// by the state of their rules.
+func securityGroupVmIds(sg *SecurityGroup) []int {
+	var ids []int
+	for _, vms := range [][]int{sg.UpdatedVms, sg.OutdatedVms, sg.UpdatingVms, sg.ErrorVms} {
+		ids = append(ids, vms...)
+	}
+
+	return sortedVmIds(ids)
+}
+
+func readSecurityGroupRules(sgRules []*SecurityGroupRule) []interface{} {
+	rules := make([]interface{}, 0, len(sgRules))
+	for _, r := range sgRules {
+		rules = append(rules, map[string]interface{}{
+			"protocol":   r.Protocol,
+			"rule_type":  r.RuleType,
+			"range":      r.Range,
+			"network_id": convertToOptionalInt(r.NetworkId, -1),
+			"icmp_type":  convertToOptionalInt(r.IcmpType, -1),
+		})
+	}
+
+	return rules
+}
@@ -0,0 +1,61 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildSecurityGroupRuleString(t *testing.T) {
+	s := buildSecurityGroupRuleString(map[string]interface{}{
+		"protocol":   "TCP",
+		"rule_type":  "INBOUND",
+		"range":      "22,80:90",
+		"network_id": 0,
+		"icmp_type":  -1,
+	})
+	assert.Equal(t, "RULE = [\n  NETWORK_ID = \"0\",\n  PROTOCOL = \"TCP\",\n  RANGE = \"22,80:90\",\n  RULE_TYPE = \"INBOUND\" ]", s)
+}
+
+func TestBuildSecurityGroupRuleStringIcmp(t *testing.T) {
+	s := buildSecurityGroupRuleString(map[string]interface{}{
+		"protocol":   "ICMP",
+		"rule_type":  "OUTBOUND",
+		"range":      "",
+		"network_id": -1,
+		"icmp_type":  8,
+	})
+	assert.Equal(t, "RULE = [\n  ICMP_TYPE = \"8\",\n  PROTOCOL = \"ICMP\",\n  RULE_TYPE = \"OUTBOUND\" ]", s)
+}
+
+func TestReadSecurityGroupRules(t *testing.T) {
+	var sg *SecurityGroup
+	resp := `<SECURITY_GROUP><ID>102</ID><NAME>web</NAME><TEMPLATE>
+		<DESCRIPTION><![CDATA[web servers]]></DESCRIPTION>
+		<RULE><PROTOCOL><![CDATA[TCP]]></PROTOCOL><RANGE><![CDATA[80,443]]></RANGE><RULE_TYPE><![CDATA[INBOUND]]></RULE_TYPE></RULE>
+		<RULE><ICMP_TYPE><![CDATA[8]]></ICMP_TYPE><PROTOCOL><![CDATA[ICMP]]></PROTOCOL><RULE_TYPE><![CDATA[INBOUND]]></RULE_TYPE></RULE>
+		<RULE><NETWORK_ID><![CDATA[3]]></NETWORK_ID><PROTOCOL><![CDATA[ALL]]></PROTOCOL><RULE_TYPE><![CDATA[OUTBOUND]]></RULE_TYPE></RULE>
+	</TEMPLATE></SECURITY_GROUP>`
+
+	assert.NoError(t, xml.Unmarshal([]byte(resp), &sg))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"protocol": "TCP", "rule_type": "INBOUND", "range": "80,443", "network_id": -1, "icmp_type": -1},
+		map[string]interface{}{"protocol": "ICMP", "rule_type": "INBOUND", "range": "", "network_id": -1, "icmp_type": 8},
+		map[string]interface{}{"protocol": "ALL", "rule_type": "OUTBOUND", "range": "", "network_id": 3, "icmp_type": -1},
+	}, readSecurityGroupRules(sg.Rules))
+}
+
+func TestSecurityGroupVmIds(t *testing.T) {
+	var sg *SecurityGroup
+	resp := `<SECURITY_GROUP><ID>102</ID><NAME>web</NAME>
+		<UPDATED_VMS><ID>8</ID><ID>3</ID></UPDATED_VMS>
+		<OUTDATED_VMS><ID>11</ID></OUTDATED_VMS>
+		<UPDATING_VMS/>
+		<ERROR_VMS><ID>5</ID></ERROR_VMS>
+	</SECURITY_GROUP>`
+
+	assert.NoError(t, xml.Unmarshal([]byte(resp), &sg))
+	assert.Equal(t, []int{3, 5, 8, 11}, securityGroupVmIds(sg))
+	assert.Equal(t, []int{}, securityGroupVmIds(&SecurityGroup{}))
+}
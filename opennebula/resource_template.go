@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"log"
 	"strconv"
 	"strings"
@@ -14,18 +15,26 @@ type UserTemplates struct {
 }
 
 type UserTemplate struct {
-	Name        string       `xml:"NAME"`
-	Id          int          `xml:"ID"`
-	Uid         int          `xml:"UID"`
-	Gid         int          `xml:"GID"`
-	Uname       string       `xml:"UNAME"`
-	Gname       string       `xml:"GNAME"`
-	RegTime     int          `xml:"REGTIME"`
-	Permissions *Permissions `xml:"PERMISSIONS"`
+	Name        string          `xml:"NAME"`
+	Id          int             `xml:"ID"`
+	Uid         int             `xml:"UID"`
+	Gid         int             `xml:"GID"`
+	Uname       string          `xml:"UNAME"`
+	Gname       string          `xml:"GNAME"`
+	RegTime     int             `xml:"REGTIME"`
+	Permissions *Permissions    `xml:"PERMISSIONS"`
+	Disks       []*TemplateDisk `xml:"TEMPLATE>DISK"`
+}
+
+// TemplateDisk is a DISK of a template, which references an image by ID or by name.
+type TemplateDisk struct {
+	ImageId    string `xml:"IMAGE_ID"`
+	Image      string `xml:"IMAGE"`
+	ImageUname string `xml:"IMAGE_UNAME"`
 }
 
 func resourceTemplate() *schema.Resource {
-	return &schema.Resource{
+	r := &schema.Resource{
 		Create: resourceTemplateCreate,
 		Read:   resourceTemplateRead,
 		Exists: resourceTemplateExists,
@@ -42,9 +51,82 @@ func resourceTemplate() *schema.Resource {
 				Description: "Name of the template",
 			},
 			"description": {
-				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Description of the template, in OpenNebula's XML or String format",
+				Type:             schema.TypeString,
+				Optional:         true,
+				Description:      "Description of the template, in OpenNebula's XML or String format. Only the String format can be combined with the cpu, vcpu, memory, disk, nic and context attributes",
+				DiffSuppressFunc: suppressEquivalentTemplates,
+			},
+			"cpu": {
+				Type:         schema.TypeFloat,
+				Optional:     true,
+				Description:  "Share of physical CPUs assigned to VMs of the template",
+				ValidateFunc: validation.FloatBetween(0.01, 1024),
+			},
+			"vcpu": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Number of virtual CPUs of VMs of the template",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"memory": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Memory of VMs of the template in MB",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"disk": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Disks of VMs of the template, in the order they are attached",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"image_id": {
+							Type:        schema.TypeInt,
+							Required:    true,
+							Description: "ID of the image of the disk",
+						},
+						"size": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "Size of the disk in MB, images are grown to this size",
+						},
+						"target": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Device the disk is attached as, e.g. vdb",
+						},
+					},
+				},
+			},
+			"nic": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "NICs of VMs of the template, in the order they are attached",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"network_id": {
+							Type:        schema.TypeInt,
+							Required:    true,
+							Description: "ID of the vnet the NIC is attached to",
+						},
+						"ip": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "IP address to request from the vnet",
+						},
+						"model": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Hardware model of the NIC, e.g. virtio",
+						},
+					},
+				},
+			},
+			"context": {
+				Type:             schema.TypeMap,
+				Optional:         true,
+				Description:      "Context variables of VMs of the template",
+				DiffSuppressFunc: suppressEquivalentTemplateValues,
 			},
 			"permissions": {
 				Type:        schema.TypeString,
@@ -70,6 +152,12 @@ func resourceTemplate() *schema.Resource {
 					return
 				},
 			},
+			"chmod_recursive": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Also apply the permissions to the images referenced by the template",
+			},
 
 			"uid": {
 				Type:        schema.TypeInt,
@@ -94,18 +182,35 @@ func resourceTemplate() *schema.Resource {
 			"reg_time": {
 				Type:        schema.TypeInt,
 				Computed:    true,
-				Description: "Registration time",
+				Description: "Time the template was registered, as a Unix timestamp",
+			},
+			"image_ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Description: "IDs of the images referenced by the disks of the template, in the order of the disks. Images whose name matches no image or several ones are left out",
 			},
 		},
 	}
+
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
+	}
+
+	return r
 }
 
 func resourceTemplateCreate(d *schema.ResourceData, meta interface{}) error {
 	client := meta.(*Client)
 
+	template, err := buildTemplateString(d)
+	if err != nil {
+		return err
+	}
+
 	resp, err := client.Call(
 		"one.template.allocate",
-		fmt.Sprintf("NAME = \"%s\"\n", d.Get("name").(string))+d.Get("description").(string),
+		fmt.Sprintf("NAME = \"%s\"\n", d.Get("name").(string))+template,
 	)
 	if err != nil {
 		return err
@@ -113,7 +218,7 @@ func resourceTemplateCreate(d *schema.ResourceData, meta interface{}) error {
 
 	d.SetId(resp)
 
-	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.template.chmod"); err != nil {
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.template.chmod", d.Get("chmod_recursive").(bool)); err != nil {
 		return err
 	}
 
@@ -122,7 +227,6 @@ func resourceTemplateCreate(d *schema.ResourceData, meta interface{}) error {
 
 func resourceTemplateRead(d *schema.ResourceData, meta interface{}) error {
 	var tmpl *UserTemplate
-	var tmpls *UserTemplates
 
 	client := meta.(*Client)
 	found := false
@@ -135,34 +239,32 @@ func resourceTemplateRead(d *schema.ResourceData, meta interface{}) error {
 			if err = xml.Unmarshal([]byte(resp), &tmpl); err != nil {
 				return err
 			}
-		} else {
+		} else if isNotFoundError(err) {
 			log.Printf("Could not find template by ID %s", d.Id())
+		} else {
+			return err
 		}
 	}
 
 	// Otherwise, try to find the template by (user, name) as the de facto compound primary key
 	if d.Id() == "" || !found {
-		resp, err := client.Call("one.templatepool.info", -3, -1, -1)
+		match, err := findInPool(client, "one.templatepool.info", "VMTEMPLATE", nameMatches(d.Get("name").(string)), -3, -1, -1)
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find template with name %s for user %s", d.Get("name").(string), client.Username)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 
-		if err = xml.Unmarshal([]byte(resp), &tmpls); err != nil {
+		resp, err := client.Call("one.template.info", intId(match["ID"]), false)
+		if err != nil {
 			return err
 		}
 
-		for _, t := range tmpls.UserTemplate {
-			if t.Name == d.Get("name").(string) {
-				tmpl = t
-				found = true
-				break
-			}
-		}
-
-		if !found || tmpl == nil {
-			d.SetId("")
-			log.Printf("Could not find template with name %s for user %s", d.Get("name").(string), client.Username)
-			return nil
+		if err = xml.Unmarshal([]byte(resp), &tmpl); err != nil {
+			return err
 		}
 	}
 
@@ -174,10 +276,50 @@ func resourceTemplateRead(d *schema.ResourceData, meta interface{}) error {
 	d.Set("gname", tmpl.Gname)
 	d.Set("reg_time", tmpl.RegTime)
 	d.Set("permissions", permissionString(tmpl.Permissions))
+	setPermissionBits(d, tmpl.Permissions)
+	imageIds, err := templateImageIds(client, tmpl)
+	if err != nil {
+		return err
+	}
+	d.Set("image_ids", imageIds)
 
 	return nil
 }
 
+// templateImageIds returns the IDs of the images the disks of a template use. Images
+// referenced by name belong to IMAGE_UNAME or, without it, to the owner of the template.
+// Disks without an image, e.g. volatile ones, are skipped, as are images which can't
+// be told by their name, the template is not broken by them before it is instantiated.
+func templateImageIds(client OneClient, tmpl *UserTemplate) ([]int, error) {
+	ids := make([]int, 0, len(tmpl.Disks))
+	for _, disk := range tmpl.Disks {
+		switch {
+		case disk.ImageId != "":
+			id, err := strconv.Atoi(disk.ImageId)
+			if err != nil {
+				return nil, fmt.Errorf("Template %d references the invalid image ID %q", tmpl.Id, disk.ImageId)
+			}
+			ids = append(ids, id)
+		case disk.Image != "":
+			owner := disk.ImageUname
+			if owner == "" {
+				owner = tmpl.Uname
+			}
+			img, err := findInPool(client, "one.imagepool.info", "IMAGE", imageMatches(disk.Image, -1, owner), -2, -1, -1)
+			if _, ambiguous := err.(*ambiguousInPoolError); ambiguous || isNotFoundError(err) {
+				log.Printf("[WARN] Leaving image %q of template %d out of image_ids: %s", disk.Image, tmpl.Id, err)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, convertToInt(img["ID"]))
+		}
+	}
+
+	return ids, nil
+}
+
 func resourceTemplateExists(d *schema.ResourceData, meta interface{}) (bool, error) {
 	err := resourceTemplateRead(d, meta)
 	if err != nil || d.Id() == "" {
@@ -202,11 +344,15 @@ func resourceTemplateUpdate(d *schema.ResourceData, meta interface{}) error {
 		log.Printf("[INFO] Successfully updated template name to %s\n", resp)
 	}
 
-	if d.HasChange("description") {
-		_, err := client.Call(
+	if hasTemplateContentChange(d) {
+		template, err := buildTemplateString(d)
+		if err != nil {
+			return err
+		}
+		_, err = client.Call(
 			"one.template.update",
 			intId(d.Id()),
-			d.Get("description").(string),
+			template,
 			0, // replace the whole template instead of merging it with the existing one
 		)
 		if err != nil {
@@ -215,7 +361,7 @@ func resourceTemplateUpdate(d *schema.ResourceData, meta interface{}) error {
 	}
 
 	if d.HasChange("permissions") {
-		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.template.chmod")
+		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.template.chmod", d.Get("chmod_recursive").(bool))
 		if err != nil {
 			return err
 		}
@@ -240,3 +386,88 @@ func resourceTemplateDelete(d *schema.ResourceData, meta interface{}) error {
 	log.Printf("[INFO] Successfully deleted template %s\n", resp)
 	return nil
 }
+
+// Attributes which make up the contents of the template
+var templateContentAttributes = []string{"description", "cpu", "vcpu", "memory", "disk", "nic", "context"}
+
+func hasTemplateContentChange(d *schema.ResourceData) bool {
+	for _, key := range templateContentAttributes {
+		if d.HasChange(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildTemplateString renders the description followed by the structured attributes.
+// An attribute set both in the description and by a structured attribute is rejected.
+func buildTemplateString(d *schema.ResourceData) (string, error) {
+	description := d.Get("description").(string)
+	sections := []string{
+		buildAttributes(configuredCapacityAttributes(d)),
+		buildTemplateDisksString(d.Get("disk").([]interface{})),
+		buildTemplateNicsString(d.Get("nic").([]interface{})),
+		buildTemplateContextString(d.Get("context").(map[string]interface{})),
+	}
+	if joinTemplateSections(sections...) == "" {
+		return description, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(description), "<") {
+		return "", fmt.Errorf("A description in the XML format can not be combined with the cpu, vcpu, memory, disk, nic and context attributes")
+	}
+
+	template := joinTemplateSections(append([]string{description}, sections...)...)
+	if key := duplicateTemplateAttribute(template, vmRepeatableAttributes); key != "" {
+		return "", fmt.Errorf("The attribute %s is set more than once in the template", key)
+	}
+
+	return template, nil
+}
+
+func buildTemplateDisksString(disks []interface{}) string {
+	sections := make([]string, 0, len(disks))
+	for _, d := range disks {
+		disk := d.(map[string]interface{})
+		attributes := map[string]string{
+			"IMAGE_ID": strconv.Itoa(disk["image_id"].(int)),
+		}
+		if size := disk["size"].(int); size > 0 {
+			attributes["SIZE"] = strconv.Itoa(size)
+		}
+		if target := disk["target"].(string); target != "" {
+			attributes["TARGET"] = target
+		}
+		sections = append(sections, buildVectorAttribute("DISK", attributes))
+	}
+
+	return strings.Join(sections, "\n")
+}
+
+func buildTemplateNicsString(nics []interface{}) string {
+	sections := make([]string, 0, len(nics))
+	for _, n := range nics {
+		nic := n.(map[string]interface{})
+		attributes := map[string]string{
+			"NETWORK_ID": strconv.Itoa(nic["network_id"].(int)),
+		}
+		if ip := nic["ip"].(string); ip != "" {
+			attributes["IP"] = ip
+		}
+		if model := nic["model"].(string); model != "" {
+			attributes["MODEL"] = model
+		}
+		sections = append(sections, buildVectorAttribute("NIC", attributes))
+	}
+
+	return strings.Join(sections, "\n")
+}
+
+func buildTemplateContextString(context map[string]interface{}) string {
+	attributes := make(map[string]string, len(context))
+	for key, value := range context {
+		attributes[strings.ToUpper(key)] = value.(string)
+	}
+
+	return buildVectorAttribute("CONTEXT", attributes)
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/xml"
 	"fmt"
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
 	"reflect"
 	"strings"
 	"testing"
@@ -133,3 +135,113 @@ resource "opennebula_template" "test" {
   permissions = "600"
 }
 `
+
+func TestTemplateImageIds(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.imagepool.info", []interface{}{-2, 0, -poolPageSize}).Return(`<IMAGE_POOL>
+		<IMAGE><ID>7</ID><NAME>debian</NAME><UNAME>oneadmin</UNAME></IMAGE>
+		<IMAGE><ID>9</ID><NAME>debian</NAME><UNAME>jdoe</UNAME></IMAGE>
+	</IMAGE_POOL>`, nil)
+
+	var tmpl *UserTemplate
+	err := xml.Unmarshal([]byte(`<VMTEMPLATE><ID>2</ID><UNAME>jdoe</UNAME><TEMPLATE>
+		<DISK><IMAGE_ID><![CDATA[4]]></IMAGE_ID></DISK>
+		<DISK><IMAGE><![CDATA[debian]]></IMAGE></DISK>
+		<DISK><TYPE><![CDATA[fs]]></TYPE><SIZE><![CDATA[1024]]></SIZE></DISK>
+		<DISK><IMAGE><![CDATA[debian]]></IMAGE><IMAGE_UNAME><![CDATA[oneadmin]]></IMAGE_UNAME></DISK>
+	</TEMPLATE></VMTEMPLATE>`), &tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := templateImageIds(mockClient, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{4, 9, 7}) {
+		t.Errorf("Expected the image IDs [4 9 7], got %v", ids)
+	}
+}
+
+func TestTemplateImageIdsSkipsUnresolvableImages(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.imagepool.info", []interface{}{-2, 0, -poolPageSize}).Return(`<IMAGE_POOL>
+		<IMAGE><ID>7</ID><NAME>debian</NAME><UNAME>jdoe</UNAME><DATASTORE_ID>1</DATASTORE_ID></IMAGE>
+		<IMAGE><ID>9</ID><NAME>debian</NAME><UNAME>jdoe</UNAME><DATASTORE_ID>100</DATASTORE_ID></IMAGE>
+		<IMAGE><ID>11</ID><NAME>ubuntu</NAME><UNAME>jdoe</UNAME><DATASTORE_ID>1</DATASTORE_ID></IMAGE>
+	</IMAGE_POOL>`, nil)
+
+	var tmpl *UserTemplate
+	err := xml.Unmarshal([]byte(`<VMTEMPLATE><ID>2</ID><UNAME>jdoe</UNAME><TEMPLATE>
+		<DISK><IMAGE><![CDATA[debian]]></IMAGE></DISK>
+		<DISK><IMAGE><![CDATA[centos]]></IMAGE></DISK>
+		<DISK><IMAGE><![CDATA[ubuntu]]></IMAGE></DISK>
+	</TEMPLATE></VMTEMPLATE>`), &tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := templateImageIds(mockClient, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{11}) {
+		t.Errorf("Expected the image IDs [11], got %v", ids)
+	}
+}
+
+func TestBuildTemplateString(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceTemplate().Schema, map[string]interface{}{
+		"description": "HYPERVISOR = \"kvm\"",
+		"cpu":         0.5,
+		"memory":      1024,
+		"disk": []interface{}{
+			map[string]interface{}{"image_id": 3},
+			map[string]interface{}{"image_id": 8, "size": 10240, "target": "vdb"},
+		},
+		"nic":     []interface{}{map[string]interface{}{"network_id": 2, "model": "virtio"}},
+		"context": map[string]interface{}{"network": "YES"},
+	})
+
+	template, err := buildTemplateString(d)
+	assert.NoError(t, err)
+	assert.Equal(t, `HYPERVISOR = "kvm"
+CPU = "0.5"
+MEMORY = "1024"
+DISK = [
+  IMAGE_ID = "3" ]
+DISK = [
+  IMAGE_ID = "8",
+  SIZE = "10240",
+  TARGET = "vdb" ]
+NIC = [
+  MODEL = "virtio",
+  NETWORK_ID = "2" ]
+CONTEXT = [
+  NETWORK = "YES" ]`, template)
+}
+
+func TestBuildTemplateStringKeepsPlainDescription(t *testing.T) {
+	description := "<TEMPLATE><MEMORY>512</MEMORY></TEMPLATE>"
+	d := schema.TestResourceDataRaw(t, resourceTemplate().Schema, map[string]interface{}{"description": description})
+
+	template, err := buildTemplateString(d)
+	assert.NoError(t, err)
+	assert.Equal(t, description, template)
+}
+
+func TestBuildTemplateStringRejectsConflicts(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceTemplate().Schema, map[string]interface{}{
+		"description": "MEMORY = 512",
+		"memory":      1024,
+	})
+	_, err := buildTemplateString(d)
+	assert.EqualError(t, err, "The attribute MEMORY is set more than once in the template")
+
+	d = schema.TestResourceDataRaw(t, resourceTemplate().Schema, map[string]interface{}{
+		"description": "<TEMPLATE><CPU>1</CPU></TEMPLATE>",
+		"memory":      1024,
+	})
+	_, err = buildTemplateString(d)
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"github.com/hashicorp/terraform/helper/schema"
+	"log"
+	"strconv"
+)
+
+func resourceUser() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceUserCreate,
+		Read:   resourceUserRead,
+		Exists: resourceUserExists,
+		Update: resourceUserUpdate,
+		Delete: resourceUserDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Name of the user",
+			},
+			"password": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				Description: "Password of the user. It is not read back, OpenNebula only keeps a hash of it",
+			},
+			"auth_driver": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "core",
+				Description: "Authentication driver of the user, e.g. core, ldap or public",
+			},
+			"primary_group": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				Description: "ID of the primary group of the user, the default group of new users if not set",
+			},
+			"gname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the primary group of the user",
+			},
+			"groups": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Description: "IDs of all groups the user is a member of",
+			},
+		},
+	}
+}
+
+func resourceUserCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call(
+		"one.user.allocate",
+		d.Get("name").(string),
+		d.Get("password").(string),
+		d.Get("auth_driver").(string),
+	)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	if group, ok := d.GetOk("primary_group"); ok {
+		if _, err = client.Call("one.user.chgrp", intId(d.Id()), group.(int)); err != nil {
+			return err
+		}
+	}
+
+	return resourceUserRead(d, meta)
+}
+
+func resourceUserRead(d *schema.ResourceData, meta interface{}) error {
+	var user *User
+
+	client := meta.(*Client)
+
+	// Try to find the user by ID, if specified
+	if d.Id() != "" {
+		resp, err := client.Call("one.user.info", intId(d.Id()))
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &user); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise, try to find the user by name, which is unique
+	if d.Id() == "" {
+		match, err := findInPool(client, "one.userpool.info", "USER", nameMatches(d.Get("name").(string)))
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find user with name %s", d.Get("name").(string))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Call("one.user.info", intId(match["ID"]))
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &user); err != nil {
+			return err
+		}
+	}
+
+	d.SetId(strconv.Itoa(user.Id))
+	d.Set("name", user.Name)
+	d.Set("auth_driver", user.AuthDriver)
+	d.Set("primary_group", user.Gid)
+	d.Set("gname", user.Gname)
+	d.Set("groups", user.Groups)
+
+	return nil
+}
+
+func resourceUserExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceUserRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceUserUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if d.HasChange("auth_driver") || d.HasChange("password") {
+		err := changeUserCredentials(client, intId(d.Id()), d.Get("auth_driver").(string), d.Get("password").(string), d.HasChange("auth_driver"))
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated the credentials of user %s\n", d.Id())
+	}
+
+	if d.HasChange("primary_group") {
+		resp, err := client.Call("one.user.chgrp", intId(d.Id()), d.Get("primary_group").(int))
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully changed the primary group of user %s\n", resp)
+	}
+
+	return resourceUserRead(d, meta)
+}
+
+func resourceUserDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceUserRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	client := meta.(*Client)
+	resp, err := client.Call("one.user.delete", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted user %s\n", resp)
+	return nil
+}
+
+// changeUserCredentials sets the password of a user. one.user.passwd only works for
+// the current driver, so a new driver is set along with the password by one.user.chauth.
+func changeUserCredentials(client OneClient, id int, driver string, password string, driverChanged bool) error {
+	if driverChanged {
+		_, err := client.Call("one.user.chauth", id, driver, password)
+		return err
+	}
+
+	_, err := client.Call("one.user.passwd", id, password)
+	return err
+}
@@ -0,0 +1,34 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserInfo(t *testing.T) {
+	var user *User
+	err := xml.Unmarshal([]byte(`<USER><ID>12</ID><GID>100</GID><GROUPS><ID>100</ID><ID>101</ID></GROUPS>
+		<GNAME>tenant-a</GNAME><NAME>jdoe</NAME><PASSWORD>5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8</PASSWORD>
+		<AUTH_DRIVER>core</AUTH_DRIVER><ENABLED>1</ENABLED></USER>`), &user)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &User{Name: "jdoe", Id: 12, Gid: 100, Gname: "tenant-a", Groups: []int{100, 101}, AuthDriver: "core"}, user)
+}
+
+func TestChangeUserPassword(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.user.passwd", []interface{}{12, "new-secret"}).Return("12", nil)
+
+	assert.NoError(t, changeUserCredentials(mockClient, 12, "core", "new-secret", false))
+	mockClient.AssertExpectations(t)
+}
+
+func TestChangeUserAuthDriver(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.user.chauth", []interface{}{12, "ldap", ""}).Return("12", nil)
+
+	assert.NoError(t, changeUserCredentials(mockClient, 12, "ldap", "", true))
+	mockClient.AssertExpectations(t)
+}
@@ -0,0 +1,324 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type VirtualRouter struct {
+	Id          int                 `xml:"ID"`
+	Name        string              `xml:"NAME"`
+	Uid         int                 `xml:"UID"`
+	Gid         int                 `xml:"GID"`
+	Uname       string              `xml:"UNAME"`
+	Gname       string              `xml:"GNAME"`
+	Permissions *Permissions        `xml:"PERMISSIONS"`
+	Vms         []int               `xml:"VMS>ID"`
+	Nics        []*VirtualRouterNic `xml:"TEMPLATE>NIC"`
+}
+
+type VirtualRouterNic struct {
+	NetworkId  int    `xml:"NETWORK_ID"`
+	Ip         string `xml:"IP"`
+	FloatingIp string `xml:"FLOATING_IP"`
+}
+
+func resourceVirtualRouter() *schema.Resource {
+	r := &schema.Resource{
+		Create: resourceVirtualRouterCreate,
+		Read:   resourceVirtualRouterRead,
+		Exists: resourceVirtualRouterExists,
+		Update: resourceVirtualRouterUpdate,
+		Delete: resourceVirtualRouterDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Name of the virtual router",
+			},
+			"permissions": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Permissions for the virtual router (in Unix format, owner-group-other, use-manage-admin)",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+
+					if len(value) != 3 {
+						errors = append(errors, fmt.Errorf("%q has specify 3 permission sets: owner-group-other", k))
+					}
+
+					all := true
+					for _, c := range strings.Split(value, "") {
+						if c < "0" || c > "7" {
+							all = false
+						}
+					}
+					if !all {
+						errors = append(errors, fmt.Errorf("Each character in %q should specify a Unix-like permission set with a number from 0 to 7", k))
+					}
+
+					return
+				},
+			},
+			"template_id": {
+				Type:        schema.TypeInt,
+				Required:    true,
+				ForceNew:    true,
+				Description: "ID of the VM template the VMs of the virtual router are instantiated from",
+			},
+			"vm_count": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      1,
+				Description:  "Number of VMs to instantiate for the virtual router, more than one for high availability",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"nic": {
+				Type:        schema.TypeList,
+				Required:    true,
+				ForceNew:    true,
+				Description: "NICs of the virtual router, every VM of the router gets one NIC per vnet",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"network_id": {
+							Type:        schema.TypeInt,
+							Required:    true,
+							ForceNew:    true,
+							Description: "ID of the vnet the router is connected to",
+						},
+						"floating_ip": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							ForceNew:    true,
+							Default:     false,
+							Description: "Lease an IP address shared by the VMs of the router, which the active one of them holds",
+						},
+						"ip": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							ForceNew:    true,
+							Description: "Floating IP address to request from the vnet",
+						},
+					},
+				},
+			},
+
+			"uid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the user that will own the virtual router",
+			},
+			"gid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the group that will own the virtual router",
+			},
+			"uname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the user that will own the virtual router",
+			},
+			"gname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the group that will own the virtual router",
+			},
+			"vms": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Description: "IDs of the VMs of the virtual router",
+			},
+		},
+	}
+
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
+	}
+
+	return r
+}
+
+func resourceVirtualRouterCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call(
+		"one.vrouter.allocate",
+		fmt.Sprintf("NAME = \"%s\"\n", escapeTemplateValue(d.Get("name").(string)))+buildVirtualRouterNicsString(d.Get("nic").([]interface{})),
+	)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	// update permisions
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vrouter.chmod", false); err != nil {
+		return err
+	}
+
+	// an empty name lets OpenNebula name the VMs vr-<router name>-<index>
+	_, err = client.Call(
+		"one.vrouter.instantiate",
+		intId(d.Id()),
+		d.Get("vm_count").(int),
+		d.Get("template_id").(int),
+		"",
+		false,
+		"",
+	)
+	if err != nil {
+		return fmt.Errorf("Could not instantiate the VMs of virtual router %s: %s", d.Id(), err)
+	}
+
+	return resourceVirtualRouterRead(d, meta)
+}
+
+func resourceVirtualRouterRead(d *schema.ResourceData, meta interface{}) error {
+	var vrouter *VirtualRouter
+
+	client := meta.(*Client)
+
+	// Try to find the virtual router by ID, if specified
+	if d.Id() != "" {
+		resp, err := client.Call("one.vrouter.info", intId(d.Id()), false)
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &vrouter); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise, try to find the virtual router by (user, name) as the de facto compound primary key
+	if d.Id() == "" {
+		match, err := findInPool(client, "one.vrouterpool.info", "VROUTER", nameMatches(d.Get("name").(string)), -3, -1, -1)
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find virtual router with name %s for user %s", d.Get("name").(string), client.Username)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Call("one.vrouter.info", intId(match["ID"]), false)
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &vrouter); err != nil {
+			return err
+		}
+	}
+
+	d.SetId(strconv.Itoa(vrouter.Id))
+	d.Set("name", vrouter.Name)
+	d.Set("uid", vrouter.Uid)
+	d.Set("gid", vrouter.Gid)
+	d.Set("uname", vrouter.Uname)
+	d.Set("gname", vrouter.Gname)
+	d.Set("permissions", permissionString(vrouter.Permissions))
+	setPermissionBits(d, vrouter.Permissions)
+	d.Set("vms", sortedVmIds(vrouter.Vms))
+	if err := d.Set("nic", readVirtualRouterNics(vrouter.Nics)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceVirtualRouterExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceVirtualRouterRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceVirtualRouterUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if d.HasChange("name") {
+		resp, err := client.Call(
+			"one.vrouter.rename",
+			intId(d.Id()),
+			d.Get("name").(string),
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated name for virtual router %s\n", resp)
+	}
+
+	if d.HasChange("permissions") {
+		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vrouter.chmod", false)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated virtual router %s\n", resp)
+	}
+
+	return resourceVirtualRouterRead(d, meta)
+}
+
+func resourceVirtualRouterDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceVirtualRouterRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	// OpenNebula terminates the VMs of the virtual router along with it
+	client := meta.(*Client)
+	resp, err := client.Call("one.vrouter.delete", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted virtual router %s\n", resp)
+	return nil
+}
+
+func buildVirtualRouterNicsString(nics []interface{}) string {
+	sections := make([]string, 0, len(nics))
+	for _, n := range nics {
+		nic := n.(map[string]interface{})
+		attributes := map[string]string{
+			"NETWORK_ID": strconv.Itoa(nic["network_id"].(int)),
+		}
+		if nic["floating_ip"].(bool) {
+			attributes["FLOATING_IP"] = boolToYesNo(true)
+		}
+		if ip := nic["ip"].(string); ip != "" {
+			attributes["IP"] = ip
+		}
+		sections = append(sections, buildVectorAttribute("NIC", attributes))
+	}
+
+	return joinTemplateSections(sections...)
+}
+
+func readVirtualRouterNics(vrouterNics []*VirtualRouterNic) []interface{} {
+	nics := make([]interface{}, 0, len(vrouterNics))
+	for _, n := range vrouterNics {
+		nics = append(nics, map[string]interface{}{
+			"network_id":  n.NetworkId,
+			"floating_ip": strings.EqualFold(n.FloatingIp, "YES"),
+			"ip":          n.Ip,
+		})
+	}
+
+	return nics
+}
@@ -0,0 +1,76 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuildVirtualRouterNicsString(t *testing.T) {
+	nics := []interface{}{
+		map[string]interface{}{"network_id": 2, "floating_ip": true, "ip": "10.0.0.1"},
+		map[string]interface{}{"network_id": 5, "floating_ip": false, "ip": ""},
+	}
+
+	assert.Equal(t, `NIC = [
+  FLOATING_IP = "YES",
+  IP = "10.0.0.1",
+  NETWORK_ID = "2" ]
+NIC = [
+  NETWORK_ID = "5" ]`, buildVirtualRouterNicsString(nics))
+}
+
+func TestVirtualRouterCreateInstantiatesVms(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vrouter.allocate", []interface{}{"user:pass", "NAME = \"gateway\"\nNIC = [\n  FLOATING_IP = \"YES\",\n  NETWORK_ID = \"2\" ]"}, mock.Anything).Run(answer(true, int64(7))).Return(nil).Once()
+	rpc.On("Call", "one.vrouter.chmod", []interface{}{"user:pass", 7, 1, 1, 0, 0, 0, 0, 0, 0, 0, false}, mock.Anything).Run(answer(true, int64(7))).Return(nil).Once()
+	rpc.On("Call", "one.vrouter.instantiate", []interface{}{"user:pass", 7, 2, 12, "", false, ""}, mock.Anything).Run(answer(true, int64(7))).Return(nil).Once()
+	rpc.On("Call", "one.vrouter.info", []interface{}{"user:pass", 7, false}, mock.Anything).Run(answer(true, `<VROUTER>
+		<ID>7</ID><NAME>gateway</NAME><UID>0</UID><GID>0</GID><UNAME>oneadmin</UNAME><GNAME>oneadmin</GNAME>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<VMS><ID>41</ID><ID>40</ID></VMS>
+		<TEMPLATE><NIC><FLOATING_IP>YES</FLOATING_IP><IP>10.0.0.1</IP><NETWORK_ID>2</NETWORK_ID></NIC></TEMPLATE>
+	</VROUTER>`)).Return(nil).Once()
+
+	d := schema.TestResourceDataRaw(t, resourceVirtualRouter().Schema, map[string]interface{}{
+		"name":        "gateway",
+		"permissions": "600",
+		"template_id": 12,
+		"vm_count":    2,
+		"nic":         []interface{}{map[string]interface{}{"network_id": 2, "floating_ip": true}},
+	})
+
+	assert.NoError(t, resourceVirtualRouterCreate(d, client))
+	rpc.AssertExpectations(t)
+	assert.Equal(t, "7", d.Id())
+	assert.Equal(t, []interface{}{40, 41}, d.Get("vms"))
+	assert.Equal(t, "10.0.0.1", d.Get("nic.0.ip"))
+}
+
+func TestVirtualRouterReadKeepsAuthorizationErrors(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vrouter.info", []interface{}{"user:pass", 42, false}, mock.Anything).Run(answer(false, "Not authorized", int64(OneErrorAuthorization))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVirtualRouter().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.Error(t, resourceVirtualRouterRead(d, client))
+	assert.Equal(t, "42", d.Id())
+	assert.Equal(t, []string{"one.vrouter.info"}, testRpcMethods(rpc))
+}
+
+func TestVirtualRouterReadClearsIdOfMissingVirtualRouters(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vrouter.info", []interface{}{"user:pass", 42, false}, mock.Anything).Run(answer(false, "Object does not exist", int64(OneErrorNoExists))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVirtualRouter().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.NoError(t, resourceVirtualRouterRead(d, client))
+	assert.Equal(t, "", d.Id())
+}
@@ -1,14 +1,19 @@
 package opennebula
 
 import (
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 )
 
 const (
@@ -18,18 +23,243 @@ const (
 	DefaultIpAttribute = "TEMPLATE/CONTEXT/ETH0_IP"
 	StateAttribute     = "STATE"
 	LcmStateAttribute  = "LCM_STATE"
+
+	TemplateElementName     = "TEMPLATE"
+	UserTemplateElementName = "USER_TEMPLATE"
+
+	DefaultVmTimeout = 10 * time.Minute
+)
+
+var vmFeatures = map[string]string{
+	"acpi":        "ACPI",
+	"apic":        "APIC",
+	"pae":         "PAE",
+	"hyperv":      "HYPERV",
+	"localtime":   "LOCALTIME",
+	"guest_agent": "GUEST_AGENT",
+}
+
+// Placement policy attributes which are kept in the VM's user template
+var vmSchedulingAttributes = map[string]string{
+	"sched_requirements":    "SCHED_REQUIREMENTS",
+	"sched_rank":            "SCHED_RANK",
+	"sched_ds_requirements": "SCHED_DS_REQUIREMENTS",
+	"sched_ds_rank":         "SCHED_DS_RANK",
+}
+
+var vmRawTypes = []string{"kvm", "vcenter", "lxc", "lxd"}
+
+var vmMemoryResizeModes = []string{"BALLOONING", "HOTPLUG"}
+
+var vmFirmwares = []string{"BIOS", "UEFI"}
+
+var vmGraphicsTypes = []string{"VNC", "SPICE"}
+
+var vmNicIpChangeStrategies = []string{"recreate", "swap"}
+
+var vmCreateModes = []string{"instantiate", "hold_and_deploy"}
+
+var vmDesiredStates = []string{"running", "poweroff", "poweroff-hard", "suspended"}
+
+// Levels of one.vm.lock, OpenNebula stores the index of the value plus one. Each
+// level also blocks the operations of the levels above it, all blocks every operation.
+var vmLockLevels = []string{"use", "manage", "admin", "all"}
+
+// Attributes which change with every monitoring cycle, left out of info_json
+var vmVolatileAttributePrefixes = []string{"MONITORING" + PathSeparator, "LAST_POLL"}
+
+// Attributes holding credentials, which are left out of info_json
+var vmSecretAttributes = map[string]bool{
+	"TEMPLATE/GRAPHICS/PASSWD": true,
+}
+
+// User template attributes written by OpenNebula, which are not synchronized
+// into user_template_attributes
+var vmReadOnlyUserTemplateAttributes = map[string]bool{
+	"SCHED_MESSAGE": true,
+}
+
+// Changes which resize the VM or only take effect after a power cycle
+var vmDisruptiveAttributes = []string{"cpu", "vcpu", "memory", "memory_slots", "memory_resize_mode", "raw", "features", "graphics"}
+
+// Snapshots taken by snapshot_before_update are not managed through the snapshot block
+const preUpdateSnapshotPrefix = "terraform-pre-update-"
+
+var vmScheduledActions = []string{
+	"terminate", "terminate-hard", "undeploy", "undeploy-hard", "hold", "release", "stop",
+	"suspend", "resume", "reboot", "reboot-hard", "poweroff", "poweroff-hard", "snapshot-create",
+}
+
+// Recurrence of scheduled actions, OpenNebula stores the index of the value
+var (
+	vmSchedRepeats  = []string{"weekly", "monthly", "yearly", "hourly"}
+	vmSchedEndTypes = []string{"never", "times", "date"}
+
+	// Valid values of DAYS, for hourly actions it is the number of hours between executions
+	vmSchedDayRanges = map[string][2]int{
+		"weekly":  {0, 6},
+		"monthly": {1, 31},
+		"yearly":  {0, 365},
+		"hourly":  {1, 168},
+	}
+)
+
+// LCM states of active VMs which wait for an operator instead of settling on their own
+var vmFailureLcmStates = map[string]bool{
+	"14": true, // FAILURE
+	"16": true, // UNKNOWN
+	"36": true, // BOOT_FAILURE
+	"37": true, // BOOT_MIGRATE_FAILURE
+	"38": true, // PROLOG_MIGRATE_FAILURE
+	"39": true, // PROLOG_FAILURE
+	"40": true, // EPILOG_FAILURE
+	"41": true, // EPILOG_STOP_FAILURE
+	"42": true, // EPILOG_UNDEPLOY_FAILURE
+	"44": true, // PROLOG_MIGRATE_POWEROFF_FAILURE
+	"46": true, // PROLOG_MIGRATE_SUSPEND_FAILURE
+	"47": true, // BOOT_UNDEPLOY_FAILURE
+	"48": true, // BOOT_STOPPED_FAILURE
+	"49": true, // PROLOG_RESUME_FAILURE
+	"50": true, // PROLOG_UNDEPLOY_FAILURE
+	"60": true, // PROLOG_MIGRATE_UNKNOWN_FAILURE
+}
+
+var (
+	vmPinPolicies   = []string{"NONE", "THREAD", "SHARED", "CORE"}
+	vmMemoryAccess  = []string{"shared", "private"}
+	vmTopologyCount = map[string]string{
+		"sockets":       "SOCKETS",
+		"cores":         "CORES",
+		"threads":       "THREADS",
+		"hugepage_size": "HUGEPAGE_SIZE",
+	}
 )
 
+type Vm struct {
+	Id        int           `xml:"ID"`
+	Name      string        `xml:"NAME"`
+	State     int           `xml:"STATE"`
+	LcmState  int           `xml:"LCM_STATE"`
+	Disks     []*VmDisk     `xml:"TEMPLATE>DISK"`
+	Nics      []*VmNic      `xml:"TEMPLATE>NIC"`
+	Snapshots []*VmSnapshot `xml:"TEMPLATE>SNAPSHOT"`
+	History   []*VmHistory  `xml:"HISTORY_RECORDS>HISTORY"`
+
+	SchedActions []*VmSchedAction `xml:"USER_TEMPLATE>SCHED_ACTION"`
+}
+
+type VmSchedAction struct {
+	Id       int    `xml:"ID"`
+	Action   string `xml:"ACTION"`
+	Time     string `xml:"TIME"`
+	Repeat   string `xml:"REPEAT"`
+	Days     string `xml:"DAYS"`
+	EndType  string `xml:"END_TYPE"`
+	EndValue string `xml:"END_VALUE"`
+}
+
+type VmSnapshot struct {
+	SnapshotId int    `xml:"SNAPSHOT_ID"`
+	Name       string `xml:"NAME"`
+	Time       int    `xml:"TIME"`
+}
+
+type VmHistory struct {
+	Seq    int    `xml:"SEQ"`
+	HostId int    `xml:"HID"`
+	VmMad  string `xml:"VM_MAD"`
+}
+
+type VmDisk struct {
+	DiskId     int    `xml:"DISK_ID"`
+	ImageId    int    `xml:"IMAGE_ID"`
+	Persistent string `xml:"PERSISTENT"`
+	Size       int    `xml:"SIZE"`
+	Target     string `xml:"TARGET"`
+}
+
+type VmNic struct {
+	NicId          int    `xml:"NIC_ID"`
+	NetworkId      int    `xml:"NETWORK_ID"`
+	ArId           int    `xml:"AR_ID"`
+	Ip             string `xml:"IP"`
+	Mac            string `xml:"MAC"`
+	SecurityGroups string `xml:"SECURITY_GROUPS"`
+}
+
 func resourceVm() *schema.Resource {
-	return &schema.Resource{
-		Create: resourceVmCreate,
-		Read:   resourceVmRead,
-		Exists: resourceVmExists,
-		Update: resourceVmUpdate,
-		Delete: resourceVmDelete,
+	nic := &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"network_id": {
+				Type:        schema.TypeInt,
+				Required:    true,
+				Description: "ID of the virtual network to connect the NIC to",
+			},
+			"ip": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "IP address to request from the network, assigned by OpenNebula if not set. How changes are applied depends on nic_ip_change",
+			},
+			"mac": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "MAC address to request from the network, assigned by OpenNebula if not set",
+			},
+			"model": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Hardware model of the NIC, e.g. virtio. Overrides the model of nic_default",
+			},
+			"filter": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Network filter applied to the NIC, e.g. clean-traffic. Overrides the filter of nic_default",
+			},
+			"nic_id": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the NIC inside the VM",
+			},
+			"ar_id": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the address range of the network the NIC's addresses were leased from",
+			},
+			"security_groups": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "IDs of security groups applied to the NIC in addition to default_security_groups",
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+			},
+			"effective_security_groups": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "IDs of all security groups applied to the NIC, including the ones added by OpenNebula",
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+			},
+		},
+	}
+	for key, s := range qosSchema() {
+		nic.Schema[key] = s
+	}
+
+	r := &schema.Resource{
+		Create:        resourceVmCreate,
+		CustomizeDiff: resourceVmCustomizeDiff,
+		Read:          resourceVmRead,
+		Exists:        resourceVmExists,
+		Update:        resourceVmUpdate,
+		Delete:        resourceVmDelete,
 		Importer: &schema.ResourceImporter{
 			State: schema.ImportStatePassthrough,
 		},
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(DefaultVmTimeout),
+			Update: schema.DefaultTimeout(DefaultVmTimeout),
+			Delete: schema.DefaultTimeout(DefaultVmTimeout),
+		},
 
 		Schema: map[string]*schema.Schema{
 			"name": {
@@ -37,6 +267,19 @@ func resourceVm() *schema.Resource {
 				Optional:    true,
 				Description: "Name of the VM. If empty, defaults to 'templatename-<vmid>'",
 			},
+			"name_template": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Description:   "Name of the VM with the placeholders {{template}} (name of the template), {{id}} (ID of the VM) and {{index}} (name_index). {{id:N}} and {{index:N}} zero-pad the number to N digits. The VM is renamed once its ID is known",
+				ValidateFunc:  validateVmNameTemplate,
+				ConflictsWith: []string{"name"},
+			},
+			"name_index": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				Description: "Value of the {{index}} placeholder of name_template, e.g. count.index",
+			},
 			"instance": {
 				Type:        schema.TypeString,
 				Computed:    true,
@@ -71,14 +314,22 @@ func resourceVm() *schema.Resource {
 					return
 				},
 			},
+			"chmod_recursive": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Also apply the permissions to the images used by the VM's disks",
+			},
 
 			"uid": {
 				Type:        schema.TypeInt,
+				Optional:    true,
 				Computed:    true,
 				Description: "ID of the user that will own the VM",
 			},
 			"gid": {
 				Type:        schema.TypeInt,
+				Optional:    true,
 				Computed:    true,
 				Description: "ID of the group that will own the VM",
 			},
@@ -97,6 +348,23 @@ func resourceVm() *schema.Resource {
 				Computed:    true,
 				Description: "IP address that is assigned to the VM",
 			},
+			"ips": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "IP addresses of the NICs of the VM in NIC order, the IPv6 address for NICs without an IPv4 one",
+			},
+			"ip6": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "IPv6 address that is assigned to the VM, empty if it has none",
+			},
+			"ip6s": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "IPv6 addresses of the NICs of the VM in NIC order, preferring global ones over link local ones. NICs without IPv6 are left out",
+			},
 			"state": {
 				Type:        schema.TypeInt,
 				Computed:    true,
@@ -107,287 +375,4316 @@ func resourceVm() *schema.Resource {
 				Computed:    true,
 				Description: "Current LCM state of the VM",
 			},
+			"make_template_persistent": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				ForceNew:    true,
+				Description: "Instantiate the VM from a private persistent copy of the template and its images, instead of the template itself",
+			},
+			"template_override": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				Description:      "Attributes in OpenNebula's String format overriding the template's ones when the VM is instantiated, e.g. CPU or CONTEXT. The template itself is not changed. An attribute can not be set both here and by another argument, e.g. CPU and cpu",
+				DiffSuppressFunc: suppressEquivalentTemplates,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if _, err := parseTemplate(v.(string)); err != nil {
+						errors = append(errors, fmt.Errorf("%q is not a valid template: %s", k, err))
+					}
+					return
+				},
+			},
+			"nic_ip_change": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "recreate",
+				Description:  "How a changed NIC ip is applied: recreate replaces the whole VM, swap attaches a NIC with the new address (reserving it) and detaches the old one afterwards, so the VM briefly has both addresses and the guest has to configure the new interface",
+				ValidateFunc: validation.StringInSlice(vmNicIpChangeStrategies, false),
+			},
+			"require_unique_name": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Refuse to create the VM if a VM with the same name already exists",
+			},
+			"hard_shutdown": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Destroy the VM immediately on deletion. If false, the guest is asked to shut down cleanly first, which requires ACPI",
+			},
+			"destroy_action": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Description:   "Action performed on deletion: " + strings.Join(vmDestroyActions, ", ") + ". Defaults to terminate-hard, or terminate if hard_shutdown is false. undeploy and stop keep the VM in OpenNebula along with its disks, IP leases and quota usage, it is only no longer managed by Terraform",
+				ValidateFunc:  validation.StringInSlice(vmDestroyActions, false),
+				ConflictsWith: []string{"hard_shutdown"},
+			},
+			"on_hold": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Create the VM in the HOLD state, so that it is not deployed. Setting it to false later releases the VM",
+			},
+			"desired_state": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "running",
+				Description:  "State the VM is kept in: " + strings.Join(vmDesiredStates, ", ") + ". poweroff-hard powers the VM off without waiting for the guest to shut down",
+				ValidateFunc: validation.StringInSlice(vmDesiredStates, false),
+			},
+			"lock": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Lock the VM against changes outside of Terraform: " + strings.Join(vmLockLevels, ", ") + ", or empty to unlock it. Terraform unlocks the VM while it applies changes and before it is deleted",
+				ValidateFunc: validation.StringInSlice(append([]string{""}, vmLockLevels...), false),
+			},
 			"wait_for_attribute": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Description: "Wait for specific attribute from VM Info to become available during vm creation",
 			},
+			"wait_for_attribute_value": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Value wait_for_attribute has to reach, e.g. ok for TEMPLATE/CONTEXT/SET_HOSTNAME. If empty, the attribute only has to be present",
+			},
+			"wait_for_ready": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Only consider the VM created once its guest reported READY through OneGate. Without OneGate enabled in the context (TOKEN = YES) only the VM state is waited for",
+			},
+			"create_mode": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "instantiate",
+				Description:  "How the VM is created: instantiate deploys it right away, hold_and_deploy instantiates it on hold and deploys it (to host_id if set) once it exists, then waits for the guest to report READY through OneGate like wait_for_ready. Ignored if on_hold is set",
+				ValidateFunc: validation.StringInSlice(vmCreateModes, false),
+			},
 			"ip_attribute": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Description: "Use different attribute from VM Info. TEMPLATE/CONTEXT/ETH0_IP is the default value",
 			},
+			"ip6_attribute": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Read ip6 from this attribute of the VM info instead, e.g. TEMPLATE/CONTEXT/ETH0_IP6",
+			},
 			"user_template_attributes": {
+				Type:             schema.TypeMap,
+				Optional:         true,
+				Description:      "User template attributes. Attributes removed from the configuration are cleared",
+				DiffSuppressFunc: suppressEquivalentTemplateValues,
+			},
+			"ignore_user_template_attributes": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Names of user template attributes managed outside of Terraform, they are neither set nor cleared",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"disk": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Additional disks of the VM. Disks added later on are hot-attached, removed disks are detached",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"image_id": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "ID of the image to attach. Exactly one of image_id and image is required",
+						},
+						"image": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Name of the image to attach, resolved to its ID when the VM is created",
+						},
+						"image_datastore_id": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Default:     -1,
+							Description: "Only look up the image by name in this datastore",
+						},
+						"image_owner": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Only look up the image by name among the images of this user",
+						},
+						"persistent": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Keep the changes made to the disk after the VM is terminated. The image has to be manageable by the user",
+						},
+						"disk_id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID of the disk inside the VM",
+						},
+						"size": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "Size of the disk in MB, images are grown to this size. Attached disks are resized in place, they can't shrink",
+						},
+						"target": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "Device the disk is attached as, e.g. vdb",
+						},
+					},
+				},
+			},
+			"nic": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Additional NICs of the VM. NICs added later on are hot-attached, removed NICs are detached",
+				Elem:        nic,
+			},
+			"debug": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Log every OpenNebula call made for this VM, along with its response, at INFO level",
+			},
+			"default_security_groups": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "IDs of security groups applied to every NIC of the nic block. Removing a group here detaches it from all NICs",
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+			},
+			"nic_default": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Settings applied to every NIC of the VM which doesn't set them itself",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"model": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "Hardware model of the NICs, e.g. virtio",
+						},
+						"filter": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "Network filter applied to the NICs, e.g. clean-traffic",
+						},
+					},
+				},
+			},
+			"skip_reference_validation": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Don't check that the template and the images and networks of the disks and NICs exist before creating the VM",
+			},
+			"context": {
+				Type:             schema.TypeMap,
+				Optional:         true,
+				Description:      "Context variables. They are merged into the CONTEXT section of the template",
+				DiffSuppressFunc: suppressEquivalentTemplateValues,
+			},
+			"secret_context": {
 				Type:        schema.TypeMap,
 				Optional:    true,
-				Description: "User template attributes",
+				Sensitive:   true,
+				Description: "Context variables whose values are resolved from secret references (env:NAME or file:PATH) when they are applied. Only the references are kept in the state, so a changed secret is applied once its reference changes",
 			},
-		},
-	}
-}
-
-func resourceVmCreate(d *schema.ResourceData, meta interface{}) error {
-	client := meta.(*Client)
-
-	resp, err := client.Call(
-		"one.template.instantiate",
-		d.Get("template_id"),
-		d.Get("name"),
-		false,
-		buildUserTemplateAttributesString(d.Get("user_template_attributes").(map[string]interface{})),
-		false,
-	)
-	if err != nil {
-		return err
-	}
-
-	d.SetId(resp)
-
-	_, err = waitForVmState(d, meta, "running")
-	if err != nil {
-		return fmt.Errorf(
-			"Error waiting for virtual machine (%s) to be in state RUNNING: %s", d.Id(), err)
-	}
-
-	attribute := d.Get("wait_for_attribute").(string)
-	if attribute != "" {
-		err = waitForAttribute(d, meta, attribute)
-		if err != nil {
-			return fmt.Errorf("Error waiting for attribute %s of virtual machine %s: %s", attribute, d.Id(), err)
-		}
-	}
-
-	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vm.chmod"); err != nil {
-		return err
-	}
-
-	return resourceVmRead(d, meta)
-}
-
-func resourceVmRead(d *schema.ResourceData, meta interface{}) error {
-	var attributes map[string]string
-	var err error
-
-	if d.Id() != "" {
-		client := meta.(*Client)
-		if attributes, err = loadVMInfo(client, intId(d.Id())); err != nil {
-			return err
-		}
-	} else {
-		name := d.Get("name").(string)
-		if name == "" {
-			name = d.Get("instance").(string)
-		}
-		return fmt.Errorf("VM ID not set for VM: %s", name)
-	}
-
-	saveVmInfoToState(d, attributes)
-
-	return nil
-}
-
-func saveVmInfoToState(state *schema.ResourceData, attributes map[string]string) {
-	state.Set("instance", attributes["NAME"])
-	state.Set("uid", convertToInt(attributes["UID"]))
-	state.Set("gid", convertToInt(attributes["GID"]))
-	state.Set("uname", attributes["UNAME"])
-	state.Set("gname", attributes["GNAME"])
-	state.Set("state", convertToInt(attributes[StateAttribute]))
-	state.Set("lcmstate", convertToInt(attributes[LcmStateAttribute]))
-	state.Set("ip", determineIp(state, attributes))
-	state.Set("permissions", permissionString(buildPermissions(attributes)))
-	userTemplateAttributes := synchronizeUserTemplateAttributes(state.Get("user_template_attributes").(map[string]interface{}), attributes)
-	state.Set("user_template_attributes", userTemplateAttributes)
-}
-
-func determineIp(state *schema.ResourceData, attributes map[string]string) string {
-	ipAttribute := state.Get("ip_attribute").(string)
-	if ipAttribute == "" {
-		ipAttribute = DefaultIpAttribute
-	}
-	return attributes[ipAttribute]
-}
-
-func buildPermissions(attributes map[string]string) *Permissions {
-	permissions := Permissions{
-		Owner_U: convertToInt(attributes["PERMISSIONS/OWNER_U"]),
-		Owner_M: convertToInt(attributes["PERMISSIONS/OWNER_M"]),
-		Owner_A: convertToInt(attributes["PERMISSIONS/OWNER_A"]),
-		Group_U: convertToInt(attributes["PERMISSIONS/GROUP_U"]),
-		Group_M: convertToInt(attributes["PERMISSIONS/GROUP_M"]),
-		Group_A: convertToInt(attributes["PERMISSIONS/GROUP_A"]),
-		Other_U: convertToInt(attributes["PERMISSIONS/OTHER_U"]),
-		Other_M: convertToInt(attributes["PERMISSIONS/OTHER_M"]),
-		Other_A: convertToInt(attributes["PERMISSIONS/OTHER_A"]),
-	}
-
-	return &permissions
-}
-
-func convertToInt(value string) int {
-	i, err := strconv.Atoi(value)
-	if err != nil {
-		log.Fatalf("Unexpected value '%s' received from OpenNebula. Expected an integer", value)
-	}
-
-	return i
-}
-
-func resourceVmExists(d *schema.ResourceData, meta interface{}) (bool, error) {
-	err := resourceVmRead(d, meta)
-	// a terminated VM is in state 6 (DONE)
-	if err != nil || d.Id() == "" || d.Get("state").(int) == 6 {
-		return false, err
-	}
-
-	return true, nil
-}
-
-func resourceVmUpdate(d *schema.ResourceData, meta interface{}) error {
-	client := meta.(*Client)
-
-	if d.HasChange("permissions") {
-		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vm.chmod")
-		if err != nil {
-			return err
-		}
-		log.Printf("[INFO] Successfully updated VM %s\n", resp)
-	}
-
-	if d.HasChange("user_template_attributes") {
-		userTemplateAttributes := buildUserTemplateAttributesString(d.Get("user_template_attributes").(map[string]interface{}))
-		if err := updateUserTemplate(client, intId(d.Id()), userTemplateAttributes); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func resourceVmDelete(d *schema.ResourceData, meta interface{}) error {
-	err := resourceVmRead(d, meta)
-	if err != nil || d.Id() == "" {
-		return err
-	}
-
-	client := meta.(*Client)
-	resp, err := client.Call("one.vm.action", "terminate-hard", intId(d.Id()))
-	if err != nil {
-		return err
+			"appliance_params": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Parameters of a marketplace appliance, e.g. mysql_password. They are added to the context with the ONEAPP_ prefix, which may also be given",
+			},
+			"init_scripts": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Scripts to run on boot, in the given order. They have to be shipped by the context, e.g. through `files_ds`",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"files_ds": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "IDs of CONTEXT images whose files are made available to the VM",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
+			},
+			"snapshot": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				Description: "Snapshots of the VM. Snapshots missing on the VM are created, snapshots which are not configured are deleted unless `ignore_external_snapshots` is set",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Name of the snapshot, it identifies the snapshot and has to be unique",
+						},
+						"snapshot_id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID OpenNebula assigned to the snapshot",
+						},
+						"time": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Creation time of the snapshot",
+						},
+					},
+				},
+			},
+			"attached_disks": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Every disk attached to the VM, including the disks of its template and disks attached outside of Terraform",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"disk_id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID of the disk inside the VM",
+						},
+						"image_id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID of the image of the disk",
+						},
+						"size": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Size of the disk in MB",
+						},
+						"target": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Device the disk is attached as, e.g. vdb",
+						},
+					},
+				},
+			},
+			"template_disk_ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "IDs of the disks the VM got from its template. They are not reported in `disk`",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
+			},
+			"template_nic_ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "IDs of the NICs the VM got from its template. They are not reported in `nic`",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
+			},
+			"ignore_external_disks": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Don't report disks which have been attached outside of Terraform in `disk`",
+			},
+			"ignore_external_nics": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Don't report NICs which have been attached outside of Terraform in `nic`",
+			},
+			"ignore_external_snapshots": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Keep snapshots which have been taken outside of Terraform",
+			},
+			"revert_to": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of a snapshot to revert the VM to. The VM is reverted whenever the value changes, it is ignored when the VM is created",
+			},
+			"snapshot_before_update": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Take a snapshot of the VM before changes which resize it or need a power cycle, so they can be rolled back manually. These snapshots are kept, also when the change fails",
+			},
+			"pre_update_snapshot_id": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the snapshot taken by snapshot_before_update before the latest disruptive change",
+			},
+			"scheduled_action": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Actions OpenNebula executes on the VM at a given time, optionally repeated",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"action": {
+							Type:         schema.TypeString,
+							Required:     true,
+							Description:  "Action to execute: " + strings.Join(vmScheduledActions, ", "),
+							ValidateFunc: validation.StringInSlice(vmScheduledActions, false),
+						},
+						"time": {
+							Type:         schema.TypeInt,
+							Required:     true,
+							Description:  "Time of the (first) execution as UNIX timestamp",
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+						"repeat": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Description:  "Repeat the action: " + strings.Join(vmSchedRepeats, ", "),
+							ValidateFunc: validation.StringInSlice(vmSchedRepeats, false),
+						},
+						"days": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Description:      "Comma separated days the action is repeated on: week days (0-6, Sunday is 0) for weekly, days of the month (1-31) for monthly, days of the year (0-365) for yearly. For hourly, the number of hours between executions",
+							DiffSuppressFunc: suppressEquivalentDays,
+						},
+						"end_type": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "never",
+							Description:  "When a repeated action ends: " + strings.Join(vmSchedEndTypes, ", "),
+							ValidateFunc: validation.StringInSlice(vmSchedEndTypes, false),
+						},
+						"end_value": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "Number of executions for end_type times, UNIX timestamp of the end for end_type date",
+						},
+					},
+				},
+			},
+			"vmgroup": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Role of an existing VM group the VM joins on creation",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"vmgroup_id": {
+							Type:        schema.TypeInt,
+							Required:    true,
+							ForceNew:    true,
+							Description: "ID of the VM group",
+						},
+						"role": {
+							Type:        schema.TypeString,
+							Required:    true,
+							ForceNew:    true,
+							Description: "Name of the role inside the VM group",
+						},
+					},
+				},
+			},
+			"sched_requirements": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Boolean expression that rules out hosts which are not suitable for the VM. Removing it clears the expression, also one taken over from the template",
+			},
+			"sched_rank": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Arithmetic expression used to sort the suitable hosts for the VM. Removing it clears the expression, also one taken over from the template",
+			},
+			"sched_ds_requirements": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Boolean expression that rules out system datastores which are not suitable for the VM. Removing it clears the expression, also one taken over from the template",
+			},
+			"sched_ds_rank": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Arithmetic expression used to sort the suitable system datastores for the VM. Removing it clears the expression, also one taken over from the template",
+			},
+			"info_json": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "All attributes of the VM as a JSON object keyed by their path, e.g. TEMPLATE/CONTEXT/ETH0_IP. Monitoring values and credentials, like the secret_context variables, are left out",
+			},
+			"sched_message": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Message of the scheduler explaining why the VM could not be deployed",
+			},
+			"host_id": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				Description:  "ID of the host the VM runs on. The VM is deployed to it on creation, changing it migrates the VM to the host",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"migrate_live": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Migrate a running VM without stopping it when host_id changes",
+			},
+			"migrate_datastore_id": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     -1,
+				Description: "ID of the system datastore to move the VM to when host_id changes, or to deploy it to with create_mode hold_and_deploy, -1 to keep the current (or default) one",
+			},
+			"deployed_host_id": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the host the scheduler selected for the last deployment of the VM, -1 if it was never deployed",
+			},
+			"deployed_host": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the host the scheduler selected for the last deployment of the VM",
+			},
+			"cpu_usage": {
+				Type:        schema.TypeFloat,
+				Computed:    true,
+				Description: "CPU usage in percent of one CPU, as last monitored. 0 if the VM has not been monitored yet",
+			},
+			"memory_usage": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Memory usage in KB, as last monitored. 0 if the VM has not been monitored yet",
+			},
+			"net_rx": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Bytes received over the network, as last monitored",
+			},
+			"net_tx": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Bytes sent over the network, as last monitored",
+			},
+			"automatic_requirements": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Host requirements OpenNebula adds on its own, e.g. from the clusters of the VM's resources",
+			},
+			"lxc_unprivileged": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Run the container as an unprivileged LXC container. Only supported on LXC",
+			},
+			"lxc_mount_entries": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				Description:   "Mount entries of the container in fstab format, rendered as lxc.mount.entry lines of a raw section of type lxc",
+				ConflictsWith: []string{"raw"},
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"raw": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				MaxItems:    1,
+				Description: "Raw data passed to the hypervisor. The type has to match the hypervisor the VM runs on",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:         schema.TypeString,
+							Required:     true,
+							Description:  "Hypervisor the data is meant for, in lower case as OpenNebula reports it: " + strings.Join(vmRawTypes, ", "),
+							ValidateFunc: validation.StringInSlice(vmRawTypes, false),
+						},
+						"data": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Raw data in the hypervisor's format, e.g. libvirt XML for KVM",
+						},
+					},
+				},
+			},
+			"cpu": {
+				Type:         schema.TypeFloat,
+				Optional:     true,
+				Computed:     true,
+				Description:  "Share of physical CPUs assigned to the VM, overrides the template. Changes are applied without a power cycle if hot_resize allows it",
+				ValidateFunc: validation.FloatBetween(0.01, 1024),
+			},
+			"vcpu": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				Description:  "Number of virtual CPUs, overrides the template. Changes are applied without a power cycle if hot_resize allows it",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"memory": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				Description:  "Memory of the VM in MB, overrides the template. Changes are applied without a power cycle if hot_resize allows it",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"hot_resize": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Which resources can be resized while the VM is running (OpenNebula 6). It is only applied when the VM is deployed, so changes recreate the VM",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"cpu_hot_add_enabled": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "Allow changing cpu and vcpu of the running VM",
+						},
+						"memory_hot_add_enabled": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "Allow changing the memory of the running VM",
+						},
+					},
+				},
+			},
+			"enforce": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Make OpenNebula check the capacity of the host and the quotas when resizing, deploying or migrating the VM",
+			},
+			"memory_slots": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				Description:  "Number of slots available to hotplug memory into the VM. Only supported on KVM",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"memory_resize_mode": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				Description:  "How the memory of the VM is resized while it is running: " + strings.Join(vmMemoryResizeModes, ", ") + ". HOTPLUG is only supported on KVM",
+				ValidateFunc: validation.StringInSlice(vmMemoryResizeModes, false),
+			},
+			"topology": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Virtual CPU topology and NUMA pinning of the VM. It is only applied when the VM is deployed, so changes recreate the VM",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"pin_policy": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Description:  "How virtual CPUs are pinned to the host's CPUs: " + strings.Join(vmPinPolicies, ", "),
+							ValidateFunc: validation.StringInSlice(vmPinPolicies, false),
+						},
+						"sockets": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ForceNew:     true,
+							Description:  "Number of sockets",
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+						"cores": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ForceNew:     true,
+							Description:  "Number of cores per socket",
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+						"threads": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ForceNew:     true,
+							Description:  "Number of threads per core",
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+						"hugepage_size": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ForceNew:     true,
+							Description:  "Size of the huge pages backing the VM's memory, in MB",
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+						"memory_access": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Description:  "Whether the memory is shared with other processes: " + strings.Join(vmMemoryAccess, ", "),
+							ValidateFunc: validation.StringInSlice(vmMemoryAccess, false),
+						},
+					},
+				},
+			},
+			"graphics": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				MaxItems:    1,
+				Description: "Graphical console of the VM. Changes are applied through one.vm.updateconf and only take effect after the VM has been power cycled",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:         schema.TypeString,
+							Required:     true,
+							Description:  "Protocol of the console: " + strings.Join(vmGraphicsTypes, ", "),
+							ValidateFunc: validation.StringInSlice(vmGraphicsTypes, false),
+						},
+						"listen": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Address the console listens on, e.g. 0.0.0.0",
+						},
+						"port": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "Port the console listens on, assigned by OpenNebula if not set",
+						},
+						"keymap": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Keyboard layout of the console, e.g. en-us",
+						},
+						"passwd": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Password of the console. It is not read back from OpenNebula, see passwd_set",
+						},
+						"passwd_set": {
+							Type:        schema.TypeBool,
+							Computed:    true,
+							Description: "Whether OpenNebula has a console password for the VM",
+						},
+					},
+				},
+			},
+			"os": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Boot settings of the VM. Most guests can not boot anymore after switching the firmware, so changes recreate the VM",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"firmware": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Description:  "Firmware the VM boots with: " + strings.Join(vmFirmwares, ", "),
+							ValidateFunc: validation.StringInSlice(vmFirmwares, false),
+						},
+						"secure_boot": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "Enable secure boot. Requires the UEFI firmware",
+						},
+					},
+				},
+			},
+			"features": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				MaxItems:    1,
+				Description: "Hypervisor features of the VM. Unset features are rendered as disabled. Changes are applied through one.vm.updateconf and only take effect after the VM has been power cycled",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"acpi": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Enable ACPI (required for a clean shutdown of most guests)",
+						},
+						"apic": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Enable the APIC",
+						},
+						"pae": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Enable the physical address extension mode",
+						},
+						"hyperv": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Enable the Hyper-V enlightenments for Windows guests",
+						},
+						"localtime": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Set the guest clock to the host's local time instead of UTC",
+						},
+						"guest_agent": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Enable the communication channel with the QEMU guest agent",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
+	}
+
+	return r
+}
+
+func resourceVmCreate(d *schema.ResourceData, meta interface{}) error {
+	client := resourceClient(d, meta)
+
+	if d.Get("require_unique_name").(bool) {
+		if err := checkUniqueVmName(client, d.Get("name").(string)); err != nil {
+			return err
+		}
+	}
+
+	disks, err := resolveDiskImages(client, d.Get("disk").([]interface{}))
+	if err != nil {
+		return err
+	}
+	d.Set("disk", disks)
+
+	nics := d.Get("nic").([]interface{})
+	if !d.Get("skip_reference_validation").(bool) {
+		if err := validateVmReferences(client, d.Get("template_id").(int), disks, nics); err != nil {
+			return err
+		}
+	}
+
+	if err := validatePersistentDisks(client, disks); err != nil {
+		return err
+	}
+
+	raw := d.Get("raw").([]interface{})
+	if entries := d.Get("lxc_mount_entries").([]interface{}); len(entries) > 0 {
+		raw = buildLxcMountRaw(entries)
+	}
+	memory := configuredMemoryAttributes(d)
+	lxc := configuredLxcAttributes(d)
+	if len(raw) > 0 || len(memory) > 0 || len(lxc) > 0 {
+		hypervisor, err := templateHypervisor(client, d.Get("template_id").(int))
+		if err != nil {
+			return err
+		}
+		if err = validateRawHypervisor(raw, hypervisor); err != nil {
+			return err
+		}
+		if err = validateMemoryHypervisor(memory, hypervisor); err != nil {
+			return err
+		}
+		if len(lxc) > 0 && hypervisor != "" && !strings.EqualFold(hypervisor, "lxc") {
+			return fmt.Errorf("lxc_unprivileged is only supported on LXC, but the VM runs on the %q hypervisor", strings.ToLower(hypervisor))
+		}
+	}
+
+	filesDs := d.Get("files_ds").([]interface{})
+	if err := validateContextFiles(client, filesDs); err != nil {
+		return err
+	}
+
+	vmOs := d.Get("os").([]interface{})
+	if err := validateOs(vmOs); err != nil {
+		return err
+	}
+
+	topology := d.Get("topology").([]interface{})
+	if len(topology) > 0 {
+		vcpu, err := vmVcpu(client, d)
+		if err != nil {
+			return err
+		}
+		if err = validateTopology(topology, vcpu); err != nil {
+			return err
+		}
+	}
+
+	vmGroup := d.Get("vmgroup").([]interface{})
+	if err := validateVmGroupRole(client, vmGroup); err != nil {
+		return err
+	}
+
+	scheduledActions := d.Get("scheduled_action").([]interface{})
+	if err := validateScheduledActions(scheduledActions); err != nil {
+		return err
+	}
+
+	contextString := ""
+	if contextConfigured(d) {
+		templateCtx, err := templateContext(client, d.Get("template_id").(int))
+		if err != nil {
+			return err
+		}
+		context, err := configuredContext(d)
+		if err != nil {
+			return err
+		}
+		contextString = buildContextString(templateCtx, context, nil, d.Get("init_scripts").([]interface{}), filesDs)
+	}
+
+	extraTemplate, err := renderVmTemplate(map[string]string{
+		"capacity":          buildAttributes(configuredCapacityAttributes(d)),
+		"hot_resize":        buildHotResizeString(d.Get("hot_resize").([]interface{})),
+		"memory":            buildAttributes(memory),
+		"topology":          buildTopologyString(topology),
+		"os":                buildOsString(vmOs),
+		"features":          buildFeaturesString(d.Get("features").([]interface{})),
+		"disk":              buildDisksString(disks),
+		"nic":               buildNicsString(nics, d.Get("default_security_groups").([]interface{})),
+		"nic_default":       buildNicDefaultString(d.Get("nic_default").([]interface{})),
+		"graphics":          buildGraphicsString(d.Get("graphics").([]interface{})),
+		"context":           contextString,
+		"raw":               buildRawString(raw),
+		"lxc":               buildAttributes(lxc),
+		"vmgroup":           buildVmGroupString(vmGroup),
+		"scheduling":        buildSchedulingString(configuredSchedulingAttributes(d)),
+		"scheduled_action":  buildScheduledActionsString(scheduledActions),
+		"user_template":     buildUserTemplateAttributesUpdate(nil, d.Get("user_template_attributes").(map[string]interface{}), d.Get("ignore_user_template_attributes").([]interface{})),
+		"template_override": d.Get("template_override").(string),
+	})
+	if err != nil {
+		return err
+	}
+
+	instantiateClient := client
+	if graphicsPasswd(d.Get("graphics").([]interface{})) != "" {
+		// the console password must not show up in the traced calls
+		instantiateClient = untracedClient(client)
+	}
+	onHold := d.Get("on_hold").(bool)
+	// a VM with host_id is deployed to the host right away rather than migrated there
+	_, hostSet := d.GetOkExists("host_id")
+	holdAndDeploy := !onHold && (d.Get("create_mode").(string) == "hold_and_deploy" || hostSet)
+	resp, err := instantiateVm(instantiateClient, d, extraTemplate, onHold || holdAndDeploy)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	if d.Get("name_template").(string) != "" {
+		if err = renameVmFromTemplate(client, d); err != nil {
+			return err
+		}
+	}
+
+	if onHold || holdAndDeploy {
+		_, err = waitForVmState(d, meta, "hold", d.Timeout(schema.TimeoutCreate))
+		if err != nil {
+			return fmt.Errorf(
+				"Error waiting for virtual machine (%s) to be in state HOLD: %s", d.Id(), err)
+		}
+	}
+	if holdAndDeploy {
+		if err = deployVm(d, meta); err != nil {
+			return err
+		}
+	}
+	if !onHold {
+		if err = waitForVmStartup(d, meta, d.Timeout(schema.TimeoutCreate)); err != nil {
+			return err
+		}
+	}
+
+	vm, err := loadVm(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	recordTemplateDevices(d, vm)
+
+	uid, gid := -1, -1
+	if v, ok := d.GetOkExists("uid"); ok {
+		uid = v.(int)
+	}
+	if v, ok := d.GetOkExists("gid"); ok {
+		gid = v.(int)
+	}
+
+	if err = changeVmOwnershipAndPermissions(client, intId(d.Id()), uid, gid, permission(d.Get("permissions").(string)), d.Get("chmod_recursive").(bool)); err != nil {
+		return err
+	}
+
+	// snapshots can only be taken once the VM is running
+	if !d.Get("on_hold").(bool) {
+		if err = reconcileSnapshots(d, meta, d.Timeout(schema.TimeoutCreate)); err != nil {
+			return err
+		}
+		if err = applyDesiredState(d, meta, d.Timeout(schema.TimeoutCreate)); err != nil {
+			return err
+		}
+	}
+
+	if lock := d.Get("lock").(string); lock != "" {
+		if err = lockVm(client, intId(d.Id()), lock); err != nil {
+			return err
+		}
+	}
+
+	return resourceVmRead(d, meta)
+}
+
+// checkUniqueVmName makes sure that none of the VMs the user has access to is named name.
+func checkUniqueVmName(client OneClient, name string) error {
+	// -1 for the state includes all VMs except the terminated ones
+	vm, err := findInPool(client, "one.vmpool.info", VmElementName, nameMatches(name), -2, -1, -1, -1)
+	if isNotFoundError(err) {
+		return nil
+	}
+	if _, ok := err.(*ambiguousInPoolError); ok {
+		return fmt.Errorf("A VM named %q already exists: %s", name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not check whether a VM named %q exists: %s", name, err)
+	}
+
+	return fmt.Errorf("A VM named %q already exists with the ID %s", name, vm["ID"])
+}
+
+// Sections of the template a VM is instantiated with, in the order they are rendered
+var vmTemplateSections = []string{
+	"capacity", "hot_resize", "memory", "topology", "os", "features", "disk", "nic", "nic_default",
+	"graphics", "context", "raw", "lxc", "vmgroup", "scheduling", "scheduled_action", "user_template",
+	"template_override",
+}
+
+// Vector attributes which may occur several times in a template
+var vmRepeatableAttributes = map[string]bool{
+	"DISK":         true,
+	"NIC":          true,
+	"NIC_ALIAS":    true,
+	"SCHED_ACTION": true,
+}
+
+// renderVmTemplate joins the rendered sections in the order of vmTemplateSections.
+// An attribute set by several sections (e.g. MEMORY in user_template_attributes)
+// is rejected instead of leaving it to OpenNebula which one wins.
+func renderVmTemplate(sections map[string]string) (string, error) {
+	ordered := make([]string, 0, len(vmTemplateSections))
+	for _, name := range vmTemplateSections {
+		ordered = append(ordered, sections[name])
+	}
+	for name := range sections {
+		if indexOf(vmTemplateSections, name) < 0 {
+			return "", fmt.Errorf("Unknown template section %s", name)
+		}
+	}
+
+	template := joinTemplateSections(ordered...)
+	if key := duplicateTemplateAttribute(template, vmRepeatableAttributes); key != "" {
+		return "", fmt.Errorf("The attribute %s is set more than once in the VM template", key)
+	}
+
+	return template, nil
+}
+
+// Placeholders of name_template, with the optional width to zero-pad numbers to
+var vmNamePlaceholderPattern = regexp.MustCompile(`\{\{(template|id|index)(?::(\d+))?\}\}`)
+
+var vmNameAnyPlaceholderPattern = regexp.MustCompile(`\{\{[^}]*\}\}`)
+
+func validateVmNameTemplate(v interface{}, k string) (ws []string, errors []error) {
+	for _, placeholder := range vmNameAnyPlaceholderPattern.FindAllString(v.(string), -1) {
+		if !vmNamePlaceholderPattern.MatchString(placeholder) {
+			errors = append(errors, fmt.Errorf("%q contains the unknown placeholder %s, supported are {{template}}, {{id}} and {{index}}", k, placeholder))
+		}
+	}
+	return
+}
+
+// renderVmName replaces the placeholders of a name_template.
+func renderVmName(nameTemplate string, templateName string, id int, index int) string {
+	return vmNamePlaceholderPattern.ReplaceAllStringFunc(nameTemplate, func(placeholder string) string {
+		m := vmNamePlaceholderPattern.FindStringSubmatch(placeholder)
+		switch m[1] {
+		case "template":
+			return templateName
+		case "id":
+			return padVmNameNumber(id, m[2])
+		default:
+			return padVmNameNumber(index, m[2])
+		}
+	})
+}
+
+func padVmNameNumber(value int, width string) string {
+	return fmt.Sprintf("%0*d", convertToOptionalInt(width, 0), value)
+}
+
+// vmNameMatchesTemplate tells whether name is a rendering of nameTemplate. The
+// template may have been renamed since, so {{template}} matches any name.
+func vmNameMatchesTemplate(nameTemplate string, name string, id int, index int) bool {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, m := range vmNamePlaceholderPattern.FindAllStringSubmatchIndex(nameTemplate, -1) {
+		pattern.WriteString(regexp.QuoteMeta(nameTemplate[last:m[0]]))
+		if nameTemplate[m[2]:m[3]] == "template" {
+			pattern.WriteString(".*")
+		} else {
+			pattern.WriteString(regexp.QuoteMeta(renderVmName(nameTemplate[m[0]:m[1]], "", id, index)))
+		}
+		last = m[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(nameTemplate[last:]))
+	pattern.WriteString("$")
+
+	return regexp.MustCompile(pattern.String()).MatchString(name)
+}
+
+// renameVmFromTemplate renames the VM to the rendering of name_template.
+func renameVmFromTemplate(client OneClient, d *schema.ResourceData) error {
+	nameTemplate := d.Get("name_template").(string)
+
+	templateName := ""
+	if strings.Contains(nameTemplate, "{{template") {
+		attributes, err := loadTemplateInfo(client, d.Get("template_id").(int))
+		if err != nil {
+			return fmt.Errorf("Could not read the name of template %d for name_template: %s", d.Get("template_id").(int), err)
+		}
+		templateName = attributes["NAME"]
+	}
+
+	name := renderVmName(nameTemplate, templateName, intId(d.Id()), d.Get("name_index").(int))
+	if _, err := client.Call("one.vm.rename", intId(d.Id()), name); err != nil {
+		return fmt.Errorf("Could not rename VM %s to %s: %s", d.Id(), name, err)
+	}
+
+	log.Printf("[INFO] Successfully renamed VM %s to %s\n", d.Id(), name)
+	return nil
+}
+
+// instantiateVm creates the VM from its template, extraTemplate is merged into the
+// template's attributes. With hold the VM is created in the HOLD state.
+func instantiateVm(client OneClient, d *schema.ResourceData, extraTemplate string, hold bool) (string, error) {
+	resp, err := client.Call(
+		"one.template.instantiate",
+		d.Get("template_id"),
+		d.Get("name"),
+		hold,
+		extraTemplate,
+		d.Get("make_template_persistent").(bool),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return parseScalarResponse([]byte(resp))
+}
+
+// deployVm deploys a VM on hold, to host_id if it is set and otherwise wherever the
+// scheduler places it.
+func deployVm(d *schema.ResourceData, meta interface{}) error {
+	client := resourceClient(d, meta)
+	id := intId(d.Id())
+
+	if hostId, ok := d.GetOkExists("host_id"); ok {
+		_, err := client.Call(
+			"one.vm.deploy",
+			id,
+			hostId.(int),
+			d.Get("enforce").(bool),
+			d.Get("migrate_datastore_id").(int),
+		)
+		if err != nil {
+			return fmt.Errorf("Could not deploy VM %d to host %d: %s", id, hostId.(int), err)
+		}
+		log.Printf("[INFO] Successfully deployed VM %d to host %d", id, hostId.(int))
+		return nil
+	}
+
+	// a VM on hold is in state 2 (HOLD) and LCM state 0 (LCM_INIT)
+	if _, err := vmAction(client, id, "release", 2, 0); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Successfully released VM %d", id)
+	return nil
+}
+
+// releaseVm releases a VM created on hold and waits for it to start up.
+func releaseVm(d *schema.ResourceData, meta interface{}, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+
+	resp, err := vmAction(client, intId(d.Id()), "release", d.Get("state").(int), d.Get("lcmstate").(int))
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Successfully released VM %s\n", resp)
+
+	return waitForVmStartup(d, meta, timeout)
+}
+
+// waitForVmStartup waits for the VM to run and, if configured, for the guest to be ready.
+func waitForVmStartup(d *schema.ResourceData, meta interface{}, timeout time.Duration) error {
+	_, err := waitForVmState(d, meta, "running", timeout)
+	if err != nil {
+		return fmt.Errorf(
+			"Error waiting for virtual machine (%s) to be in state RUNNING: %s", d.Id(), err)
+	}
+
+	if d.Get("wait_for_ready").(bool) || d.Get("create_mode").(string) == "hold_and_deploy" {
+		err = waitForVmReady(d, meta, timeout)
+		if err != nil {
+			return fmt.Errorf("Error waiting for virtual machine %s to report READY: %s", d.Id(), err)
+		}
+	}
+
+	attribute := d.Get("wait_for_attribute").(string)
+	if attribute != "" {
+		err = waitForAttribute(d, meta, attribute, d.Get("wait_for_attribute_value").(string), timeout)
+		if err != nil {
+			return fmt.Errorf("Error waiting for attribute %s of virtual machine %s: %s", attribute, d.Id(), err)
+		}
+	}
+
+	return nil
+}
+
+func resourceVmRead(d *schema.ResourceData, meta interface{}) error {
+	var attributes map[string]string
+	var vm *Vm
+	var err error
+
+	if d.Id() != "" {
+		client := resourceClient(d, meta)
+		attributes, err = loadVMInfo(client, intId(d.Id()))
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		// a terminated VM is kept in state 6 (DONE) until OpenNebula purges it
+		if convertToOptionalInt(attributes[StateAttribute], -1) == 6 {
+			log.Printf("[WARN] VM %s has been terminated, removing it from the state", d.Id())
+			d.SetId("")
+			return nil
+		}
+		vm, err = loadVm(client, intId(d.Id()))
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+	} else {
+		name := d.Get("name").(string)
+		if name == "" {
+			name = d.Get("instance").(string)
+		}
+		return fmt.Errorf("VM ID not set for VM: %s", name)
+	}
+
+	saveVmInfoToState(d, attributes)
+	// a VM renamed outside of Terraform shows up as a change of name_template
+	if nameTemplate := d.Get("name_template").(string); nameTemplate != "" && !vmNameMatchesTemplate(nameTemplate, attributes["NAME"], intId(d.Id()), d.Get("name_index").(int)) {
+		log.Printf("[WARN] VM %s has been renamed to %s outside of Terraform", d.Id(), attributes["NAME"])
+		d.Set("name_template", attributes["NAME"])
+	}
+	// imported VMs and VMs created by an older version have no record of their template
+	// devices, without one they would be taken for external devices and detached
+	_, disksRecorded := d.GetOkExists("template_disk_ids")
+	_, nicsRecorded := d.GetOkExists("template_nic_ids")
+	if !disksRecorded || !nicsRecorded {
+		recordTemplateDevices(d, vm)
+	}
+	d.Set("disk", synchronizeDisks(d.Get("disk").([]interface{}), vm.Disks, d.Get("template_disk_ids").([]interface{}), d.Get("ignore_external_disks").(bool)))
+	d.Set("attached_disks", readAttachedDisks(vm.Disks))
+	d.Set("nic", synchronizeNics(d.Get("nic").([]interface{}), vm.Nics, d.Get("template_nic_ids").([]interface{}), d.Get("ignore_external_nics").(bool)))
+	d.Set("nic_default", readNicDefault(attributes))
+	d.Set("snapshot", synchronizeSnapshots(d.Get("snapshot").([]interface{}), vm.Snapshots, d.Get("ignore_external_snapshots").(bool)))
+	d.Set("scheduled_action", synchronizeScheduledActions(d.Get("scheduled_action").([]interface{}), vm.SchedActions))
+
+	return nil
+}
+
+func saveVmInfoToState(state *schema.ResourceData, attributes map[string]string) {
+	state.Set("instance", attributes["NAME"])
+	state.Set("uid", convertToInt(attributes["UID"]))
+	state.Set("gid", convertToInt(attributes["GID"]))
+	state.Set("uname", attributes["UNAME"])
+	state.Set("gname", attributes["GNAME"])
+	state.Set("state", convertToInt(attributes[StateAttribute]))
+	state.Set("lcmstate", convertToInt(attributes[LcmStateAttribute]))
+	current := vmActionState(convertToInt(attributes[StateAttribute]), convertToInt(attributes[LcmStateAttribute]))
+	if desiredState := readDesiredState(current, state.Get("desired_state").(string)); desiredState != "" {
+		state.Set("desired_state", desiredState)
+	}
+	ips := readVmIps(attributes)
+	state.Set("ip", determineIp(state, attributes, ips))
+	state.Set("ips", ips)
+	ip6s := readVmIp6s(attributes)
+	state.Set("ip6", determineIp6(state, attributes, ip6s))
+	state.Set("ip6s", ip6s)
+	// don't write a bogus "000" when OpenNebula has not reported the permissions yet
+	if hasPermissions(attributes) {
+		permissions := buildPermissions(attributes)
+		state.Set("permissions", permissionString(permissions))
+		setPermissionBits(state, permissions)
+	}
+	for key, value := range readSchedulingAttributes(attributes) {
+		state.Set(key, value)
+	}
+	state.Set("automatic_requirements", templateAttr(attributes, "AUTOMATIC_REQUIREMENTS"))
+	state.Set("sched_message", userTemplateAttr(attributes, "SCHED_MESSAGE"))
+	hostId, hostname := readDeployment(attributes)
+	state.Set("host_id", hostId)
+	state.Set("deployed_host_id", hostId)
+	state.Set("deployed_host", hostname)
+	for key, value := range readVmUsage(attributes) {
+		state.Set(key, value)
+	}
+	state.Set("lock", readVmLock(attributes))
+	if infoJson, err := vmInfoJson(attributes, state.Get("secret_context").(map[string]interface{})); err == nil {
+		state.Set("info_json", infoJson)
+	} else {
+		log.Printf("[WARN] Could not serialize the info of VM %s: %s", state.Id(), err)
+	}
+	if cpu, err := strconv.ParseFloat(templateAttr(attributes, "CPU"), 64); err == nil {
+		state.Set("cpu", cpu)
+	}
+	if vcpu, present := lookupTemplateAttr(attributes, "VCPU"); present {
+		state.Set("vcpu", convertToInt(vcpu))
+	}
+	if memory, present := lookupTemplateAttr(attributes, "MEMORY"); present {
+		state.Set("memory", convertToInt(memory))
+	}
+	state.Set("hot_resize", readHotResize(attributes))
+	if slots, present := lookupTemplateAttr(attributes, "MEMORY_SLOTS"); present {
+		state.Set("memory_slots", convertToInt(slots))
+	}
+	state.Set("memory_resize_mode", templateAttr(attributes, "MEMORY_RESIZE_MODE"))
+	state.Set("context", synchronizeContext(state.Get("context").(map[string]interface{}), attributes))
+	state.Set("appliance_params", synchronizeApplianceParams(state.Get("appliance_params").(map[string]interface{}), attributes))
+	if _, present := lookupTemplateAttr(attributes, "CONTEXT/INIT_SCRIPTS"); present || len(state.Get("init_scripts").([]interface{})) > 0 {
+		state.Set("init_scripts", readInitScripts(attributes))
+	}
+	if _, present := lookupTemplateAttr(attributes, "CONTEXT/FILES_DS"); present || len(state.Get("files_ds").([]interface{})) > 0 {
+		state.Set("files_ds", readContextFiles(attributes))
+	}
+	state.Set("vmgroup", readVmGroup(attributes))
+	state.Set("raw", readRaw(attributes))
+	if unprivileged, present := lookupTemplateAttr(attributes, "LXC_UNPRIVILEGED"); present {
+		state.Set("lxc_unprivileged", strings.EqualFold(unprivileged, "yes"))
+	}
+	state.Set("lxc_mount_entries", readLxcMountEntries(attributes))
+	state.Set("features", readFeatures(attributes))
+	state.Set("os", readOs(attributes))
+	state.Set("graphics", readGraphics(attributes, graphicsPasswd(state.Get("graphics").([]interface{}))))
+	state.Set("topology", readTopology(attributes))
+	userTemplateAttributes := synchronizeUserTemplateAttributes(state.Get("user_template_attributes").(map[string]interface{}), attributes, state.Get("ignore_user_template_attributes").([]interface{}))
+	state.Set("user_template_attributes", userTemplateAttributes)
+}
+
+// vmInfoJson serializes the attributes of a VM without the volatile ones and the
+// credentials, including the variables of secret_context. The keys are sorted, so
+// the result only changes with the VM.
+func vmInfoJson(attributes map[string]string, secretContext map[string]interface{}) (string, error) {
+	secrets := make(map[string]bool, len(secretContext))
+	for key := range secretContext {
+		secrets[TemplateElementName+PathSeparator+"CONTEXT"+PathSeparator+strings.ToUpper(key)] = true
+	}
+
+	stable := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		volatile := vmSecretAttributes[key] || secrets[key]
+		for _, prefix := range vmVolatileAttributePrefixes {
+			volatile = volatile || strings.HasPrefix(key, prefix)
+		}
+		if !volatile {
+			stable[key] = value
+		}
+	}
+
+	info, err := json.Marshal(stable)
+	return string(info), err
+}
+
+// determineIp returns the value of ip_attribute or, without it, ETH0_IP of the
+// context. VMs whose context has no ETH0_IP get the first of their ips.
+func determineIp(state *schema.ResourceData, attributes map[string]string, ips []string) string {
+	if ipAttribute := state.Get("ip_attribute").(string); ipAttribute != "" {
+		ip, _ := lookupAttribute(attributes, ipAttribute)
+		return ip
+	}
+	if ip := attributes[DefaultIpAttribute]; ip != "" || len(ips) == 0 {
+		return ip
+	}
+	return ips[0]
+}
+
+var contextIpPattern = regexp.MustCompile(`^TEMPLATE/CONTEXT/ETH(\d+)_IP$`)
+
+// determineIp6 returns the value of ip6_attribute or, without it, the first of ip6s.
+func determineIp6(state *schema.ResourceData, attributes map[string]string, ip6s []string) string {
+	if ipAttribute := state.Get("ip6_attribute").(string); ipAttribute != "" {
+		ip6, _ := lookupAttribute(attributes, ipAttribute)
+		return ip6
+	}
+	if len(ip6s) == 0 {
+		return ""
+	}
+	return ip6s[0]
+}
+
+// nicAddresses returns the first of keys set for every NIC, in NIC order.
+func nicAddresses(attributes map[string]string, keys ...string) []string {
+	addresses := make([]string, 0)
+	for _, nic := range subTrees(attributes, "TEMPLATE/NIC") {
+		for _, key := range keys {
+			if address := nic[key]; address != "" {
+				addresses = append(addresses, address)
+				break
+			}
+		}
+	}
+
+	return addresses
+}
+
+// readVmIp6s returns the IPv6 address of every NIC which has one. OpenNebula sets
+// IP6 for static addresses and IP6_GLOBAL, IP6_ULA or IP6_LINK for SLAAC ones.
+func readVmIp6s(attributes map[string]string) []string {
+	return nicAddresses(attributes, "IP6", "IP6_GLOBAL", "IP6_ULA", "IP6_LINK")
+}
+
+// readVmIps returns the address of every NIC in NIC order, falling back to the IPv6
+// address for IPv6 only NICs. VMs without NICs in their info, e.g. imported ones,
+// get the ETH<n>_IP context variables ordered by n.
+func readVmIps(attributes map[string]string) []string {
+	ips := nicAddresses(attributes, "IP", "IP6", "IP6_GLOBAL", "IP6_ULA")
+	if len(ips) > 0 {
+		return ips
+	}
+
+	contextIps := make(map[int]string)
+	indexes := make([]int, 0)
+	for key, value := range attributes {
+		if m := contextIpPattern.FindStringSubmatch(key); m != nil && value != "" {
+			i := convertToInt(m[1])
+			contextIps[i] = value
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		ips = append(ips, contextIps[i])
+	}
+
+	return ips
+}
+
+// buildPermissions reads the permission bits of a VM. Bits missing from the
+// response (e.g. right after the VM has been created) are treated as not set.
+func buildPermissions(attributes map[string]string) *Permissions {
+	bit := func(name string) int {
+		value, err := strconv.Atoi(attributes["PERMISSIONS/"+name])
+		if err != nil {
+			return 0
+		}
+		return value
+	}
+
+	permissions := Permissions{
+		Owner_U: bit("OWNER_U"),
+		Owner_M: bit("OWNER_M"),
+		Owner_A: bit("OWNER_A"),
+		Group_U: bit("GROUP_U"),
+		Group_M: bit("GROUP_M"),
+		Group_A: bit("GROUP_A"),
+		Other_U: bit("OTHER_U"),
+		Other_M: bit("OTHER_M"),
+		Other_A: bit("OTHER_A"),
+	}
+
+	return &permissions
+}
+
+func hasPermissions(attributes map[string]string) bool {
+	for key := range attributes {
+		if strings.HasPrefix(key, "PERMISSIONS/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func convertToInt(value string) int {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Unexpected value '%s' received from OpenNebula. Expected an integer", value)
+	}
+
+	return i
+}
+
+// convertToOptionalInt is convertToInt for attributes OpenNebula may leave out.
+func convertToOptionalInt(value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+
+	return convertToInt(value)
+}
+
+func resourceVmExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceVmRead(d, meta)
+	// a terminated VM is in state 6 (DONE)
+	if err != nil || d.Id() == "" || d.Get("state").(int) == 6 {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceVmUpdate(d *schema.ResourceData, meta interface{}) (err error) {
+	client := resourceClient(d, meta)
+
+	// OpenNebula rejects most changes while the VM is e.g. migrating or saving
+	if err := waitForVmSettled(client, intId(d.Id()), d.Timeout(schema.TimeoutUpdate), meta.(*Client).pollInterval); err != nil {
+		return fmt.Errorf("Error waiting for virtual machine %s to finish its current operation: %s", d.Id(), err)
+	}
+
+	// a locked VM rejects the changes, it is locked again afterwards, also if they fail
+	if lock, _ := d.GetChange("lock"); lock.(string) != "" {
+		if err := lockVm(client, intId(d.Id()), ""); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if lock := d.Get("lock").(string); lock != "" {
+			if lockErr := lockVm(client, intId(d.Id()), lock); lockErr != nil && err == nil {
+				err = lockErr
+			}
+		}
+	}()
+
+	if (d.HasChange("name_template") || d.HasChange("name_index")) && d.Get("name_template").(string) != "" {
+		if err := renameVmFromTemplate(client, d); err != nil {
+			return err
+		}
+	}
+
+	// resourceVmCustomizeDiff rejects putting a VM on hold again
+	if d.HasChange("on_hold") && !d.Get("on_hold").(bool) {
+		if err := releaseVm(d, meta, d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("uid") || d.HasChange("gid") || d.HasChange("permissions") {
+		uid, gid := -1, -1
+		if d.HasChange("uid") {
+			uid = d.Get("uid").(int)
+		}
+		if d.HasChange("gid") {
+			gid = d.Get("gid").(int)
+		}
+
+		var p *Permissions
+		if d.HasChange("permissions") {
+			p = permission(d.Get("permissions").(string))
+		}
+
+		if err := changeVmOwnershipAndPermissions(client, intId(d.Id()), uid, gid, p, d.Get("chmod_recursive").(bool)); err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated VM %s\n", d.Id())
+	}
+
+	changedScheduling := make(map[string]string)
+	for key := range vmSchedulingAttributes {
+		if d.HasChange(key) {
+			changedScheduling[key] = d.Get(key).(string)
+		}
+	}
+	if len(changedScheduling) > 0 {
+		if err := updateUserTemplate(client, intId(d.Id()), buildSchedulingString(changedScheduling)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("user_template_attributes") {
+		old, new := d.GetChange("user_template_attributes")
+		userTemplateAttributes := buildUserTemplateAttributesUpdate(old.(map[string]interface{}), new.(map[string]interface{}), d.Get("ignore_user_template_attributes").([]interface{}))
+		if userTemplateAttributes != "" {
+			if err := updateUserTemplate(client, intId(d.Id()), userTemplateAttributes); err != nil {
+				return err
+			}
+		}
+	}
+
+	if d.HasChange("scheduled_action") {
+		if err := reconcileScheduledActions(client, intId(d.Id()), d.Get("scheduled_action").([]interface{})); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("disk") {
+		if err := reconcileDisks(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("nic") {
+		if err := reconcileNics(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("nic") || d.HasChange("default_security_groups") {
+		if err := reconcileSecurityGroups(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("snapshot") && !d.Get("on_hold").(bool) {
+		if err := reconcileSnapshots(d, meta, d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("revert_to") && d.Get("revert_to").(string) != "" {
+		if err := revertToSnapshot(d, meta, d.Get("revert_to").(string), d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return err
+		}
+	}
+
+	if d.Get("snapshot_before_update").(bool) && !d.Get("on_hold").(bool) && hasDisruptiveChange(d) {
+		if err := snapshotBeforeUpdate(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("cpu") || d.HasChange("vcpu") || d.HasChange("memory") {
+		if err := resizeVm(d, meta, d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("memory_slots") || d.HasChange("memory_resize_mode") {
+		memory := configuredMemoryAttributes(d)
+		vm, err := loadVm(client, intId(d.Id()))
+		if err != nil {
+			return err
+		}
+		if err = validateMemoryHypervisor(memory, vmHypervisor(vm)); err != nil {
+			return err
+		}
+		resp, err := client.Call("one.vm.resize", intId(d.Id()), buildAttributes(memory), d.Get("enforce").(bool))
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully resized VM %s\n", resp)
+	}
+
+	if err := updateVmConfiguration(client, d); err != nil {
+		return err
+	}
+
+	if d.HasChange("host_id") {
+		if err := migrateVm(d, meta, d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return err
+		}
+	}
+
+	// the other changes may power cycle the VM, so its state is changed last
+	if d.HasChange("desired_state") && !d.Get("on_hold").(bool) {
+		if err := applyDesiredState(d, meta, d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasDisruptiveChange(d *schema.ResourceData) bool {
+	for _, key := range vmDisruptiveAttributes {
+		if d.HasChange(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotBeforeUpdate takes a snapshot of the VM to roll back a failed update to.
+func snapshotBeforeUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := resourceClient(d, meta)
+	name := preUpdateSnapshotPrefix + time.Now().UTC().Format("20060102150405")
+
+	resp, err := client.Call("one.vm.snapshotcreate", intId(d.Id()), name)
+	if err != nil {
+		return fmt.Errorf("Could not snapshot virtual machine %s before updating it: %s", d.Id(), err)
+	}
+	if _, err = waitForVmState(d, meta, "running", d.Timeout(schema.TimeoutUpdate)); err != nil {
+		return fmt.Errorf("Error waiting for snapshot %s of virtual machine %s to be created: %s", name, d.Id(), err)
+	}
+
+	d.Set("pre_update_snapshot_id", convertToInt(resp))
+	log.Printf("[INFO] Successfully created snapshot %s (%s) of VM %s before updating it\n", name, resp, d.Id())
+	return nil
+}
+
+// updateVmConfiguration applies the changes to the sections of the VM's template
+// which can only be changed through one.vm.updateconf. Only the changed sections
+// are sent, OpenNebula applies them on the next power cycle of the VM.
+func updateVmConfiguration(client OneClient, d *schema.ResourceData) error {
+	contextChanged := d.HasChange("context") || d.HasChange("secret_context") || d.HasChange("appliance_params") || d.HasChange("init_scripts") || d.HasChange("files_ds")
+	var sections []string
+
+	if d.HasChange("raw") {
+		raw := d.Get("raw").([]interface{})
+		if len(raw) > 0 {
+			vm, err := loadVm(client, intId(d.Id()))
+			if err != nil {
+				return err
+			}
+			if err = validateRawHypervisor(raw, vmHypervisor(vm)); err != nil {
+				return err
+			}
+		}
+		sections = append(sections, buildRawString(raw))
+	}
+
+	if d.HasChange("features") {
+		sections = append(sections, buildFeaturesString(d.Get("features").([]interface{})))
+	}
+
+	if d.HasChange("graphics") {
+		graphics := d.Get("graphics").([]interface{})
+		sections = append(sections, buildGraphicsString(graphics))
+		if graphicsPasswd(graphics) != "" {
+			// the console password must not show up in the traced calls
+			client = untracedClient(client)
+		}
+	}
+
+	if contextChanged {
+		filesDs := d.Get("files_ds").([]interface{})
+		if err := validateContextFiles(client, filesDs); err != nil {
+			return err
+		}
+
+		// CONTEXT is replaced as a whole, so start from what the VM currently has
+		attributes, err := loadVMInfo(client, intId(d.Id()))
+		if err != nil {
+			return err
+		}
+		context, err := configuredContext(d)
+		if err != nil {
+			return err
+		}
+		removed := make(map[string]interface{})
+		for _, key := range []string{"context", "secret_context"} {
+			old, _ := d.GetChange(key)
+			for k, v := range old.(map[string]interface{}) {
+				removed[k] = v
+			}
+		}
+		oldParams, _ := d.GetChange("appliance_params")
+		for k, v := range oldParams.(map[string]interface{}) {
+			removed[applianceKey(k)] = v
+		}
+		sections = append(sections, buildContextString(
+			vmContext(attributes),
+			context,
+			removed,
+			d.Get("init_scripts").([]interface{}),
+			filesDs,
+		))
+	}
+
+	if len(sections) == 0 {
+		return nil
+	}
+
+	resp, err := client.Call("one.vm.updateconf", intId(d.Id()), joinTemplateSections(sections...))
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Successfully updated the configuration of VM %s, it will be applied on the next power cycle\n", resp)
+
+	return nil
+}
+
+func resourceVmDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceVmRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	client := resourceClient(d, meta)
+	if d.Get("lock").(string) != "" {
+		if err = lockVm(client, intId(d.Id()), ""); err != nil {
+			return err
+		}
+	}
+
+	action := vmDestroyAction(d)
+	target := vmDestroyTargetStates[action]
+	if vmActionState(d.Get("state").(int), d.Get("lcmstate").(int)) == strings.ToUpper(target) {
+		log.Printf("[INFO] VM %s is already in state %s, skipping %s\n", d.Id(), strings.ToUpper(target), action)
+		return nil
+	}
+
+	resp, err := vmAction(client, intId(d.Id()), action, d.Get("state").(int), d.Get("lcmstate").(int))
+	if err != nil {
+		return err
+	}
+
+	_, err = waitForVmState(d, meta, target, d.Timeout(schema.TimeoutDelete))
+	if err != nil {
+		return fmt.Errorf(
+			"Error waiting for virtual machine (%s) to be in state %s: %s", d.Id(), strings.ToUpper(target), err)
+	}
+
+	log.Printf("[INFO] Successfully destroyed VM %s (%s)\n", resp, action)
+	return nil
+}
+
+// lockVm locks the VM at the given level of vmLockLevels, an empty level unlocks it.
+func lockVm(client OneClient, id int, level string) error {
+	if level == "" {
+		if _, err := client.Call("one.vm.unlock", id); err != nil {
+			return fmt.Errorf("Could not unlock VM %d: %s", id, err)
+		}
+		log.Printf("[INFO] Successfully unlocked VM %d\n", id)
+		return nil
+	}
+
+	if _, err := client.Call("one.vm.lock", id, indexOf(vmLockLevels, level)+1); err != nil {
+		return fmt.Errorf("Could not lock VM %d: %s", id, err)
+	}
+	log.Printf("[INFO] Successfully locked VM %d (%s)\n", id, level)
+	return nil
+}
+
+// readVmLock returns the level the VM is locked at, empty if it is not locked.
+func readVmLock(attributes map[string]string) string {
+	level := convertToOptionalInt(attributes["LOCK/LOCKED"], 0)
+	if level < 1 || level > len(vmLockLevels) {
+		return ""
+	}
+
+	return vmLockLevels[level-1]
+}
+
+// Values of destroy_action, in the order of how much of the VM they remove
+var vmDestroyActions = []string{"terminate-hard", "terminate", "undeploy-hard", "undeploy", "stop"}
+
+// States waitForVmState waits for after the destroy actions
+var vmDestroyTargetStates = map[string]string{
+	"terminate-hard": "done",
+	"terminate":      "done",
+	"undeploy-hard":  "undeployed",
+	"undeploy":       "undeployed",
+	"stop":           "stopped",
+}
+
+// vmDestroyAction returns destroy_action, falling back to a terminate action
+// according to hard_shutdown.
+func vmDestroyAction(d *schema.ResourceData) string {
+	if action := d.Get("destroy_action").(string); action != "" {
+		return action
+	}
+	return vmTerminateAction(d.Get("hard_shutdown").(bool))
+}
+
+func vmTerminateAction(hard bool) string {
+	if hard {
+		return "terminate-hard"
+	}
+	return "terminate"
+}
+
+func waitForVmState(d *schema.ResourceData, meta interface{}, state string, timeout time.Duration) (interface{}, error) {
+	client := resourceClient(d, meta)
+
+	log.Printf("Waiting for VM (%s) to be in state Done", d.Id())
+
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"anythingelse"},
+		Target:  []string{state},
+		Refresh: func() (interface{}, string, error) {
+			log.Println("Refreshing VM state...")
+			if d.Id() != "" {
+				attributes, err := loadVMInfo(client, intId(d.Id()))
+				if err == nil {
+					state := attributes[StateAttribute]
+					lcmState := attributes[LcmStateAttribute]
+					log.Printf("VM is currently in state %s and in LCM state %s", state, lcmState)
+					if current := vmWaitState(state, lcmState); current != "anythingelse" {
+						return &attributes, current, nil
+					}
+				} else {
+					return nil, "", fmt.Errorf("Could not find VM by ID %s", d.Id())
+				}
+			}
+			return nil, "anythingelse", nil
+		},
+		Timeout:    vmTimeout(timeout),
+		Delay:      meta.(*Client).pollDelay,
+		MinTimeout: meta.(*Client).pollInterval,
+	}
+
+	return stateConf.WaitForState()
+}
+
+// vmWaitState maps STATE and LCM_STATE to the states waitForVmState waits for.
+func vmWaitState(state string, lcmState string) string {
+	switch {
+	case state == "3" && lcmState == "3":
+		return "running"
+	case state == "2":
+		return "hold"
+	case state == "6":
+		return "done"
+	case state == "8":
+		return "poweroff"
+	case state == "5":
+		return "suspended"
+	case state == "4":
+		return "stopped"
+	case state == "9":
+		return "undeployed"
+	}
+	return "anythingelse"
+}
+
+// waitForHotplug waits for a hotplug operation on the VM to finish. The VM returns
+// from the hotplug LCM state to the state it was in before, which is RUNNING as well
+// as POWEROFF or UNDEPLOYED.
+func waitForHotplug(d *schema.ResourceData, meta interface{}, vm *Vm) error {
+	previous := vmWaitState(strconv.Itoa(vm.State), strconv.Itoa(vm.LcmState))
+	_, err := waitForVmState(d, meta, previous, d.Timeout(schema.TimeoutUpdate))
+	return err
+}
+
+// desiredStateActions returns the actions which bring a VM from its current state
+// (see vmActionState) into the desired one. Powering off and suspending are only
+// possible for a running VM, so a VM in another state is resumed first.
+func desiredStateActions(current string, desired string) []string {
+	if readDesiredState(current, desired) == desired {
+		return nil
+	}
+
+	var actions []string
+	if indexOf(vmActionStates["resume"], current) >= 0 {
+		actions = append(actions, "resume")
+	}
+
+	switch desired {
+	case "poweroff", "poweroff-hard":
+		actions = append(actions, desired)
+	case "suspended":
+		actions = append(actions, "suspend")
+	}
+
+	return actions
+}
+
+// readDesiredState maps the current state (see vmActionState) to a desired_state
+// value. A powered off VM matches both poweroff and poweroff-hard, so the configured
+// one is kept. It returns "" for states desired_state does not cover.
+func readDesiredState(current string, configured string) string {
+	switch current {
+	case "RUNNING":
+		return "running"
+	case "POWEROFF":
+		if configured == "poweroff-hard" {
+			return configured
+		}
+		return "poweroff"
+	case "SUSPENDED":
+		return "suspended"
+	}
+
+	return ""
+}
+
+// applyDesiredState brings the VM into desired_state, waiting for every action to complete.
+func applyDesiredState(d *schema.ResourceData, meta interface{}, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+	id := intId(d.Id())
+
+	attributes, err := loadVMInfo(client, id)
+	if err != nil {
+		return err
+	}
+	state, lcmState := convertToInt(attributes[StateAttribute]), convertToInt(attributes[LcmStateAttribute])
+
+	for _, action := range desiredStateActions(vmActionState(state, lcmState), d.Get("desired_state").(string)) {
+		if _, err = vmAction(client, id, action, state, lcmState); err != nil {
+			return err
+		}
+
+		target := vmActionTargetStates[action]
+		result, err := waitForVmState(d, meta, target, timeout)
+		if err != nil {
+			return fmt.Errorf("Error waiting for virtual machine %d to be in state %s: %s", id, strings.ToUpper(target), err)
+		}
+		attributes = *result.(*map[string]string)
+		state, lcmState = convertToInt(attributes[StateAttribute]), convertToInt(attributes[LcmStateAttribute])
+		log.Printf("[INFO] Successfully performed %s on VM %d", action, id)
+	}
+
+	return nil
+}
+
+// migrateVm moves the VM to host_id unless it already runs there, and waits for it
+// to settle on the new host.
+func migrateVm(d *schema.ResourceData, meta interface{}, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+	id := intId(d.Id())
+	hostId := d.Get("host_id").(int)
+
+	attributes, err := loadVMInfo(client, id)
+	if err != nil {
+		return err
+	}
+	current, _ := readDeployment(attributes)
+	if current == hostId {
+		log.Printf("[INFO] VM %d already runs on host %d", id, hostId)
+		return nil
+	}
+
+	if current == -1 {
+		// a VM without history (HOLD or PENDING) has not been deployed yet, so
+		// there is nothing to migrate and it is deployed to the host instead
+		if err = deployVm(d, meta); err != nil {
+			return err
+		}
+	} else {
+		_, err = client.Call(
+			"one.vm.migrate",
+			id,
+			hostId,
+			d.Get("migrate_live").(bool),
+			d.Get("enforce").(bool),
+			d.Get("migrate_datastore_id").(int),
+		)
+		if err != nil {
+			return fmt.Errorf("Could not migrate VM %d to host %d: %s", id, hostId, err)
+		}
+	}
+
+	if err = waitForVmMigration(client, id, hostId, vmTimeout(timeout), meta.(*Client).pollInterval); err != nil {
+		return fmt.Errorf("Error waiting for virtual machine %d to be migrated to host %d: %s", id, hostId, err)
+	}
+
+	log.Printf("[INFO] Successfully migrated VM %d to host %d", id, hostId)
+	return nil
+}
+
+// waitForVmMigration waits until the last history record of the VM is on hostId and
+// the VM is no longer in a transient state, i.e. RUNNING again for a running VM.
+func waitForVmMigration(client OneClient, id int, hostId int, timeout time.Duration, minTimeout time.Duration) error {
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"migrating"},
+		Target:  []string{"migrated"},
+		Refresh: func() (interface{}, string, error) {
+			attributes, err := loadVMInfo(client, id)
+			if err != nil {
+				return nil, "", err
+			}
+			current, _ := readDeployment(attributes)
+			if current == hostId && vmFailureLcmStates[attributes[LcmStateAttribute]] {
+				return nil, "", fmt.Errorf("VM %d is in the failure LCM state %s", id, attributes[LcmStateAttribute])
+			}
+			if current != hostId || isTransientVmState(attributes[StateAttribute], attributes[LcmStateAttribute]) {
+				log.Printf("VM %d is on host %d in LCM state %s, waiting for the migration", id, current, attributes[LcmStateAttribute])
+				return &attributes, "migrating", nil
+			}
+			return &attributes, "migrated", nil
+		},
+		Timeout:    timeout,
+		MinTimeout: minTimeout,
+	}
+
+	_, err := stateConf.WaitForState()
+	return err
+}
+
+// vmTimeout falls back to the default for a timeout configured as zero.
+func vmTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultVmTimeout
+	}
+	return timeout
+}
+
+// isTransientVmState tells whether an active VM is in the middle of an operation,
+// such as a migration or a snapshot.
+func isTransientVmState(state string, lcmState string) bool {
+	return state == "3" && lcmState != "3" && !vmFailureLcmStates[lcmState]
+}
+
+// waitForVmSettled waits until the VM is no longer in a transient state.
+func waitForVmSettled(client OneClient, id int, timeout time.Duration, minTimeout time.Duration) error {
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"transient"},
+		Target:  []string{"settled"},
+		Refresh: func() (interface{}, string, error) {
+			attributes, err := loadVMInfo(client, id)
+			if err != nil {
+				return nil, "", err
+			}
+			state, lcmState := attributes[StateAttribute], attributes[LcmStateAttribute]
+			if isTransientVmState(state, lcmState) {
+				log.Printf("VM %d is in the transient LCM state %s, waiting for it to settle", id, lcmState)
+				return &attributes, "transient", nil
+			}
+			return &attributes, "settled", nil
+		},
+		Timeout:    timeout,
+		MinTimeout: minTimeout,
+	}
+
+	_, err := stateConf.WaitForState()
+	return err
+}
+
+func waitForAttribute(d *schema.ResourceData, meta interface{}, attributeName string, value string, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+
+	log.Printf("Waiting for VM (%s) to have attribute %s", d.Id(), attributeName)
+
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"attributeNotFound", "attributeMismatch"},
+		Target:     []string{attributeName},
+		Refresh:    vmAttributeRefreshFunc(client, intId(d.Id()), attributeName, value),
+		Timeout:    vmTimeout(timeout),
+		Delay:      meta.(*Client).pollDelay,
+		MinTimeout: meta.(*Client).pollInterval,
+	}
+
+	_, err := stateConf.WaitForState()
+	return err
+}
+
+// vmAttributeRefreshFunc reports whether the VM has the attribute and, unless value
+// is empty, whether the attribute has that value.
+func vmAttributeRefreshFunc(client OneClient, id int, attributeName string, value string) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		log.Println("Refreshing VM info...")
+		attributes, err := loadVMInfo(client, id)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not find VM by ID %d", id)
+		}
+
+		current, present := lookupAttribute(attributes, attributeName)
+		if !present {
+			return nil, "attributeNotFound", nil
+		}
+		if value != "" && current != value {
+			log.Printf("Attribute %s of VM %d is %q, waiting for %q", attributeName, id, current, value)
+			return &attributes, "attributeMismatch", nil
+		}
+
+		return &attributes, attributeName, nil
+	}
+}
+
+// waitForVmReady waits for the guest to report READY = YES through OneGate, which
+// is a better signal for a usable VM than its state. If the VM can not reach OneGate
+// there will never be such a report, so the state waiter's result is kept.
+func waitForVmReady(d *schema.ResourceData, meta interface{}, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+
+	attributes, err := loadVMInfo(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(templateAttr(attributes, "CONTEXT/TOKEN"), "YES") {
+		log.Printf("[WARN] OneGate is not enabled for VM %s, relying on its state only", d.Id())
+		return nil
+	}
+
+	log.Printf("Waiting for VM (%s) to report READY", d.Id())
+
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"notReady"},
+		Target:  []string{"ready"},
+		Refresh: func() (interface{}, string, error) {
+			log.Println("Refreshing VM info...")
+			attributes, err := loadVMInfo(client, intId(d.Id()))
+			if err != nil {
+				return nil, "", fmt.Errorf("Could not find VM by ID %s", d.Id())
+			}
+			if strings.EqualFold(userTemplateAttr(attributes, "READY"), "YES") {
+				return &attributes, "ready", nil
+			}
+			return nil, "notReady", nil
+		},
+		Timeout:    vmTimeout(timeout),
+		Delay:      meta.(*Client).pollDelay,
+		MinTimeout: meta.(*Client).pollInterval,
+	}
+
+	_, err = stateConf.WaitForState()
+	return err
+}
+
+func loadVMInfo(client OneClient, id int) (map[string]string, error) {
+	resp, err := client.Call("one.vm.info", id)
+	if err == nil {
+		return parseResponse([]byte(resp), VmElementName)
+	} else {
+		log.Printf("Could not load VM Info with ID %d due to error: %s", id, err)
+		return nil, err
+	}
+}
+
+// changeVmOwnershipAndPermissions changes the owner before the permissions, as
+// the new permissions may not allow to change the ownership afterwards.
+// A uid or gid of -1 leaves the respective owner untouched, nil permissions are not changed.
+func changeVmOwnershipAndPermissions(client OneClient, id int, uid int, gid int, p *Permissions, recursive bool) error {
+	if uid != -1 || gid != -1 {
+		if _, err := client.Call("one.vm.chown", id, uid, gid); err != nil {
+			return err
+		}
+
+		// make sure the new ownership is in place before touching the permissions
+		attributes, err := loadVMInfo(client, id)
+		if err != nil {
+			return err
+		}
+		if (uid != -1 && attributes["UID"] != strconv.Itoa(uid)) || (gid != -1 && attributes["GID"] != strconv.Itoa(gid)) {
+			return fmt.Errorf("Ownership of VM %d was not changed to %d:%d", id, uid, gid)
+		}
+	}
+
+	if p != nil {
+		// one.vm.chmod has no recursive mode, the images are changed one by one below
+		if _, err := changePermissions(id, p, client, "one.vm.chmod", false); err != nil {
+			return err
+		}
+		if recursive {
+			return changeVmImagePermissions(client, id, p)
+		}
+	}
+
+	return nil
+}
+
+// changeVmImagePermissions applies the permissions to the images used by the disks
+// of the VM. Volatile disks have no image and are skipped.
+func changeVmImagePermissions(client OneClient, id int, p *Permissions) error {
+	attributes, err := loadVMInfo(client, id)
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range subTrees(attributes, "TEMPLATE/DISK") {
+		imageId, ok := disk["IMAGE_ID"]
+		if !ok {
+			continue
+		}
+		if _, err := changePermissions(intId(imageId), p, client, "one.image.chmod", false); err != nil {
+			return fmt.Errorf("Could not change the permissions of image %s of VM %d: %s", imageId, id, err)
+		}
+	}
+
+	return nil
+}
+
+func loadVm(client OneClient, id int) (*Vm, error) {
+	var vm *Vm
+
+	resp, err := client.Call("one.vm.info", id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+func updateUserTemplate(client OneClient, id int, attribute string) error {
+	resp, err := client.Call("one.vm.update", id, attribute, 1)
+	if err == nil {
+		log.Printf("[INFO] Successfully updated user template for VM %s\n", resp)
+		return nil
+	} else {
+		return err
+	}
+}
+
+func synchronizeUserTemplateAttributes(state map[string]interface{}, vmInfo map[string]string, ignored []interface{}) map[string]string {
+	synchronizedAttributes := make(map[string]string)
+
+	for key := range state {
+		if vmReadOnlyUserTemplateAttributes[strings.ToUpper(key)] {
+			continue
+		}
+		// the configured value of an ignored attribute is not applied, so it is kept as is
+		if isIgnoredAttribute(ignored, key) {
+			synchronizedAttributes[key] = state[key].(string)
+			continue
+		}
+		synchronizedAttributes[key] = userTemplateAttr(vmInfo, strings.ToUpper(key))
+	}
+
+	return synchronizedAttributes
+}
+
+// buildUserTemplateAttributesUpdate renders the changed user template attributes to
+// be merged into the user template. Attributes removed from the configuration are
+// cleared, ignored attributes are left alone.
+func buildUserTemplateAttributesUpdate(old map[string]interface{}, new map[string]interface{}, ignored []interface{}) string {
+	attributes := make(map[string]interface{})
+	for key, value := range new {
+		if !isIgnoredAttribute(ignored, key) {
+			attributes[key] = value
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok && !isIgnoredAttribute(ignored, key) && !vmReadOnlyUserTemplateAttributes[strings.ToUpper(key)] {
+			attributes[key] = ""
+		}
+	}
+
+	return buildUserTemplateAttributesString(attributes)
+}
+
+// isIgnoredAttribute tells whether key is one of the ignored attribute names,
+// which are compared case-insensitively like OpenNebula does.
+func isIgnoredAttribute(ignored []interface{}, key string) bool {
+	for _, name := range ignored {
+		if strings.EqualFold(name.(string), key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func buildUserTemplateAttributesString(m map[string]interface{}) string {
+	pairs := make([]string, 0, len(m))
+
+	for key, value := range m {
+		pairs = append(pairs, fmt.Sprintf("%s = \"%s\"", key, escapeTemplateValue(value.(string))))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "\n")
+}
+
+func buildDisksString(disks []interface{}) string {
+	sections := make([]string, 0, len(disks))
+
+	for _, d := range disks {
+		disk := d.(map[string]interface{})
+		attributes := map[string]string{
+			"IMAGE_ID": strconv.Itoa(disk["image_id"].(int)),
+		}
+		if disk["persistent"].(bool) {
+			attributes["PERSISTENT"] = boolToYesNo(true)
+		}
+		if size, _ := disk["size"].(int); size > 0 {
+			attributes["SIZE"] = strconv.Itoa(size)
+		}
+		if target, _ := disk["target"].(string); target != "" {
+			attributes["TARGET"] = target
+		}
+		sections = append(sections, buildVectorAttribute("DISK", attributes))
+	}
+
+	return strings.Join(sections, "\n")
+}
+
+// synchronizeDisks matches the configured disks with the ones attached to the VM
+// by image ID. Disks attached outside of Terraform are added to the end unless
+// ignoreExternal is set, the disks coming from the template are never reported.
+func synchronizeDisks(state []interface{}, vmDisks []*VmDisk, templateDiskIds []interface{}, ignoreExternal bool) []interface{} {
+	synchronized := make([]interface{}, 0, len(state))
+	used := make(map[int]bool)
+
+	for _, s := range state {
+		disk := s.(map[string]interface{})
+		for _, vmDisk := range vmDisks {
+			if used[vmDisk.DiskId] || vmDisk.ImageId != disk["image_id"].(int) {
+				continue
+			}
+			used[vmDisk.DiskId] = true
+			synchronized = append(synchronized, map[string]interface{}{
+				"image_id":           vmDisk.ImageId,
+				"image":              disk["image"],
+				"image_datastore_id": disk["image_datastore_id"],
+				"image_owner":        disk["image_owner"],
+				"persistent":         vmDisk.Persistent == "YES",
+				"disk_id":            vmDisk.DiskId,
+				"size":               vmDisk.Size,
+				"target":             vmDisk.Target,
+			})
+			break
+		}
+	}
+
+	if ignoreExternal {
+		return synchronized
+	}
+
+	for _, id := range templateDiskIds {
+		used[id.(int)] = true
+	}
+	for _, vmDisk := range vmDisks {
+		if used[vmDisk.DiskId] {
+			continue
+		}
+		synchronized = append(synchronized, map[string]interface{}{
+			"image_id":           vmDisk.ImageId,
+			"image":              "",
+			"image_datastore_id": -1,
+			"image_owner":        "",
+			"persistent":         vmDisk.Persistent == "YES",
+			"disk_id":            vmDisk.DiskId,
+			"size":               vmDisk.Size,
+			"target":             vmDisk.Target,
+		})
+	}
+
+	return synchronized
+}
+
+func buildNicsString(nics []interface{}, defaultSecurityGroups []interface{}) string {
+	sections := make([]string, 0, len(nics))
+
+	for _, n := range nics {
+		nic := n.(map[string]interface{})
+		attributes := buildQosAttributes(nic)
+		attributes["NETWORK_ID"] = strconv.Itoa(nic["network_id"].(int))
+		if groups := nicSecurityGroups(defaultSecurityGroups, nic); len(groups) > 0 {
+			attributes["SECURITY_GROUPS"] = joinInts(groups)
+		}
+		if ip := nic["ip"].(string); ip != "" {
+			attributes["IP"] = ip
+		}
+		if mac := nic["mac"].(string); mac != "" {
+			attributes["MAC"] = mac
+		}
+		for key, value := range buildNicModelAttributes(nic) {
+			attributes[key] = value
+		}
+		sections = append(sections, buildVectorAttribute("NIC", attributes))
+	}
+
+	return strings.Join(sections, "\n")
+}
+
+// synchronizeNics matches the configured NICs with the ones of the VM by network,
+// like synchronizeDisks does. Traffic shaping values are kept as configured.
+func synchronizeNics(state []interface{}, vmNics []*VmNic, templateNicIds []interface{}, ignoreExternal bool) []interface{} {
+	synchronized := make([]interface{}, 0, len(state))
+	used := make(map[int]bool)
+
+	for _, s := range state {
+		nic := s.(map[string]interface{})
+		for _, vmNic := range vmNics {
+			if used[vmNic.NicId] || vmNic.NetworkId != nic["network_id"].(int) {
+				continue
+			}
+			used[vmNic.NicId] = true
+			synchronizedNic := map[string]interface{}{
+				"network_id":                vmNic.NetworkId,
+				"ip":                        vmNic.Ip,
+				"mac":                       vmNic.Mac,
+				"nic_id":                    vmNic.NicId,
+				"ar_id":                     vmNic.ArId,
+				"security_groups":           nic["security_groups"],
+				"effective_security_groups": splitInts(vmNic.SecurityGroups),
+			}
+			for key := range qosAttributes {
+				synchronizedNic[key] = nic[key]
+			}
+			// a model or filter set through nic_default shows up on every NIC
+			synchronizedNic["model"] = nic["model"]
+			synchronizedNic["filter"] = nic["filter"]
+			synchronized = append(synchronized, synchronizedNic)
+			break
+		}
+	}
+
+	if ignoreExternal {
+		return synchronized
+	}
+
+	for _, id := range templateNicIds {
+		used[id.(int)] = true
+	}
+	for _, vmNic := range vmNics {
+		if used[vmNic.NicId] {
+			continue
+		}
+		externalNic := map[string]interface{}{
+			"network_id":                vmNic.NetworkId,
+			"ip":                        vmNic.Ip,
+			"mac":                       vmNic.Mac,
+			"nic_id":                    vmNic.NicId,
+			"ar_id":                     vmNic.ArId,
+			"model":                     "",
+			"filter":                    "",
+			"security_groups":           []interface{}{},
+			"effective_security_groups": splitInts(vmNic.SecurityGroups),
+		}
+		for key := range qosAttributes {
+			externalNic[key] = 0
+		}
+		synchronized = append(synchronized, externalNic)
+	}
+
+	return synchronized
+}
+
+func resourceVmCustomizeDiff(diff *schema.ResourceDiff, meta interface{}) error {
+	if err := validateDiskImageReferences(diff); err != nil {
+		return err
+	}
+
+	if diff.Id() != "" && diff.HasChange("on_hold") && diff.Get("on_hold").(bool) {
+		return fmt.Errorf("VM %s has already been deployed and can not be put on hold again", diff.Id())
+	}
+
+	if !diff.HasChange("nic") || diff.Get("nic_ip_change").(string) != "recreate" {
+		return nil
+	}
+
+	old, new := diff.GetChange("nic")
+	if len(changedNicAddresses(old.([]interface{}), new.([]interface{}))) > 0 {
+		return diff.ForceNew("nic")
+	}
+
+	return nil
+}
+
+// validateDiskImageReferences checks that every disk references its image either by
+// image_id or by image. image_id is computed for disks referencing their image by name,
+// so it is only set when planning if it is configured, or if the disk is attached
+// already and keeps the image_id resolved from its name.
+func validateDiskImageReferences(diff *schema.ResourceDiff) error {
+	old, new := diff.GetChange("disk")
+	oldDisks := old.([]interface{})
+
+	for i, d := range new.([]interface{}) {
+		disk := d.(map[string]interface{})
+		name := disk["image"].(string)
+		_, idSet := diff.GetOkExists(fmt.Sprintf("disk.%d.image_id", i))
+
+		if name == "" && !idSet {
+			return fmt.Errorf("Disk %d requires either image_id or image", i)
+		}
+		if name == "" || !idSet {
+			continue
+		}
+		if i < len(oldDisks) && oldDisks[i].(map[string]interface{})["image_id"] == disk["image_id"] {
+			continue
+		}
+		return fmt.Errorf("Disk %d can only set one of image_id and image", i)
+	}
+
+	return nil
+}
+
+// changedNicAddresses returns the NICs which request a different IP, as the index of
+// each configured NIC mapped to the index of the NIC in the state it replaces. These are
+// the configured NICs matchNics leaves without a match which only differ in their
+// addresses from one of the remaining NICs, preferably the one at their position.
+func changedNicAddresses(old []interface{}, new []interface{}) map[int]int {
+	matches := matchNics(old, new)
+	used := make(map[int]bool)
+	for _, j := range matches {
+		used[j] = true
+	}
+
+	changed := make(map[int]int)
+	for i, n := range new {
+		if _, matched := matches[i]; matched {
+			continue
+		}
+		nic := configuredNic(old, i, n.(map[string]interface{}))
+		ip := nic["ip"].(string)
+		if ip == "" {
+			continue
+		}
+		nic["ip"], nic["mac"] = "", ""
+
+		candidates := make([]int, 0, len(old)+1)
+		if i < len(old) {
+			candidates = append(candidates, i)
+		}
+		for j := range old {
+			candidates = append(candidates, j)
+		}
+		for _, j := range candidates {
+			oldNic := old[j].(map[string]interface{})
+			if !used[j] && oldNic["ip"] != ip && sameNic(oldNic, nic) {
+				changed[i] = j
+				used[j] = true
+				break
+			}
+		}
+	}
+
+	return changed
+}
+
+// sameNic tells whether a NIC of the VM matches the configured NIC. The IP and
+// MAC are only compared if they are configured, security groups are reconciled
+// on their own.
+func sameNic(vmNic map[string]interface{}, nic map[string]interface{}) bool {
+	if vmNic["network_id"] != nic["network_id"] || vmNic["model"] != nic["model"] || vmNic["filter"] != nic["filter"] {
+		return false
+	}
+	for _, key := range []string{"ip", "mac"} {
+		if v, _ := nic[key].(string); v != "" && v != vmNic[key] {
+			return false
+		}
+	}
+	for key := range qosAttributes {
+		if vmNic[key] != nic[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchNics returns the index of the NIC in the state, and thus the nic_id, matching
+// each configured NIC. Terraform hands the nic_id of a NIC in the state on to the
+// configured NIC at the same position, so it can't be relied on: a NIC is matched with
+// the NIC at its position if it is unchanged, otherwise with any other unchanged one.
+// Removing a NIC thus leaves the NICs after it attached.
+func matchNics(old []interface{}, new []interface{}) map[int]int {
+	matches := make(map[int]int)
+	used := make(map[int]bool)
+
+	for i := 0; i < len(new) && i < len(old); i++ {
+		if sameNic(old[i].(map[string]interface{}), configuredNic(old, i, new[i].(map[string]interface{}))) {
+			matches[i] = i
+			used[i] = true
+		}
+	}
+
+	for i, n := range new {
+		if _, matched := matches[i]; matched {
+			continue
+		}
+		nic := configuredNic(old, i, n.(map[string]interface{}))
+		for j, o := range old {
+			if !used[j] && sameNic(o.(map[string]interface{}), nic) {
+				matches[i] = j
+				used[j] = true
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// configuredNic returns the configured NIC at position i. Terraform fills the ip, mac
+// and nic_id left out of the configuration in from the NIC at the same position of
+// the state, so the addresses are only kept if they differ from it.
+func configuredNic(old []interface{}, i int, nic map[string]interface{}) map[string]interface{} {
+	configured := make(map[string]interface{}, len(nic))
+	for key, value := range nic {
+		configured[key] = value
+	}
+	if i >= len(old) {
+		return configured
+	}
+
+	previous := old[i].(map[string]interface{})
+	for _, key := range []string{"ip", "mac"} {
+		if configured[key] == previous[key] {
+			configured[key] = ""
+		}
+	}
+
+	return configured
+}
+
+// reconcileNics hot-attaches and detaches NICs, see matchNics. NICs left without a
+// match are detached before the new ones are attached, except for IP changes with
+// nic_ip_change = "swap": then the NIC with the new IP is attached first, so the VM
+// stays connected to the network.
+func reconcileNics(d *schema.ResourceData, meta interface{}) error {
+	client := resourceClient(d, meta)
+	old, new := d.GetChange("nic")
+	oldNics := old.([]interface{})
+	newNics := new.([]interface{})
+	defaultSecurityGroups := d.Get("default_security_groups").([]interface{})
+
+	matches := matchNics(oldNics, newNics)
+	used := make(map[int]bool)
+	for _, j := range matches {
+		used[j] = true
+	}
+
+	vm, err := loadVm(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	present := make(map[int]bool)
+	for _, nic := range vm.Nics {
+		present[nic.NicId] = true
+	}
+
+	attach := func(nic map[string]interface{}) error {
+		if _, err := client.Call("one.vm.attachnic", intId(d.Id()), buildNicsString([]interface{}{nic}, defaultSecurityGroups)); err != nil {
+			return fmt.Errorf("Could not attach a NIC to network %d: %s", nic["network_id"], err)
+		}
+		if err := waitForHotplug(d, meta, vm); err != nil {
+			return fmt.Errorf("Error waiting for the NIC of network %d to be attached to virtual machine %s: %s", nic["network_id"], d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully attached a NIC of network %d to VM %s\n", nic["network_id"], d.Id())
+		return nil
+	}
+	detach := func(nic map[string]interface{}) error {
+		nicId := nic["nic_id"].(int)
+		if !present[nicId] {
+			log.Printf("[INFO] NIC %d of VM %s is already gone\n", nicId, d.Id())
+			return nil
+		}
+		if _, err := client.Call("one.vm.detachnic", intId(d.Id()), nicId); err != nil {
+			return fmt.Errorf("Could not detach NIC %d: %s", nicId, err)
+		}
+		if err := waitForHotplug(d, meta, vm); err != nil {
+			return fmt.Errorf("Error waiting for NIC %d to be detached from virtual machine %s: %s", nicId, d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully detached NIC %d from VM %s\n", nicId, d.Id())
+		return nil
+	}
+
+	swapped := make(map[int]bool)
+	replaced := make(map[int]bool)
+	if d.Get("nic_ip_change").(string) == "swap" {
+		changed := changedNicAddresses(oldNics, newNics)
+		indexes := make([]int, 0, len(changed))
+		for i := range changed {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+		for _, i := range indexes {
+			oldNic := oldNics[changed[i]].(map[string]interface{})
+			newNic := configuredNic(oldNics, i, newNics[i].(map[string]interface{}))
+			// the MAC still belongs to the old NIC, let OpenNebula pick a new one
+			newNic["mac"] = ""
+			if err := attach(newNic); err != nil {
+				return err
+			}
+			if err := detach(oldNic); err != nil {
+				return err
+			}
+			swapped[i] = true
+			replaced[changed[i]] = true
+			log.Printf("[INFO] Successfully moved NIC %d of VM %s from %s to %s\n", oldNic["nic_id"], d.Id(), oldNic["ip"], newNic["ip"])
+		}
+	}
+
+	for j, o := range oldNics {
+		if used[j] || replaced[j] {
+			continue
+		}
+		if err := detach(o.(map[string]interface{})); err != nil {
+			return err
+		}
+	}
+
+	for i, n := range newNics {
+		if _, matched := matches[i]; matched || swapped[i] {
+			continue
+		}
+		if err := attach(configuredNic(oldNics, i, n.(map[string]interface{}))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nicSecurityGroups returns the security groups a NIC should have: the defaults
+// plus its own ones.
+func nicSecurityGroups(defaults []interface{}, nic map[string]interface{}) []int {
+	groups := make(map[int]bool)
+	for _, id := range defaults {
+		groups[id.(int)] = true
+	}
+	own, _ := nic["security_groups"].([]interface{})
+	for _, id := range own {
+		groups[id.(int)] = true
+	}
+
+	ids := make([]int, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// securityGroupChanges compares the security groups a NIC should have with the ones
+// it has. Only groups which were requested before are detached, so the groups
+// OpenNebula adds on its own (e.g. the default group 0) are left alone.
+func securityGroupChanges(oldDesired []int, newDesired []int, effective []int) ([]int, []int) {
+	var attach, detach []int
+
+	wanted := make(map[int]bool)
+	for _, id := range newDesired {
+		wanted[id] = true
+	}
+	present := make(map[int]bool)
+	for _, id := range effective {
+		present[id] = true
+	}
+
+	for _, id := range newDesired {
+		if !present[id] {
+			attach = append(attach, id)
+		}
+	}
+	for _, id := range oldDesired {
+		if !wanted[id] && present[id] {
+			detach = append(detach, id)
+		}
+	}
+
+	return attach, detach
+}
+
+// reconcileSecurityGroups attaches and detaches security groups so that every NIC
+// has the default groups plus its own ones.
+func reconcileSecurityGroups(d *schema.ResourceData, meta interface{}) error {
+	client := resourceClient(d, meta)
+	oldDefaults, newDefaults := d.GetChange("default_security_groups")
+	oldNics, newNics := d.GetChange("nic")
+
+	vm, err := loadVm(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	oldByNicId := make(map[int]map[string]interface{})
+	for _, n := range oldNics.([]interface{}) {
+		nic := n.(map[string]interface{})
+		oldByNicId[nic["nic_id"].(int)] = nic
+	}
+
+	for _, n := range synchronizeNics(newNics.([]interface{}), vm.Nics, nil, true) {
+		nic := n.(map[string]interface{})
+		nicId := nic["nic_id"].(int)
+
+		var oldDesired []int
+		if oldNic, ok := oldByNicId[nicId]; ok {
+			oldDesired = nicSecurityGroups(oldDefaults.([]interface{}), oldNic)
+		}
+		attach, detach := securityGroupChanges(oldDesired, nicSecurityGroups(newDefaults.([]interface{}), nic), nic["effective_security_groups"].([]int))
+
+		for _, sg := range attach {
+			if _, err := client.Call("one.vm.attachsg", intId(d.Id()), nicId, sg); err != nil {
+				return fmt.Errorf("Could not attach security group %d to NIC %d: %s", sg, nicId, err)
+			}
+			log.Printf("[INFO] Successfully attached security group %d to NIC %d of VM %s\n", sg, nicId, d.Id())
+		}
+		for _, sg := range detach {
+			if _, err := client.Call("one.vm.detachsg", intId(d.Id()), nicId, sg); err != nil {
+				return fmt.Errorf("Could not detach security group %d from NIC %d: %s", sg, nicId, err)
+			}
+			log.Printf("[INFO] Successfully detached security group %d from NIC %d of VM %s\n", sg, nicId, d.Id())
+		}
+	}
+
+	return nil
+}
+
+func joinInts(values []int) string {
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		s = append(s, strconv.Itoa(v))
+	}
+	return strings.Join(s, ",")
+}
+
+// splitInts parses a comma separated list of IDs as OpenNebula reports them.
+func splitInts(values string) []int {
+	ints := []int{}
+	for _, v := range strings.Split(values, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			ints = append(ints, n)
+		}
+	}
+	return ints
+}
+
+// recordTemplateDevices remembers the disks and NICs a new VM got from its template,
+// so that they are not taken for devices attached outside of Terraform later on. For
+// a VM which is not new, every device not in the configuration counts as such.
+func recordTemplateDevices(d *schema.ResourceData, vm *Vm) {
+	managed := make(map[int]bool)
+	for _, disk := range synchronizeDisks(d.Get("disk").([]interface{}), vm.Disks, nil, true) {
+		managed[disk.(map[string]interface{})["disk_id"].(int)] = true
+	}
+	templateDiskIds := []interface{}{}
+	for _, disk := range vm.Disks {
+		if !managed[disk.DiskId] {
+			templateDiskIds = append(templateDiskIds, disk.DiskId)
+		}
+	}
+	d.Set("template_disk_ids", templateDiskIds)
+
+	managed = make(map[int]bool)
+	for _, nic := range synchronizeNics(d.Get("nic").([]interface{}), vm.Nics, nil, true) {
+		managed[nic.(map[string]interface{})["nic_id"].(int)] = true
+	}
+	templateNicIds := []interface{}{}
+	for _, nic := range vm.Nics {
+		if !managed[nic.NicId] {
+			templateNicIds = append(templateNicIds, nic.NicId)
+		}
+	}
+	d.Set("template_nic_ids", templateNicIds)
+}
+
+func buildNicModelAttributes(nic map[string]interface{}) map[string]string {
+	attributes := make(map[string]string)
+	if model, ok := nic["model"].(string); ok && model != "" {
+		attributes["MODEL"] = model
+	}
+	if filter, ok := nic["filter"].(string); ok && filter != "" {
+		attributes["FILTER"] = filter
+	}
+
+	return attributes
+}
+
+func buildNicDefaultString(nicDefault []interface{}) string {
+	if len(nicDefault) == 0 || nicDefault[0] == nil {
+		return ""
+	}
+
+	return buildVectorAttribute("NIC_DEFAULT", buildNicModelAttributes(nicDefault[0].(map[string]interface{})))
+}
+
+func readNicDefault(attributes map[string]string) []interface{} {
+	nicDefault := subTree(attributes, TemplateElementName+PathSeparator+"NIC_DEFAULT")
+	if len(nicDefault) == 0 {
+		return []interface{}{}
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"model":  nicDefault["MODEL"],
+			"filter": nicDefault["FILTER"],
+		},
+	}
+}
+
+// validateVmReferences checks that the template, images and networks used by the VM
+// exist and are accessible, before the instantiation fails with a less helpful error.
+// The check is best effort: errors other than a missing object are only logged.
+func validateVmReferences(client OneClient, templateId int, disks []interface{}, nics []interface{}) error {
+	check := func(kind string, method string, id int) error {
+		_, err := client.Call(method, id, false)
+		if err == nil {
+			return nil
+		}
+		if isNotFoundError(err) || strings.Contains(err.Error(), "Not authorized") {
+			return fmt.Errorf("%s %d does not exist or is not accessible: %s", kind, id, err)
+		}
+		log.Printf("[WARN] Could not check %s %d: %s", strings.ToLower(kind), id, err)
+		return nil
+	}
+
+	if err := check("Template", "one.template.info", templateId); err != nil {
+		return err
+	}
+	for _, d := range disks {
+		if err := check("Image", "one.image.info", d.(map[string]interface{})["image_id"].(int)); err != nil {
+			return err
+		}
+	}
+	for _, n := range nics {
+		if err := check("Virtual network", "one.vn.info", n.(map[string]interface{})["network_id"].(int)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveDiskImages sets the image ID of the disks which reference their image by
+// name. The image pool is read once for all disks. A name has to identify a single
+// image among all images the user has access to, optionally restricted to a
+// datastore (-1 for any) and owner.
+func resolveDiskImages(client OneClient, disks []interface{}) ([]interface{}, error) {
+	resolved := make([]interface{}, 0, len(disks))
+	predicates := make(map[int]func(map[string]string) bool)
+
+	for i, d := range disks {
+		disk := make(map[string]interface{})
+		for key, value := range d.(map[string]interface{}) {
+			disk[key] = value
+		}
+
+		if name, _ := disk["image"].(string); name != "" {
+			datastoreId, _ := disk["image_datastore_id"].(int)
+			owner, _ := disk["image_owner"].(string)
+			predicates[i] = imageMatches(name, datastoreId, owner)
+		}
+
+		resolved = append(resolved, disk)
+	}
+	if len(predicates) == 0 {
+		return resolved, nil
+	}
+
+	// like findInPool, the search stops once every name is known to be ambiguous
+	matches := make(map[int][]map[string]string)
+	err := callPool(client, "one.imagepool.info", "IMAGE", []interface{}{-2, -1, -1}, func(attributes map[string]string) bool {
+		done := true
+		for i, predicate := range predicates {
+			if len(matches[i]) < 2 && predicate(attributes) {
+				matches[i] = append(matches[i], attributes)
+			}
+			done = done && len(matches[i]) == 2
+		}
+		return !done
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resolved {
+		if predicates[i] == nil {
+			continue
+		}
+		disk := resolved[i].(map[string]interface{})
+		name := disk["image"].(string)
+		switch len(matches[i]) {
+		case 0:
+			return nil, fmt.Errorf("Could not find image %q", name)
+		case 1:
+			id, err := strconv.Atoi(matches[i][0]["ID"])
+			if err != nil {
+				return nil, err
+			}
+			disk["image_id"] = id
+		default:
+			err := &ambiguousInPoolError{element: "IMAGE", matches: matches[i]}
+			return nil, fmt.Errorf("Image name %q: %s. Set image_datastore_id or image_owner, or use image_id", name, err)
+		}
+	}
+
+	return resolved, nil
+}
+
+// imageMatches matches images by name, optionally only in a datastore or of an owner.
+func imageMatches(name string, datastoreId int, owner string) func(map[string]string) bool {
+	return func(attributes map[string]string) bool {
+		return attributes["NAME"] == name &&
+			(datastoreId == -1 || attributes["DATASTORE_ID"] == strconv.Itoa(datastoreId)) &&
+			(owner == "" || attributes["UNAME"] == owner)
+	}
+}
+
+// diskChanges matches the configured disks with the disks in the state by image. A
+// disk keeps its match if it still references the same image at the same position,
+// so that removing a disk leaves the others attached. Matched disks are grown to a
+// bigger configured size. Disks whose persistence or target changed are attached
+// again, OpenNebula can't change these on an attached disk.
+func diskChanges(old []interface{}, new []interface{}) ([]interface{}, []int, map[int]int, error) {
+	var attach []interface{}
+	var detach []int
+	resize := make(map[int]int)
+
+	matches := matchDisks(old, new)
+	used := make(map[int]bool)
+	for i, n := range new {
+		newDisk := configuredDisk(old, i, n.(map[string]interface{}))
+		j, matched := matches[i]
+		if !matched {
+			attach = append(attach, newDisk)
+			continue
+		}
+		used[j] = true
+
+		oldDisk := old[j].(map[string]interface{})
+		diskId := oldDisk["disk_id"].(int)
+		if newDisk["persistent"] != oldDisk["persistent"] || (newDisk["target"] != "" && newDisk["target"] != oldDisk["target"]) {
+			detach = append(detach, diskId)
+			attach = append(attach, newDisk)
+			continue
+		}
+
+		size, oldSize := newDisk["size"].(int), oldDisk["size"].(int)
+		if size > 0 && size < oldSize {
+			return nil, nil, nil, fmt.Errorf("Disk %d with image %d can't be shrunk from %d MB to %d MB", diskId, newDisk["image_id"], oldSize, size)
+		}
+		if size > oldSize {
+			resize[diskId] = size
+		}
+	}
+
+	for j, o := range old {
+		if !used[j] {
+			detach = append(detach, o.(map[string]interface{})["disk_id"].(int))
+		}
+	}
+
+	return attach, detach, resize, nil
+}
+
+// matchDisks returns the index of the disk in the state matching each configured
+// disk. Disks still referencing the same image at their position are matched first,
+// then the remaining ones by image.
+func matchDisks(old []interface{}, new []interface{}) map[int]int {
+	matches := make(map[int]int)
+	used := make(map[int]bool)
+
+	for i := 0; i < len(new) && i < len(old); i++ {
+		if new[i].(map[string]interface{})["image_id"] == old[i].(map[string]interface{})["image_id"] {
+			matches[i] = i
+			used[i] = true
+		}
+	}
+
+	for i, n := range new {
+		if _, matched := matches[i]; matched {
+			continue
+		}
+		for j, o := range old {
+			if !used[j] && n.(map[string]interface{})["image_id"] == o.(map[string]interface{})["image_id"] {
+				matches[i] = j
+				used[j] = true
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// configuredDisk returns the configured disk at position i. Terraform fills the size
+// and target left out of the configuration in from the disk at the same position of
+// the state, so they are only kept if they differ from it.
+func configuredDisk(old []interface{}, i int, disk map[string]interface{}) map[string]interface{} {
+	configured := make(map[string]interface{}, len(disk))
+	for key, value := range disk {
+		configured[key] = value
+	}
+	if i >= len(old) {
+		return configured
+	}
+
+	previous := old[i].(map[string]interface{})
+	if configured["size"] == previous["size"] {
+		configured["size"] = 0
+	}
+	if configured["target"] == previous["target"] {
+		configured["target"] = ""
+	}
+
+	return configured
+}
+
+// reconcileDisks hot-attaches, resizes and detaches disks. OpenNebula handles one
+// hotplug operation at a time, so each one is waited for.
+func reconcileDisks(d *schema.ResourceData, meta interface{}) error {
+	client := resourceClient(d, meta)
+	old, _ := d.GetChange("disk")
+
+	disks, err := resolveDiskImages(client, d.Get("disk").([]interface{}))
+	if err != nil {
+		return err
+	}
+	if err = validatePersistentDisks(client, disks); err != nil {
+		return err
+	}
+
+	attach, detach, resize, err := diskChanges(old.([]interface{}), disks)
+	if err != nil {
+		return err
+	}
+
+	vm, err := loadVm(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	present := make(map[int]bool)
+	for _, disk := range vm.Disks {
+		present[disk.DiskId] = true
+	}
+
+	for _, diskId := range detach {
+		if !present[diskId] {
+			log.Printf("[INFO] Disk %d of VM %s is already gone\n", diskId, d.Id())
+			continue
+		}
+		if _, err = client.Call("one.vm.detach", intId(d.Id()), diskId); err != nil {
+			return fmt.Errorf("Could not detach disk %d: %s", diskId, err)
+		}
+		if err = waitForHotplug(d, meta, vm); err != nil {
+			return fmt.Errorf("Error waiting for disk %d to be detached from virtual machine %s: %s", diskId, d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully detached disk %d from VM %s\n", diskId, d.Id())
+	}
+
+	diskIds := make([]int, 0, len(resize))
+	for diskId := range resize {
+		diskIds = append(diskIds, diskId)
+	}
+	sort.Ints(diskIds)
+	for _, diskId := range diskIds {
+		if _, err = client.Call("one.vm.diskresize", intId(d.Id()), diskId, strconv.Itoa(resize[diskId])); err != nil {
+			return fmt.Errorf("Could not resize disk %d: %s", diskId, err)
+		}
+		if err = waitForHotplug(d, meta, vm); err != nil {
+			return fmt.Errorf("Error waiting for disk %d of virtual machine %s to be resized: %s", diskId, d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully resized disk %d of VM %s to %d MB\n", diskId, d.Id(), resize[diskId])
+	}
+
+	for _, disk := range attach {
+		if _, err = client.Call("one.vm.attach", intId(d.Id()), buildDisksString([]interface{}{disk})); err != nil {
+			return fmt.Errorf("Could not attach image %d: %s", disk.(map[string]interface{})["image_id"], err)
+		}
+		if err = waitForHotplug(d, meta, vm); err != nil {
+			return fmt.Errorf("Error waiting for image %d to be attached to virtual machine %s: %s", disk.(map[string]interface{})["image_id"], d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully attached image %d to VM %s\n", disk.(map[string]interface{})["image_id"], d.Id())
+	}
+
+	d.Set("disk", disks)
+	return nil
+}
+
+// readAttachedDisks reads every disk of the VM, unlike synchronizeDisks which only
+// reports the disks managed through `disk`.
+func readAttachedDisks(vmDisks []*VmDisk) []interface{} {
+	disks := make([]interface{}, 0, len(vmDisks))
+	for _, disk := range vmDisks {
+		disks = append(disks, map[string]interface{}{
+			"disk_id":  disk.DiskId,
+			"image_id": disk.ImageId,
+			"size":     disk.Size,
+			"target":   disk.Target,
+		})
+	}
+
+	return disks
+}
+
+func validatePersistentDisks(client OneClient, disks []interface{}) error {
+	for _, d := range disks {
+		disk := d.(map[string]interface{})
+		if !disk["persistent"].(bool) {
+			continue
+		}
+		if err := checkImageManageable(client, disk["image_id"].(int)); err != nil {
+			return fmt.Errorf("Disk with image %d can not be made persistent: %s", disk["image_id"].(int), err)
+		}
+	}
+
+	return nil
+}
+
+func buildFeaturesString(features []interface{}) string {
+	if len(features) == 0 || features[0] == nil {
+		return ""
+	}
+
+	feature := features[0].(map[string]interface{})
+	attributes := make(map[string]string)
+	for key, name := range vmFeatures {
+		attributes[name] = strings.ToLower(boolToYesNo(feature[key].(bool)))
+	}
+
+	return buildVectorAttribute("FEATURES", attributes)
+}
+
+func readFeatures(attributes map[string]string) []interface{} {
+	feature := make(map[string]interface{})
+	for key, name := range vmFeatures {
+		if value, present := lookupTemplateAttr(attributes, "FEATURES/"+name); present {
+			feature[key] = strings.EqualFold(value, "yes")
+		}
+	}
+
+	if len(feature) == 0 {
+		return []interface{}{}
+	}
+
+	return []interface{}{feature}
+}
+
+func buildTopologyString(topology []interface{}) string {
+	if len(topology) == 0 || topology[0] == nil {
+		return ""
+	}
+
+	t := topology[0].(map[string]interface{})
+	attributes := make(map[string]string)
+	for key, name := range vmTopologyCount {
+		if v := t[key].(int); v > 0 {
+			attributes[name] = strconv.Itoa(v)
+		}
+	}
+	if pinPolicy := t["pin_policy"].(string); pinPolicy != "" {
+		attributes["PIN_POLICY"] = pinPolicy
+	}
+	if memoryAccess := t["memory_access"].(string); memoryAccess != "" {
+		attributes["MEMORY_ACCESS"] = memoryAccess
+	}
+
+	return buildVectorAttribute("TOPOLOGY", attributes)
+}
+
+func readTopology(attributes map[string]string) []interface{} {
+	values := subTree(attributes, TemplateElementName+PathSeparator+"TOPOLOGY")
+	if len(values) == 0 {
+		return []interface{}{}
+	}
+
+	topology := map[string]interface{}{
+		"pin_policy":    values["PIN_POLICY"],
+		"memory_access": values["MEMORY_ACCESS"],
+	}
+	for key, name := range vmTopologyCount {
+		// OpenNebula fills in the counts it derived itself, they are 0 if missing
+		count, _ := strconv.Atoi(values[name])
+		topology[key] = count
+	}
+
+	return []interface{}{topology}
+}
+
+// vmVcpu returns the virtual CPUs of the VM: the configured vcpu, which overrides the
+// template, or else the VCPU of the template.
+func vmVcpu(client OneClient, d *schema.ResourceData) (string, error) {
+	if vcpu, ok := d.GetOk("vcpu"); ok {
+		return strconv.Itoa(vcpu.(int)), nil
+	}
+
+	attributes, err := loadTemplateInfo(client, d.Get("template_id").(int))
+	if err != nil {
+		return "", err
+	}
+	return templateAttr(attributes, "VCPU"), nil
+}
+
+// validateTopology checks that the topology provides exactly the virtual CPUs of the VM.
+// Counts which are not set, as well as an unknown number of virtual CPUs, are not checked.
+func validateTopology(topology []interface{}, vcpu string) error {
+	if len(topology) == 0 || topology[0] == nil || vcpu == "" {
+		return nil
+	}
+
+	t := topology[0].(map[string]interface{})
+	sockets, cores, threads := t["sockets"].(int), t["cores"].(int), t["threads"].(int)
+	if sockets == 0 || cores == 0 || threads == 0 {
+		return nil
+	}
+
+	vcpus, err := strconv.Atoi(vcpu)
+	if err != nil {
+		return fmt.Errorf("Unexpected VCPU %q in the template: %s", vcpu, err)
+	}
+	if sockets*cores*threads != vcpus {
+		return fmt.Errorf("The topology provides %d virtual CPUs (%d sockets * %d cores * %d threads), but the VM has VCPU = %d", sockets*cores*threads, sockets, cores, threads, vcpus)
+	}
+
+	return nil
+}
+
+func buildGraphicsString(graphics []interface{}) string {
+	if len(graphics) == 0 || graphics[0] == nil {
+		return ""
+	}
+
+	g := graphics[0].(map[string]interface{})
+	attributes := map[string]string{
+		"TYPE": g["type"].(string),
+	}
+	if listen := g["listen"].(string); listen != "" {
+		attributes["LISTEN"] = listen
+	}
+	if port := g["port"].(int); port > 0 {
+		attributes["PORT"] = strconv.Itoa(port)
+	}
+	if keymap := g["keymap"].(string); keymap != "" {
+		attributes["KEYMAP"] = keymap
+	}
+	if passwd, _ := g["passwd"].(string); passwd != "" {
+		attributes["PASSWD"] = passwd
+	}
+
+	return buildVectorAttribute("GRAPHICS", attributes)
+}
+
+// readGraphics reads the console settings. The password is kept as configured, only
+// whether OpenNebula has one is read.
+func readGraphics(attributes map[string]string, passwd string) []interface{} {
+	graphicsType, present := lookupTemplateAttr(attributes, "GRAPHICS/TYPE")
+	if !present {
+		return []interface{}{}
+	}
+
+	port, _ := strconv.Atoi(templateAttr(attributes, "GRAPHICS/PORT"))
+	return []interface{}{
+		map[string]interface{}{
+			"type":       strings.ToUpper(graphicsType),
+			"listen":     templateAttr(attributes, "GRAPHICS/LISTEN"),
+			"port":       port,
+			"keymap":     templateAttr(attributes, "GRAPHICS/KEYMAP"),
+			"passwd":     passwd,
+			"passwd_set": templateAttr(attributes, "GRAPHICS/PASSWD") != "",
+		},
+	}
+}
+
+// graphicsPasswd returns the configured console password.
+func graphicsPasswd(graphics []interface{}) string {
+	if len(graphics) == 0 || graphics[0] == nil {
+		return ""
+	}
+
+	passwd, _ := graphics[0].(map[string]interface{})["passwd"].(string)
+	return passwd
+}
+
+func buildOsString(vmOs []interface{}) string {
+	if len(vmOs) == 0 || vmOs[0] == nil {
+		return ""
+	}
+
+	o := vmOs[0].(map[string]interface{})
+	attributes := make(map[string]string)
+	if firmware := o["firmware"].(string); firmware != "" {
+		attributes["FIRMWARE"] = firmware
+	}
+	if o["secure_boot"].(bool) {
+		attributes["FIRMWARE_SECURE"] = boolToYesNo(true)
+	}
+
+	return buildVectorAttribute("OS", attributes)
+}
+
+func readOs(attributes map[string]string) []interface{} {
+	firmware, present := lookupTemplateAttr(attributes, "OS/FIRMWARE")
+	if !present {
+		return []interface{}{}
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"firmware":    strings.ToUpper(firmware),
+			"secure_boot": strings.EqualFold(templateAttr(attributes, "OS/FIRMWARE_SECURE"), "yes"),
+		},
+	}
+}
+
+func validateOs(vmOs []interface{}) error {
+	if len(vmOs) == 0 || vmOs[0] == nil {
+		return nil
+	}
+
+	o := vmOs[0].(map[string]interface{})
+	if o["secure_boot"].(bool) && o["firmware"].(string) != "UEFI" {
+		return fmt.Errorf("Secure boot requires the UEFI firmware")
+	}
+
+	return nil
+}
+
+func buildRawString(raw []interface{}) string {
+	if len(raw) == 0 || raw[0] == nil {
+		return ""
+	}
+
+	r := raw[0].(map[string]interface{})
+	return buildVectorAttribute("RAW", map[string]string{
+		"TYPE": strings.ToLower(r["type"].(string)),
+		"DATA": r["data"].(string),
+	})
+}
+
+func readRaw(attributes map[string]string) []interface{} {
+	rawType, present := lookupTemplateAttr(attributes, "RAW/TYPE")
+	if !present {
+		return []interface{}{}
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"type": strings.ToLower(rawType),
+			"data": templateAttr(attributes, "RAW/DATA"),
+		},
+	}
+}
+
+func configuredLxcAttributes(d *schema.ResourceData) map[string]string {
+	attributes := make(map[string]string)
+	if v, ok := d.GetOkExists("lxc_unprivileged"); ok {
+		attributes["LXC_UNPRIVILEGED"] = strings.ToLower(boolToYesNo(v.(bool)))
+	}
+
+	return attributes
+}
+
+const lxcMountEntryKey = "lxc.mount.entry"
+
+// buildLxcMountRaw turns mount entries into the raw section LXC reads them from.
+func buildLxcMountRaw(entries []interface{}) []interface{} {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		lines = append(lines, fmt.Sprintf("%s = %s", lxcMountEntryKey, entry.(string)))
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"type": "lxc",
+			"data": strings.Join(lines, "\n"),
+		},
+	}
+}
+
+// readLxcMountEntries extracts the mount entries from a raw section of type lxc.
+// Other raw LXC settings are left alone.
+func readLxcMountEntries(attributes map[string]string) []interface{} {
+	entries := []interface{}{}
+	if !strings.EqualFold(templateAttr(attributes, "RAW/TYPE"), "lxc") {
+		return entries
+	}
+
+	for _, line := range strings.Split(templateAttr(attributes, "RAW/DATA"), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == lxcMountEntryKey {
+			entries = append(entries, strings.TrimSpace(parts[1]))
+		}
+	}
+
+	return entries
+}
+
+// validateRawHypervisor rejects raw data meant for another hypervisor. An unknown
+// hypervisor (empty string) can not be checked and is accepted.
+func validateRawHypervisor(raw []interface{}, hypervisor string) error {
+	if len(raw) == 0 || raw[0] == nil || hypervisor == "" {
+		return nil
+	}
+
+	rawType := raw[0].(map[string]interface{})["type"].(string)
+	if !strings.EqualFold(rawType, hypervisor) {
+		return fmt.Errorf("The raw section is of type %q, but the VM runs on the %q hypervisor", strings.ToLower(rawType), strings.ToLower(hypervisor))
+	}
+
+	return nil
+}
+
+func loadTemplateInfo(client OneClient, templateId int) (map[string]string, error) {
+	resp, err := client.Call("one.template.info", templateId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseResponse([]byte(resp), "VMTEMPLATE")
+}
+
+// templateHypervisor returns the hypervisor a template is restricted to, if any.
+func templateHypervisor(client OneClient, templateId int) (string, error) {
+	attributes, err := loadTemplateInfo(client, templateId)
+	if err != nil {
+		return "", err
+	}
+
+	return templateAttr(attributes, "HYPERVISOR"), nil
+}
+
+func templateContext(client OneClient, templateId int) (map[string]string, error) {
+	attributes, err := loadTemplateInfo(client, templateId)
+	if err != nil {
+		return nil, err
+	}
+
+	return subTree(attributes, TemplateElementName+PathSeparator+"CONTEXT"), nil
+}
+
+// readDeployment returns the host of the last history record, which stays the same
+// until the VM is deployed again. OpenNebula does not record the rank the host had.
+func readDeployment(attributes map[string]string) (int, string) {
+	history := subTrees(attributes, "HISTORY_RECORDS/HISTORY")
+	if len(history) == 0 {
+		return -1, ""
+	}
+
+	last := history[len(history)-1]
+	return convertToOptionalInt(last["HID"], -1), last["HOSTNAME"]
+}
+
+// readVmUsage returns the latest monitoring values of the VM. They only change the
+// state, never the plan, as the attributes are computed only.
+func readVmUsage(attributes map[string]string) map[string]interface{} {
+	counter := func(name string) int {
+		value, _ := strconv.ParseInt(attributes["MONITORING/"+name], 10, 64)
+		return int(value)
+	}
+	cpu, _ := strconv.ParseFloat(attributes["MONITORING/CPU"], 64)
+
+	return map[string]interface{}{
+		"cpu_usage":    cpu,
+		"memory_usage": counter("MEMORY"),
+		"net_rx":       counter("NETRX"),
+		"net_tx":       counter("NETTX"),
+	}
+}
+
+// vmHypervisor returns the driver of the host the VM was last deployed to.
+func vmHypervisor(vm *Vm) string {
+	if len(vm.History) == 0 {
+		return ""
+	}
+
+	return vm.History[len(vm.History)-1].VmMad
+}
+
+func configuredMemoryAttributes(d *schema.ResourceData) map[string]string {
+	attributes := make(map[string]string)
+	if v, ok := d.GetOk("memory_slots"); ok {
+		attributes["MEMORY_SLOTS"] = strconv.Itoa(v.(int))
+	}
+	if v, ok := d.GetOk("memory_resize_mode"); ok {
+		attributes["MEMORY_RESIZE_MODE"] = v.(string)
+	}
+
+	return attributes
+}
+
+// configuredCapacityAttributes returns the capacity overriding the template's.
+func configuredCapacityAttributes(d *schema.ResourceData) map[string]string {
+	attributes := make(map[string]string)
+	if v, ok := d.GetOk("cpu"); ok {
+		attributes["CPU"] = strconv.FormatFloat(v.(float64), 'f', -1, 64)
+	}
+	if v, ok := d.GetOk("vcpu"); ok {
+		attributes["VCPU"] = strconv.Itoa(v.(int))
+	}
+	if v, ok := d.GetOk("memory"); ok {
+		attributes["MEMORY"] = strconv.Itoa(v.(int))
+	}
+
+	return attributes
+}
+
+func buildHotResizeString(hotResize []interface{}) string {
+	if len(hotResize) == 0 || hotResize[0] == nil {
+		return ""
+	}
+
+	h := hotResize[0].(map[string]interface{})
+	return buildVectorAttribute("HOT_RESIZE", map[string]string{
+		"CPU_HOT_ADD_ENABLED":    boolToYesNo(h["cpu_hot_add_enabled"].(bool)),
+		"MEMORY_HOT_ADD_ENABLED": boolToYesNo(h["memory_hot_add_enabled"].(bool)),
+	})
+}
+
+func readHotResize(attributes map[string]string) []interface{} {
+	values := subTree(attributes, TemplateElementName+PathSeparator+"HOT_RESIZE")
+	if len(values) == 0 {
+		return []interface{}{}
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"cpu_hot_add_enabled":    strings.EqualFold(values["CPU_HOT_ADD_ENABLED"], "yes"),
+			"memory_hot_add_enabled": strings.EqualFold(values["MEMORY_HOT_ADD_ENABLED"], "yes"),
+		},
+	}
+}
+
+// resizeNeedsPowerCycle tells whether the changed capacity can only be applied to a
+// powered off VM, because hot_resize does not cover it.
+func resizeNeedsPowerCycle(hotResize []interface{}, cpuChanged bool, memoryChanged bool) bool {
+	cpuHotAdd, memoryHotAdd := false, false
+	if len(hotResize) > 0 && hotResize[0] != nil {
+		h := hotResize[0].(map[string]interface{})
+		cpuHotAdd = h["cpu_hot_add_enabled"].(bool)
+		memoryHotAdd = h["memory_hot_add_enabled"].(bool)
+	}
+
+	return (cpuChanged && !cpuHotAdd) || (memoryChanged && !memoryHotAdd)
+}
+
+// resizeVm applies changes of cpu, vcpu and memory. Unless hot_resize allows the
+// change, a running VM is powered off for the resize and resumed afterwards.
+func resizeVm(d *schema.ResourceData, meta interface{}, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+	id := intId(d.Id())
+
+	state, lcmState := d.Get("state").(int), d.Get("lcmstate").(int)
+	running := vmActionState(state, lcmState) == "RUNNING"
+	powerCycle := running && resizeNeedsPowerCycle(d.Get("hot_resize").([]interface{}), d.HasChange("cpu") || d.HasChange("vcpu"), d.HasChange("memory"))
+
+	if powerCycle {
+		log.Printf("[INFO] Powering off VM %d to resize it", id)
+		if _, err := vmAction(client, id, "poweroff", state, lcmState); err != nil {
+			return err
+		}
+		if _, err := waitForVmState(d, meta, "poweroff", timeout); err != nil {
+			return fmt.Errorf("Error waiting for virtual machine %d to be in state POWEROFF: %s", id, err)
+		}
+	}
+
+	resp, err := client.Call("one.vm.resize", id, buildAttributes(configuredCapacityAttributes(d)), d.Get("enforce").(bool))
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Successfully resized VM %s\n", resp)
+
+	if powerCycle {
+		if _, err = vmAction(client, id, "resume", 8, 0); err != nil {
+			return err
+		}
+		if _, err = waitForVmState(d, meta, "running", timeout); err != nil {
+			return fmt.Errorf("Error waiting for virtual machine %d to be in state RUNNING: %s", id, err)
+		}
+	}
+
+	return nil
+}
+
+// validateMemoryHypervisor rejects memory hotplug settings on hypervisors other than
+// KVM. As with raw data, an unknown hypervisor is accepted.
+func validateMemoryHypervisor(attributes map[string]string, hypervisor string) error {
+	_, slots := attributes["MEMORY_SLOTS"]
+	hotplug := attributes["MEMORY_RESIZE_MODE"] == "HOTPLUG"
+	if (!slots && !hotplug) || hypervisor == "" || strings.EqualFold(hypervisor, "kvm") {
+		return nil
+	}
+
+	return fmt.Errorf("Memory hotplug is only supported on KVM, but the VM runs on the %q hypervisor", strings.ToLower(hypervisor))
+}
+
+func configuredSchedulingAttributes(d *schema.ResourceData) map[string]string {
+	values := make(map[string]string)
+	for key := range vmSchedulingAttributes {
+		if v, ok := d.GetOk(key); ok {
+			values[key] = v.(string)
+		}
+	}
+
+	return values
+}
+
+// buildSchedulingString renders the given placement attributes. Empty values are
+// kept so that removed expressions are cleared when merged into the user template.
+func buildSchedulingString(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s = \"%s\"", vmSchedulingAttributes[key], escapeTemplateValue(values[key])))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// readSchedulingAttributes only looks at the user template, so that the
+// AUTOMATIC_* requirements OpenNebula maintains in the template are not taken
+// for user defined placement constraints.
+func readSchedulingAttributes(attributes map[string]string) map[string]string {
+	values := make(map[string]string)
+	for key, name := range vmSchedulingAttributes {
+		values[key] = userTemplateAttr(attributes, name)
+	}
+
+	return values
+}
+
+func contextConfigured(d *schema.ResourceData) bool {
+	return len(d.Get("context").(map[string]interface{})) > 0 ||
+		len(d.Get("secret_context").(map[string]interface{})) > 0 ||
+		len(d.Get("appliance_params").(map[string]interface{})) > 0 ||
+		len(d.Get("init_scripts").([]interface{})) > 0 ||
+		len(d.Get("files_ds").([]interface{})) > 0
+}
+
+func vmContext(attributes map[string]string) map[string]string {
+	return subTree(attributes, TemplateElementName+PathSeparator+"CONTEXT")
+}
+
+// templateAttr reads an attribute from the VM's TEMPLATE, which holds the attributes
+// fixed on instantiation. Nested attributes are addressed by their path, e.g. CONTEXT/NETWORK.
+func templateAttr(attributes map[string]string, key string) string {
+	value, _ := lookupTemplateAttr(attributes, key)
+	return value
+}
+
+func lookupTemplateAttr(attributes map[string]string, key string) (string, bool) {
+	value, present := attributes[TemplateElementName+PathSeparator+key]
+	return value, present
+}
+
+// userTemplateAttr reads an attribute from the VM's USER_TEMPLATE, which holds the
+// attributes users can change at any time. An attribute of the same name in TEMPLATE is ignored.
+func userTemplateAttr(attributes map[string]string, key string) string {
+	return attributes[UserTemplateElementName+PathSeparator+key]
+}
+
+// subTree returns the direct children of the given path with their names as keys.
+func subTree(attributes map[string]string, path string) map[string]string {
+	children := make(map[string]string)
+	prefix := path + PathSeparator
+	for key, value := range attributes {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], PathSeparator) {
+			children[key[len(prefix):]] = value
+		}
+	}
+
+	return children
+}
+
+// subTrees returns the children of every element at path, which is indexed by
+// parseResponse if the element is repeated (e.g. TEMPLATE/NIC[1]).
+func subTrees(attributes map[string]string, path string) []map[string]string {
+	var trees []map[string]string
+	for i := 0; hasElement(attributes, fmt.Sprintf("%s[%d]", path, i)); i++ {
+		trees = append(trees, subTree(attributes, fmt.Sprintf("%s[%d]", path, i)))
 	}
 
-	_, err = waitForVmState(d, meta, "done")
+	if len(trees) == 0 && hasElement(attributes, path) {
+		trees = append(trees, subTree(attributes, path))
+	}
+
+	return trees
+}
+
+func hasElement(attributes map[string]string, path string) bool {
+	for key := range attributes {
+		if key == path || strings.HasPrefix(key, path+PathSeparator) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configuredContext returns the context variables along with the resolved secrets.
+func configuredContext(d *schema.ResourceData) (map[string]interface{}, error) {
+	context, err := resolveSecrets(d.Get("secret_context").(map[string]interface{}))
 	if err != nil {
-		return fmt.Errorf(
-			"Error waiting for virtual machine (%s) to be in state DONE: %s", d.Id(), err)
+		return nil, err
+	}
+	for key, value := range d.Get("appliance_params").(map[string]interface{}) {
+		if !applianceParamRegexp.MatchString(key) {
+			return nil, fmt.Errorf("Appliance parameter %q may only contain letters, digits and underscores", key)
+		}
+		context[applianceKey(key)] = value
+	}
+	for key, value := range d.Get("context").(map[string]interface{}) {
+		context[key] = value
+	}
+
+	return context, nil
+}
+
+const applianceParamPrefix = "ONEAPP_"
+
+var applianceParamRegexp = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+// applianceKey returns the context variable of an appliance parameter, e.g.
+// ONEAPP_MYSQL_PASSWORD for mysql_password or oneapp_mysql_password.
+func applianceKey(param string) string {
+	key := strings.ToUpper(param)
+	if strings.HasPrefix(key, applianceParamPrefix) {
+		return key
+	}
+
+	return applianceParamPrefix + key
+}
+
+// synchronizeApplianceParams reads the configured appliance parameters back from the context.
+func synchronizeApplianceParams(state map[string]interface{}, vmInfo map[string]string) map[string]string {
+	synchronized := make(map[string]string)
+
+	for key := range state {
+		synchronized[key] = templateAttr(vmInfo, "CONTEXT/"+applianceKey(key))
+	}
+
+	return synchronized
+}
+
+// buildContextString renders the CONTEXT section from the existing context and the
+// configured variables. Variables which were dropped from the configuration are removed.
+func buildContextString(existing map[string]string, context map[string]interface{}, removed map[string]interface{}, initScripts []interface{}, filesDs []interface{}) string {
+	merged := make(map[string]string)
+	for key, value := range existing {
+		merged[key] = value
+	}
+
+	for key := range removed {
+		delete(merged, strings.ToUpper(key))
+	}
+	for key, value := range context {
+		merged[strings.ToUpper(key)] = value.(string)
+	}
+
+	delete(merged, "INIT_SCRIPTS")
+	if len(initScripts) > 0 {
+		scripts := make([]string, 0, len(initScripts))
+		for _, script := range initScripts {
+			scripts = append(scripts, script.(string))
+		}
+		merged["INIT_SCRIPTS"] = strings.Join(scripts, " ")
+	}
+
+	delete(merged, "FILES_DS")
+	if len(filesDs) > 0 {
+		files := make([]string, 0, len(filesDs))
+		for _, id := range filesDs {
+			files = append(files, fmt.Sprintf("$FILE[IMAGE_ID=%d]", id.(int)))
+		}
+		merged["FILES_DS"] = strings.Join(files, " ")
+	}
+
+	return buildVectorAttribute("CONTEXT", merged)
+}
+
+func synchronizeContext(state map[string]interface{}, vmInfo map[string]string) map[string]string {
+	synchronizedContext := make(map[string]string)
+
+	for key := range state {
+		synchronizedContext[key] = templateAttr(vmInfo, "CONTEXT/"+strings.ToUpper(key))
+	}
+
+	return synchronizedContext
+}
+
+func readInitScripts(attributes map[string]string) []interface{} {
+	scripts := []interface{}{}
+	for _, script := range strings.Fields(templateAttr(attributes, "CONTEXT/INIT_SCRIPTS")) {
+		scripts = append(scripts, script)
+	}
+
+	return scripts
+}
+
+var contextFileRegexp = regexp.MustCompile(`\$FILE\[IMAGE_ID=\"?(\d+)\"?\]`)
+
+func readContextFiles(attributes map[string]string) []interface{} {
+	ids := []interface{}{}
+	for _, match := range contextFileRegexp.FindAllStringSubmatch(templateAttr(attributes, "CONTEXT/FILES_DS"), -1) {
+		ids = append(ids, convertToInt(match[1]))
+	}
+
+	return ids
+}
+
+func validateContextFiles(client OneClient, filesDs []interface{}) error {
+	for _, id := range filesDs {
+		var img *Image
+
+		resp, err := client.Call("one.image.info", id.(int), false)
+		if err != nil {
+			return fmt.Errorf("Context file image %d is not accessible: %s", id.(int), err)
+		}
+		if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+			return err
+		}
+		if img.Type != ImageTypeContext {
+			return fmt.Errorf("Image %d can not be used as a context file, it is not of type CONTEXT", id.(int))
+		}
 	}
 
-	log.Printf("[INFO] Successfully terminated VM %s\n", resp)
 	return nil
 }
 
-func waitForVmState(d *schema.ResourceData, meta interface{}, state string) (interface{}, error) {
-	client := meta.(*Client)
+func buildVmGroupString(vmGroup []interface{}) string {
+	if len(vmGroup) == 0 || vmGroup[0] == nil {
+		return ""
+	}
 
-	log.Printf("Waiting for VM (%s) to be in state Done", d.Id())
+	g := vmGroup[0].(map[string]interface{})
+	return buildVectorAttribute("VMGROUP", map[string]string{
+		"VMGROUP_ID": strconv.Itoa(g["vmgroup_id"].(int)),
+		"ROLE":       g["role"].(string),
+	})
+}
 
-	stateConf := &resource.StateChangeConf{
-		Pending: []string{"anythingelse"},
-		Target:  []string{state},
-		Refresh: func() (interface{}, string, error) {
-			log.Println("Refreshing VM state...")
-			if d.Id() != "" {
-				attributes, err := loadVMInfo(client, intId(d.Id()))
-				if err == nil {
-					state := attributes[StateAttribute]
-					lcmState := attributes[LcmStateAttribute]
-					log.Printf("VM is currently in state %s and in LCM state %s", state, lcmState)
-					if state == "3" && lcmState == "3" {
-						return &attributes, "running", nil
-					} else if state == "6" {
-						return &attributes, "done", nil
-					}
-				} else {
-					return nil, "", fmt.Errorf("Could not find VM by ID %s", d.Id())
-				}
-			}
-			return nil, "anythingelse", nil
+func readVmGroup(attributes map[string]string) []interface{} {
+	id, present := lookupTemplateAttr(attributes, "VMGROUP/VMGROUP_ID")
+	if !present {
+		return []interface{}{}
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"vmgroup_id": convertToInt(id),
+			"role":       templateAttr(attributes, "VMGROUP/ROLE"),
 		},
-		Timeout:    10 * time.Minute,
-		Delay:      10 * time.Second,
-		MinTimeout: 3 * time.Second,
 	}
+}
 
-	return stateConf.WaitForState()
+func validateVmGroupRole(client OneClient, vmGroup []interface{}) error {
+	if len(vmGroup) == 0 || vmGroup[0] == nil {
+		return nil
+	}
+
+	g := vmGroup[0].(map[string]interface{})
+	id := g["vmgroup_id"].(int)
+	role := g["role"].(string)
+
+	var group *VmGroup
+	resp, err := client.Call("one.vmgroup.info", id, false)
+	if err != nil {
+		return fmt.Errorf("VM group %d is not accessible: %s", id, err)
+	}
+	if err = xml.Unmarshal([]byte(resp), &group); err != nil {
+		return err
+	}
+
+	roles := make([]string, 0, len(group.Roles))
+	for _, r := range group.Roles {
+		if r.Name == role {
+			return nil
+		}
+		roles = append(roles, r.Name)
+	}
+
+	return fmt.Errorf("VM group %s (%d) has no role %q, available roles are: %s", group.Name, id, role, strings.Join(roles, ", "))
 }
 
-func waitForAttribute(d *schema.ResourceData, meta interface{}, attributeName string) error {
-	client := meta.(*Client)
+// synchronizeSnapshots reports the snapshots of the VM in the order they were
+// taken. With ignoreExternal set, only the configured ones are reported.
+func synchronizeSnapshots(state []interface{}, vmSnapshots []*VmSnapshot, ignoreExternal bool) []interface{} {
+	configured := make(map[string]bool)
+	for _, s := range state {
+		configured[s.(map[string]interface{})["name"].(string)] = true
+	}
 
-	log.Printf("Waiting for VM (%s) to have attribute %s", d.Id(), attributeName)
+	synchronized := make([]interface{}, 0, len(vmSnapshots))
+	for _, snapshot := range vmSnapshots {
+		if (ignoreExternal || isPreUpdateSnapshot(snapshot)) && !configured[snapshot.Name] {
+			continue
+		}
+		synchronized = append(synchronized, map[string]interface{}{
+			"name":        snapshot.Name,
+			"snapshot_id": snapshot.SnapshotId,
+			"time":        snapshot.Time,
+		})
+	}
 
-	stateConf := &resource.StateChangeConf{
-		Pending: []string{"attributeNotFound"},
-		Target:  []string{attributeName},
-		Refresh: func() (interface{}, string, error) {
-			log.Println("Refreshing VM info...")
-			if d.Id() != "" {
-				attributes, err := loadVMInfo(client, intId(d.Id()))
-				if err == nil {
-					if _, present := attributes[attributeName]; present {
-						return &attributes, attributeName, nil
-					}
-				} else {
-					return nil, "", fmt.Errorf("Could not find VM by ID %s", d.Id())
-				}
-			}
-			return nil, "attributeNotFound", nil
-		},
-		Timeout:    10 * time.Minute,
-		Delay:      10 * time.Second,
-		MinTimeout: 3 * time.Second,
+	return synchronized
+}
+
+// snapshotChanges compares the configured snapshot names with the snapshots of
+// the VM and returns the names to create and the snapshots to delete.
+func snapshotChanges(configured []interface{}, vmSnapshots []*VmSnapshot, ignoreExternal bool) ([]string, []*VmSnapshot, error) {
+	desired := make(map[string]bool)
+	var create []string
+	var remove []*VmSnapshot
+
+	for _, c := range configured {
+		name := c.(map[string]interface{})["name"].(string)
+		if desired[name] {
+			return nil, nil, fmt.Errorf("Snapshot name %q is used more than once", name)
+		}
+		desired[name] = true
 	}
 
-	_, err := stateConf.WaitForState()
-	return err
+	existing := make(map[string]bool)
+	for _, snapshot := range vmSnapshots {
+		existing[snapshot.Name] = true
+		if !desired[snapshot.Name] && !ignoreExternal && !isPreUpdateSnapshot(snapshot) {
+			remove = append(remove, snapshot)
+		}
+	}
+
+	for _, c := range configured {
+		name := c.(map[string]interface{})["name"].(string)
+		if !existing[name] {
+			create = append(create, name)
+		}
+	}
+
+	return create, remove, nil
 }
 
-func loadVMInfo(client OneClient, id int) (map[string]string, error) {
-	resp, err := client.Call("one.vm.info", id)
-	if err == nil {
-		return parseResponse([]byte(resp), VmElementName)
-	} else {
-		log.Printf("Could not load VM Info with ID %d due to error: %s", id, err)
-		return nil, err
+func isPreUpdateSnapshot(snapshot *VmSnapshot) bool {
+	return strings.HasPrefix(snapshot.Name, preUpdateSnapshotPrefix)
+}
+
+func reconcileSnapshots(d *schema.ResourceData, meta interface{}, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+
+	vm, err := loadVm(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	create, remove, err := snapshotChanges(d.Get("snapshot").([]interface{}), vm.Snapshots, d.Get("ignore_external_snapshots").(bool))
+	if err != nil {
+		return err
+	}
+
+	// snapshot operations are serialized by OpenNebula, wait for each one to finish
+	for _, snapshot := range remove {
+		if _, err = client.Call("one.vm.snapshotdelete", intId(d.Id()), snapshot.SnapshotId); err != nil {
+			return err
+		}
+		if _, err = waitForVmState(d, meta, "running", timeout); err != nil {
+			return fmt.Errorf("Error waiting for snapshot %s of virtual machine %s to be deleted: %s", snapshot.Name, d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully deleted snapshot %s of VM %s\n", snapshot.Name, d.Id())
+	}
+
+	for _, name := range create {
+		if _, err = client.Call("one.vm.snapshotcreate", intId(d.Id()), name); err != nil {
+			return err
+		}
+		if _, err = waitForVmState(d, meta, "running", timeout); err != nil {
+			return fmt.Errorf("Error waiting for snapshot %s of virtual machine %s to be created: %s", name, d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully created snapshot %s of VM %s\n", name, d.Id())
 	}
+
+	return nil
 }
 
-func updateUserTemplate(client OneClient, id int, attribute string) error {
-	resp, err := client.Call("one.vm.update", id, attribute, 1)
-	if err == nil {
-		log.Printf("[INFO] Successfully updated user template for VM %s\n", resp)
-		return nil
-	} else {
+// revertToSnapshot reverts the VM to the snapshot with the given name.
+func revertToSnapshot(d *schema.ResourceData, meta interface{}, name string, timeout time.Duration) error {
+	client := resourceClient(d, meta)
+
+	vm, err := loadVm(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	snapshot := findSnapshot(vm.Snapshots, name)
+	if snapshot == nil {
+		return fmt.Errorf("VM %s has no snapshot %q to revert to", d.Id(), name)
+	}
+
+	if _, err = client.Call("one.vm.snapshotrevert", intId(d.Id()), snapshot.SnapshotId); err != nil {
 		return err
 	}
+	if _, err = waitForVmState(d, meta, "running", timeout); err != nil {
+		return fmt.Errorf("Error waiting for virtual machine %s to be reverted to snapshot %s: %s", d.Id(), name, err)
+	}
+	log.Printf("[INFO] Successfully reverted VM %s to snapshot %s\n", d.Id(), name)
+
+	return nil
 }
 
-func synchronizeUserTemplateAttributes(state map[string]interface{}, vmInfo map[string]string) map[string]string {
-	synchronizedAttributes := make(map[string]string)
+func findSnapshot(vmSnapshots []*VmSnapshot, name string) *VmSnapshot {
+	for _, snapshot := range vmSnapshots {
+		if snapshot.Name == name {
+			return snapshot
+		}
+	}
 
-	for key := range state {
-		synchronizedAttributes[key] = vmInfo["USER_TEMPLATE/"+strings.ToUpper(key)]
+	return nil
+}
+
+func validateScheduledActions(actions []interface{}) error {
+	for i, a := range actions {
+		action := a.(map[string]interface{})
+		repeat := action["repeat"].(string)
+		days := splitDays(action["days"].(string))
+		endType := action["end_type"].(string)
+
+		if repeat == "" {
+			if len(days) > 0 || endType != "never" {
+				return fmt.Errorf("scheduled_action %d: days and end_type can only be set for repeated actions", i)
+			}
+			continue
+		}
+
+		if len(days) == 0 {
+			return fmt.Errorf("scheduled_action %d: days are required for %s actions", i, repeat)
+		}
+		dayRange := vmSchedDayRanges[repeat]
+		if repeat == "hourly" && len(days) > 1 {
+			return fmt.Errorf("scheduled_action %d: days of an hourly action is the single number of hours between executions", i)
+		}
+		for _, day := range days {
+			n, err := strconv.Atoi(day)
+			if err != nil || n < dayRange[0] || n > dayRange[1] {
+				return fmt.Errorf("scheduled_action %d: day %q is out of range %d-%d for %s actions", i, day, dayRange[0], dayRange[1], repeat)
+			}
+		}
+
+		if endType != "never" && action["end_value"].(int) <= 0 {
+			return fmt.Errorf("scheduled_action %d: end_value is required for end_type %s", i, endType)
+		}
 	}
 
-	return synchronizedAttributes
+	return nil
 }
 
-func buildUserTemplateAttributesString(m map[string]interface{}) string {
-	pairs := make([]string, 0, len(m))
+func buildScheduledActionsString(actions []interface{}) string {
+	sections := make([]string, 0, len(actions))
+	for _, a := range actions {
+		sections = append(sections, buildScheduledActionString(a.(map[string]interface{})))
+	}
 
-	for key, value := range m {
-		pairs = append(pairs, key+"="+value.(string))
+	return strings.Join(sections, "\n")
+}
+
+func buildScheduledActionString(action map[string]interface{}) string {
+	attributes := map[string]string{
+		"ACTION": action["action"].(string),
+		"TIME":   strconv.Itoa(action["time"].(int)),
+	}
+	if repeat := action["repeat"].(string); repeat != "" {
+		attributes["REPEAT"] = strconv.Itoa(indexOf(vmSchedRepeats, repeat))
+		attributes["DAYS"] = strings.Join(splitDays(action["days"].(string)), ",")
+		endType := action["end_type"].(string)
+		attributes["END_TYPE"] = strconv.Itoa(indexOf(vmSchedEndTypes, endType))
+		if endType != "never" {
+			attributes["END_VALUE"] = strconv.Itoa(action["end_value"].(int))
+		}
 	}
 
-	return strings.Join(pairs, "\n")
+	return buildVectorAttribute("SCHED_ACTION", attributes)
+}
+
+// synchronizeScheduledActions reports the scheduled actions of the VM. OpenNebula
+// moves the time of repeated actions to their next execution, so a later time of
+// a repeated action keeps the configured one.
+func synchronizeScheduledActions(state []interface{}, vmActions []*VmSchedAction) []interface{} {
+	synchronized := make([]interface{}, 0, len(vmActions))
+
+	for i, a := range vmActions {
+		action := map[string]interface{}{
+			"action":    a.Action,
+			"time":      convertToInt(a.Time),
+			"repeat":    "",
+			"days":      a.Days,
+			"end_type":  "never",
+			"end_value": convertToOptionalInt(a.EndValue, 0),
+		}
+		if repeat := convertToOptionalInt(a.Repeat, -1); repeat >= 0 && repeat < len(vmSchedRepeats) {
+			action["repeat"] = vmSchedRepeats[repeat]
+		}
+		if endType := convertToOptionalInt(a.EndType, -1); endType >= 0 && endType < len(vmSchedEndTypes) {
+			action["end_type"] = vmSchedEndTypes[endType]
+		}
+
+		if i < len(state) {
+			configured := state[i].(map[string]interface{})
+			if action["repeat"] != "" && action["time"].(int) >= configured["time"].(int) {
+				action["time"] = configured["time"]
+			}
+		}
+
+		synchronized = append(synchronized, action)
+	}
+
+	return synchronized
+}
+
+// reconcileScheduledActions matches the configured actions with the ones of the VM
+// by their position. Changed actions are updated, missing ones added and the ones
+// left over deleted, so unchanged actions keep their ID.
+func reconcileScheduledActions(client OneClient, id int, actions []interface{}) error {
+	if err := validateScheduledActions(actions); err != nil {
+		return err
+	}
+
+	vm, err := loadVm(client, id)
+	if err != nil {
+		return err
+	}
+	current := synchronizeScheduledActions(actions, vm.SchedActions)
+
+	for i, a := range actions {
+		template := buildScheduledActionString(a.(map[string]interface{}))
+		if i >= len(vm.SchedActions) {
+			if _, err = client.Call("one.vm.schedadd", id, template); err != nil {
+				return fmt.Errorf("Could not add a scheduled action to VM %d: %s", id, err)
+			}
+			continue
+		}
+
+		if template == buildScheduledActionString(current[i].(map[string]interface{})) {
+			continue
+		}
+		if _, err = client.Call("one.vm.schedupdate", id, vm.SchedActions[i].Id, template); err != nil {
+			return fmt.Errorf("Could not update scheduled action %d of VM %d: %s", vm.SchedActions[i].Id, id, err)
+		}
+	}
+
+	for i := len(actions); i < len(vm.SchedActions); i++ {
+		if _, err = client.Call("one.vm.scheddelete", id, vm.SchedActions[i].Id); err != nil {
+			return fmt.Errorf("Could not delete scheduled action %d of VM %d: %s", vm.SchedActions[i].Id, id, err)
+		}
+	}
+	log.Printf("[INFO] Successfully updated the scheduled actions of VM %d\n", id)
+
+	return nil
+}
+
+func splitDays(days string) []string {
+	var split []string
+	for _, day := range strings.Split(days, ",") {
+		if day = strings.TrimSpace(day); day != "" {
+			split = append(split, day)
+		}
+	}
+	return split
+}
+
+func suppressEquivalentDays(k, old, new string, d *schema.ResourceData) bool {
+	return strings.Join(splitDays(old), ",") == strings.Join(splitDays(new), ",")
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// sortedVmIds returns the distinct IDs in ascending order, leaving out the -1 OpenNebula
+// uses for leases which are on hold instead of being used by a VM.
+func sortedVmIds(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	sorted := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if id >= 0 && !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Ints(sorted)
+
+	return sorted
 }
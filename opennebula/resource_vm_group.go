@@ -0,0 +1,321 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type VmGroup struct {
+	Id          int            `xml:"ID"`
+	Name        string         `xml:"NAME"`
+	Uid         int            `xml:"UID"`
+	Gid         int            `xml:"GID"`
+	Uname       string         `xml:"UNAME"`
+	Gname       string         `xml:"GNAME"`
+	Permissions *Permissions   `xml:"PERMISSIONS"`
+	Roles       []*VmGroupRole `xml:"ROLES>ROLE"`
+}
+
+type VmGroupRole struct {
+	Id              int    `xml:"ID"`
+	Name            string `xml:"NAME"`
+	Policy          string `xml:"POLICY"`
+	HostAffined     string `xml:"HOST_AFFINED"`
+	HostAntiAffined string `xml:"HOST_ANTI_AFFINED"`
+	Vms             string `xml:"VMS"`
+}
+
+var vmGroupPolicies = []string{"NONE", "AFFINED", "ANTI_AFFINED"}
+
+func resourceVmGroup() *schema.Resource {
+	r := &schema.Resource{
+		Create: resourceVmGroupCreate,
+		Read:   resourceVmGroupRead,
+		Exists: resourceVmGroupExists,
+		Update: resourceVmGroupUpdate,
+		Delete: resourceVmGroupDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Name of the VM group",
+			},
+			"permissions": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Permissions for the VM group (in Unix format, owner-group-other, use-manage-admin)",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+
+					if len(value) != 3 {
+						errors = append(errors, fmt.Errorf("%q has specify 3 permission sets: owner-group-other", k))
+					}
+
+					all := true
+					for _, c := range strings.Split(value, "") {
+						if c < "0" || c > "7" {
+							all = false
+						}
+					}
+					if !all {
+						errors = append(errors, fmt.Errorf("Each character in %q should specify a Unix-like permission set with a number from 0 to 7", k))
+					}
+
+					return
+				},
+			},
+
+			"uid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the user that will own the VM group",
+			},
+			"gid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the group that will own the VM group",
+			},
+			"uname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the user that will own the VM group",
+			},
+			"gname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the group that will own the VM group",
+			},
+			"role": {
+				Type:        schema.TypeList,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Roles of the VM group. OpenNebula can not change the roles of an existing group",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Required:    true,
+							ForceNew:    true,
+							Description: "Name of the role, VMs join the group by it",
+						},
+						"policy": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Default:      "NONE",
+							Description:  "Placement of the VMs of the role relative to each other: " + strings.Join(vmGroupPolicies, ", "),
+							ValidateFunc: validation.StringInSlice(vmGroupPolicies, false),
+						},
+						"host_affined": {
+							Type:        schema.TypeList,
+							Optional:    true,
+							ForceNew:    true,
+							Elem:        &schema.Schema{Type: schema.TypeInt},
+							Description: "IDs of the hosts the VMs of the role have to run on",
+						},
+						"host_anti_affined": {
+							Type:        schema.TypeList,
+							Optional:    true,
+							ForceNew:    true,
+							Elem:        &schema.Schema{Type: schema.TypeInt},
+							Description: "IDs of the hosts the VMs of the role must not run on",
+						},
+						"vms": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Elem:        &schema.Schema{Type: schema.TypeInt},
+							Description: "IDs of the VMs in the role",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
+	}
+
+	return r
+}
+
+func resourceVmGroupCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call(
+		"one.vmgroup.allocate",
+		fmt.Sprintf("NAME = \"%s\"\n", escapeTemplateValue(d.Get("name").(string)))+buildVmGroupRolesString(d.Get("role").([]interface{})),
+	)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	// update permisions
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vmgroup.chmod", false); err != nil {
+		return err
+	}
+
+	return resourceVmGroupRead(d, meta)
+}
+
+func resourceVmGroupRead(d *schema.ResourceData, meta interface{}) error {
+	var group *VmGroup
+
+	client := meta.(*Client)
+
+	// Try to find the VM group by ID, if specified
+	if d.Id() != "" {
+		resp, err := client.Call("one.vmgroup.info", intId(d.Id()), false)
+		if done, err := handleNotFound(d, err); done {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &group); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise, try to find the VM group by (user, name) as the de facto compound primary key
+	if d.Id() == "" {
+		match, err := findInPool(client, "one.vmgrouppool.info", "VM_GROUP", nameMatches(d.Get("name").(string)), -3, -1, -1)
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find VM group with name %s for user %s", d.Get("name").(string), client.Username)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Call("one.vmgroup.info", intId(match["ID"]), false)
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &group); err != nil {
+			return err
+		}
+	}
+
+	d.SetId(strconv.Itoa(group.Id))
+	d.Set("name", group.Name)
+	d.Set("uid", group.Uid)
+	d.Set("gid", group.Gid)
+	d.Set("uname", group.Uname)
+	d.Set("gname", group.Gname)
+	d.Set("permissions", permissionString(group.Permissions))
+	setPermissionBits(d, group.Permissions)
+	if err := d.Set("role", readVmGroupRoles(group.Roles)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceVmGroupExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceVmGroupRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceVmGroupUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if d.HasChange("name") {
+		resp, err := client.Call(
+			"one.vmgroup.rename",
+			intId(d.Id()),
+			d.Get("name").(string),
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated name for VM group %s\n", resp)
+	}
+
+	if d.HasChange("permissions") {
+		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vmgroup.chmod", false)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated VM group %s\n", resp)
+	}
+
+	return resourceVmGroupRead(d, meta)
+}
+
+func resourceVmGroupDelete(d *schema.ResourceData, meta interface{}) error {
+	err := resourceVmGroupRead(d, meta)
+	if err != nil || d.Id() == "" {
+		return err
+	}
+
+	client := meta.(*Client)
+	resp, err := client.Call("one.vmgroup.delete", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted VM group %s\n", resp)
+	return nil
+}
+
+func buildVmGroupRolesString(roles []interface{}) string {
+	sections := make([]string, 0, len(roles))
+	for _, role := range roles {
+		r := role.(map[string]interface{})
+		attributes := map[string]string{
+			"NAME":   r["name"].(string),
+			"POLICY": r["policy"].(string),
+		}
+		if hosts := interfaceInts(r["host_affined"].([]interface{})); len(hosts) > 0 {
+			attributes["HOST_AFFINED"] = joinInts(hosts)
+		}
+		if hosts := interfaceInts(r["host_anti_affined"].([]interface{})); len(hosts) > 0 {
+			attributes["HOST_ANTI_AFFINED"] = joinInts(hosts)
+		}
+		sections = append(sections, buildVectorAttribute("ROLE", attributes))
+	}
+
+	return joinTemplateSections(sections...)
+}
+
+func readVmGroupRoles(groupRoles []*VmGroupRole) []interface{} {
+	roles := make([]interface{}, 0, len(groupRoles))
+	for _, r := range groupRoles {
+		policy := r.Policy
+		if policy == "" {
+			policy = "NONE"
+		}
+		roles = append(roles, map[string]interface{}{
+			"name":              r.Name,
+			"policy":            policy,
+			"host_affined":      splitInts(r.HostAffined),
+			"host_anti_affined": splitInts(r.HostAntiAffined),
+			"vms":               splitInts(r.Vms),
+		})
+	}
+
+	return roles
+}
+
+func interfaceInts(values []interface{}) []int {
+	ints := make([]int, 0, len(values))
+	for _, v := range values {
+		ints = append(ints, v.(int))
+	}
+	return ints
+}
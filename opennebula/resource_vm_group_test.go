@@ -0,0 +1,62 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuildVmGroupRolesString(t *testing.T) {
+	s := buildVmGroupRolesString([]interface{}{
+		map[string]interface{}{"name": "db", "policy": "ANTI_AFFINED", "host_affined": []interface{}{1, 2}, "host_anti_affined": []interface{}{}},
+		map[string]interface{}{"name": "web", "policy": "NONE", "host_affined": []interface{}{}, "host_anti_affined": []interface{}{5}},
+	})
+
+	assert.Equal(t, "ROLE = [\n  HOST_AFFINED = \"1,2\",\n  NAME = \"db\",\n  POLICY = \"ANTI_AFFINED\" ]\nROLE = [\n  HOST_ANTI_AFFINED = \"5\",\n  NAME = \"web\",\n  POLICY = \"NONE\" ]", s)
+}
+
+func TestReadVmGroupRoles(t *testing.T) {
+	var group *VmGroup
+	err := xml.Unmarshal([]byte(`<VM_GROUP><ID>3</ID><NAME>ha-pair</NAME>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<ROLES>
+			<ROLE><HOST_AFFINED>1,2</HOST_AFFINED><ID>0</ID><NAME>db</NAME><POLICY>ANTI_AFFINED</POLICY><VMS>10,11</VMS></ROLE>
+			<ROLE><ID>1</ID><NAME>web</NAME></ROLE>
+		</ROLES>
+	</VM_GROUP>`), &group)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "600", permissionString(group.Permissions))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "db", "policy": "ANTI_AFFINED", "host_affined": []int{1, 2}, "host_anti_affined": []int{}, "vms": []int{10, 11}},
+		map[string]interface{}{"name": "web", "policy": "NONE", "host_affined": []int{}, "host_anti_affined": []int{}, "vms": []int{}},
+	}, readVmGroupRoles(group.Roles))
+}
+
+func TestVmGroupReadKeepsAuthorizationErrors(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vmgroup.info", []interface{}{"user:pass", 42, false}, mock.Anything).Run(answer(false, "Not authorized", int64(OneErrorAuthorization))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVmGroup().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.Error(t, resourceVmGroupRead(d, client))
+	assert.Equal(t, "42", d.Id())
+	assert.Equal(t, []string{"one.vmgroup.info"}, testRpcMethods(rpc))
+}
+
+func TestVmGroupReadClearsIdOfMissingVmGroups(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	rpc.On("Call", "one.vmgroup.info", []interface{}{"user:pass", 42, false}, mock.Anything).Run(answer(false, "Object does not exist", int64(OneErrorNoExists))).Return(nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVmGroup().Schema, map[string]interface{}{"name": "other"})
+	d.SetId("42")
+
+	assert.NoError(t, resourceVmGroupRead(d, client))
+	assert.Equal(t, "", d.Id())
+}
@@ -3,12 +3,16 @@ package opennebula
 import (
 	"encoding/xml"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -57,7 +61,7 @@ func TestSynchronizeUserTemplateAttributes(t *testing.T) {
 		"USER_TEMPLATE/ATTR2": "value2",
 	}
 
-	synchronized := synchronizeUserTemplateAttributes(state, vmInfo)
+	synchronized := synchronizeUserTemplateAttributes(state, vmInfo, nil)
 
 	expected := map[string]string{
 		"attr1": "anotherValue",
@@ -74,7 +78,7 @@ func TestSynchronizeUserTemplateAttributesEmptyState(t *testing.T) {
 		"USER_TEMPLATE/ATTR2": "value2",
 	}
 
-	synchronized := synchronizeUserTemplateAttributes(make(map[string]interface{}), vmInfo)
+	synchronized := synchronizeUserTemplateAttributes(make(map[string]interface{}), vmInfo, nil)
 	assert.Equal(t, make(map[string]string), synchronized)
 }
 
@@ -87,7 +91,7 @@ func TestSynchronizeUserTemplateAttributesNilState(t *testing.T) {
 
 	expected := make(map[string]string)
 
-	synchronized := synchronizeUserTemplateAttributes(nil, vmInfo)
+	synchronized := synchronizeUserTemplateAttributes(nil, vmInfo, nil)
 	assert.Equal(t, expected, synchronized)
 }
 
@@ -98,7 +102,7 @@ func TestSynchronizeUserTemplateAttributesEmptyVmInfo(t *testing.T) {
 		"attr3": "value3",
 	}
 
-	synchronized := synchronizeUserTemplateAttributes(state, make(map[string]string))
+	synchronized := synchronizeUserTemplateAttributes(state, make(map[string]string), nil)
 
 	expected := map[string]string{
 		"attr1": "",
@@ -115,7 +119,7 @@ func TestSynchronizeUserTemplateAttributesNilVmInfo(t *testing.T) {
 		"attr3": "value3",
 	}
 
-	synchronized := synchronizeUserTemplateAttributes(state, nil)
+	synchronized := synchronizeUserTemplateAttributes(state, nil, nil)
 
 	expected := map[string]string{
 		"attr1": "",
@@ -132,10 +136,15 @@ func TestBuildUserTemplateAttributesString(t *testing.T) {
 		"key3": "value3",
 	}
 	s := buildUserTemplateAttributesString(m)
-	expected := []string{"key1=value1", "key2=value2", "key3=value3"}
+	expected := []string{`key1 = "value1"`, `key2 = "value2"`, `key3 = "value3"`}
 	assert.ElementsMatch(t, expected, strings.Split(s, "\n"))
 }
 
+func TestBuildUserTemplateAttributesStringQuotesValues(t *testing.T) {
+	s := buildUserTemplateAttributesString(map[string]interface{}{"description": `web "frontend"`, "path": `C:\data`})
+	assert.Equal(t, "description = \"web \\\"frontend\\\"\"\npath = \"C:\\\\data\"", s)
+}
+
 func TestBuildUserTemplateAttributesStringEmptyMap(t *testing.T) {
 	s := buildUserTemplateAttributesString(make(map[string]interface{}))
 	assert.Equal(t, "", s)
@@ -292,3 +301,2008 @@ func testAccCheckVmPermissions(name string, expected *Permissions) resource.Test
 		return nil
 	}
 }
+
+func TestBuildDisksString(t *testing.T) {
+	disks := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": true},
+		map[string]interface{}{"image_id": 4, "persistent": false},
+	}
+	s := buildDisksString(disks)
+	assert.Equal(t, "DISK = [\n  IMAGE_ID = \"3\",\n  PERSISTENT = \"YES\" ]\nDISK = [\n  IMAGE_ID = \"4\" ]", s)
+}
+
+func TestSynchronizeDisksIgnoresTemplateDisks(t *testing.T) {
+	state := []interface{}{
+		map[string]interface{}{"image_id": 3, "image": "", "image_datastore_id": -1, "image_owner": "", "persistent": true, "disk_id": 0},
+	}
+	vmDisks := []*VmDisk{
+		{DiskId: 0, ImageId: 1},
+		{DiskId: 1, ImageId: 3, Persistent: "YES", Size: 2048, Target: "vdb"},
+	}
+
+	synchronized := synchronizeDisks(state, vmDisks, []interface{}{0}, false)
+
+	expected := []interface{}{
+		map[string]interface{}{"image_id": 3, "image": "", "image_datastore_id": -1, "image_owner": "", "persistent": true, "disk_id": 1, "size": 2048, "target": "vdb"},
+	}
+	assert.Equal(t, expected, synchronized)
+}
+
+func TestValidatePersistentDisksRejectsForeignImage(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.image.info", []interface{}{3, false}).Return(
+		"<IMAGE><ID>3</ID><UID>5</UID><GID>1</GID><PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M><GROUP_U>1</GROUP_U></PERMISSIONS></IMAGE>", nil)
+	mockClient.On("Call", "one.user.info", []interface{}{-1}).Return(
+		"<USER><ID>7</ID><GID>1</GID><NAME>jdoe</NAME><GROUPS><ID>1</ID></GROUPS></USER>", nil)
+
+	err := validatePersistentDisks(mockClient, []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": true},
+	})
+	assert.Error(t, err)
+}
+
+func TestValidatePersistentDisksAcceptsOwnImage(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.image.info", []interface{}{3, false}).Return(
+		"<IMAGE><ID>3</ID><UID>7</UID><GID>1</GID><PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS></IMAGE>", nil)
+	mockClient.On("Call", "one.user.info", []interface{}{-1}).Return(
+		"<USER><ID>7</ID><GID>1</GID><NAME>jdoe</NAME><GROUPS><ID>1</ID></GROUPS></USER>", nil)
+
+	err := validatePersistentDisks(mockClient, []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": true},
+		map[string]interface{}{"image_id": 4, "persistent": false},
+	})
+	assert.NoError(t, err)
+}
+
+func TestBuildFeaturesString(t *testing.T) {
+	features := []interface{}{
+		map[string]interface{}{
+			"acpi":        true,
+			"apic":        true,
+			"pae":         false,
+			"hyperv":      false,
+			"localtime":   true,
+			"guest_agent": false,
+		},
+	}
+	s := buildFeaturesString(features)
+	assert.Contains(t, s, "ACPI = \"yes\"")
+	assert.Contains(t, s, "LOCALTIME = \"yes\"")
+	assert.Contains(t, s, "HYPERV = \"no\"")
+	assert.True(t, strings.HasPrefix(s, "FEATURES = ["))
+}
+
+func TestBuildFeaturesStringEmpty(t *testing.T) {
+	assert.Equal(t, "", buildFeaturesString(nil))
+}
+
+func TestReadFeatures(t *testing.T) {
+	attributes := map[string]string{
+		"TEMPLATE/FEATURES/ACPI":      "YES",
+		"TEMPLATE/FEATURES/LOCALTIME": "no",
+	}
+	expected := []interface{}{
+		map[string]interface{}{"acpi": true, "localtime": false},
+	}
+	assert.Equal(t, expected, readFeatures(attributes))
+	assert.Empty(t, readFeatures(map[string]string{}))
+}
+
+func TestChangeVmOwnershipAndPermissionsOrder(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.chown", []interface{}{1, 5, 100}).Return("1", nil)
+	mockClient.On("Call", "one.vm.info", []interface{}{1}).Return("<VM><UID>5</UID><GID>100</GID></VM>", nil)
+	mockClient.On("Call", "one.vm.chmod", mock.Anything).Return("1", nil)
+
+	err := changeVmOwnershipAndPermissions(mockClient, 1, 5, 100, permission("600"), false)
+
+	assert.NoError(t, err)
+	assert.Len(t, mockClient.Calls, 3)
+	assert.Equal(t, "one.vm.chown", mockClient.Calls[0].Arguments.String(0))
+	assert.Equal(t, "one.vm.info", mockClient.Calls[1].Arguments.String(0))
+	assert.Equal(t, "one.vm.chmod", mockClient.Calls[2].Arguments.String(0))
+}
+
+func TestChangeVmOwnershipAndPermissionsOnlyPermissions(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.chmod", mock.Anything).Return("1", nil)
+
+	err := changeVmOwnershipAndPermissions(mockClient, 1, -1, -1, permission("600"), false)
+
+	assert.NoError(t, err)
+	mockClient.AssertNotCalled(t, "Call", "one.vm.chown", mock.Anything)
+	mockClient.AssertNumberOfCalls(t, "Call", 1)
+}
+
+func TestChangeVmOwnershipAndPermissionsRecursive(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.chmod", []interface{}{1, 1, 1, 0, 0, 0, 0, 0, 0, 0, false}).Return("1", nil)
+	mockClient.On("Call", "one.vm.info", []interface{}{1}).Return(`<VM><TEMPLATE>
+		<DISK><DISK_ID>0</DISK_ID><IMAGE_ID>3</IMAGE_ID></DISK>
+		<DISK><DISK_ID>1</DISK_ID><SIZE>1024</SIZE><TYPE>fs</TYPE></DISK>
+		<DISK><DISK_ID>2</DISK_ID><IMAGE_ID>8</IMAGE_ID></DISK>
+	</TEMPLATE></VM>`, nil)
+	mockClient.On("Call", "one.image.chmod", []interface{}{3, 1, 1, 0, 0, 0, 0, 0, 0, 0, false}).Return("3", nil).Once()
+	mockClient.On("Call", "one.image.chmod", []interface{}{8, 1, 1, 0, 0, 0, 0, 0, 0, 0, false}).Return("8", nil).Once()
+
+	err := changeVmOwnershipAndPermissions(mockClient, 1, -1, -1, permission("600"), true)
+
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+	mockClient.AssertNumberOfCalls(t, "Call", 4)
+}
+
+func TestChangeVmOwnershipAndPermissionsStopsOnStaleOwner(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.chown", []interface{}{1, 5, -1}).Return("1", nil)
+	mockClient.On("Call", "one.vm.info", []interface{}{1}).Return("<VM><UID>0</UID><GID>0</GID></VM>", nil)
+
+	err := changeVmOwnershipAndPermissions(mockClient, 1, 5, -1, permission("600"), false)
+
+	assert.Error(t, err)
+	mockClient.AssertNotCalled(t, "Call", "one.vm.chmod", mock.Anything)
+}
+
+func TestValidateRawHypervisor(t *testing.T) {
+	raw := []interface{}{map[string]interface{}{"type": "kvm", "data": "<devices/>"}}
+
+	assert.NoError(t, validateRawHypervisor(raw, "kvm"))
+	assert.NoError(t, validateRawHypervisor(raw, "KVM"))
+	assert.NoError(t, validateRawHypervisor(raw, ""))
+	assert.NoError(t, validateRawHypervisor(nil, "vcenter"))
+	assert.Error(t, validateRawHypervisor(raw, "vcenter"))
+}
+
+func TestVmVcpuPrefersTheConfiguredVcpu(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.info", []interface{}{7, false}).Return(
+		"<VMTEMPLATE><ID>7</ID><TEMPLATE><VCPU>2</VCPU></TEMPLATE></VMTEMPLATE>", nil)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm", "template_id": 7, "vcpu": 4})
+	vcpu, err := vmVcpu(mockClient, d)
+	assert.NoError(t, err)
+	assert.Equal(t, "4", vcpu)
+	mockClient.AssertNotCalled(t, "Call", "one.template.info", []interface{}{7, false})
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm", "template_id": 7})
+	vcpu, err = vmVcpu(mockClient, d)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", vcpu)
+}
+
+func TestTemplateHypervisor(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.info", []interface{}{7, false}).Return(
+		"<VMTEMPLATE><ID>7</ID><TEMPLATE><HYPERVISOR>vcenter</HYPERVISOR></TEMPLATE></VMTEMPLATE>", nil)
+
+	hypervisor, err := templateHypervisor(mockClient, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "vcenter", hypervisor)
+}
+
+func TestVmHypervisorUsesLastHistoryRecord(t *testing.T) {
+	var vm *Vm
+	err := xml.Unmarshal([]byte(`<VM><HISTORY_RECORDS>
+		<HISTORY><SEQ>0</SEQ><VM_MAD>kvm</VM_MAD></HISTORY>
+		<HISTORY><SEQ>1</SEQ><VM_MAD>lxd</VM_MAD></HISTORY>
+	</HISTORY_RECORDS></VM>`), &vm)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "lxd", vmHypervisor(vm))
+	assert.Equal(t, "", vmHypervisor(&Vm{}))
+}
+
+func TestReadDeploymentUsesLastHistoryRecord(t *testing.T) {
+	attributes, err := parseResponse([]byte(`<VM><ID>4</ID><HISTORY_RECORDS>
+		<HISTORY><SEQ>0</SEQ><HID>2</HID><HOSTNAME>node2</HOSTNAME></HISTORY>
+		<HISTORY><SEQ>1</SEQ><HID>5</HID><HOSTNAME>node5</HOSTNAME></HISTORY>
+	</HISTORY_RECORDS></VM>`), VmElementName)
+	assert.NoError(t, err)
+
+	hostId, hostname := readDeployment(attributes)
+	assert.Equal(t, 5, hostId)
+	assert.Equal(t, "node5", hostname)
+}
+
+func TestReadDeploymentOfSingleAndMissingHistory(t *testing.T) {
+	hostId, hostname := readDeployment(map[string]string{"HISTORY_RECORDS/HISTORY/HID": "0", "HISTORY_RECORDS/HISTORY/HOSTNAME": "node0"})
+	assert.Equal(t, 0, hostId)
+	assert.Equal(t, "node0", hostname)
+
+	hostId, hostname = readDeployment(map[string]string{"STATE": "1"})
+	assert.Equal(t, -1, hostId)
+	assert.Equal(t, "", hostname)
+}
+
+func TestReadVmIps(t *testing.T) {
+	attributes, err := parseResponse([]byte(`<VM><ID>4</ID><TEMPLATE>
+		<CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP></CONTEXT>
+		<NIC><NIC_ID>0</NIC_ID><IP>10.0.0.2</IP></NIC>
+		<NIC><NIC_ID>1</NIC_ID><IP6_GLOBAL>2001:db8::5</IP6_GLOBAL></NIC>
+		<NIC><NIC_ID>2</NIC_ID><IP>192.168.1.7</IP><IP6_GLOBAL>2001:db8::7</IP6_GLOBAL></NIC>
+	</TEMPLATE></VM>`), VmElementName)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"10.0.0.2", "2001:db8::5", "192.168.1.7"}, readVmIps(attributes))
+}
+
+func TestReadVmIpsFromContext(t *testing.T) {
+	attributes := map[string]string{
+		"TEMPLATE/CONTEXT/ETH10_IP": "10.0.0.10",
+		"TEMPLATE/CONTEXT/ETH2_IP":  "10.0.0.2",
+		"TEMPLATE/CONTEXT/ETH2_MAC": "02:00:0a:00:00:02",
+	}
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.10"}, readVmIps(attributes))
+	assert.Equal(t, []string{}, readVmIps(map[string]string{"NAME": "web"}))
+}
+
+func TestReadVmIp6s(t *testing.T) {
+	attributes, err := parseResponse([]byte(`<VM><ID>4</ID><TEMPLATE>
+		<NIC><NIC_ID>0</NIC_ID><IP>10.0.0.2</IP></NIC>
+		<NIC><NIC_ID>1</NIC_ID><IP6_GLOBAL>2001:db8::5</IP6_GLOBAL><IP6_LINK>fe80::5</IP6_LINK></NIC>
+		<NIC><NIC_ID>2</NIC_ID><IP6_LINK>fe80::7</IP6_LINK></NIC>
+	</TEMPLATE></VM>`), VmElementName)
+	assert.NoError(t, err)
+
+	ip6s := readVmIp6s(attributes)
+	assert.Equal(t, []string{"2001:db8::5", "fe80::7"}, ip6s)
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	assert.Equal(t, "2001:db8::5", determineIp6(d, attributes, ip6s))
+	assert.Equal(t, "", determineIp6(d, attributes, []string{}))
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"ip6_attribute": "TEMPLATE/NIC[2]/IP6_LINK"})
+	assert.Equal(t, "fe80::7", determineIp6(d, attributes, ip6s))
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"ip_attribute": "TEMPLATE/NIC/IP"})
+	assert.Equal(t, "10.0.0.2", determineIp(d, attributes, readVmIps(attributes)))
+}
+
+func TestDetermineIp(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	assert.Equal(t, "10.0.0.2", determineIp(d, map[string]string{DefaultIpAttribute: "10.0.0.2"}, []string{"10.0.0.5"}))
+	assert.Equal(t, "10.0.0.5", determineIp(d, map[string]string{}, []string{"10.0.0.5"}))
+	assert.Equal(t, "", determineIp(d, map[string]string{}, []string{}))
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"ip_attribute": "USER_TEMPLATE/PUBLIC_IP"})
+	assert.Equal(t, "", determineIp(d, map[string]string{}, []string{"10.0.0.5"}))
+}
+
+func TestBuildAndReadRaw(t *testing.T) {
+	raw := []interface{}{map[string]interface{}{"type": "KVM", "data": "<devices/>"}}
+	assert.Equal(t, "RAW = [\n  DATA = \"<devices/>\",\n  TYPE = \"kvm\" ]", buildRawString(raw))
+
+	attributes := map[string]string{"TEMPLATE/RAW/TYPE": "kvm", "TEMPLATE/RAW/DATA": "<devices/>"}
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "kvm", "data": "<devices/>"}}, readRaw(attributes))
+}
+
+func TestRawTypeIsValidatedCaseSensitively(t *testing.T) {
+	validate := resourceVm().Schema["raw"].Elem.(*schema.Resource).Schema["type"].ValidateFunc
+
+	_, errs := validate("kvm", "raw.0.type")
+	assert.Empty(t, errs)
+	// OpenNebula reports the type in lower case, so KVM would never match the state
+	_, errs = validate("KVM", "raw.0.type")
+	assert.Len(t, errs, 1)
+}
+
+func TestReadSchedulingAttributesIgnoresAutomaticRequirements(t *testing.T) {
+	attributes := map[string]string{
+		"USER_TEMPLATE/SCHED_REQUIREMENTS":  "FREE_CPU > 50",
+		"TEMPLATE/AUTOMATIC_REQUIREMENTS":   "(CLUSTER_ID = 100) & !(PUBLIC_CLOUD = YES)",
+		"TEMPLATE/SCHED_RANK":               "FREE_MEM",
+		"USER_TEMPLATE/AUTOMATIC_DS_RANK":   "FREE_MB",
+		"USER_TEMPLATE/SCHED_DS_RANK":       "-USED_MB",
+		"TEMPLATE/AUTOMATIC_DS_REQUIREMENT": "(\"CLUSTERS/ID\" @> 100)",
+	}
+
+	expected := map[string]string{
+		"sched_requirements":    "FREE_CPU > 50",
+		"sched_rank":            "",
+		"sched_ds_requirements": "",
+		"sched_ds_rank":         "-USED_MB",
+	}
+	assert.Equal(t, expected, readSchedulingAttributes(attributes))
+}
+
+func TestRemovedSchedulingAttributesAreCleared(t *testing.T) {
+	d := testVmUpdate(t, map[string]string{
+		"name":                  "web",
+		"template_id":           "1",
+		"sched_requirements":    "FREE_CPU > 50",
+		"sched_rank":            "FREE_MEM",
+		"sched_ds_requirements": "ID = 100",
+	}, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"sched_rank":  "FREE_MEM",
+	})
+
+	assert.True(t, d.HasChange("sched_requirements"))
+	assert.True(t, d.HasChange("sched_ds_requirements"))
+	assert.False(t, d.HasChange("sched_rank"))
+	assert.Equal(t, "", d.Get("sched_requirements"))
+	assert.Equal(t, "", d.Get("sched_ds_requirements"))
+}
+
+func TestBuildSchedulingString(t *testing.T) {
+	s := buildSchedulingString(map[string]string{
+		"sched_requirements": "HOSTNAME = \"node1\"",
+		"sched_rank":         "",
+	})
+	assert.Equal(t, "SCHED_RANK = \"\"\nSCHED_REQUIREMENTS = \"HOSTNAME = \\\"node1\\\"\"", s)
+}
+
+func TestBuildContextStringMergesWithExisting(t *testing.T) {
+	existing := map[string]string{
+		"NETWORK":        "YES",
+		"SSH_PUBLIC_KEY": "$USER[SSH_PUBLIC_KEY]",
+		"OLD_VAR":        "gone",
+		"FILES_DS":       "$FILE[IMAGE_ID=\"1\"]",
+	}
+	context := map[string]interface{}{"hostname": "web"}
+	removed := map[string]interface{}{"old_var": "gone", "hostname": "app"}
+
+	s := buildContextString(existing, context, removed, []interface{}{"init.sh", "app.sh"}, []interface{}{12, 13})
+
+	expected := "CONTEXT = [\n" +
+		"  FILES_DS = \"$FILE[IMAGE_ID=12] $FILE[IMAGE_ID=13]\",\n" +
+		"  HOSTNAME = \"web\",\n" +
+		"  INIT_SCRIPTS = \"init.sh app.sh\",\n" +
+		"  NETWORK = \"YES\",\n" +
+		"  SSH_PUBLIC_KEY = \"$USER[SSH_PUBLIC_KEY]\" ]"
+	assert.Equal(t, expected, s)
+}
+
+func TestReadContextFilesAndInitScripts(t *testing.T) {
+	attributes := map[string]string{
+		"TEMPLATE/CONTEXT/FILES_DS":     "$FILE[IMAGE_ID=12] $FILE[IMAGE_ID=\"13\"]",
+		"TEMPLATE/CONTEXT/INIT_SCRIPTS": "init.sh  app.sh",
+	}
+
+	assert.Equal(t, []interface{}{12, 13}, readContextFiles(attributes))
+	assert.Equal(t, []interface{}{"init.sh", "app.sh"}, readInitScripts(attributes))
+	assert.Empty(t, readContextFiles(map[string]string{}))
+}
+
+func TestSubTreeOnlyReturnsDirectChildren(t *testing.T) {
+	attributes := map[string]string{
+		"TEMPLATE/CONTEXT/NETWORK":  "YES",
+		"TEMPLATE/CONTEXT/A/NESTED": "no",
+		"TEMPLATE/CONTEXTUAL":       "no",
+		"USER_TEMPLATE/CONTEXT/X":   "no",
+	}
+
+	assert.Equal(t, map[string]string{"NETWORK": "YES"}, subTree(attributes, "TEMPLATE/CONTEXT"))
+}
+
+func TestSubTreesOfRepeatedElements(t *testing.T) {
+	attributes := map[string]string{
+		"TEMPLATE/NIC[0]/NIC_ID": "0",
+		"TEMPLATE/NIC[0]/IP":     "10.0.0.2",
+		"TEMPLATE/NIC[1]/NIC_ID": "1",
+		"TEMPLATE/DISK/SIZE":     "2048",
+	}
+
+	assert.Equal(t, []map[string]string{{"NIC_ID": "0", "IP": "10.0.0.2"}, {"NIC_ID": "1"}}, subTrees(attributes, "TEMPLATE/NIC"))
+	assert.Equal(t, []map[string]string{{"SIZE": "2048"}}, subTrees(attributes, "TEMPLATE/DISK"))
+	assert.Empty(t, subTrees(attributes, "TEMPLATE/GRAPHICS"))
+}
+
+func TestValidateContextFilesRejectsNonContextImage(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.image.info", []interface{}{12, false}).Return("<IMAGE><ID>12</ID><TYPE>5</TYPE></IMAGE>", nil)
+	mockClient.On("Call", "one.image.info", []interface{}{13, false}).Return("<IMAGE><ID>13</ID><TYPE>0</TYPE></IMAGE>", nil)
+
+	assert.NoError(t, validateContextFiles(mockClient, []interface{}{12}))
+	assert.Error(t, validateContextFiles(mockClient, []interface{}{12, 13}))
+}
+
+func TestValidateVmGroupRole(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vmgroup.info", []interface{}{3, false}).Return(`<VM_GROUP>
+		<ID>3</ID><NAME>ha</NAME>
+		<ROLES>
+			<ROLE><ID>0</ID><NAME>db</NAME></ROLE>
+			<ROLE><ID>1</ID><NAME>web</NAME></ROLE>
+		</ROLES>
+	</VM_GROUP>`, nil)
+
+	assert.NoError(t, validateVmGroupRole(mockClient, []interface{}{map[string]interface{}{"vmgroup_id": 3, "role": "web"}}))
+	err := validateVmGroupRole(mockClient, []interface{}{map[string]interface{}{"vmgroup_id": 3, "role": "cache"}})
+	assert.EqualError(t, err, "VM group ha (3) has no role \"cache\", available roles are: db, web")
+	assert.NoError(t, validateVmGroupRole(mockClient, nil))
+}
+
+func TestBuildAndReadVmGroup(t *testing.T) {
+	vmGroup := []interface{}{map[string]interface{}{"vmgroup_id": 3, "role": "web"}}
+	assert.Equal(t, "VMGROUP = [\n  ROLE = \"web\",\n  VMGROUP_ID = \"3\" ]", buildVmGroupString(vmGroup))
+
+	attributes := map[string]string{"TEMPLATE/VMGROUP/VMGROUP_ID": "3", "TEMPLATE/VMGROUP/ROLE": "web"}
+	assert.Equal(t, vmGroup, readVmGroup(attributes))
+	assert.Empty(t, readVmGroup(map[string]string{}))
+}
+
+func TestBuildPermissionsWithoutPermissions(t *testing.T) {
+	attributes, err := parseResponse([]byte("<VM><ID>1</ID><UID>0</UID></VM>"), "VM")
+	assert.NoError(t, err)
+
+	assert.False(t, hasPermissions(attributes))
+	assert.Equal(t, &Permissions{}, buildPermissions(attributes))
+}
+
+func TestBuildPermissionsWithPartialPermissions(t *testing.T) {
+	attributes, err := parseResponse([]byte("<VM><PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M><GROUP_U></GROUP_U></PERMISSIONS></VM>"), "VM")
+	assert.NoError(t, err)
+
+	assert.True(t, hasPermissions(attributes))
+	assert.Equal(t, "600", permissionString(buildPermissions(attributes)))
+}
+
+func TestSaveVmInfoToStateWithoutPermissions(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"template_id": 1,
+		"permissions": "640",
+	})
+	attributes := map[string]string{
+		"NAME":      "vm",
+		"UID":       "0",
+		"GID":       "0",
+		"STATE":     "3",
+		"LCM_STATE": "3",
+	}
+
+	saveVmInfoToState(d, attributes)
+
+	assert.Equal(t, "640", d.Get("permissions"))
+	assert.Equal(t, "vm", d.Get("instance"))
+}
+
+var testVmSnapshots = []*VmSnapshot{
+	{SnapshotId: 0, Name: "before-upgrade", Time: 100},
+	{SnapshotId: 1, Name: "manual", Time: 200},
+}
+
+func TestSnapshotChanges(t *testing.T) {
+	configured := []interface{}{
+		map[string]interface{}{"name": "before-upgrade"},
+		map[string]interface{}{"name": "nightly"},
+	}
+
+	create, remove, err := snapshotChanges(configured, testVmSnapshots, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nightly"}, create)
+	assert.Equal(t, []*VmSnapshot{testVmSnapshots[1]}, remove)
+
+	create, remove, err = snapshotChanges(configured, testVmSnapshots, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nightly"}, create)
+	assert.Empty(t, remove)
+}
+
+func TestFindSnapshot(t *testing.T) {
+	snapshots := []*VmSnapshot{{SnapshotId: 0, Name: "before-upgrade"}, {SnapshotId: 3, Name: "nightly"}}
+
+	assert.Equal(t, 3, findSnapshot(snapshots, "nightly").SnapshotId)
+	assert.Nil(t, findSnapshot(snapshots, "weekly"))
+}
+
+func TestSnapshotChangesRejectsDuplicateNames(t *testing.T) {
+	configured := []interface{}{
+		map[string]interface{}{"name": "nightly"},
+		map[string]interface{}{"name": "nightly"},
+	}
+
+	_, _, err := snapshotChanges(configured, nil, false)
+	assert.Error(t, err)
+}
+
+func TestSynchronizeSnapshots(t *testing.T) {
+	state := []interface{}{map[string]interface{}{"name": "before-upgrade"}}
+
+	all := synchronizeSnapshots(state, testVmSnapshots, false)
+	assert.Len(t, all, 2)
+	assert.Equal(t, "manual", all[1].(map[string]interface{})["name"])
+
+	configuredOnly := synchronizeSnapshots(state, testVmSnapshots, true)
+	expected := []interface{}{
+		map[string]interface{}{"name": "before-upgrade", "snapshot_id": 0, "time": 100},
+	}
+	assert.Equal(t, expected, configuredOnly)
+}
+
+func TestValidateMemoryHypervisor(t *testing.T) {
+	hotplug := map[string]string{"MEMORY_RESIZE_MODE": "HOTPLUG", "MEMORY_SLOTS": "4"}
+	assert.NoError(t, validateMemoryHypervisor(hotplug, "kvm"))
+	assert.NoError(t, validateMemoryHypervisor(hotplug, ""))
+	assert.Error(t, validateMemoryHypervisor(hotplug, "vcenter"))
+	assert.Error(t, validateMemoryHypervisor(map[string]string{"MEMORY_SLOTS": "2"}, "lxd"))
+	assert.NoError(t, validateMemoryHypervisor(map[string]string{"MEMORY_RESIZE_MODE": "BALLOONING"}, "vcenter"))
+}
+
+var overlappingAttributes = map[string]string{
+	"TEMPLATE/SCHED_REQUIREMENTS":      "ID=\"1\"",
+	"USER_TEMPLATE/SCHED_REQUIREMENTS": "ID=\"2\"",
+	"TEMPLATE/CONTEXT/LABEL":           "from-context",
+	"USER_TEMPLATE/LABEL":              "from-user",
+}
+
+func TestTemplateAttributeLookups(t *testing.T) {
+	assert.Equal(t, "ID=\"1\"", templateAttr(overlappingAttributes, "SCHED_REQUIREMENTS"))
+	assert.Equal(t, "ID=\"2\"", userTemplateAttr(overlappingAttributes, "SCHED_REQUIREMENTS"))
+	assert.Equal(t, "from-context", templateAttr(overlappingAttributes, "CONTEXT/LABEL"))
+	assert.Equal(t, "", templateAttr(overlappingAttributes, "LABEL"))
+
+	_, present := lookupTemplateAttr(overlappingAttributes, "LABEL")
+	assert.False(t, present)
+}
+
+func TestSynchronizeWithOverlappingKeys(t *testing.T) {
+	userTemplate := synchronizeUserTemplateAttributes(map[string]interface{}{"label": "x"}, overlappingAttributes, nil)
+	assert.Equal(t, map[string]string{"label": "from-user"}, userTemplate)
+
+	context := synchronizeContext(map[string]interface{}{"label": "x"}, overlappingAttributes)
+	assert.Equal(t, map[string]string{"label": "from-context"}, context)
+
+	assert.Equal(t, "ID=\"2\"", readSchedulingAttributes(overlappingAttributes)["sched_requirements"])
+}
+
+func TestValidateVmReferences(t *testing.T) {
+	disks := []interface{}{map[string]interface{}{"image_id": 3}}
+	nics := []interface{}{map[string]interface{}{"network_id": 8}}
+
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.info", []interface{}{1, false}).Return("<VMTEMPLATE><ID>1</ID></VMTEMPLATE>", nil)
+	mockClient.On("Call", "one.image.info", []interface{}{3, false}).Return("<IMAGE><ID>3</ID></IMAGE>", nil)
+	mockClient.On("Call", "one.vn.info", []interface{}{8, false}).Return("", fmt.Errorf("[one.vn.info] Error getting virtual network [8]."))
+
+	err := validateVmReferences(mockClient, 1, disks, nics)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Virtual network 8")
+}
+
+func TestValidateVmReferencesIgnoresUnreachableEndpoint(t *testing.T) {
+	disks := []interface{}{map[string]interface{}{"image_id": 3}}
+
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.info", []interface{}{1, false}).Return("", fmt.Errorf("connection refused"))
+	mockClient.On("Call", "one.image.info", []interface{}{3, false}).Return("", fmt.Errorf("connection refused"))
+
+	assert.NoError(t, validateVmReferences(mockClient, 1, disks, nil))
+}
+
+func TestValidateVmReferencesRejectsMissingTemplate(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.info", []interface{}{42, false}).Return("", &OneError{Code: OneErrorAuthorization, Message: "[one.template.info] User [3] : Not authorized to perform USE TEMPLATE [42]."})
+
+	err := validateVmReferences(mockClient, 42, nil, nil)
+	assert.EqualError(t, err, "Template 42 does not exist or is not accessible: [one.template.info] User [3] : Not authorized to perform USE TEMPLATE [42].")
+	mockClient.AssertExpectations(t)
+}
+
+func TestBuildNicsString(t *testing.T) {
+	nics := []interface{}{
+		map[string]interface{}{"network_id": 2, "ip": "10.0.0.5", "mac": "", "inbound_avg_bw": 1000},
+	}
+
+	assert.Equal(t, "NIC = [\n  INBOUND_AVG_BW = \"1000\",\n  IP = \"10.0.0.5\",\n  NETWORK_ID = \"2\" ]", buildNicsString(nics, nil))
+}
+
+func TestLxcMountEntries(t *testing.T) {
+	entries := []interface{}{"/srv/data srv/data none bind,create=dir 0 0", "tmpfs tmp tmpfs defaults 0 0"}
+	raw := buildLxcMountRaw(entries)
+
+	r := raw[0].(map[string]interface{})
+	attributes := map[string]string{
+		"TEMPLATE/RAW/TYPE": "LXC",
+		"TEMPLATE/RAW/DATA": r["data"].(string) + "\nlxc.apparmor.profile = unconfined",
+	}
+	assert.Equal(t, entries, readLxcMountEntries(attributes))
+
+	attributes["TEMPLATE/RAW/TYPE"] = "kvm"
+	assert.Empty(t, readLxcMountEntries(attributes))
+}
+
+func TestNicDefault(t *testing.T) {
+	nicDefault := []interface{}{map[string]interface{}{"model": "virtio", "filter": ""}}
+	assert.Equal(t, "NIC_DEFAULT = [\n  MODEL = \"virtio\" ]", buildNicDefaultString(nicDefault))
+
+	attributes := map[string]string{"TEMPLATE/NIC_DEFAULT/MODEL": "virtio"}
+	assert.Equal(t, []interface{}{map[string]interface{}{"model": "virtio", "filter": ""}}, readNicDefault(attributes))
+	assert.Empty(t, readNicDefault(map[string]string{}))
+}
+
+func TestNicSettingsOverrideNicDefault(t *testing.T) {
+	nics := []interface{}{
+		map[string]interface{}{"network_id": 2, "ip": "", "mac": "", "model": "e1000", "filter": ""},
+	}
+
+	assert.Equal(t, "NIC = [\n  MODEL = \"e1000\",\n  NETWORK_ID = \"2\" ]", buildNicsString(nics, nil))
+}
+
+func TestInstantiateVmPassesPersistentFlag(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"name":                     "vm",
+		"template_id":              7,
+		"make_template_persistent": true,
+	})
+
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.instantiate", []interface{}{7, "vm", false, "CPU = \"1\"", true}).Return("12", nil)
+
+	id, err := instantiateVm(mockClient, d, "CPU = \"1\"", false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "12", id)
+	mockClient.AssertExpectations(t)
+}
+
+func TestInstantiateVmOnHold(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"name":        "vm",
+		"template_id": 7,
+	})
+
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.instantiate", []interface{}{7, "vm", true, "", false}).Return("12", nil)
+
+	id, err := instantiateVm(mockClient, d, "", true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "12", id)
+	mockClient.AssertExpectations(t)
+}
+
+const testVmWithOneGate = `<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE>
+	<CONTEXT><TOKEN>YES</TOKEN></CONTEXT>
+</TEMPLATE><USER_TEMPLATE></USER_TEMPLATE></VM>`
+
+const testVmReady = `<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE>
+	<CONTEXT><TOKEN>YES</TOKEN></CONTEXT>
+</TEMPLATE><USER_TEMPLATE><READY>YES</READY></USER_TEMPLATE></VM>`
+
+func testVmStartupData(t *testing.T, raw map[string]interface{}) *schema.ResourceData {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, raw)
+	d.SetId("42")
+	return d
+}
+
+func testVmStartupClient() (*MockRpc, *Client) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.pollInterval = 10 * time.Millisecond
+	return rpc, client
+}
+
+func TestWaitForVmReadyWaitsForReady(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7})
+
+	rpc, client := testVmStartupClient()
+	info := []interface{}{"user:pass", 42}
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmWithOneGate)).Return(nil).Times(3)
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmReady)).Return(nil).Once()
+
+	assert.NoError(t, waitForVmReady(d, client, time.Minute))
+	rpc.AssertExpectations(t)
+}
+
+func TestWaitForVmReadyTimesOut(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7})
+
+	rpc, client := testVmStartupClient()
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithOneGate)).Return(nil)
+
+	assert.Error(t, waitForVmReady(d, client, 50*time.Millisecond))
+}
+
+func TestWaitForVmReadyWithoutOneGate(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7})
+
+	rpc, client := testVmStartupClient()
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithNics)).Return(nil).Once()
+
+	assert.NoError(t, waitForVmReady(d, client, time.Minute))
+	assert.Equal(t, []string{"one.vm.info"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestWaitForVmStartupWaitsForReadyWithHoldAndDeploy(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7, "create_mode": "hold_and_deploy"})
+
+	rpc, client := testVmStartupClient()
+	info := []interface{}{"user:pass", 42}
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmWithOneGate)).Return(nil).Twice()
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmReady)).Return(nil).Once()
+
+	assert.NoError(t, waitForVmStartup(d, client, time.Minute))
+	rpc.AssertExpectations(t)
+}
+
+func TestVmCustomizeDiffRejectsHoldingAgain(t *testing.T) {
+	config := map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"on_hold":     true,
+	}
+	assert.NoError(t, testPlanCreate(resourceVm(), config))
+
+	state := &terraform.InstanceState{
+		ID: "42",
+		Attributes: map[string]string{
+			"name":        "web",
+			"template_id": "1",
+			"permissions": "640",
+			"on_hold":     "false",
+		},
+	}
+	_, err := resourceVm().Diff(state, terraform.NewResourceConfigRaw(config), nil)
+	assert.EqualError(t, err, "VM 42 has already been deployed and can not be put on hold again")
+}
+
+const testVmPending = `<VM><ID>42</ID><STATE>1</STATE><LCM_STATE>0</LCM_STATE><TEMPLATE></TEMPLATE></VM>`
+
+const testVmOnHold = `<VM><ID>42</ID><STATE>2</STATE><LCM_STATE>0</LCM_STATE><TEMPLATE></TEMPLATE></VM>`
+
+func TestWaitForVmStateWaitsForHold(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7, "on_hold": true})
+
+	rpc, client := testVmStartupClient()
+	info := []interface{}{"user:pass", 42}
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmPending)).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmOnHold)).Return(nil).Once()
+
+	_, err := waitForVmState(d, client, "hold", time.Minute)
+	assert.NoError(t, err)
+	rpc.AssertExpectations(t)
+}
+
+func TestReleaseVmWaitsForStartup(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7})
+	d.Set("state", 2)
+	d.Set("lcmstate", 0)
+
+	rpc, client := testVmStartupClient()
+	rpc.On("Call", "one.vm.action", []interface{}{"user:pass", "release", 42}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithNics)).Return(nil).Once()
+
+	assert.NoError(t, releaseVm(d, client, time.Minute))
+	assert.Equal(t, []string{"one.vm.action", "one.vm.info"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+const testVmWithTemplateDevices = `<VM><ID>42</ID><UID>0</UID><GID>0</GID><NAME>web</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE>
+	<DISK><DISK_ID>0</DISK_ID><IMAGE_ID>1</IMAGE_ID></DISK>
+	<DISK><DISK_ID>1</DISK_ID><IMAGE_ID>3</IMAGE_ID></DISK>
+	<NIC><NIC_ID>0</NIC_ID><NETWORK_ID>2</NETWORK_ID></NIC>
+</TEMPLATE><USER_TEMPLATE></USER_TEMPLATE><PERMISSIONS><OWNER_U>1</OWNER_U></PERMISSIONS></VM>`
+
+func TestVmReadRecordsTemplateDevicesOfImportedVms(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"disk":        []interface{}{map[string]interface{}{"image_id": 3}},
+	})
+
+	rpc, client := testVmStartupClient()
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithTemplateDevices)).Return(nil)
+
+	assert.NoError(t, resourceVmRead(d, client))
+	assert.Equal(t, []interface{}{0}, d.Get("template_disk_ids"))
+	assert.Equal(t, []interface{}{0}, d.Get("template_nic_ids"))
+	assert.Equal(t, 1, d.Get("disk.#"))
+	assert.Equal(t, 1, d.Get("disk.0.disk_id"))
+	assert.Equal(t, 0, d.Get("nic.#"))
+	assert.Equal(t, 2, d.Get("attached_disks.#"))
+	assert.Equal(t, 0, d.Get("attached_disks.0.disk_id"))
+	assert.Equal(t, 1, d.Get("attached_disks.0.image_id"))
+	assert.Equal(t, 3, d.Get("attached_disks.1.image_id"))
+}
+
+func TestVmReadKeepsRecordedTemplateDevices(t *testing.T) {
+	d, err := schema.InternalMap(resourceVm().Schema).Data(&terraform.InstanceState{
+		ID: "42",
+		Attributes: map[string]string{
+			"name":                "web",
+			"template_id":         "1",
+			"template_disk_ids.#": "0",
+			"template_nic_ids.#":  "1",
+			"template_nic_ids.0":  "0",
+		},
+	}, nil)
+	assert.NoError(t, err)
+
+	rpc, client := testVmStartupClient()
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithTemplateDevices)).Return(nil)
+
+	assert.NoError(t, resourceVmRead(d, client))
+	assert.Equal(t, []interface{}{}, d.Get("template_disk_ids"))
+	assert.Equal(t, 2, d.Get("disk.#"))
+}
+
+func TestDeployVmReleasesWithoutHost(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7, "create_mode": "hold_and_deploy"})
+
+	rpc, client := testVmStartupClient()
+	rpc.On("Call", "one.vm.action", []interface{}{"user:pass", "release", 42}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.NoError(t, deployVm(d, client))
+	rpc.AssertExpectations(t)
+}
+
+func TestDeployVmDeploysToHost(t *testing.T) {
+	d := testVmStartupData(t, map[string]interface{}{"name": "vm", "template_id": 7, "create_mode": "hold_and_deploy", "host_id": 5, "enforce": true})
+
+	rpc, client := testVmStartupClient()
+	rpc.On("Call", "one.vm.deploy", []interface{}{"user:pass", 42, 5, true, -1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.NoError(t, deployVm(d, client))
+	assert.Equal(t, []string{"one.vm.deploy"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+var testImagePool = `<IMAGE_POOL>
+	<IMAGE><ID>3</ID><NAME>ubuntu</NAME><UNAME>oneadmin</UNAME><DATASTORE_ID>1</DATASTORE_ID></IMAGE>
+	<IMAGE><ID>7</ID><NAME>ubuntu</NAME><UNAME>jdoe</UNAME><DATASTORE_ID>100</DATASTORE_ID></IMAGE>
+	<IMAGE><ID>9</ID><NAME>debian</NAME><UNAME>jdoe</UNAME><DATASTORE_ID>100</DATASTORE_ID></IMAGE>
+</IMAGE_POOL>`
+
+func TestResolveDiskImages(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.imagepool.info", []interface{}{-2, 0, -poolPageSize}).Return(testImagePool, nil).Once()
+
+	disks := []interface{}{
+		map[string]interface{}{"image_id": 0, "image": "debian", "image_datastore_id": -1, "image_owner": ""},
+		map[string]interface{}{"image_id": 0, "image": "ubuntu", "image_datastore_id": -1, "image_owner": "jdoe"},
+		map[string]interface{}{"image_id": 4, "image": "", "image_datastore_id": -1, "image_owner": ""},
+	}
+
+	resolved, err := resolveDiskImages(mockClient, disks)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 9, resolved[0].(map[string]interface{})["image_id"])
+	assert.Equal(t, 7, resolved[1].(map[string]interface{})["image_id"])
+	assert.Equal(t, 4, resolved[2].(map[string]interface{})["image_id"])
+	mockClient.AssertExpectations(t)
+}
+
+func TestResolveDiskImagesRejectsAmbiguousNames(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.imagepool.info", []interface{}{-2, 0, -poolPageSize}).Return(testImagePool, nil)
+
+	disks := []interface{}{
+		map[string]interface{}{"image_id": 0, "image": "ubuntu", "image_datastore_id": -1, "image_owner": ""},
+	}
+
+	_, err := resolveDiskImages(mockClient, disks)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "3, 7")
+}
+
+func TestSynchronizeDisksReportsExternalDisks(t *testing.T) {
+	state := []interface{}{
+		map[string]interface{}{"image_id": 3, "image": "", "image_datastore_id": -1, "image_owner": "", "persistent": false, "disk_id": 1},
+	}
+	vmDisks := []*VmDisk{
+		{DiskId: 0, ImageId: 1},
+		{DiskId: 1, ImageId: 3},
+		{DiskId: 2, ImageId: 8, Persistent: "YES"},
+	}
+
+	synchronized := synchronizeDisks(state, vmDisks, []interface{}{0}, false)
+	assert.Len(t, synchronized, 2)
+	assert.Equal(t, map[string]interface{}{"image_id": 8, "image": "", "image_datastore_id": -1, "image_owner": "", "persistent": true, "disk_id": 2, "size": 0, "target": ""}, synchronized[1])
+
+	synchronized = synchronizeDisks(state, vmDisks, []interface{}{0}, true)
+	assert.Len(t, synchronized, 1)
+}
+
+func TestSynchronizeNicsReportsExternalNics(t *testing.T) {
+	state := []interface{}{
+		map[string]interface{}{"network_id": 2, "model": "", "filter": ""},
+	}
+	vmNics := []*VmNic{
+		{NicId: 0, NetworkId: 0, Ip: "10.0.0.2"},
+		{NicId: 1, NetworkId: 2, Ip: "10.0.2.2"},
+		{NicId: 2, NetworkId: 5, Ip: "10.0.5.2"},
+	}
+
+	synchronized := synchronizeNics(state, vmNics, []interface{}{0}, false)
+	assert.Len(t, synchronized, 2)
+	assert.Equal(t, 1, synchronized[0].(map[string]interface{})["nic_id"])
+	assert.Equal(t, 5, synchronized[1].(map[string]interface{})["network_id"])
+	assert.Equal(t, "10.0.5.2", synchronized[1].(map[string]interface{})["ip"])
+
+	synchronized = synchronizeNics(state, vmNics, []interface{}{0}, true)
+	assert.Len(t, synchronized, 1)
+}
+
+func TestOs(t *testing.T) {
+	vmOs := []interface{}{map[string]interface{}{"firmware": "UEFI", "secure_boot": true}}
+	assert.NoError(t, validateOs(vmOs))
+	assert.Equal(t, "OS = [\n  FIRMWARE = \"UEFI\",\n  FIRMWARE_SECURE = \"YES\" ]", buildOsString(vmOs))
+
+	attributes := map[string]string{"TEMPLATE/OS/FIRMWARE": "UEFI", "TEMPLATE/OS/FIRMWARE_SECURE": "YES"}
+	assert.Equal(t, vmOs, readOs(attributes))
+	assert.Empty(t, readOs(map[string]string{"TEMPLATE/OS/ARCH": "x86_64"}))
+}
+
+func TestOsRejectsSecureBootWithBios(t *testing.T) {
+	assert.Error(t, validateOs([]interface{}{map[string]interface{}{"firmware": "BIOS", "secure_boot": true}}))
+	assert.Error(t, validateOs([]interface{}{map[string]interface{}{"firmware": "", "secure_boot": true}}))
+}
+
+func TestTopology(t *testing.T) {
+	topology := []interface{}{map[string]interface{}{
+		"pin_policy": "CORE", "sockets": 2, "cores": 2, "threads": 1, "hugepage_size": 0, "memory_access": "",
+	}}
+
+	assert.NoError(t, validateTopology(topology, "4"))
+	assert.NoError(t, validateTopology(topology, ""))
+	assert.Error(t, validateTopology(topology, "8"))
+	assert.Equal(t, "TOPOLOGY = [\n  CORES = \"2\",\n  PIN_POLICY = \"CORE\",\n  SOCKETS = \"2\",\n  THREADS = \"1\" ]", buildTopologyString(topology))
+
+	attributes := map[string]string{
+		"TEMPLATE/TOPOLOGY/PIN_POLICY": "CORE",
+		"TEMPLATE/TOPOLOGY/SOCKETS":    "2",
+		"TEMPLATE/TOPOLOGY/CORES":      "2",
+		"TEMPLATE/TOPOLOGY/THREADS":    "1",
+	}
+	assert.Equal(t, topology, readTopology(attributes))
+}
+
+func TestUpdateVmConfigurationSendsChangedSections(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"graphics": []interface{}{map[string]interface{}{"type": "VNC", "listen": "0.0.0.0"}},
+		"features": []interface{}{map[string]interface{}{"acpi": true}},
+	})
+	d.SetId("42")
+
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.updateconf", []interface{}{42, buildFeaturesString(d.Get("features").([]interface{})) +
+		"\nGRAPHICS = [\n  LISTEN = \"0.0.0.0\",\n  TYPE = \"VNC\" ]"}).Return("42", nil)
+
+	assert.NoError(t, updateVmConfiguration(mockClient, d))
+	mockClient.AssertExpectations(t)
+}
+
+func TestUpdateVmConfigurationWithoutChanges(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	mockClient := new(MockClient)
+
+	assert.NoError(t, updateVmConfiguration(mockClient, d))
+	mockClient.AssertNotCalled(t, "Call", "one.vm.updateconf", mock.Anything)
+}
+
+func TestReadGraphics(t *testing.T) {
+	attributes := map[string]string{"TEMPLATE/GRAPHICS/TYPE": "vnc", "TEMPLATE/GRAPHICS/PORT": "5942"}
+	expected := []interface{}{map[string]interface{}{"type": "VNC", "listen": "", "port": 5942, "keymap": "", "passwd": "", "passwd_set": false}}
+	assert.Equal(t, expected, readGraphics(attributes, ""))
+}
+
+func TestReadGraphicsKeepsConfiguredPasswd(t *testing.T) {
+	attributes := map[string]string{"TEMPLATE/GRAPHICS/TYPE": "VNC", "TEMPLATE/GRAPHICS/PASSWD": "stored"}
+	graphics := readGraphics(attributes, "configured")
+	assert.Equal(t, "configured", graphics[0].(map[string]interface{})["passwd"])
+	assert.Equal(t, true, graphics[0].(map[string]interface{})["passwd_set"])
+}
+
+func TestUpdateVmConfigurationRotatesGraphicsPasswd(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"graphics": []interface{}{map[string]interface{}{"type": "VNC", "passwd": "s3cret"}},
+	})
+	d.SetId("42")
+
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.updateconf", []interface{}{42, "GRAPHICS = [\n  PASSWD = \"s3cret\",\n  TYPE = \"VNC\" ]"}).Return("42", nil)
+
+	assert.NoError(t, updateVmConfiguration(mockClient, d))
+	mockClient.AssertExpectations(t)
+}
+
+func TestVmInfoJsonLeavesOutGraphicsPasswd(t *testing.T) {
+	info, err := vmInfoJson(map[string]string{"TEMPLATE/GRAPHICS/TYPE": "VNC", "TEMPLATE/GRAPHICS/PASSWD": "s3cret"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"TEMPLATE/GRAPHICS/TYPE":"VNC"}`, info)
+}
+
+func TestVmInfoJsonLeavesOutSecretContext(t *testing.T) {
+	attributes := map[string]string{
+		"TEMPLATE/CONTEXT/DB_USER":     "app",
+		"TEMPLATE/CONTEXT/DB_PASSWORD": "s3cret",
+	}
+
+	info, err := vmInfoJson(attributes, map[string]interface{}{"db_password": "env:DB_PASSWORD"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"TEMPLATE/CONTEXT/DB_USER":"app"}`, info)
+}
+
+func TestWaitForVmSettled(t *testing.T) {
+	mockClient := new(MockClient)
+	// MIGRATE, then RUNNING
+	mockClient.On("Call", "one.vm.info", []interface{}{5}).Return("<VM><STATE>3</STATE><LCM_STATE>4</LCM_STATE></VM>", nil).Once()
+	mockClient.On("Call", "one.vm.info", []interface{}{5}).Return("<VM><STATE>3</STATE><LCM_STATE>3</LCM_STATE></VM>", nil).Once()
+
+	assert.NoError(t, waitForVmSettled(mockClient, 5, time.Minute, 10*time.Millisecond))
+	mockClient.AssertExpectations(t)
+}
+
+func TestIsTransientVmState(t *testing.T) {
+	assert.True(t, isTransientVmState("3", "4"))
+	assert.False(t, isTransientVmState("3", "3"))
+	assert.False(t, isTransientVmState("3", "36"))
+	assert.False(t, isTransientVmState("8", "0"))
+}
+
+func TestApplianceParams(t *testing.T) {
+	assert.Equal(t, "ONEAPP_MYSQL_PASSWORD", applianceKey("mysql_password"))
+	assert.Equal(t, "ONEAPP_MYSQL_PASSWORD", applianceKey("oneapp_mysql_password"))
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"appliance_params": map[string]interface{}{"mysql_password": "secret", "ONEAPP_SITE_TITLE": "Blog"},
+		"context":          map[string]interface{}{"network": "YES"},
+	})
+	context, err := configuredContext(d)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"ONEAPP_MYSQL_PASSWORD": "secret",
+		"ONEAPP_SITE_TITLE":     "Blog",
+		"network":               "YES",
+	}, context)
+
+	attributes := map[string]string{"TEMPLATE/CONTEXT/ONEAPP_MYSQL_PASSWORD": "secret"}
+	assert.Equal(t, map[string]string{"mysql_password": "secret"}, synchronizeApplianceParams(map[string]interface{}{"mysql_password": ""}, attributes))
+}
+
+func TestApplianceParamsRejectsInvalidNames(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"appliance_params": map[string]interface{}{"mysql-password": "secret"},
+	})
+
+	_, err := configuredContext(d)
+	assert.Error(t, err)
+}
+
+func TestBuildScheduledActionsString(t *testing.T) {
+	actions := []interface{}{
+		map[string]interface{}{"action": "poweroff", "time": 1600000000, "repeat": "", "days": "", "end_type": "never", "end_value": 0},
+		map[string]interface{}{"action": "snapshot-create", "time": 1600000000, "repeat": "weekly", "days": "0, 6", "end_type": "times", "end_value": 4},
+	}
+
+	assert.Equal(t,
+		"SCHED_ACTION = [\n  ACTION = \"poweroff\",\n  TIME = \"1600000000\" ]\n"+
+			"SCHED_ACTION = [\n  ACTION = \"snapshot-create\",\n  DAYS = \"0,6\",\n  END_TYPE = \"1\",\n  END_VALUE = \"4\",\n  REPEAT = \"0\",\n  TIME = \"1600000000\" ]",
+		buildScheduledActionsString(actions))
+}
+
+func TestValidateScheduledActions(t *testing.T) {
+	action := func(repeat string, days string, endType string, endValue int) []interface{} {
+		return []interface{}{map[string]interface{}{"action": "reboot", "time": 1600000000, "repeat": repeat, "days": days, "end_type": endType, "end_value": endValue}}
+	}
+
+	assert.NoError(t, validateScheduledActions(action("", "", "never", 0)))
+	assert.NoError(t, validateScheduledActions(action("monthly", "1,15", "date", 1700000000)))
+	assert.NoError(t, validateScheduledActions(action("hourly", "12", "never", 0)))
+	assert.Error(t, validateScheduledActions(action("", "0", "never", 0)))
+	assert.Error(t, validateScheduledActions(action("weekly", "", "never", 0)))
+	assert.Error(t, validateScheduledActions(action("weekly", "7", "never", 0)))
+	assert.Error(t, validateScheduledActions(action("hourly", "1,2", "never", 0)))
+	assert.Error(t, validateScheduledActions(action("weekly", "0", "times", 0)))
+}
+
+func TestSynchronizeScheduledActionsKeepsConfiguredTimeOfRepeatedActions(t *testing.T) {
+	state := []interface{}{
+		map[string]interface{}{"action": "snapshot-create", "time": 1600000000, "repeat": "weekly", "days": "0", "end_type": "never", "end_value": 0},
+		map[string]interface{}{"action": "poweroff", "time": 1600000000, "repeat": "", "days": "", "end_type": "never", "end_value": 0},
+	}
+	vmActions := []*VmSchedAction{
+		{Id: 0, Action: "snapshot-create", Time: "1600604800", Repeat: "0", Days: "0", EndType: "0"},
+		{Id: 1, Action: "poweroff", Time: "1600100000"},
+	}
+
+	synchronized := synchronizeScheduledActions(state, vmActions)
+
+	assert.Equal(t, 1600000000, synchronized[0].(map[string]interface{})["time"])
+	assert.Equal(t, "weekly", synchronized[0].(map[string]interface{})["repeat"])
+	assert.Equal(t, "never", synchronized[0].(map[string]interface{})["end_type"])
+	assert.Equal(t, 1600100000, synchronized[1].(map[string]interface{})["time"])
+	assert.Equal(t, "never", synchronized[1].(map[string]interface{})["end_type"])
+}
+
+func TestReconcileScheduledActions(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.info", []interface{}{12}).Return(`<VM><ID>12</ID><USER_TEMPLATE>
+		<SCHED_ACTION><ACTION>snapshot-create</ACTION><DAYS>0</DAYS><END_TYPE>0</END_TYPE><ID>0</ID><REPEAT>0</REPEAT><TIME>1600604800</TIME></SCHED_ACTION>
+		<SCHED_ACTION><ACTION>poweroff</ACTION><ID>1</ID><TIME>1600100000</TIME></SCHED_ACTION>
+		<SCHED_ACTION><ACTION>reboot</ACTION><ID>2</ID><TIME>1600200000</TIME></SCHED_ACTION>
+	</USER_TEMPLATE></VM>`, nil)
+	mockClient.On("Call", "one.vm.schedupdate", []interface{}{12, 1, "SCHED_ACTION = [\n  ACTION = \"poweroff\",\n  TIME = \"1600300000\" ]"}).Return("12", nil).Once()
+	mockClient.On("Call", "one.vm.scheddelete", []interface{}{12, 2}).Return("12", nil).Once()
+
+	actions := []interface{}{
+		map[string]interface{}{"action": "snapshot-create", "time": 1600000000, "repeat": "weekly", "days": "0", "end_type": "never", "end_value": 0},
+		map[string]interface{}{"action": "poweroff", "time": 1600300000, "repeat": "", "days": "", "end_type": "never", "end_value": 0},
+	}
+
+	assert.NoError(t, reconcileScheduledActions(mockClient, 12, actions))
+	mockClient.AssertExpectations(t)
+}
+
+func TestReconcileScheduledActionsAddsNewActions(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.info", []interface{}{12}).Return(`<VM><ID>12</ID><USER_TEMPLATE></USER_TEMPLATE></VM>`, nil)
+	mockClient.On("Call", "one.vm.schedadd", []interface{}{12, "SCHED_ACTION = [\n  ACTION = \"reboot\",\n  TIME = \"1600000000\" ]"}).Return("0", nil).Once()
+
+	actions := []interface{}{
+		map[string]interface{}{"action": "reboot", "time": 1600000000, "repeat": "", "days": "", "end_type": "never", "end_value": 0},
+	}
+
+	assert.NoError(t, reconcileScheduledActions(mockClient, 12, actions))
+	mockClient.AssertExpectations(t)
+}
+
+func TestVmTimeoutsDefaultToTenMinutes(t *testing.T) {
+	timeouts := resourceVm().Timeouts
+
+	assert.Equal(t, 10*time.Minute, *timeouts.Create)
+	assert.Equal(t, 10*time.Minute, *timeouts.Delete)
+	assert.Equal(t, 10*time.Minute, vmTimeout(0))
+	assert.Equal(t, 25*time.Minute, vmTimeout(25*time.Minute))
+}
+
+func TestVmTerminateAction(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm"})
+
+	assert.Equal(t, "terminate-hard", vmTerminateAction(d.Get("hard_shutdown").(bool)))
+	assert.Equal(t, "terminate", vmTerminateAction(false))
+}
+
+func TestVmDestroyAction(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm"})
+	assert.Equal(t, "terminate-hard", vmDestroyAction(d))
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm", "hard_shutdown": false})
+	assert.Equal(t, "terminate", vmDestroyAction(d))
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm", "destroy_action": "undeploy"})
+	assert.Equal(t, "undeploy", vmDestroyAction(d))
+
+	for _, action := range vmDestroyActions {
+		assert.Contains(t, vmActionStates, action)
+		assert.Contains(t, vmDestroyTargetStates, action)
+	}
+}
+
+func testVmNicState(nicIpChange string) map[string]string {
+	state := map[string]string{
+		"name":          "web",
+		"template_id":   "1",
+		"permissions":   "640",
+		"nic_ip_change": nicIpChange,
+		"nic.#":         "3",
+	}
+	for i, ip := range []string{"10.0.0.5", "10.1.0.5", "10.2.0.5"} {
+		prefix := fmt.Sprintf("nic.%d.", i)
+		state[prefix+"network_id"] = fmt.Sprint(i + 2)
+		state[prefix+"ip"] = ip
+		state[prefix+"mac"] = fmt.Sprintf("02:00:0a:0%d:00:05", i)
+		state[prefix+"nic_id"] = fmt.Sprint(i)
+	}
+	return state
+}
+
+const testVmWithNics = `<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE>
+	<NIC><NIC_ID>0</NIC_ID><NETWORK_ID>2</NETWORK_ID></NIC>
+	<NIC><NIC_ID>1</NIC_ID><NETWORK_ID>3</NETWORK_ID></NIC>
+	<NIC><NIC_ID>2</NIC_ID><NETWORK_ID>4</NETWORK_ID></NIC>
+</TEMPLATE></VM>`
+
+func testNicReconcileClient() (*MockRpc, *Client) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.pollInterval = 10 * time.Millisecond
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithNics)).Return(nil)
+	return rpc, client
+}
+
+func TestReconcileNicsDetachesOnlyRemovedNics(t *testing.T) {
+	d := testVmUpdate(t, testVmNicState("recreate"), map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"nic":         []interface{}{map[string]interface{}{"network_id": 3}, map[string]interface{}{"network_id": 4}},
+	})
+
+	rpc, client := testNicReconcileClient()
+	rpc.On("Call", "one.vm.detachnic", []interface{}{"user:pass", 42, 0}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.NoError(t, reconcileNics(d, client))
+	assert.Equal(t, []string{"one.vm.info", "one.vm.detachnic", "one.vm.info"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestReconcileNicsReplacesChangedNics(t *testing.T) {
+	d := testVmUpdate(t, testVmNicState("recreate"), map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"nic": []interface{}{
+			map[string]interface{}{"network_id": 2},
+			map[string]interface{}{"network_id": 3, "model": "virtio"},
+			map[string]interface{}{"network_id": 4},
+			map[string]interface{}{"network_id": 5},
+		},
+	})
+
+	rpc, client := testNicReconcileClient()
+	rpc.On("Call", "one.vm.detachnic", []interface{}{"user:pass", 42, 1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.attachnic", []interface{}{"user:pass", 42, "NIC = [\n  MODEL = \"virtio\",\n  NETWORK_ID = \"3\" ]"}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.attachnic", []interface{}{"user:pass", 42, "NIC = [\n  NETWORK_ID = \"5\" ]"}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.NoError(t, reconcileNics(d, client))
+	assert.Equal(t, []string{
+		"one.vm.info",
+		"one.vm.detachnic", "one.vm.info",
+		"one.vm.attachnic", "one.vm.info",
+		"one.vm.attachnic", "one.vm.info",
+	}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestReconcileNicsSwapsChangedAddresses(t *testing.T) {
+	d := testVmUpdate(t, testVmNicState("swap"), map[string]interface{}{
+		"name":          "web",
+		"template_id":   1,
+		"permissions":   "640",
+		"nic_ip_change": "swap",
+		"nic": []interface{}{
+			map[string]interface{}{"network_id": 2},
+			map[string]interface{}{"network_id": 3, "ip": "10.1.0.9"},
+			map[string]interface{}{"network_id": 4},
+		},
+	})
+
+	rpc, client := testNicReconcileClient()
+	rpc.On("Call", "one.vm.attachnic", []interface{}{"user:pass", 42, "NIC = [\n  IP = \"10.1.0.9\",\n  NETWORK_ID = \"3\" ]"}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.detachnic", []interface{}{"user:pass", 42, 1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.NoError(t, reconcileNics(d, client))
+	assert.Equal(t, []string{
+		"one.vm.info",
+		"one.vm.attachnic", "one.vm.info",
+		"one.vm.detachnic", "one.vm.info",
+	}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestChangedNicAddresses(t *testing.T) {
+	old := []interface{}{
+		map[string]interface{}{"network_id": 2, "ip": "10.0.0.5", "nic_id": 0},
+		map[string]interface{}{"network_id": 3, "ip": "10.1.0.5", "nic_id": 1},
+	}
+	new := []interface{}{
+		map[string]interface{}{"network_id": 2, "ip": "10.0.0.5", "nic_id": 0},
+		map[string]interface{}{"network_id": 3, "ip": "10.1.0.9", "nic_id": 1},
+		map[string]interface{}{"network_id": 4, "ip": "10.2.0.1", "nic_id": 0},
+	}
+
+	assert.Equal(t, map[int]int{1: 1}, changedNicAddresses(old, new))
+	assert.Empty(t, changedNicAddresses(old, old))
+
+	// the first NIC is removed, the NICs after it are compared with the NICs they match
+	shifted := []interface{}{
+		map[string]interface{}{"network_id": 3, "ip": "10.1.0.5", "nic_id": 0},
+	}
+	assert.Empty(t, changedNicAddresses(old, shifted))
+
+	shifted = []interface{}{
+		map[string]interface{}{"network_id": 3, "ip": "10.1.0.9", "nic_id": 0},
+	}
+	assert.Equal(t, map[int]int{0: 1}, changedNicAddresses(old, shifted))
+}
+
+func TestNicSecurityGroups(t *testing.T) {
+	nic := map[string]interface{}{"network_id": 2, "ip": "", "mac": "", "security_groups": []interface{}{105, 101}}
+
+	assert.Equal(t, []int{100, 101, 105}, nicSecurityGroups([]interface{}{101, 100}, nic))
+	assert.Equal(t, "NIC = [\n  NETWORK_ID = \"2\",\n  SECURITY_GROUPS = \"100,101,105\" ]", buildNicsString([]interface{}{nic}, []interface{}{100}))
+}
+
+func TestSecurityGroupChanges(t *testing.T) {
+	// the baseline group 100 is replaced by 102, the NIC's own group 105 stays
+	attach, detach := securityGroupChanges([]int{100, 105}, []int{102, 105}, []int{0, 100, 105})
+
+	assert.Equal(t, []int{102}, attach)
+	assert.Equal(t, []int{100}, detach)
+}
+
+func TestSynchronizeNicsReportsEffectiveSecurityGroups(t *testing.T) {
+	state := []interface{}{
+		map[string]interface{}{"network_id": 2, "model": "", "filter": "", "security_groups": []interface{}{105}},
+	}
+	vmNics := []*VmNic{{NicId: 0, NetworkId: 2, SecurityGroups: "0,100,105"}}
+
+	synchronized := synchronizeNics(state, vmNics, nil, true)
+	assert.Equal(t, []interface{}{105}, synchronized[0].(map[string]interface{})["security_groups"])
+	assert.Equal(t, []int{0, 100, 105}, synchronized[0].(map[string]interface{})["effective_security_groups"])
+}
+
+func TestPreUpdateSnapshotsAreNotManaged(t *testing.T) {
+	vmSnapshots := []*VmSnapshot{
+		{SnapshotId: 0, Name: "base"},
+		{SnapshotId: 1, Name: preUpdateSnapshotPrefix + "20200101120000"},
+	}
+	configured := []interface{}{map[string]interface{}{"name": "base"}}
+
+	create, remove, err := snapshotChanges(configured, vmSnapshots, false)
+	assert.NoError(t, err)
+	assert.Empty(t, create)
+	assert.Empty(t, remove)
+
+	assert.Len(t, synchronizeSnapshots(configured, vmSnapshots, false), 1)
+}
+
+func TestHasDisruptiveChange(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm"})
+	assert.False(t, hasDisruptiveChange(d))
+
+	d = schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"name": "vm", "memory_slots": 4})
+	assert.True(t, hasDisruptiveChange(d))
+}
+
+func TestLoadVmReadsDiskDetails(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.info", []interface{}{12}).Return(`<VM><ID>12</ID><TEMPLATE>
+		<DISK><DISK_ID>0</DISK_ID><IMAGE_ID>1</IMAGE_ID><SIZE>10240</SIZE><TARGET>vda</TARGET></DISK>
+		<DISK><DISK_ID>1</DISK_ID><IMAGE_ID>3</IMAGE_ID><SIZE>2048</SIZE><TARGET>vdb</TARGET></DISK>
+	</TEMPLATE></VM>`, nil)
+
+	vm, err := loadVm(mockClient, 12)
+
+	assert.NoError(t, err)
+	assert.Len(t, vm.Disks, 2)
+	assert.Equal(t, 2048, vm.Disks[1].Size)
+	assert.Equal(t, "vdb", vm.Disks[1].Target)
+	assert.Empty(t, synchronizeDisks(nil, nil, nil, false))
+}
+
+func TestDiskChanges(t *testing.T) {
+	old := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": false, "disk_id": 1, "size": 2048, "target": "vdb"},
+		map[string]interface{}{"image_id": 4, "persistent": false, "disk_id": 2, "size": 1024, "target": "vdc"},
+		map[string]interface{}{"image_id": 5, "persistent": false, "disk_id": 3, "size": 1024, "target": "vdd"},
+	}
+	new := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": false, "disk_id": 1, "size": 2048, "target": "vdb"},
+		map[string]interface{}{"image_id": 4, "persistent": false, "disk_id": 2, "size": 4096, "target": "vdc"},
+		map[string]interface{}{"image_id": 6, "persistent": false, "disk_id": 3, "size": 1024, "target": "vdd"},
+	}
+
+	attach, detach, resize, err := diskChanges(old, new)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{map[string]interface{}{"image_id": 6, "persistent": false, "disk_id": 3, "size": 0, "target": ""}}, attach)
+	assert.Equal(t, []int{3}, detach)
+	assert.Equal(t, map[int]int{2: 4096}, resize)
+}
+
+func TestDiskChangesRemovingTheFirstDisk(t *testing.T) {
+	old := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": false, "disk_id": 1, "size": 2048, "target": "vdb"},
+		map[string]interface{}{"image_id": 4, "persistent": false, "disk_id": 2, "size": 1024, "target": "vdc"},
+		map[string]interface{}{"image_id": 5, "persistent": false, "disk_id": 3, "size": 1024, "target": "vdd"},
+	}
+	// size and target are taken over from the disk at the same position of the state
+	new := []interface{}{
+		map[string]interface{}{"image_id": 4, "persistent": false, "disk_id": 1, "size": 2048, "target": "vdb"},
+		map[string]interface{}{"image_id": 5, "persistent": false, "disk_id": 2, "size": 1024, "target": "vdc"},
+	}
+
+	attach, detach, resize, err := diskChanges(old, new)
+
+	assert.NoError(t, err)
+	assert.Empty(t, attach)
+	assert.Equal(t, []int{1}, detach)
+	assert.Empty(t, resize)
+}
+
+func TestDiskChangesReattachesChangedPersistence(t *testing.T) {
+	old := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": false, "disk_id": 1, "size": 2048, "target": "vdb"},
+	}
+	new := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": true, "disk_id": 1, "size": 2048, "target": "vdb"},
+	}
+
+	attach, detach, _, err := diskChanges(old, new)
+
+	assert.NoError(t, err)
+	assert.Len(t, attach, 1)
+	assert.Equal(t, []int{1}, detach)
+}
+
+func TestDiskChangesRejectsShrinking(t *testing.T) {
+	old := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": false, "disk_id": 1, "size": 2048, "target": "vdb"},
+	}
+	new := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": false, "disk_id": 1, "size": 1024, "target": "vdb"},
+	}
+
+	_, _, _, err := diskChanges(old, new)
+
+	assert.EqualError(t, err, "Disk 1 with image 3 can't be shrunk from 2048 MB to 1024 MB")
+}
+
+// testVmUpdate returns the data of VM 42 being updated from the state to the configuration.
+func testVmUpdate(t *testing.T, state map[string]string, config map[string]interface{}) *schema.ResourceData {
+	r := resourceVm()
+	s := &terraform.InstanceState{ID: "42", Attributes: state}
+
+	diff, err := r.Diff(s, terraform.NewResourceConfigRaw(config), nil)
+	assert.NoError(t, err)
+	d, err := schema.InternalMap(r.Schema).Data(s, diff)
+	assert.NoError(t, err)
+
+	return d
+}
+
+// testRpcMethods returns the methods called on the mock, in order.
+func testRpcMethods(rpc *MockRpc) []string {
+	methods := make([]string, 0, len(rpc.Calls))
+	for _, call := range rpc.Calls {
+		methods = append(methods, call.Arguments.String(0))
+	}
+	return methods
+}
+
+var testVmDiskState = map[string]string{
+	"name":                      "web",
+	"template_id":               "1",
+	"permissions":               "640",
+	"disk.#":                    "3",
+	"disk.0.image_id":           "3",
+	"disk.0.image_datastore_id": "-1",
+	"disk.0.persistent":         "false",
+	"disk.0.disk_id":            "1",
+	"disk.0.size":               "2048",
+	"disk.0.target":             "vdb",
+	"disk.1.image_id":           "4",
+	"disk.1.image_datastore_id": "-1",
+	"disk.1.persistent":         "false",
+	"disk.1.disk_id":            "2",
+	"disk.1.size":               "1024",
+	"disk.1.target":             "vdc",
+	"disk.2.image_id":           "5",
+	"disk.2.image_datastore_id": "-1",
+	"disk.2.persistent":         "false",
+	"disk.2.disk_id":            "3",
+	"disk.2.size":               "1024",
+	"disk.2.target":             "vdd",
+}
+
+const testVmWithDisks = `<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE>
+	<DISK><DISK_ID>1</DISK_ID><IMAGE_ID>3</IMAGE_ID></DISK>
+	<DISK><DISK_ID>2</DISK_ID><IMAGE_ID>4</IMAGE_ID></DISK>
+	<DISK><DISK_ID>3</DISK_ID><IMAGE_ID>5</IMAGE_ID></DISK>
+</TEMPLATE></VM>`
+
+func TestReconcileDisksDetachesOnlyRemovedDisks(t *testing.T) {
+	d := testVmUpdate(t, testVmDiskState, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"disk":        []interface{}{map[string]interface{}{"image_id": 4}, map[string]interface{}{"image_id": 5}},
+	})
+
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.pollInterval = 10 * time.Millisecond
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithDisks)).Return(nil)
+	rpc.On("Call", "one.vm.detach", []interface{}{"user:pass", 42, 1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.NoError(t, reconcileDisks(d, client))
+	assert.Equal(t, []string{"one.vm.info", "one.vm.detach", "one.vm.info"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestReconcileDisksWaitsForPoweredOffVmToReturnToPoweroff(t *testing.T) {
+	d := testVmUpdate(t, testVmDiskState, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"disk":        []interface{}{map[string]interface{}{"image_id": 4}, map[string]interface{}{"image_id": 5}},
+	})
+
+	poweredOff := strings.Replace(testVmWithDisks, "<STATE>3</STATE><LCM_STATE>3</LCM_STATE>", "<STATE>8</STATE><LCM_STATE>0</LCM_STATE>", 1)
+	// HOTPLUG_EPILOG_POWEROFF
+	hotplugging := strings.Replace(testVmWithDisks, "<LCM_STATE>3</LCM_STATE>", "<LCM_STATE>18</LCM_STATE>", 1)
+
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.pollInterval = 10 * time.Millisecond
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, poweredOff)).Return(nil).Once()
+	rpc.On("Call", "one.vm.detach", []interface{}{"user:pass", 42, 1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, hotplugging)).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, poweredOff)).Return(nil).Once()
+
+	assert.NoError(t, reconcileDisks(d, client))
+	assert.Equal(t, []string{"one.vm.info", "one.vm.detach", "one.vm.info", "one.vm.info"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestReconcileDisksResizesInPlace(t *testing.T) {
+	d := testVmUpdate(t, testVmDiskState, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"disk": []interface{}{
+			map[string]interface{}{"image_id": 3},
+			map[string]interface{}{"image_id": 4, "size": 4096},
+			map[string]interface{}{"image_id": 6},
+		},
+	})
+
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.pollInterval = 10 * time.Millisecond
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmWithDisks)).Return(nil)
+	rpc.On("Call", "one.vm.detach", []interface{}{"user:pass", 42, 3}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.diskresize", []interface{}{"user:pass", 42, 2, "4096"}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.attach", []interface{}{"user:pass", 42, "DISK = [\n  IMAGE_ID = \"6\" ]"}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.NoError(t, reconcileDisks(d, client))
+	assert.Equal(t, []string{
+		"one.vm.info",
+		"one.vm.detach", "one.vm.info",
+		"one.vm.diskresize", "one.vm.info",
+		"one.vm.attach", "one.vm.info",
+	}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestBuildDisksStringWithSizeAndTarget(t *testing.T) {
+	disks := []interface{}{
+		map[string]interface{}{"image_id": 3, "persistent": false, "size": 4096, "target": "vdb"},
+	}
+	assert.Equal(t, "DISK = [\n  IMAGE_ID = \"3\",\n  SIZE = \"4096\",\n  TARGET = \"vdb\" ]", buildDisksString(disks))
+}
+
+func TestSynchronizeUserTemplateAttributesSkipsSchedMessage(t *testing.T) {
+	state := map[string]interface{}{"attr1": "value1", "sched_message": ""}
+	vmInfo := map[string]string{
+		"USER_TEMPLATE/ATTR1":         "value1",
+		"USER_TEMPLATE/SCHED_MESSAGE": "Mon Jan 1 00:00:00 2020 : No host with enough capacity to deploy the VM",
+	}
+
+	assert.Equal(t, map[string]string{"attr1": "value1"}, synchronizeUserTemplateAttributes(state, vmInfo, nil))
+}
+
+func TestSameNic(t *testing.T) {
+	vmNic := map[string]interface{}{"network_id": 2, "ip": "10.0.0.5", "mac": "02:00:0a:00:00:05", "model": "", "filter": "", "inbound_avg_bw": 0}
+
+	assert.True(t, sameNic(vmNic, map[string]interface{}{"network_id": 2, "ip": "", "mac": "", "model": "", "filter": "", "inbound_avg_bw": 0}))
+	assert.False(t, sameNic(vmNic, map[string]interface{}{"network_id": 3, "ip": "", "mac": "", "model": "", "filter": "", "inbound_avg_bw": 0}))
+	assert.False(t, sameNic(vmNic, map[string]interface{}{"network_id": 2, "ip": "10.0.0.6", "mac": "", "model": "", "filter": "", "inbound_avg_bw": 0}))
+	assert.False(t, sameNic(vmNic, map[string]interface{}{"network_id": 2, "ip": "", "mac": "", "model": "virtio", "filter": "", "inbound_avg_bw": 0}))
+	assert.False(t, sameNic(vmNic, map[string]interface{}{"network_id": 2, "ip": "", "mac": "", "model": "", "filter": "", "inbound_avg_bw": 100}))
+}
+
+func TestCheckUniqueVmName(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vmpool.info", []interface{}{-2, 0, -poolPageSize, -1}).Return(`<VM_POOL>
+		<VM><ID>12</ID><NAME>web</NAME></VM>
+		<VM><ID>13</ID><NAME>db</NAME></VM>
+	</VM_POOL>`, nil)
+
+	assert.NoError(t, checkUniqueVmName(mockClient, "cache"))
+	err := checkUniqueVmName(mockClient, "web")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ID 12")
+}
+
+func TestCheckUniqueVmNamePassesPoolErrorsThrough(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vmpool.info", []interface{}{-2, 0, -poolPageSize, -1}).Return("", &OneError{Code: OneErrorAuthorization, Message: "[one.vmpool.info] Not authorized"})
+
+	err := checkUniqueVmName(mockClient, "web")
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "already exists")
+	assert.Contains(t, err.Error(), "Not authorized")
+}
+
+func TestVmInfoJsonLeavesOutMonitoring(t *testing.T) {
+	attributes := map[string]string{
+		"NAME":                      "web",
+		"TEMPLATE/CONTEXT/ETH0_IP":  "10.0.0.5",
+		"MONITORING/CPU":            "12",
+		"LAST_POLL":                 "1600000000",
+		"USER_TEMPLATE/DESCRIPTION": "web server",
+	}
+
+	info, err := vmInfoJson(attributes, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"NAME":"web","TEMPLATE/CONTEXT/ETH0_IP":"10.0.0.5","USER_TEMPLATE/DESCRIPTION":"web server"}`, info)
+}
+
+func TestSynchronizeNicsReportsNetworkAndAddressRange(t *testing.T) {
+	var vm *Vm
+	err := xml.Unmarshal([]byte(`<VM><ID>7</ID><TEMPLATE>
+		<NIC><NIC_ID>0</NIC_ID><NETWORK_ID>2</NETWORK_ID><AR_ID>0</AR_ID><IP>10.0.2.5</IP></NIC>
+		<NIC><NIC_ID>1</NIC_ID><NETWORK_ID>5</NETWORK_ID><AR_ID>3</AR_ID><IP>192.168.5.9</IP></NIC>
+	</TEMPLATE></VM>`), &vm)
+	assert.NoError(t, err)
+
+	state := []interface{}{
+		map[string]interface{}{"network_id": 5, "model": "", "filter": ""},
+		map[string]interface{}{"network_id": 2, "model": "", "filter": ""},
+	}
+
+	synchronized := synchronizeNics(state, vm.Nics, []interface{}{}, false)
+	assert.Len(t, synchronized, 2)
+	assert.Equal(t, 5, synchronized[0].(map[string]interface{})["network_id"])
+	assert.Equal(t, 3, synchronized[0].(map[string]interface{})["ar_id"])
+	assert.Equal(t, "192.168.5.9", synchronized[0].(map[string]interface{})["ip"])
+	assert.Equal(t, 2, synchronized[1].(map[string]interface{})["network_id"])
+	assert.Equal(t, 0, synchronized[1].(map[string]interface{})["ar_id"])
+}
+
+func TestHotResize(t *testing.T) {
+	hotResize := []interface{}{map[string]interface{}{"cpu_hot_add_enabled": true, "memory_hot_add_enabled": false}}
+	assert.Equal(t, "HOT_RESIZE = [\n  CPU_HOT_ADD_ENABLED = \"YES\",\n  MEMORY_HOT_ADD_ENABLED = \"NO\" ]", buildHotResizeString(hotResize))
+
+	attributes := map[string]string{"TEMPLATE/HOT_RESIZE/CPU_HOT_ADD_ENABLED": "YES", "TEMPLATE/HOT_RESIZE/MEMORY_HOT_ADD_ENABLED": "NO"}
+	assert.Equal(t, hotResize, readHotResize(attributes))
+	assert.Empty(t, readHotResize(map[string]string{"TEMPLATE/CPU": "1"}))
+}
+
+func TestResizeNeedsPowerCycle(t *testing.T) {
+	cpuOnly := []interface{}{map[string]interface{}{"cpu_hot_add_enabled": true, "memory_hot_add_enabled": false}}
+	both := []interface{}{map[string]interface{}{"cpu_hot_add_enabled": true, "memory_hot_add_enabled": true}}
+
+	assert.True(t, resizeNeedsPowerCycle([]interface{}{}, true, false))
+	assert.True(t, resizeNeedsPowerCycle([]interface{}{}, false, true))
+	assert.False(t, resizeNeedsPowerCycle(cpuOnly, true, false))
+	assert.True(t, resizeNeedsPowerCycle(cpuOnly, true, true))
+	assert.False(t, resizeNeedsPowerCycle(both, true, true))
+}
+
+func TestDesiredStateActions(t *testing.T) {
+	tests := []struct {
+		current string
+		desired string
+		actions []string
+	}{
+		{"RUNNING", "running", nil},
+		{"RUNNING", "poweroff", []string{"poweroff"}},
+		{"RUNNING", "poweroff-hard", []string{"poweroff-hard"}},
+		{"RUNNING", "suspended", []string{"suspend"}},
+		{"POWEROFF", "running", []string{"resume"}},
+		{"POWEROFF", "poweroff-hard", nil},
+		{"POWEROFF", "suspended", []string{"resume", "suspend"}},
+		{"SUSPENDED", "poweroff", []string{"resume", "poweroff"}},
+		{"SUSPENDED", "suspended", nil},
+		{"UNDEPLOYED", "running", []string{"resume"}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.actions, desiredStateActions(test.current, test.desired), "%s to %s", test.current, test.desired)
+	}
+}
+
+func TestReadDesiredState(t *testing.T) {
+	assert.Equal(t, "running", readDesiredState("RUNNING", "poweroff"))
+	assert.Equal(t, "poweroff", readDesiredState("POWEROFF", "running"))
+	assert.Equal(t, "poweroff-hard", readDesiredState("POWEROFF", "poweroff-hard"))
+	assert.Equal(t, "suspended", readDesiredState("SUSPENDED", "running"))
+	assert.Equal(t, "", readDesiredState("ACTIVE", "running"))
+}
+
+func TestVmAttributeRefreshFuncWaitsForValue(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.info", []interface{}{12}).Return(`<VM><ID>12</ID><TEMPLATE><CONTEXT><SET_HOSTNAME>pending</SET_HOSTNAME></CONTEXT></TEMPLATE></VM>`, nil).Once()
+	mockClient.On("Call", "one.vm.info", []interface{}{12}).Return(`<VM><ID>12</ID><TEMPLATE><CONTEXT><SET_HOSTNAME>ok</SET_HOSTNAME></CONTEXT></TEMPLATE></VM>`, nil).Once()
+
+	refresh := vmAttributeRefreshFunc(mockClient, 12, "TEMPLATE/CONTEXT/SET_HOSTNAME", "ok")
+
+	_, state, err := refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "attributeMismatch", state)
+
+	_, state, err = refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "TEMPLATE/CONTEXT/SET_HOSTNAME", state)
+	mockClient.AssertExpectations(t)
+}
+
+func TestVmAttributeRefreshFuncWaitsForPresence(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.info", []interface{}{12}).Return(`<VM><ID>12</ID><TEMPLATE></TEMPLATE></VM>`, nil).Once()
+	mockClient.On("Call", "one.vm.info", []interface{}{12}).Return(`<VM><ID>12</ID><TEMPLATE><CONTEXT><SET_HOSTNAME>pending</SET_HOSTNAME></CONTEXT></TEMPLATE></VM>`, nil).Once()
+
+	refresh := vmAttributeRefreshFunc(mockClient, 12, "TEMPLATE/CONTEXT/SET_HOSTNAME", "")
+
+	_, state, err := refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "attributeNotFound", state)
+
+	_, state, err = refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "TEMPLATE/CONTEXT/SET_HOSTNAME", state)
+}
+
+func TestReadVmUsage(t *testing.T) {
+	attributes := map[string]string{
+		"MONITORING/CPU":    "12.5",
+		"MONITORING/MEMORY": "786432",
+		"MONITORING/NETRX":  "123456789012",
+		"MONITORING/NETTX":  "4096",
+	}
+	assert.Equal(t, map[string]interface{}{"cpu_usage": 12.5, "memory_usage": 786432, "net_rx": 123456789012, "net_tx": 4096}, readVmUsage(attributes))
+
+	assert.Equal(t, map[string]interface{}{"cpu_usage": 0.0, "memory_usage": 0, "net_rx": 0, "net_tx": 0}, readVmUsage(map[string]string{"NAME": "web"}))
+}
+
+func TestLockVm(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.lock", []interface{}{42, 3}).Return("42", nil).Once()
+	mockClient.On("Call", "one.vm.unlock", []interface{}{42}).Return("42", nil).Once()
+
+	assert.NoError(t, lockVm(mockClient, 42, "admin"))
+	assert.NoError(t, lockVm(mockClient, 42, ""))
+	mockClient.AssertExpectations(t)
+}
+
+func TestVmUpdateRelocksAfterAFailedChange(t *testing.T) {
+	d := testVmUpdate(t, map[string]string{"name": "web", "template_id": "1", "permissions": "640", "lock": "use"}, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "600",
+		"lock":        "use",
+	})
+
+	rpc, client := testNicReconcileClient()
+	rpc.On("Call", "one.vm.unlock", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.chmod", mock.Anything, mock.Anything).Run(answer(false, "[one.vm.chmod] Not authorized", int64(OneErrorAuthorization))).Return(nil).Once()
+	rpc.On("Call", "one.vm.lock", []interface{}{"user:pass", 42, 1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+
+	assert.Error(t, resourceVmUpdate(d, client))
+	assert.Equal(t, []string{"one.vm.info", "one.vm.unlock", "one.vm.chmod", "one.vm.lock"}, testRpcMethods(rpc))
+	rpc.AssertExpectations(t)
+}
+
+func TestReadVmLock(t *testing.T) {
+	assert.Equal(t, "use", readVmLock(map[string]string{"LOCK/LOCKED": "1", "LOCK/OWNER": "0"}))
+	assert.Equal(t, "all", readVmLock(map[string]string{"LOCK/LOCKED": "4"}))
+	assert.Equal(t, "", readVmLock(map[string]string{"NAME": "web"}))
+}
+
+func testVmOnHost(hostId int, lcmState int) string {
+	return fmt.Sprintf("<VM><STATE>3</STATE><LCM_STATE>%d</LCM_STATE><HISTORY_RECORDS><HISTORY><HID>%d</HID></HISTORY></HISTORY_RECORDS></VM>", lcmState, hostId)
+}
+
+func TestMigrateVm(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.pollInterval = 10 * time.Millisecond
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"host_id": 2, "migrate_live": true})
+	d.SetId("42")
+
+	info := []interface{}{"user:pass", 42}
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmOnHost(1, 3))).Return(nil).Once()
+	rpc.On("Call", "one.vm.migrate", []interface{}{"user:pass", 42, 2, true, false, -1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	// still RUNNING on the old host, then MIGRATE and RUNNING on the new one
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmOnHost(1, 3))).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmOnHost(2, 4))).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmOnHost(2, 3))).Return(nil).Once()
+
+	assert.NoError(t, migrateVm(d, client, time.Minute))
+	rpc.AssertExpectations(t)
+}
+
+func TestMigrateVmDeploysVmWithoutHistory(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	client.pollInterval = 10 * time.Millisecond
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"host_id": 2})
+	d.SetId("42")
+
+	info := []interface{}{"user:pass", 42}
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, "<VM><STATE>2</STATE><LCM_STATE>0</LCM_STATE></VM>")).Return(nil).Once()
+	rpc.On("Call", "one.vm.deploy", []interface{}{"user:pass", 42, 2, false, -1}, mock.Anything).Run(answer(true, int64(42))).Return(nil).Once()
+	rpc.On("Call", "one.vm.info", info, mock.Anything).Run(answer(true, testVmOnHost(2, 3))).Return(nil).Once()
+
+	assert.NoError(t, migrateVm(d, client, time.Minute))
+	assert.NotContains(t, testRpcMethods(rpc), "one.vm.migrate")
+	rpc.AssertExpectations(t)
+}
+
+func TestMigrateVmToUnchangedHost(t *testing.T) {
+	rpc := new(MockRpc)
+	client := failoverClient(rpc)
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"host_id": 0})
+	d.SetId("42")
+
+	rpc.On("Call", "one.vm.info", []interface{}{"user:pass", 42}, mock.Anything).Run(answer(true, testVmOnHost(0, 3))).Return(nil).Once()
+
+	assert.NoError(t, migrateVm(d, client, time.Minute))
+	rpc.AssertExpectations(t)
+}
+
+func TestWaitForVmMigrationFailsOnNewHost(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.info", []interface{}{42}).Return(testVmOnHost(2, 37), nil).Once()
+
+	assert.Error(t, waitForVmMigration(mockClient, 42, 2, time.Minute, 10*time.Millisecond))
+	mockClient.AssertExpectations(t)
+}
+
+func TestRenderVmName(t *testing.T) {
+	assert.Equal(t, "web-prod-42", renderVmName("web-prod-{{id}}", "ubuntu", 42, 0))
+	assert.Equal(t, "ubuntu-web-007-0042", renderVmName("{{template}}-web-{{index:3}}-{{id:4}}", "ubuntu", 42, 7))
+	assert.Equal(t, "web-{{name}}", renderVmName("web-{{name}}", "ubuntu", 42, 0))
+
+	_, errs := validateVmNameTemplate("web-{{index:2}}-{{id}}", "name_template")
+	assert.Empty(t, errs)
+	_, errs = validateVmNameTemplate("web-{{name}}", "name_template")
+	assert.Len(t, errs, 1)
+}
+
+func TestVmNameMatchesTemplate(t *testing.T) {
+	assert.True(t, vmNameMatchesTemplate("web.{{index:2}}-{{id}}", "web.03-42", 42, 3))
+	assert.True(t, vmNameMatchesTemplate("{{template}}-{{id}}", "renamed-template-42", 42, 0))
+	assert.False(t, vmNameMatchesTemplate("web.{{index:2}}-{{id}}", "webx03-42", 42, 3))
+	assert.False(t, vmNameMatchesTemplate("web-{{id}}", "db-42", 42, 0))
+}
+
+func TestRenameVmFromTemplate(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"template_id":   3,
+		"name_template": "{{template}}-{{index:2}}",
+		"name_index":    4,
+	})
+	d.SetId("42")
+
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.template.info", []interface{}{3, false}).Return("<VMTEMPLATE><ID>3</ID><NAME>web</NAME></VMTEMPLATE>", nil).Once()
+	mockClient.On("Call", "one.vm.rename", []interface{}{42, "web-04"}).Return("42", nil).Once()
+
+	assert.NoError(t, renameVmFromTemplate(mockClient, d))
+	mockClient.AssertExpectations(t)
+}
+
+func testVmTemplateSections() map[string]string {
+	return map[string]string{
+		"capacity":   buildAttributes(map[string]string{"CPU": "0.5", "VCPU": "2", "MEMORY": "1024"}),
+		"hot_resize": buildHotResizeString([]interface{}{map[string]interface{}{"cpu_hot_add_enabled": true, "memory_hot_add_enabled": false}}),
+		"os":         buildOsString([]interface{}{map[string]interface{}{"firmware": "UEFI", "secure_boot": false}}),
+		"disk": buildDisksString([]interface{}{
+			map[string]interface{}{"image_id": 3, "image": "", "image_datastore_id": -1, "image_owner": "", "persistent": false, "size": 0, "target": ""},
+			map[string]interface{}{"image_id": 8, "image": "", "image_datastore_id": -1, "image_owner": "", "persistent": true, "size": 10240, "target": "vdb"},
+		}),
+		"nic": buildNicsString([]interface{}{
+			map[string]interface{}{"network_id": 2, "ip": "10.0.0.5", "mac": "", "model": "virtio", "filter": "", "security_groups": []interface{}{}},
+		}, nil),
+		"context":       buildContextString(map[string]string{"NETWORK": "YES"}, map[string]interface{}{"start_script": "echo \"a=1\""}, nil, nil, nil),
+		"raw":           buildRawString([]interface{}{map[string]interface{}{"type": "kvm", "data": "<devices><input type=\"tablet\"/></devices>"}}),
+		"graphics":      buildGraphicsString([]interface{}{map[string]interface{}{"type": "VNC", "listen": "0.0.0.0", "port": 0, "keymap": ""}}),
+		"user_template": buildUserTemplateAttributesString(map[string]interface{}{"labels": "web", "owner": "ops"}),
+	}
+}
+
+func TestRenderVmTemplate(t *testing.T) {
+	template, err := renderVmTemplate(testVmTemplateSections())
+	assert.NoError(t, err)
+
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "vm_template.golden"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(golden), template+"\n")
+}
+
+func TestRenderVmTemplateRejectsDuplicateAttributes(t *testing.T) {
+	sections := testVmTemplateSections()
+	sections["user_template"] = buildUserTemplateAttributesString(map[string]interface{}{"MEMORY": "2048"})
+
+	_, err := renderVmTemplate(sections)
+	assert.EqualError(t, err, "The attribute MEMORY is set more than once in the VM template")
+}
+
+func TestRenderVmTemplateRejectsUnknownSections(t *testing.T) {
+	_, err := renderVmTemplate(map[string]string{"cpu": "CPU = \"1\""})
+	assert.Error(t, err)
+}
+
+func TestRenderVmTemplateOverride(t *testing.T) {
+	template, err := renderVmTemplate(map[string]string{
+		"capacity":          buildAttributes(map[string]string{"MEMORY": "1024"}),
+		"template_override": "CPU = 4\nCONTEXT = [ SSH_PUBLIC_KEY = \"key\" ]",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "MEMORY = \"1024\"\nCPU = 4\nCONTEXT = [ SSH_PUBLIC_KEY = \"key\" ]", template)
+
+	_, err = renderVmTemplate(map[string]string{
+		"capacity":          buildAttributes(map[string]string{"MEMORY": "1024"}),
+		"template_override": "memory = 2048",
+	})
+	assert.EqualError(t, err, "The attribute MEMORY is set more than once in the VM template")
+}
+
+func TestBuildUserTemplateAttributesUpdate(t *testing.T) {
+	old := map[string]interface{}{"labels": "web", "owner": "ops", "backup": "daily"}
+	new := map[string]interface{}{"labels": "web,prod", "backup": "weekly"}
+
+	assert.Equal(t, "labels = \"web,prod\"\nowner = \"\"", buildUserTemplateAttributesUpdate(old, new, []interface{}{"BACKUP"}))
+	assert.Equal(t, "", buildUserTemplateAttributesUpdate(map[string]interface{}{"backup": "daily"}, map[string]interface{}{}, []interface{}{"backup"}))
+}
+
+func TestSynchronizeUserTemplateAttributesKeepsIgnoredAttributes(t *testing.T) {
+	state := map[string]interface{}{"labels": "web", "backup_id": "placeholder"}
+	vmInfo := map[string]string{
+		"USER_TEMPLATE/LABELS":    "web",
+		"USER_TEMPLATE/BACKUP_ID": "42",
+		"USER_TEMPLATE/BACKUPS":   "3",
+	}
+
+	synchronized := synchronizeUserTemplateAttributes(state, vmInfo, []interface{}{"BACKUP_ID"})
+	assert.Equal(t, map[string]string{"labels": "web", "backup_id": "placeholder"}, synchronized)
+}
+
+func TestVmCustomizeDiffRequiresOneDiskImageReference(t *testing.T) {
+	config := func(disk map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"name":        "web",
+			"template_id": 1,
+			"permissions": "640",
+			"disk":        []interface{}{disk},
+		}
+	}
+
+	assert.NoError(t, testPlanCreate(resourceVm(), config(map[string]interface{}{"image_id": 3})))
+	assert.NoError(t, testPlanCreate(resourceVm(), config(map[string]interface{}{"image": "data"})))
+
+	err := testPlanCreate(resourceVm(), config(map[string]interface{}{"size": 1024}))
+	assert.EqualError(t, err, "Disk 0 requires either image_id or image")
+
+	err = testPlanCreate(resourceVm(), config(map[string]interface{}{"image_id": 3, "image": "data"}))
+	assert.EqualError(t, err, "Disk 0 can only set one of image_id and image")
+}
+
+func TestVmCustomizeDiffKeepsResolvedImageIds(t *testing.T) {
+	state := &terraform.InstanceState{
+		ID: "42",
+		Attributes: map[string]string{
+			"name":                      "web",
+			"template_id":               "1",
+			"permissions":               "640",
+			"disk.#":                    "1",
+			"disk.0.image":              "data",
+			"disk.0.image_id":           "3",
+			"disk.0.image_datastore_id": "-1",
+			"disk.0.disk_id":            "1",
+		},
+	}
+	config := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"disk":        []interface{}{map[string]interface{}{"image": "data"}, map[string]interface{}{"image": "logs"}},
+	})
+
+	_, err := resourceVm().Diff(state, config, nil)
+	assert.NoError(t, err)
+
+	config = terraform.NewResourceConfigRaw(map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"permissions": "640",
+		"disk":        []interface{}{map[string]interface{}{"image": "data"}, map[string]interface{}{"size": 1024}},
+	})
+
+	_, err = resourceVm().Diff(state, config, nil)
+	assert.EqualError(t, err, "Disk 1 requires either image_id or image")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"log"
 	"net"
 	"strconv"
@@ -15,18 +16,43 @@ type UserVnets struct {
 }
 
 type UserVnet struct {
-	Name        string       `xml:"NAME"`
-	Id          int          `xml:"ID"`
-	Uid         int          `xml:"UID"`
-	Gid         int          `xml:"GID"`
-	Uname       string       `xml:"UNAME"`
-	Gname       string       `xml:"GNAME"`
-	Permissions *Permissions `xml:"PERMISSIONS"`
-	Bridge      string       `xml:"BRIDGE"`
+	Name        string        `xml:"NAME"`
+	Id          int           `xml:"ID"`
+	Uid         int           `xml:"UID"`
+	Gid         int           `xml:"GID"`
+	Uname       string        `xml:"UNAME"`
+	Gname       string        `xml:"GNAME"`
+	Permissions *Permissions  `xml:"PERMISSIONS"`
+	Bridge      string        `xml:"BRIDGE"`
+	VlanId      string        `xml:"VLAN_ID"`
+	AutoVlanId  int           `xml:"VLAN_ID_AUTOMATIC"`
+	VnMad       string        `xml:"VN_MAD"`
+	Template    *VnetTemplate `xml:"TEMPLATE"`
+	ARs         []*VnetAR     `xml:"AR_POOL>AR"`
+}
+
+type VnetAR struct {
+	Id   int    `xml:"AR_ID"`
+	Type string `xml:"TYPE"`
+	Ip   string `xml:"IP"`
+	Mac  string `xml:"MAC"`
+	Size int    `xml:"SIZE"`
+	Vms  []int  `xml:"LEASES>LEASE>VM"`
+}
+
+var vnetARTypes = []string{"IP4", "IP6", "IP4_6", "ETHER"}
+
+type VnetTemplate struct {
+	InboundAvgBw   int `xml:"INBOUND_AVG_BW"`
+	InboundPeakBw  int `xml:"INBOUND_PEAK_BW"`
+	InboundPeakKb  int `xml:"INBOUND_PEAK_KB"`
+	OutboundAvgBw  int `xml:"OUTBOUND_AVG_BW"`
+	OutboundPeakBw int `xml:"OUTBOUND_PEAK_BW"`
+	OutboundPeakKb int `xml:"OUTBOUND_PEAK_KB"`
 }
 
 func resourceVnet() *schema.Resource {
-	return &schema.Resource{
+	r := &schema.Resource{
 		Create: resourceVnetCreate,
 		Read:   resourceVnetRead,
 		Exists: resourceVnetExists,
@@ -43,9 +69,10 @@ func resourceVnet() *schema.Resource {
 				Description: "Name of the vnet",
 			},
 			"description": {
-				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Description of the vnet, in OpenNebula's XML or String format",
+				Type:             schema.TypeString,
+				Required:         true,
+				Description:      "Description of the vnet, in OpenNebula's XML or String format",
+				DiffSuppressFunc: suppressEquivalentTemplates,
 			},
 			"permissions": {
 				Type:        schema.TypeString,
@@ -97,31 +124,130 @@ func resourceVnet() *schema.Resource {
 				Required:    true,
 				Description: "Name of the bridge interface to which the vnet should be associated",
 			},
-			"ip_start": {
+			"vms": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+				Description: "IDs of the VMs using the vnet, i.e. holding leases of it, sorted",
+			},
+			"vn_mad": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Start IP of the range to be allocated",
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Network driver of the vnet, e.g. bridge, 802.1Q or vxlan",
+			},
+			"ip_start": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Description:   "Start IP of the range to be allocated. Either ip_start and ip_size or ar blocks are required",
+				ConflictsWith: []string{"ar"},
 			},
 			"ip_size": {
-				Type:        schema.TypeInt,
-				Required:    true,
-				Description: "Size (in number) of the ip range",
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Description:   "Size (in number) of the ip range",
+				ConflictsWith: []string{"ar"},
+			},
+			"ar": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				Description:   "Address ranges of the vnet. Sizes can be changed, ranges can be added and removed as long as they have no leases. A range with a different type or start address replaces the range",
+				ConflictsWith: []string{"ip_start", "ip_size"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "IP4",
+							Description:  "Type of the range: " + strings.Join(vnetARTypes, ", "),
+							ValidateFunc: validation.StringInSlice(vnetARTypes, false),
+						},
+						"ip": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "First IPv4 address of the range",
+						},
+						"mac": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							ForceNew:    true,
+							Description: "First MAC address of the range, generated by OpenNebula if not set",
+						},
+						"size": {
+							Type:         schema.TypeInt,
+							Required:     true,
+							Description:  "Number of addresses in the range",
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+						"ar_id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID OpenNebula assigned to the range",
+						},
+					},
+				},
 			},
 			"reservation_size": {
-				Type:        schema.TypeInt,
-				Optional:    true,
-				Description: "Carve a network reservation of this size from the reservation starting from `ip-start`",
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Description:   "Carve a network reservation of this size from the reservation starting from `ip_start`, so it can't be used with ar blocks",
+				ConflictsWith: []string{"ar"},
+			},
+			"vlan_id": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				Description:   "VLAN ID of the vnet. Computed when `automatic_vlan` is set",
+				ValidateFunc:  validation.IntBetween(1, 4094),
+				ConflictsWith: []string{"automatic_vlan"},
+			},
+			"automatic_vlan": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Description:   "Let OpenNebula pick the VLAN ID of the vnet",
+				ConflictsWith: []string{"vlan_id"},
 			},
 		},
 	}
+
+	for key, s := range qosSchema() {
+		r.Schema[key] = s
+	}
+	for key, s := range permissionBitsSchema() {
+		r.Schema[key] = s
+	}
+
+	return r
 }
 
 func resourceVnetCreate(d *schema.ResourceData, meta interface{}) error {
 	client := meta.(*Client)
 	// Create base object
+	vlan := make(map[string]string)
+	if v, ok := d.GetOk("vlan_id"); ok {
+		vlan["VLAN_ID"] = strconv.Itoa(v.(int))
+	}
+	if d.Get("automatic_vlan").(bool) {
+		vlan["AUTOMATIC_VLAN_ID"] = boolToYesNo(true)
+	}
+
+	if v, ok := d.GetOk("vn_mad"); ok {
+		vlan["VN_MAD"] = v.(string)
+	}
+
+	ars := d.Get("ar").([]interface{})
+	if len(ars) == 0 && (d.Get("ip_start").(string) == "" || d.Get("ip_size").(int) == 0) {
+		return fmt.Errorf("Either ip_start and ip_size or at least one ar block are required")
+	}
+
 	resp, err := client.Call(
 		"one.vn.allocate",
-		fmt.Sprintf("NAME = \"%s\"\n", d.Get("name").(string))+d.Get("description").(string)+"\nBRIDGE="+d.Get("bridge").(string),
+		fmt.Sprintf("NAME = \"%s\"\n", d.Get("name").(string))+d.Get("description").(string)+"\nBRIDGE="+d.Get("bridge").(string)+
+			"\n"+joinTemplateSections(buildAttributes(vlan), buildAttributes(buildVnetQos(d))),
 		-1,
 	)
 	if err != nil {
@@ -130,22 +256,30 @@ func resourceVnetCreate(d *schema.ResourceData, meta interface{}) error {
 
 	d.SetId(resp)
 	// update permisions
-	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vn.chmod"); err != nil {
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vn.chmod", false); err != nil {
 		return err
 	}
-	// add address range and reservations
-	var address_range_string = `AR = [
+	for _, ar := range ars {
+		if _, err = client.Call("one.vn.add_ar", intId(d.Id()), buildARString(ar.(map[string]interface{}), -1)); err != nil {
+			return err
+		}
+	}
+
+	if len(ars) == 0 {
+		// add address range and reservations
+		var address_range_string = `AR = [
   TYPE = IP4,
   IP = %s,
   SIZE = %d ]`
-	_, a_err := client.Call(
-		"one.vn.add_ar",
-		intId(d.Id()),
-		fmt.Sprintf(address_range_string, d.Get("ip_start").(string), d.Get("ip_size").(int)),
-	)
+		_, a_err := client.Call(
+			"one.vn.add_ar",
+			intId(d.Id()),
+			fmt.Sprintf(address_range_string, d.Get("ip_start").(string), d.Get("ip_size").(int)),
+		)
 
-	if a_err != nil {
-		return a_err
+		if a_err != nil {
+			return a_err
+		}
 	}
 
 	if d.Get("reservation_size").(int) > 0 {
@@ -175,7 +309,6 @@ func resourceVnetCreate(d *schema.ResourceData, meta interface{}) error {
 
 func resourceVnetRead(d *schema.ResourceData, meta interface{}) error {
 	var vn *UserVnet
-	var vns *UserVnets
 
 	client := meta.(*Client)
 	found := false
@@ -188,34 +321,32 @@ func resourceVnetRead(d *schema.ResourceData, meta interface{}) error {
 			if err = xml.Unmarshal([]byte(resp), &vn); err != nil {
 				return err
 			}
-		} else {
+		} else if isNotFoundError(err) {
 			log.Printf("Could not find vnet by ID %s", d.Id())
+		} else {
+			return err
 		}
 	}
 
 	// Otherwise, try to find the vnet by (user, name) as the de facto compound primary key
 	if d.Id() == "" || !found {
-		resp, err := client.Call("one.vnpool.info", -3, -1, -1)
+		match, err := findInPool(client, "one.vnpool.info", "VNET", nameMatches(d.Get("name").(string)), -3, -1, -1)
+		if isNotFoundError(err) {
+			d.SetId("")
+			log.Printf("Could not find vnet with name %s for user %s", d.Get("name").(string), client.Username)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 
-		if err = xml.Unmarshal([]byte(resp), &vns); err != nil {
+		resp, err := client.Call("one.vn.info", intId(match["ID"]), false)
+		if err != nil {
 			return err
 		}
 
-		for _, t := range vns.UserVnet {
-			if t.Name == d.Get("name").(string) {
-				vn = t
-				found = true
-				break
-			}
-		}
-
-		if !found || vn == nil {
-			d.SetId("")
-			log.Printf("Could not find vnet with name %s for user %s", d.Get("name").(string), client.Username)
-			return nil
+		if err = xml.Unmarshal([]byte(resp), &vn); err != nil {
+			return err
 		}
 	}
 
@@ -226,7 +357,25 @@ func resourceVnetRead(d *schema.ResourceData, meta interface{}) error {
 	d.Set("uname", vn.Uname)
 	d.Set("gname", vn.Gname)
 	d.Set("bridge", vn.Bridge)
+	d.Set("vn_mad", vn.VnMad)
+	d.Set("vms", vnetVmIds(vn))
+	if len(d.Get("ar").([]interface{})) > 0 {
+		d.Set("ar", readARs(vn.ARs))
+	}
 	d.Set("permissions", permissionString(vn.Permissions))
+	setPermissionBits(d, vn.Permissions)
+	if vlanId, err := strconv.Atoi(vn.VlanId); err == nil {
+		d.Set("vlan_id", vlanId)
+	}
+	d.Set("automatic_vlan", vn.AutoVlanId == 1)
+	if vn.Template != nil {
+		d.Set("inbound_avg_bw", vn.Template.InboundAvgBw)
+		d.Set("inbound_peak_bw", vn.Template.InboundPeakBw)
+		d.Set("inbound_peak_kb", vn.Template.InboundPeakKb)
+		d.Set("outbound_avg_bw", vn.Template.OutboundAvgBw)
+		d.Set("outbound_peak_bw", vn.Template.OutboundPeakBw)
+		d.Set("outbound_peak_kb", vn.Template.OutboundPeakKb)
+	}
 
 	return nil
 }
@@ -247,12 +396,38 @@ func resourceVnetUpdate(d *schema.ResourceData, meta interface{}) error {
 		_, err := client.Call(
 			"one.vn.update",
 			intId(d.Id()),
-			d.Get("description").(string),
+			joinTemplateSections(d.Get("description").(string), buildAttributes(buildVnetQos(d))),
 			0, // replace the whole vnet instead of merging it with the existing one
 		)
 		if err != nil {
 			return err
 		}
+	} else {
+		qosChanged := false
+		for key := range qosAttributes {
+			qosChanged = qosChanged || d.HasChange(key)
+		}
+
+		if qosChanged {
+			qos := buildVnetQos(d)
+			// clear the values that were removed from the configuration
+			for _, name := range qosAttributes {
+				if _, ok := qos[name]; !ok {
+					qos[name] = ""
+				}
+			}
+
+			_, err := client.Call(
+				"one.vn.update",
+				intId(d.Id()),
+				buildAttributes(qos),
+				1, // merge the traffic shaping attributes into the existing template
+			)
+			if err != nil {
+				return err
+			}
+			log.Printf("[INFO] Successfully updated QoS of Vnet %s\n", d.Id())
+		}
 	}
 
 	if d.HasChange("name") {
@@ -285,12 +460,18 @@ func resourceVnetUpdate(d *schema.ResourceData, meta interface{}) error {
 		log.Printf("[INFO] Successfully updated size of address range for Vnet %s\n", resp)
 	}
 
+	if d.HasChange("ar") {
+		if err := updateARs(client, intId(d.Id()), d); err != nil {
+			return err
+		}
+	}
+
 	if d.HasChange("ip_start") {
 		log.Printf("[WARNING] Changing the IP address of the Vnet address range is currently not supported")
 	}
 
 	if d.HasChange("permissions") {
-		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vn.chmod")
+		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vn.chmod", false)
 		if err != nil {
 			return err
 		}
@@ -337,3 +518,144 @@ func resourceVnetDelete(d *schema.ResourceData, meta interface{}) error {
 	log.Printf("[INFO] Successfully deleted Vnet %s\n", resp)
 	return nil
 }
+
+func buildARString(ar map[string]interface{}, id int) string {
+	attributes := map[string]string{
+		"TYPE": ar["type"].(string),
+		"SIZE": strconv.Itoa(ar["size"].(int)),
+	}
+	if id >= 0 {
+		attributes["AR_ID"] = strconv.Itoa(id)
+	}
+	if ip, _ := ar["ip"].(string); ip != "" {
+		attributes["IP"] = ip
+	}
+	if mac, _ := ar["mac"].(string); mac != "" {
+		attributes["MAC"] = mac
+	}
+
+	return buildVectorAttribute("AR", attributes)
+}
+
+// vnetVmIds collects the VMs holding leases of any address range of the vnet.
+func vnetVmIds(vn *UserVnet) []int {
+	var ids []int
+	for _, ar := range vn.ARs {
+		ids = append(ids, ar.Vms...)
+	}
+
+	return sortedVmIds(ids)
+}
+
+func readARs(vnetARs []*VnetAR) []interface{} {
+	ars := make([]interface{}, 0, len(vnetARs))
+	for _, ar := range vnetARs {
+		ars = append(ars, map[string]interface{}{
+			"type":  ar.Type,
+			"ip":    ar.Ip,
+			"mac":   ar.Mac,
+			"size":  ar.Size,
+			"ar_id": ar.Id,
+		})
+	}
+
+	return ars
+}
+
+// matchARs returns the index of the address range in the state matching each
+// configured one. Terraform hands the ar_id of a range in the state on to the
+// configured range at the same position, so a range is matched by its ar_id only if
+// it starts at the same address, otherwise by its start address.
+func matchARs(old []interface{}, new []interface{}) map[int]int {
+	matches := make(map[int]int)
+	used := make(map[int]bool)
+	sameStart := func(a, b map[string]interface{}) bool {
+		return a["type"] == b["type"] && a["ip"] == b["ip"]
+	}
+
+	for i, n := range new {
+		ar := n.(map[string]interface{})
+		for j, o := range old {
+			oldAR := o.(map[string]interface{})
+			if !used[j] && oldAR["ar_id"] == ar["ar_id"] && sameStart(oldAR, ar) {
+				matches[i] = j
+				used[j] = true
+				break
+			}
+		}
+	}
+
+	for i, n := range new {
+		ar := n.(map[string]interface{})
+		if _, matched := matches[i]; matched || ar["ip"].(string) == "" {
+			continue
+		}
+		for j, o := range old {
+			if !used[j] && sameStart(o.(map[string]interface{}), ar) {
+				matches[i] = j
+				used[j] = true
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// updateARs resizes the address ranges which are still configured, see matchARs,
+// removes the ones which are not anymore and adds new ones.
+func updateARs(client OneClient, id int, d *schema.ResourceData) error {
+	old, new := d.GetChange("ar")
+	oldARs := old.([]interface{})
+	newARs := new.([]interface{})
+
+	matches := matchARs(oldARs, newARs)
+	used := make(map[int]bool)
+	for _, j := range matches {
+		used[j] = true
+	}
+
+	for j, o := range oldARs {
+		if used[j] {
+			continue
+		}
+		arId := o.(map[string]interface{})["ar_id"].(int)
+		if _, err := client.Call("one.vn.rm_ar", id, arId); err != nil {
+			return fmt.Errorf("Could not remove address range %d, it might still have leases: %s", arId, err)
+		}
+	}
+
+	for i, n := range newARs {
+		ar := n.(map[string]interface{})
+		j, matched := matches[i]
+		if !matched {
+			// a MAC left out of the configuration is the one of the range at this position
+			if i < len(oldARs) && ar["mac"] == oldARs[i].(map[string]interface{})["mac"] {
+				ar["mac"] = ""
+			}
+			if _, err := client.Call("one.vn.add_ar", id, buildARString(ar, -1)); err != nil {
+				return err
+			}
+			continue
+		}
+		oldAR := oldARs[j].(map[string]interface{})
+		if oldAR["size"] != ar["size"] {
+			resized := map[string]interface{}{"type": oldAR["type"], "ip": oldAR["ip"], "mac": oldAR["mac"], "size": ar["size"]}
+			if _, err := client.Call("one.vn.update_ar", id, buildARString(resized, oldAR["ar_id"].(int))); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("[INFO] Successfully updated the address ranges of Vnet %d\n", id)
+
+	return nil
+}
+
+func buildVnetQos(d *schema.ResourceData) map[string]string {
+	values := make(map[string]interface{})
+	for key := range qosAttributes {
+		values[key] = d.Get(key)
+	}
+
+	return buildQosAttributes(values)
+}
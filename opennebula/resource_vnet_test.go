@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 	"reflect"
 	"strings"
@@ -147,3 +148,142 @@ resource "opennebula_vnet" "test" {
   permissions = "700"
 }
 `
+
+func TestBuildARString(t *testing.T) {
+	ar := map[string]interface{}{"type": "IP4", "ip": "10.0.0.1", "mac": "", "size": 50}
+
+	if s := buildARString(ar, -1); s != "AR = [\n  IP = \"10.0.0.1\",\n  SIZE = \"50\",\n  TYPE = \"IP4\" ]" {
+		t.Errorf("Unexpected address range %q", s)
+	}
+	if s := buildARString(ar, 2); !strings.Contains(s, "AR_ID = \"2\"") {
+		t.Errorf("Expected the address range %q to contain its ID", s)
+	}
+}
+
+func TestReadARs(t *testing.T) {
+	var vnet UserVnet
+	err := xml.Unmarshal([]byte(`<VNET><ID>3</ID><VN_MAD>bridge</VN_MAD><AR_POOL>
+		<AR><AR_ID>0</AR_ID><TYPE>IP4</TYPE><IP>10.0.0.1</IP><MAC>02:00:0a:00:00:01</MAC><SIZE>50</SIZE></AR>
+		<AR><AR_ID>1</AR_ID><TYPE>ETHER</TYPE><MAC>02:00:00:00:00:01</MAC><SIZE>10</SIZE></AR>
+	</AR_POOL></VNET>`), &vnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{
+		map[string]interface{}{"type": "IP4", "ip": "10.0.0.1", "mac": "02:00:0a:00:00:01", "size": 50, "ar_id": 0},
+		map[string]interface{}{"type": "ETHER", "ip": "", "mac": "02:00:00:00:00:01", "size": 10, "ar_id": 1},
+	}
+	if ars := readARs(vnet.ARs); !reflect.DeepEqual(ars, expected) {
+		t.Errorf("Expected address ranges %v, got %v", expected, ars)
+	}
+	if vnet.VnMad != "bridge" {
+		t.Errorf("Expected VN_MAD bridge, got %q", vnet.VnMad)
+	}
+}
+
+func TestVnetVmIds(t *testing.T) {
+	var vnet *UserVnet
+	err := xml.Unmarshal([]byte(`<VNET><ID>3</ID><USED_LEASES>5</USED_LEASES><AR_POOL>
+		<AR><AR_ID>0</AR_ID><LEASES>
+			<LEASE><IP>10.0.0.1</IP><VM>12</VM></LEASE>
+			<LEASE><IP>10.0.0.2</IP><VM>-1</VM></LEASE>
+			<LEASE><IP>10.0.0.3</IP><VM>4</VM></LEASE>
+		</LEASES></AR>
+		<AR><AR_ID>1</AR_ID><LEASES>
+			<LEASE><MAC>02:00:00:00:00:01</MAC><VM>12</VM></LEASE>
+			<LEASE><MAC>02:00:00:00:00:02</MAC><VM>7</VM></LEASE>
+		</LEASES></AR>
+		<AR><AR_ID>2</AR_ID></AR>
+	</AR_POOL></VNET>`), &vnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := vnetVmIds(vnet); !reflect.DeepEqual(ids, []int{4, 7, 12}) {
+		t.Errorf("Expected the VMs [4 7 12], got %v", ids)
+	}
+	if len(vnet.ARs) != 3 {
+		t.Errorf("Expected 3 address ranges, got %d", len(vnet.ARs))
+	}
+}
+
+func TestMatchARs(t *testing.T) {
+	old := []interface{}{
+		map[string]interface{}{"type": "IP4", "ip": "10.0.0.1", "mac": "02:00:0a:00:00:01", "size": 50, "ar_id": 0},
+		map[string]interface{}{"type": "IP4", "ip": "10.0.1.1", "mac": "02:00:0a:00:01:01", "size": 50, "ar_id": 1},
+	}
+	// the first range is removed, the second one inherits its ar_id by position
+	new := []interface{}{
+		map[string]interface{}{"type": "IP4", "ip": "10.0.1.1", "mac": "02:00:0a:00:00:01", "size": 100, "ar_id": 0},
+		map[string]interface{}{"type": "IP4", "ip": "10.0.2.1", "mac": "02:00:0a:00:01:01", "size": 50, "ar_id": 1},
+	}
+
+	expected := map[int]int{0: 1}
+	if matches := matchARs(old, new); !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Expected matches %v, got %v", expected, matches)
+	}
+	if matches := matchARs(old, old); !reflect.DeepEqual(matches, map[int]int{0: 0, 1: 1}) {
+		t.Errorf("Expected the unchanged ranges to match themselves, got %v", matches)
+	}
+}
+
+func TestUpdateARsMatchesRangesByStartAddress(t *testing.T) {
+	r := resourceVnet()
+	state := &terraform.InstanceState{ID: "3", Attributes: map[string]string{
+		"name":              "net",
+		"ar.#":              "2",
+		"ar.0.type":         "IP4",
+		"ar.0.ip":           "10.0.0.1",
+		"ar.0.mac":          "02:00:0a:00:00:01",
+		"ar.0.size":         "50",
+		"ar.0.ar_id":        "0",
+		"ar.1.type":         "IP4",
+		"ar.1.ip":           "10.0.1.1",
+		"ar.1.mac":          "02:00:0a:00:01:01",
+		"ar.1.size":         "50",
+		"ar.1.ar_id":        "1",
+		"permissions":       "640",
+		"security_groups.#": "0",
+	}}
+	config := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"name":        "net",
+		"permissions": "640",
+		"ar": []interface{}{
+			map[string]interface{}{"ip": "10.0.1.1", "size": 100},
+			map[string]interface{}{"ip": "10.0.2.1", "size": 50},
+		},
+	})
+	diff, err := r.Diff(state, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := schema.InternalMap(r.Schema).Data(state, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := new(MockClient)
+	client.On("Call", "one.vn.rm_ar", []interface{}{3, 0}).Return("3", nil).Once()
+	client.On("Call", "one.vn.update_ar", []interface{}{3, "AR = [\n  AR_ID = \"1\",\n  IP = \"10.0.1.1\",\n  MAC = \"02:00:0a:00:01:01\",\n  SIZE = \"100\",\n  TYPE = \"IP4\" ]"}).Return("3", nil).Once()
+	client.On("Call", "one.vn.add_ar", []interface{}{3, "AR = [\n  IP = \"10.0.2.1\",\n  SIZE = \"50\",\n  TYPE = \"IP4\" ]"}).Return("3", nil).Once()
+
+	if err := updateARs(client, 3, d); err != nil {
+		t.Fatal(err)
+	}
+	client.AssertExpectations(t)
+}
+
+func TestReservationRequiresIpStart(t *testing.T) {
+	_, errs := resourceVnet().Validate(terraform.NewResourceConfigRaw(map[string]interface{}{
+		"name":             "net",
+		"reservation_size": 5,
+		"ar":               []interface{}{map[string]interface{}{"ip": "10.0.0.1", "size": 50}},
+	}))
+	for _, err := range errs {
+		if strings.Contains(err.Error(), "reservation_size\": conflicts with ar") {
+			return
+		}
+	}
+	t.Errorf("Expected reservation_size to be rejected along with ar blocks, got %v", errs)
+}
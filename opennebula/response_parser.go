@@ -3,6 +3,7 @@ package opennebula
 import (
 	"bytes"
 	"encoding/xml"
+	"fmt"
 	"strings"
 )
 
@@ -23,34 +24,116 @@ func parseResponse(data []byte, startElement string) (map[string]string, error)
 	}
 }
 
+// parseScalarResponse reads the response of methods returning a plain value
+// instead of an XML document, e.g. the ID returned by one.template.instantiate
+// or the version returned by one.system.version.
+func parseScalarResponse(data []byte) (string, error) {
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("Expected a value, but the response is empty")
+	}
+	if strings.HasPrefix(value, "<") {
+		return "", fmt.Errorf("Expected a plain value, but the response is an XML document")
+	}
+
+	return value, nil
+}
+
+// responseNode is an element of a response. The elements are collected before they
+// are flattened, to tell repeated elements from single ones.
+type responseNode struct {
+	name       string
+	value      string
+	attributes []xml.Attr
+	children   []*responseNode
+}
+
+// parseSubTree flattens the elements up to the end of endElement into a map of their
+// paths, e.g. TEMPLATE/MEMORY. Repeated elements are indexed by their position among
+// the elements of the same name, e.g. TEMPLATE/DISK[0]/SIZE and TEMPLATE/DISK[1]/SIZE.
+// XML attributes of the elements are keyed by their local name prefixed with @, e.g.
+// HISTORY_RECORDS/HISTORY/@oid.
 func parseSubTree(decoder xml.TokenReader, endElement string) (map[string]string, error) {
-	attributes := make(map[string]string)
-	var path []string
+	root := &responseNode{name: endElement}
+	stack := []*responseNode{root}
 	for {
 		t, err := decoder.Token()
 		if t == nil || err != nil {
 			return nil, err
 		}
 
+		current := stack[len(stack)-1]
 		switch tt := t.(type) {
 		case xml.StartElement:
-			path = append(path, tt.Name.Local)
+			node := &responseNode{name: tt.Name.Local, attributes: tt.Attr}
+			current.children = append(current.children, node)
+			stack = append(stack, node)
 		case xml.CharData:
 			value := strings.TrimSpace(string(tt))
-			if len(value) > 0 && len(path) > 0 {
-				key := strings.Join(path, PathSeparator)
-				if presentValue, isPresent := attributes[key]; isPresent {
-					value = presentValue + ValueSepartor + value
+			if len(value) > 0 && current != root {
+				if current.value != "" {
+					value = current.value + ValueSepartor + value
 				}
-				attributes[key] = value
+				current.value = value
 			}
 		case xml.EndElement:
-			if tt.Name.Local == endElement {
+			if current == root {
+				attributes := make(map[string]string)
+				root.flatten("", attributes)
 				return attributes, nil
 			}
-			if path[len(path)-1] == tt.Name.Local {
-				path = path[:len(path)-1]
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// lookupAttribute returns the value at path. The unindexed path of a repeated element
+// stands for its first one, e.g. TEMPLATE/NIC/IP for TEMPLATE/NIC[0]/IP, as configured
+// paths such as ip_attribute were written before repeated elements were indexed.
+func lookupAttribute(attributes map[string]string, path string) (string, bool) {
+	if value, ok := attributes[path]; ok {
+		return value, true
+	}
+
+	resolved := ""
+	for i, element := range strings.Split(path, PathSeparator) {
+		if i > 0 {
+			resolved += PathSeparator
+		}
+		if !strings.HasSuffix(element, "]") && hasElement(attributes, resolved+element+"[0]") {
+			element += "[0]"
+		}
+		resolved += element
+	}
+
+	value, ok := attributes[resolved]
+	return value, ok
+}
+
+func (n *responseNode) flatten(prefix string, attributes map[string]string) {
+	count := make(map[string]int)
+	for _, child := range n.children {
+		count[child.name]++
+	}
+
+	index := make(map[string]int)
+	for _, child := range n.children {
+		key := prefix + child.name
+		if count[child.name] > 1 {
+			key = fmt.Sprintf("%s[%d]", key, index[child.name])
+			index[child.name]++
+		}
+
+		if child.value != "" {
+			attributes[key] = child.value
+		}
+		for _, attr := range child.attributes {
+			// namespace declarations are no data
+			if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+				continue
 			}
+			attributes[key+PathSeparator+"@"+attr.Name.Local] = attr.Value
 		}
+		child.flatten(key+PathSeparator, attributes)
 	}
 }
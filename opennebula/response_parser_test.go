@@ -119,3 +119,132 @@ func TestParsingResponseNotOccuringStartElement(t *testing.T) {
 	assert.Error(t, err)
 	assert.Empty(t, attributes)
 }
+
+func TestParsingRepeatedElements(t *testing.T) {
+	xmlResponse := `<VM>
+						<TEMPLATE>
+							<MEMORY>512</MEMORY>
+							<DISK><DISK_ID>0</DISK_ID><SIZE>2048</SIZE></DISK>
+							<DISK><DISK_ID>1</DISK_ID><SIZE>10240</SIZE></DISK>
+						</TEMPLATE>
+					</VM>`
+	attributes, err := parseResponse([]byte(xmlResponse), "VM")
+
+	assert.NoError(t, err)
+	assert.Len(t, attributes, 5)
+	assert.Equal(t, "512", attributes["TEMPLATE/MEMORY"])
+	assert.Equal(t, "0", attributes["TEMPLATE/DISK[0]/DISK_ID"])
+	assert.Equal(t, "2048", attributes["TEMPLATE/DISK[0]/SIZE"])
+	assert.Equal(t, "1", attributes["TEMPLATE/DISK[1]/DISK_ID"])
+	assert.Equal(t, "10240", attributes["TEMPLATE/DISK[1]/SIZE"])
+}
+
+func TestParsingThreeRepeatedElements(t *testing.T) {
+	xmlResponse := `<VM>
+						<TEMPLATE>
+							<NIC><NIC_ID>0</NIC_ID><IP>10.0.0.2</IP></NIC>
+							<DISK><SIZE>2048</SIZE></DISK>
+							<NIC><NIC_ID>1</NIC_ID><IP>10.0.1.2</IP></NIC>
+							<NIC><NIC_ID>2</NIC_ID></NIC>
+						</TEMPLATE>
+						<GROUPS><ID>0</ID><ID>1</ID><ID>100</ID></GROUPS>
+					</VM>`
+	attributes, err := parseResponse([]byte(xmlResponse), "VM")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2048", attributes["TEMPLATE/DISK/SIZE"])
+	assert.Equal(t, "10.0.0.2", attributes["TEMPLATE/NIC[0]/IP"])
+	assert.Equal(t, "10.0.1.2", attributes["TEMPLATE/NIC[1]/IP"])
+	assert.Equal(t, "2", attributes["TEMPLATE/NIC[2]/NIC_ID"])
+	assert.NotContains(t, attributes, "TEMPLATE/NIC[2]/IP")
+	assert.NotContains(t, attributes, "TEMPLATE/NIC/IP")
+	assert.Equal(t, "0", attributes["GROUPS/ID[0]"])
+	assert.Equal(t, "1", attributes["GROUPS/ID[1]"])
+	assert.Equal(t, "100", attributes["GROUPS/ID[2]"])
+}
+
+func TestLookupAttributeOfRepeatedElements(t *testing.T) {
+	xmlResponse := `<VM>
+						<TEMPLATE>
+							<CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP></CONTEXT>
+							<NIC><NIC_ID>0</NIC_ID><IP>10.0.0.2</IP></NIC>
+							<NIC><NIC_ID>1</NIC_ID><IP>10.0.1.2</IP></NIC>
+						</TEMPLATE>
+						<GROUPS><ID>0</ID><ID>1</ID></GROUPS>
+					</VM>`
+	attributes, err := parseResponse([]byte(xmlResponse), "VM")
+	assert.NoError(t, err)
+
+	for path, expected := range map[string]string{
+		"TEMPLATE/CONTEXT/ETH0_IP": "10.0.0.2",
+		"TEMPLATE/NIC[1]/IP":       "10.0.1.2",
+		"TEMPLATE/NIC/IP":          "10.0.0.2",
+		"GROUPS/ID":                "0",
+	} {
+		value, ok := lookupAttribute(attributes, path)
+		assert.True(t, ok, path)
+		assert.Equal(t, expected, value, path)
+	}
+
+	_, ok := lookupAttribute(attributes, "TEMPLATE/NIC/IP6")
+	assert.False(t, ok)
+	_, ok = lookupAttribute(attributes, "TEMPLATE/NIC[2]/IP")
+	assert.False(t, ok)
+}
+
+func TestParsingRepeatedElementsAtDifferentLevels(t *testing.T) {
+	xmlResponse := `<VM>
+						<SNAPSHOTS><SNAPSHOT><ID>0</ID></SNAPSHOT><SNAPSHOT><ID>1</ID></SNAPSHOT></SNAPSHOTS>
+						<SNAPSHOTS><SNAPSHOT><ID>2</ID></SNAPSHOT></SNAPSHOTS>
+					</VM>`
+	attributes, err := parseResponse([]byte(xmlResponse), "VM")
+
+	assert.NoError(t, err)
+	assert.Len(t, attributes, 3)
+	assert.Equal(t, "0", attributes["SNAPSHOTS[0]/SNAPSHOT[0]/ID"])
+	assert.Equal(t, "1", attributes["SNAPSHOTS[0]/SNAPSHOT[1]/ID"])
+	assert.Equal(t, "2", attributes["SNAPSHOTS[1]/SNAPSHOT/ID"])
+}
+
+func TestParsingElementAttributes(t *testing.T) {
+	xmlResponse := `<VM xmlns:one="http://opennebula.org/XMLSchema">
+						<HISTORY_RECORDS>
+							<HISTORY oid="42" seq="0"><HOSTNAME>node1</HOSTNAME></HISTORY>
+							<HISTORY oid="42" seq="1" one:etime="0"/>
+						</HISTORY_RECORDS>
+						<TEMPLATE><NIC model="virtio" xmlns="http://opennebula.org/XMLSchema"/></TEMPLATE>
+					</VM>`
+	attributes, err := parseResponse([]byte(xmlResponse), "VM")
+
+	assert.NoError(t, err)
+	assert.Len(t, attributes, 7)
+	assert.Equal(t, "42", attributes["HISTORY_RECORDS/HISTORY[0]/@oid"])
+	assert.Equal(t, "0", attributes["HISTORY_RECORDS/HISTORY[0]/@seq"])
+	assert.Equal(t, "node1", attributes["HISTORY_RECORDS/HISTORY[0]/HOSTNAME"])
+	assert.Equal(t, "42", attributes["HISTORY_RECORDS/HISTORY[1]/@oid"])
+	assert.Equal(t, "1", attributes["HISTORY_RECORDS/HISTORY[1]/@seq"])
+	assert.Equal(t, "0", attributes["HISTORY_RECORDS/HISTORY[1]/@etime"])
+	assert.Equal(t, "virtio", attributes["TEMPLATE/NIC/@model"])
+}
+
+func TestParsingScalarInteger(t *testing.T) {
+	value, err := parseScalarResponse([]byte("42"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "42", value)
+}
+
+func TestParsingScalarString(t *testing.T) {
+	value, err := parseScalarResponse([]byte(" 6.4.0\n"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "6.4.0", value)
+}
+
+func TestParsingScalarRejectsDocuments(t *testing.T) {
+	_, err := parseScalarResponse([]byte("<VM><ID>42</ID></VM>"))
+	assert.Error(t, err)
+
+	_, err = parseScalarResponse([]byte(""))
+	assert.Error(t, err)
+}
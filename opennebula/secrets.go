@@ -0,0 +1,94 @@
+package opennebula
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// secretResolvers resolve secret references of the form "<scheme>:<path>". Further
+// backends can be supported by registering a resolver for their scheme.
+var secretResolvers = map[string]func(path string) (string, error){
+	"env":  resolveEnvSecret,
+	"file": resolveFileSecret,
+}
+
+func resolveEnvSecret(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return value, nil
+}
+
+func resolveFileSecret(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func resolveSecret(ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Secret reference %q has to be of the form <scheme>:<path>", ref)
+	}
+
+	resolver, ok := secretResolvers[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("Unknown scheme %q in secret reference %q", parts[0], ref)
+	}
+
+	value, err := resolver(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("Could not resolve secret reference %q: %s", ref, err)
+	}
+
+	return value, nil
+}
+
+// resolveSecrets resolves every reference of the map, keeping the keys.
+func resolveSecrets(refs map[string]interface{}) (map[string]interface{}, error) {
+	resolved := make(map[string]interface{}, len(refs))
+	for key, ref := range refs {
+		value, err := resolveSecret(ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		resolved[key] = value
+	}
+
+	return resolved, nil
+}
+
+// secretValues returns the resolved values of the secret_context of a resource and its
+// console password, to keep them out of the traced calls. References which don't
+// resolve are skipped, rendering the context reports them.
+func secretValues(d *schema.ResourceData) []string {
+	var values []string
+	// the console password is part of the template OpenNebula answers info calls with
+	if graphics, ok := d.GetOk("graphics"); ok {
+		if passwd := graphicsPasswd(graphics.([]interface{})); passwd != "" {
+			values = append(values, passwd)
+		}
+	}
+
+	refs, ok := d.GetOk("secret_context")
+	if !ok {
+		return values
+	}
+
+	for _, ref := range refs.(map[string]interface{}) {
+		if value, err := resolveSecret(ref.(string)); err == nil && value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,39 @@
+package opennebula
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	os.Setenv("OPENNEBULA_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("OPENNEBULA_TEST_SECRET")
+
+	file, err := ioutil.TempFile("", "secret")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("from-file\n")
+	file.Close()
+
+	resolved, err := resolveSecrets(map[string]interface{}{
+		"db_password": "env:OPENNEBULA_TEST_SECRET",
+		"api_token":   "file:" + file.Name(),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"db_password": "s3cret", "api_token": "from-file"}, resolved)
+}
+
+func TestResolveSecretErrors(t *testing.T) {
+	_, err := resolveSecret("plain-value")
+	assert.Error(t, err)
+
+	_, err = resolveSecret("vault:secret/data/db")
+	assert.Error(t, err)
+
+	_, err = resolveSecret("env:OPENNEBULA_TEST_UNSET_SECRET")
+	assert.Error(t, err)
+}
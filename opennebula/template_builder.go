@@ -0,0 +1,215 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// buildVectorAttribute renders a vector attribute such as DISK or FEATURES in
+// OpenNebula's String template format. Keys are sorted to keep the output stable.
+func buildVectorAttribute(name string, attributes map[string]string) string {
+	if len(attributes) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("  %s = \"%s\"", key, escapeTemplateValue(attributes[key])))
+	}
+
+	return fmt.Sprintf("%s = [\n%s ]", name, strings.Join(pairs, ",\n"))
+}
+
+// buildAttributes renders single valued attributes, one per line and sorted by name.
+func buildAttributes(attributes map[string]string) string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s = \"%s\"", key, escapeTemplateValue(attributes[key])))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func escapeTemplateValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	return strings.Replace(value, "\"", "\\\"", -1)
+}
+
+func joinTemplateSections(sections ...string) string {
+	nonEmpty := make([]string, 0, len(sections))
+	for _, section := range sections {
+		if section != "" {
+			nonEmpty = append(nonEmpty, section)
+		}
+	}
+
+	return strings.Join(nonEmpty, "\n")
+}
+
+// templateKeys returns the names of the top level attributes of a template in the
+// String format, in the order they occur. Quoted values and vector attributes are
+// skipped, so their contents are not mistaken for attributes.
+func templateKeys(template string) []string {
+	var keys []string
+	var name strings.Builder
+	inQuotes, escaped, depth, lineStart := false, false, 0, true
+
+	for _, c := range template {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes:
+			if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inQuotes = false
+			}
+		case c == '"':
+			inQuotes = true
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '\n':
+			lineStart = depth == 0
+			name.Reset()
+		case lineStart && c == '=':
+			if key := strings.TrimSpace(name.String()); key != "" {
+				keys = append(keys, key)
+			}
+			lineStart = false
+		case lineStart:
+			name.WriteRune(c)
+		}
+	}
+
+	return keys
+}
+
+// templateAttributeNames returns the names of the top level attributes of a template
+// in the String or the XML format.
+func templateAttributeNames(template string) []string {
+	if !strings.HasPrefix(strings.TrimSpace(template), "<") {
+		return templateKeys(template)
+	}
+
+	var root struct {
+		Attributes []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal([]byte(template), &root); err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(root.Attributes))
+	for _, attribute := range root.Attributes {
+		names = append(names, attribute.XMLName.Local)
+	}
+
+	return names
+}
+
+// removedTemplateAttributes returns the top level attributes of the old template the
+// new one does not set anymore. Names are compared case-insensitively like OpenNebula does.
+func removedTemplateAttributes(old string, new string) []string {
+	seen := make(map[string]bool)
+	for _, name := range templateAttributeNames(new) {
+		seen[strings.ToUpper(name)] = true
+	}
+
+	var removed []string
+	for _, name := range templateAttributeNames(old) {
+		if !seen[strings.ToUpper(name)] {
+			removed = append(removed, name)
+			seen[strings.ToUpper(name)] = true
+		}
+	}
+
+	return removed
+}
+
+// duplicateTemplateAttribute returns the first top level attribute set more than once
+// in template, or "" if there is none. Attributes in repeatable may occur several times.
+func duplicateTemplateAttribute(template string, repeatable map[string]bool) string {
+	seen := make(map[string]bool)
+	for _, key := range templateKeys(template) {
+		key = strings.ToUpper(key)
+		if seen[key] && !repeatable[key] {
+			return key
+		}
+		seen[key] = true
+	}
+
+	return ""
+}
+
+func boolToYesNo(value bool) string {
+	if value {
+		return "YES"
+	}
+	return "NO"
+}
+
+// Traffic shaping attributes shared by virtual networks and NICs
+var qosAttributes = map[string]string{
+	"inbound_avg_bw":   "INBOUND_AVG_BW",
+	"inbound_peak_bw":  "INBOUND_PEAK_BW",
+	"inbound_peak_kb":  "INBOUND_PEAK_KB",
+	"outbound_avg_bw":  "OUTBOUND_AVG_BW",
+	"outbound_peak_bw": "OUTBOUND_PEAK_BW",
+	"outbound_peak_kb": "OUTBOUND_PEAK_KB",
+}
+
+func qosSchema() map[string]*schema.Schema {
+	descriptions := map[string]string{
+		"inbound_avg_bw":   "Average inbound bandwidth in KB/s",
+		"inbound_peak_bw":  "Maximum inbound bandwidth in KB/s",
+		"inbound_peak_kb":  "Data in KB that can be received at peak bandwidth",
+		"outbound_avg_bw":  "Average outbound bandwidth in KB/s",
+		"outbound_peak_bw": "Maximum outbound bandwidth in KB/s",
+		"outbound_peak_kb": "Data in KB that can be sent at peak bandwidth",
+	}
+
+	s := make(map[string]*schema.Schema)
+	for key := range qosAttributes {
+		s[key] = &schema.Schema{
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Description:  descriptions[key],
+			ValidateFunc: validation.IntAtLeast(1),
+		}
+	}
+
+	return s
+}
+
+// buildQosAttributes collects the configured traffic shaping values, unset (zero)
+// values are left out.
+func buildQosAttributes(values map[string]interface{}) map[string]string {
+	attributes := make(map[string]string)
+	for key, name := range qosAttributes {
+		if v, ok := values[key].(int); ok && v > 0 {
+			attributes[name] = strconv.Itoa(v)
+		}
+	}
+
+	return attributes
+}
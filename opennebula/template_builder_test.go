@@ -0,0 +1,54 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildVectorAttribute(t *testing.T) {
+	s := buildVectorAttribute("DISK", map[string]string{
+		"IMAGE_ID":   "3",
+		"PERSISTENT": "YES",
+	})
+	assert.Equal(t, "DISK = [\n  IMAGE_ID = \"3\",\n  PERSISTENT = \"YES\" ]", s)
+}
+
+func TestBuildVectorAttributeEscapesValues(t *testing.T) {
+	s := buildVectorAttribute("CONTEXT", map[string]string{"START_SCRIPT": `echo "hi" \o/`})
+	assert.Equal(t, "CONTEXT = [\n  START_SCRIPT = \"echo \\\"hi\\\" \\\\o/\" ]", s)
+}
+
+func TestBuildVectorAttributeEmpty(t *testing.T) {
+	assert.Equal(t, "", buildVectorAttribute("DISK", nil))
+}
+
+func TestJoinTemplateSections(t *testing.T) {
+	assert.Equal(t, "A=1\nB=2", joinTemplateSections("", "A=1", "", "B=2"))
+}
+
+func TestBuildAttributes(t *testing.T) {
+	s := buildAttributes(map[string]string{"VLAN_ID": "10", "INBOUND_AVG_BW": "100"})
+	assert.Equal(t, "INBOUND_AVG_BW = \"100\"\nVLAN_ID = \"10\"", s)
+}
+
+func TestBuildQosAttributesSkipsUnset(t *testing.T) {
+	attributes := buildQosAttributes(map[string]interface{}{
+		"inbound_avg_bw":  1000,
+		"inbound_peak_bw": 0,
+		"outbound_avg_bw": 500,
+	})
+	assert.Equal(t, map[string]string{"INBOUND_AVG_BW": "1000", "OUTBOUND_AVG_BW": "500"}, attributes)
+}
+
+func TestRemovedTemplateAttributes(t *testing.T) {
+	assert.Equal(t, []string{"LABELS"}, removedTemplateAttributes("DESCRIPTION = \"a\"\nLABELS = \"web\"", "description = \"b\""))
+	assert.Equal(t, []string{"LABELS"}, removedTemplateAttributes("<TEMPLATE><DESCRIPTION>a</DESCRIPTION><LABELS>web</LABELS></TEMPLATE>", "DESCRIPTION = \"a\""))
+	assert.Equal(t, []string{"DESCRIPTION"}, removedTemplateAttributes("DESCRIPTION = \"a\"", ""))
+	assert.Empty(t, removedTemplateAttributes("", "DESCRIPTION = \"a\""))
+}
+
+func TestTemplateKeys(t *testing.T) {
+	template := "MEMORY = \"512\"\nCONTEXT = [\n  NETWORK = \"YES\",\n  START_SCRIPT = \"a=1\nCPU = \\\"2\\\"\" ]\nRAW = [\n  DATA = \"<x a=\\\"b\\\"/>\" ]\nlabels=web"
+	assert.Equal(t, []string{"MEMORY", "CONTEXT", "RAW", "labels"}, templateKeys(template))
+}
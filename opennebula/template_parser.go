@@ -0,0 +1,221 @@
+package opennebula
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// templateAttribute is a top level attribute of a template in the String format.
+// Vector is set for vector attributes such as DISK = [ ... ].
+type templateAttribute struct {
+	Name   string
+	Value  string
+	Vector map[string]string
+}
+
+type templateParser struct {
+	input []rune
+	pos   int
+}
+
+// parseTemplate parses a template in OpenNebula's String format. Repeated attributes
+// are kept in the order they occur, as for DISK and NIC the order matters.
+func parseTemplate(template string) ([]*templateAttribute, error) {
+	p := &templateParser{input: []rune(template)}
+	var attributes []*templateAttribute
+
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return attributes, nil
+		}
+
+		name, err := p.readName()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect('='); err != nil {
+			return nil, err
+		}
+
+		p.skipSpace(false)
+		if p.peek() != '[' {
+			value, err := p.readValue("\n")
+			if err != nil {
+				return nil, err
+			}
+			attributes = append(attributes, &templateAttribute{Name: name, Value: value})
+			continue
+		}
+
+		p.pos++
+		vector := make(map[string]string)
+		for {
+			p.skipSpace(true)
+			if p.eof() {
+				return nil, fmt.Errorf("Vector attribute %s is not closed", name)
+			}
+			if p.peek() == ']' {
+				p.pos++
+				break
+			}
+
+			key, err := p.readName()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect('='); err != nil {
+				return nil, err
+			}
+			p.skipSpace(true)
+			if vector[strings.ToUpper(key)], err = p.readValue(",]\n"); err != nil {
+				return nil, err
+			}
+
+			p.skipSpace(true)
+			if p.peek() == ',' {
+				p.pos++
+			}
+		}
+		attributes = append(attributes, &templateAttribute{Name: name, Vector: vector})
+	}
+}
+
+func (p *templateParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *templateParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// skipSpace skips blanks and, with newlines set, line breaks and comments too.
+func (p *templateParser) skipSpace(newlines bool) {
+	for !p.eof() {
+		c := p.peek()
+		switch {
+		case c == '\n' && !newlines:
+			return
+		case c == '#' && newlines:
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case unicode.IsSpace(c):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *templateParser) readName() (string, error) {
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '-' && c != '.' {
+			break
+		}
+		p.pos++
+	}
+
+	if p.pos == start {
+		return "", fmt.Errorf("Expected an attribute name at position %d of the template", p.pos)
+	}
+	return string(p.input[start:p.pos]), nil
+}
+
+func (p *templateParser) expect(c rune) error {
+	p.skipSpace(false)
+	if p.peek() != c {
+		return fmt.Errorf("Expected %q at position %d of the template", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+// readValue reads a quoted value or an unquoted one ending at one of the stop characters.
+func (p *templateParser) readValue(stop string) (string, error) {
+	if p.peek() != '"' {
+		start := p.pos
+		for !p.eof() && !strings.ContainsRune(stop, p.peek()) {
+			p.pos++
+		}
+		return strings.TrimSpace(string(p.input[start:p.pos])), nil
+	}
+
+	p.pos++
+	var value strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '\\':
+			if !p.eof() {
+				value.WriteRune(p.peek())
+				p.pos++
+			}
+		case '"':
+			return value.String(), nil
+		default:
+			value.WriteRune(c)
+		}
+	}
+
+	return "", fmt.Errorf("Quoted value is not closed")
+}
+
+// normalizeTemplate renders a template with upper case names, the attributes sorted by
+// name and all values quoted. Semantically equal templates result in the same string.
+func normalizeTemplate(template string) (string, error) {
+	attributes, err := parseTemplate(template)
+	if err != nil {
+		return "", err
+	}
+
+	sort.SliceStable(attributes, func(i, j int) bool {
+		return strings.ToUpper(attributes[i].Name) < strings.ToUpper(attributes[j].Name)
+	})
+
+	lines := make([]string, 0, len(attributes))
+	for _, a := range attributes {
+		name := strings.ToUpper(a.Name)
+		switch {
+		case a.Vector == nil:
+			lines = append(lines, fmt.Sprintf("%s = \"%s\"", name, escapeTemplateValue(a.Value)))
+		case len(a.Vector) == 0:
+			lines = append(lines, fmt.Sprintf("%s = [ ]", name))
+		default:
+			lines = append(lines, buildVectorAttribute(name, a.Vector))
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// suppressEquivalentTemplates hides differences in formatting and attribute order.
+// Templates which can not be parsed, e.g. in the XML format, are compared as they are.
+func suppressEquivalentTemplates(k, old, new string, d *schema.ResourceData) bool {
+	normalizedOld, err := normalizeTemplate(old)
+	if err != nil {
+		return false
+	}
+	normalizedNew, err := normalizeTemplate(new)
+	if err != nil {
+		return false
+	}
+
+	return normalizedOld == normalizedNew
+}
+
+// suppressEquivalentTemplateValues hides the surrounding whitespace OpenNebula strips
+// from the values of template attributes.
+func suppressEquivalentTemplateValues(k, old, new string, d *schema.ResourceData) bool {
+	return strings.TrimSpace(old) == strings.TrimSpace(new)
+}
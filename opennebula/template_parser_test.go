@@ -0,0 +1,60 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTemplate(t *testing.T) {
+	attributes, err := parseTemplate("# comment\nMEMORY = 512\nCPU=\"0.5\"\nDISK = [\n  IMAGE_ID = 3,\n  TARGET = \"vda\" ]\nDESCRIPTION = \"a \\\"quoted\\\" text\"")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []*templateAttribute{
+		{Name: "MEMORY", Value: "512"},
+		{Name: "CPU", Value: "0.5"},
+		{Name: "DISK", Vector: map[string]string{"IMAGE_ID": "3", "TARGET": "vda"}},
+		{Name: "DESCRIPTION", Value: "a \"quoted\" text"},
+	}, attributes)
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	_, err := parseTemplate("DISK = [ IMAGE_ID = 3")
+	assert.Error(t, err)
+
+	_, err = parseTemplate("MEMORY 512")
+	assert.Error(t, err)
+
+	_, err = parseTemplate("<TEMPLATE><MEMORY>512</MEMORY></TEMPLATE>")
+	assert.Error(t, err)
+}
+
+func TestNormalizeTemplateReordered(t *testing.T) {
+	config := "MEMORY = 512\nCPU = 1\nGRAPHICS = [ TYPE = \"vnc\", LISTEN = \"0.0.0.0\" ]"
+	readBack := "CPU=\"1\"\n\ngraphics=[\n  LISTEN=\"0.0.0.0\",\n  TYPE=\"vnc\"\n]\nMEMORY=\"512\""
+
+	normalizedConfig, err := normalizeTemplate(config)
+	assert.NoError(t, err)
+	normalizedReadBack, err := normalizeTemplate(readBack)
+	assert.NoError(t, err)
+	assert.Equal(t, normalizedConfig, normalizedReadBack)
+	assert.Equal(t, "CPU = \"1\"\nGRAPHICS = [\n  LISTEN = \"0.0.0.0\",\n  TYPE = \"vnc\" ]\nMEMORY = \"512\"", normalizedConfig)
+}
+
+func TestNormalizeTemplateKeepsOrderOfRepeatedAttributes(t *testing.T) {
+	a, _ := normalizeTemplate("DISK = [ IMAGE_ID = 1 ]\nDISK = [ IMAGE_ID = 2 ]")
+	b, _ := normalizeTemplate("DISK = [ IMAGE_ID = 2 ]\nDISK = [ IMAGE_ID = 1 ]")
+	assert.NotEqual(t, a, b)
+}
+
+func TestSuppressEquivalentTemplates(t *testing.T) {
+	assert.True(t, suppressEquivalentTemplates("description", "A = 1\nB = \"x y\"", "B=\"x y\"\nA=\"1\"", nil))
+	assert.False(t, suppressEquivalentTemplates("description", "A = 1\nB = 2", "A = 1\nB = 3", nil))
+	assert.False(t, suppressEquivalentTemplates("description", "", "A = 1", nil))
+	assert.False(t, suppressEquivalentTemplates("description", "<A>1</A>", "<A>1</A> ", nil))
+}
+
+func TestSuppressEquivalentTemplateValues(t *testing.T) {
+	assert.True(t, suppressEquivalentTemplateValues("context.SSH_PUBLIC_KEY", "ssh-rsa AAAA", "ssh-rsa AAAA\n", nil))
+	assert.False(t, suppressEquivalentTemplateValues("context.SSH_PUBLIC_KEY", "ssh-rsa AAAA", "ssh-rsa BBBB", nil))
+}
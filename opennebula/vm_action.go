@@ -0,0 +1,84 @@
+package opennebula
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names of the VM states, indexed by STATE
+var vmStateNames = []string{
+	"INIT", "PENDING", "HOLD", "ACTIVE", "STOPPED", "SUSPENDED", "DONE", "FAILED",
+	"POWEROFF", "UNDEPLOYED", "CLONING", "CLONING_FAILURE",
+}
+
+// States a one.vm.action verb may be issued in. RUNNING stands for an ACTIVE VM in
+// the LCM state RUNNING, ACTIVE for any other LCM state.
+var vmActionStates = map[string][]string{
+	"terminate":      {"PENDING", "HOLD", "RUNNING", "STOPPED", "SUSPENDED", "POWEROFF", "UNDEPLOYED", "CLONING_FAILURE"},
+	"terminate-hard": {"PENDING", "HOLD", "RUNNING", "ACTIVE", "STOPPED", "SUSPENDED", "POWEROFF", "UNDEPLOYED", "CLONING_FAILURE"},
+	"hold":           {"PENDING"},
+	"release":        {"HOLD"},
+	"stop":           {"RUNNING"},
+	"suspend":        {"RUNNING"},
+	"resume":         {"STOPPED", "SUSPENDED", "POWEROFF", "UNDEPLOYED"},
+	"reboot":         {"RUNNING"},
+	"reboot-hard":    {"RUNNING"},
+	"poweroff":       {"RUNNING"},
+	"poweroff-hard":  {"RUNNING"},
+	"undeploy":       {"RUNNING", "POWEROFF"},
+	"undeploy-hard":  {"RUNNING", "POWEROFF"},
+}
+
+// States waitForVmState waits for after the actions used for desired_state
+var vmActionTargetStates = map[string]string{
+	"resume":        "running",
+	"poweroff":      "poweroff",
+	"poweroff-hard": "poweroff",
+	"suspend":       "suspended",
+}
+
+// vmActionState maps STATE and LCM_STATE to the names used in vmActionStates.
+func vmActionState(state int, lcmState int) string {
+	if state == 3 {
+		if lcmState == 3 {
+			return "RUNNING"
+		}
+		return "ACTIVE"
+	}
+
+	if state >= 0 && state < len(vmStateNames) {
+		return vmStateNames[state]
+	}
+
+	return fmt.Sprintf("UNKNOWN (%d)", state)
+}
+
+// checkVmAction tells whether OpenNebula accepts the action for a VM in the given state.
+func checkVmAction(action string, state int, lcmState int) error {
+	states, ok := vmActionStates[action]
+	if !ok {
+		actions := make([]string, 0, len(vmActionStates))
+		for a := range vmActionStates {
+			actions = append(actions, a)
+		}
+		sort.Strings(actions)
+		return fmt.Errorf("Unsupported VM action %s, supported are %s", action, strings.Join(actions, ", "))
+	}
+
+	current := vmActionState(state, lcmState)
+	if indexOf(states, current) < 0 {
+		return fmt.Errorf("VM action %s is not possible in state %s, only in %s", action, current, strings.Join(states, ", "))
+	}
+
+	return nil
+}
+
+// vmAction issues one.vm.action after checking the action against the VM's state.
+func vmAction(client OneClient, id int, action string, state int, lcmState int) (string, error) {
+	if err := checkVmAction(action, state, lcmState); err != nil {
+		return "", fmt.Errorf("Can not perform action on VM %d: %s", id, err)
+	}
+
+	return client.Call("one.vm.action", action, id)
+}
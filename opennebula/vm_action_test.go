@@ -0,0 +1,63 @@
+package opennebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckVmAction(t *testing.T) {
+	tests := []struct {
+		state    int
+		lcmState int
+		allowed  []string
+	}{
+		{1, 0, []string{"hold", "terminate", "terminate-hard"}},
+		{2, 0, []string{"release", "terminate", "terminate-hard"}},
+		{3, 3, []string{"poweroff", "poweroff-hard", "reboot", "reboot-hard", "stop", "suspend", "terminate", "terminate-hard", "undeploy", "undeploy-hard"}},
+		{3, 36, []string{"terminate-hard"}},
+		{4, 0, []string{"resume", "terminate", "terminate-hard"}},
+		{5, 0, []string{"resume", "terminate", "terminate-hard"}},
+		{6, 0, []string{}},
+		{8, 0, []string{"resume", "terminate", "terminate-hard", "undeploy", "undeploy-hard"}},
+		{9, 0, []string{"resume", "terminate", "terminate-hard"}},
+		{11, 0, []string{"terminate", "terminate-hard"}},
+	}
+
+	for _, test := range tests {
+		for action := range vmActionStates {
+			err := checkVmAction(action, test.state, test.lcmState)
+			if indexOf(test.allowed, action) >= 0 {
+				assert.NoError(t, err, "%s in state %d/%d", action, test.state, test.lcmState)
+			} else {
+				assert.Error(t, err, "%s in state %d/%d", action, test.state, test.lcmState)
+			}
+		}
+	}
+}
+
+func TestCheckVmActionRejectsUnknownActions(t *testing.T) {
+	err := checkVmAction("explode", 3, 3)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unsupported VM action explode")
+}
+
+func TestVmActionDoesNotCallInInvalidState(t *testing.T) {
+	mockClient := new(MockClient)
+
+	_, err := vmAction(mockClient, 7, "release", 3, 3)
+
+	assert.EqualError(t, err, "Can not perform action on VM 7: VM action release is not possible in state RUNNING, only in HOLD")
+	mockClient.AssertNotCalled(t, "Call")
+}
+
+func TestVmAction(t *testing.T) {
+	mockClient := new(MockClient)
+	mockClient.On("Call", "one.vm.action", []interface{}{"poweroff", 7}).Return("7", nil)
+
+	_, err := vmAction(mockClient, 7, "poweroff", 3, 3)
+
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+}